@@ -24,9 +24,13 @@ import (
 	_ "go.uber.org/automaxprocs"
 
 	"github.com/blinklabs-io/cardano-node-api/internal/api"
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
+	"github.com/blinklabs-io/cardano-node-api/internal/blockstore"
 	"github.com/blinklabs-io/cardano-node-api/internal/config"
 	"github.com/blinklabs-io/cardano-node-api/internal/logging"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/tlsconfig"
+	"github.com/blinklabs-io/cardano-node-api/internal/utxoindex"
 	"github.com/blinklabs-io/cardano-node-api/internal/utxorpc"
 	"github.com/blinklabs-io/cardano-node-api/internal/version"
 )
@@ -63,18 +67,35 @@ func main() {
 		}
 	}()
 
-	// Test node connection
-	if oConn, err := node.GetConnection(nil); err != nil {
-		logger.Fatalf("failed to connect to node: %s", err)
-	} else {
-		oConn.Close()
-	}
-
 	logger.Infof(
 		"starting cardano-node-api version %s",
 		version.GetVersionString(),
 	)
 
+	// Start tracking the node connection. We don't wait for the node here, so
+	// that the API can come up while the node is still starting
+	node.Start()
+
+	// Start block store
+	if err := blockstore.Start(); err != nil {
+		logger.Fatalf("failed to start block store: %s", err)
+	}
+
+	// Start UTxO index
+	if err := utxoindex.Start(); err != nil {
+		logger.Fatalf("failed to start UTxO index: %s", err)
+	}
+
+	// Load TLS certificates for the listeners
+	if err := tlsconfig.Start(); err != nil {
+		logger.Fatalf("failed to load TLS config: %s", err)
+	}
+
+	// Load API keys
+	if err := auth.Start(); err != nil {
+		logger.Fatalf("failed to load API keys: %s", err)
+	}
+
 	// Start debug listener
 	if cfg.Debug.ListenPort > 0 {
 		logger.Infof(
@@ -110,13 +131,15 @@ func main() {
 	}()
 
 	// Start UTxO RPC gRPC listener
-	logger.Infof(
-		"starting gRPC listener on %s:%d",
-		cfg.Utxorpc.ListenAddress,
-		cfg.Utxorpc.ListenPort,
-	)
-	if err := utxorpc.Start(cfg); err != nil {
-		logger.Fatalf("failed to start gRPC: %s", err)
+	if cfg.Utxorpc.ListenPort > 0 {
+		logger.Infof(
+			"starting gRPC listener on %s:%d",
+			cfg.Utxorpc.ListenAddress,
+			cfg.Utxorpc.ListenPort,
+		)
+		if err := utxorpc.Start(cfg); err != nil {
+			logger.Fatalf("failed to start gRPC: %s", err)
+		}
 	}
 
 	select {}
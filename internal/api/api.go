@@ -16,10 +16,12 @@ package api
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/blinklabs-io/cardano-node-api/internal/config"
 	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+	"github.com/blinklabs-io/cardano-node-api/internal/tlsconfig"
 
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
@@ -42,6 +44,11 @@ import (
 //
 // @license.name	Apache 2.0
 // @license.url	http://www.apache.org/licenses/LICENSE-2.0.html
+//
+// @securityDefinitions.apikey	ApiKeyAuth
+// @in							header
+// @name						X-Api-Key
+// @description				API key, also accepted as a bearer token. Only needed when API keys are configured
 func Start(cfg *config.Config) error {
 	// Disable gin debug and color output
 	gin.SetMode(gin.ReleaseMode)
@@ -57,23 +64,27 @@ func Start(cfg *config.Config) error {
 	accessLogger := logging.GetAccessLogger()
 	skipPaths := []string{}
 	if cfg.Logging.Healthchecks {
-		skipPaths = append(skipPaths, "/healthcheck")
-		logger.Infof("disabling access logs for /healthcheck")
+		skipPaths = append(skipPaths, "/healthcheck", "/livez", "/readyz")
+		logger.Infof("disabling access logs for /healthcheck, /livez and /readyz")
 	}
 	router.Use(ginzap.GinzapWithConfig(accessLogger, &ginzap.Config{
 		TimeFormat: time.RFC3339,
 		UTC:        true,
 		SkipPaths:  skipPaths,
+		Context:    accessLogFields,
 	}))
 	router.Use(ginzap.RecoveryWithZap(accessLogger, true))
 
-	// Create a healthcheck
+	// Create healthchecks
 	router.GET("/healthcheck", handleHealthcheck)
+	router.GET("/livez", handleLivez)
+	router.GET("/readyz", handleReadyz)
 	// Create a swagger endpoint
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	// Configure API routes
-	apiGroup := router.Group("/api")
+	apiGroup := router.Group("/api", rateLimit())
+	configureBlocksRoutes(apiGroup)
 	configureChainSyncRoutes(apiGroup)
 	configureLocalStateQueryRoutes(apiGroup)
 	configureLocalTxMonitorRoutes(apiGroup)
@@ -93,19 +104,35 @@ func Start(cfg *config.Config) error {
 		logger.Infof("starting metrics listener on %s:%d",
 			cfg.Metrics.ListenAddress,
 			cfg.Metrics.ListenPort)
-		err := metricsRouter.Run(fmt.Sprintf("%s:%d",
-			cfg.Metrics.ListenAddress,
-			cfg.Metrics.ListenPort))
+		metricsServer := &http.Server{
+			Addr: fmt.Sprintf("%s:%d",
+				cfg.Metrics.ListenAddress,
+				cfg.Metrics.ListenPort),
+			Handler:           metricsRouter,
+			ReadHeaderTimeout: 60 * time.Second,
+		}
+		err := tlsconfig.ListenAndServe(metricsServer, tlsconfig.ListenerMetrics)
 		if err != nil {
 			logger.Fatalf("failed to start metrics listener: %s", err)
 		}
 	}()
 
 	// Start API listener
-	err := router.Run(fmt.Sprintf("%s:%d",
-		cfg.Api.ListenAddress,
-		cfg.Api.ListenPort))
-	return err
+	server := &http.Server{
+		Addr: fmt.Sprintf("%s:%d",
+			cfg.Api.ListenAddress,
+			cfg.Api.ListenPort),
+		Handler:           router,
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+	// Load balancers and orchestrators probe health without a client certificate
+	return tlsconfig.ListenAndServe(
+		server,
+		tlsconfig.ListenerApi,
+		"/healthcheck",
+		"/livez",
+		"/readyz",
+	)
 }
 
 type responseApiError struct {
@@ -118,7 +145,8 @@ func apiError(msg string) responseApiError {
 	}
 }
 
+// handleHealthcheck is kept for existing deployments. Like /livez, it only reports that we're
+// up. Use /readyz to check that we can serve requests
 func handleHealthcheck(c *gin.Context) {
-	// TODO: add some actual health checking here
 	c.JSON(200, gin.H{"failed": false})
 }
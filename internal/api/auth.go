@@ -0,0 +1,65 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
+)
+
+// Gin context key for the name of the request's API key
+const apiKeyNameKey = "apiKeyName"
+
+// requireScopes returns middleware that rejects requests whose API key doesn't have all of the
+// given scopes. It runs before a websocket upgrade, so streams are covered too. Everything is
+// allowed when authentication isn't enabled
+func requireScopes(scopes ...auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyStore := auth.GetKeyStore()
+		if keyStore == nil {
+			c.Next()
+			return
+		}
+		key, err := keyStore.Authorize(c.Request.Header, scopes...)
+		if key != nil {
+			c.Set(apiKeyNameKey, key.Name)
+		}
+		if err != nil {
+			var scopeErr auth.ScopeError
+			if errors.As(err, &scopeErr) {
+				c.AbortWithStatusJSON(http.StatusForbidden, apiError(err.Error()))
+				return
+			}
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, apiError(err.Error()))
+			return
+		}
+		c.Next()
+	}
+}
+
+// accessLogFields adds the name of the request's API key to its access log entry
+func accessLogFields(c *gin.Context) []zapcore.Field {
+	if name := c.GetString(apiKeyNameKey); name != "" {
+		return []zapcore.Field{zap.String("api_key", name)}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
+	"github.com/blinklabs-io/cardano-node-api/internal/blockstore"
+
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/gin-gonic/gin"
+)
+
+func configureBlocksRoutes(apiGroup *gin.RouterGroup) {
+	group := apiGroup.Group("/blocks", requireScopes(auth.ScopeQuery))
+	group.GET("/:id", handleBlocksGet)
+}
+
+type responseBlock struct {
+	Hash             string `json:"hash"`
+	Slot             uint64 `json:"slot"`
+	Height           uint64 `json:"height"`
+	Era              string `json:"era"`
+	TransactionCount int    `json:"tx_count"`
+	Cbor             string `json:"cbor"`
+}
+
+// handleBlocksGet godoc
+//
+//	@Summary		Get a block by hash or slot
+//	@Description	Get a block from the block store. The block is returned as JSON, or as raw CBOR if the Accept header is application/cbor.
+//	@Tags			blocks
+//	@Produce		json
+//	@Param			id	path		string	true	"block hash (hex) or slot number"
+//	@Success		200	{object}	responseBlock
+//	@Failure		400	{object}	responseApiError
+//	@Failure		401	{object}	responseApiError
+//	@Failure		403	{object}	responseApiError
+//	@Failure		404	{object}	responseApiError
+//	@Failure		429	{object}	responseApiError
+//	@Failure		500	{object}	responseApiError
+//	@Failure		503	{object}	responseApiError
+//	@Security		ApiKeyAuth
+//	@Router			/blocks/{id} [get]
+func handleBlocksGet(c *gin.Context) {
+	store := blockstore.GetBlockStore()
+	if store == nil {
+		c.JSON(503, apiError("block store is not enabled"))
+		return
+	}
+	// Look up the block by hash or slot, depending on what we were given
+	id := c.Param("id")
+	var block ledger.Block
+	var err error
+	if len(id) == 64 {
+		hash, hashErr := hex.DecodeString(id)
+		if hashErr != nil {
+			c.JSON(400, apiError("invalid block hash: "+hashErr.Error()))
+			return
+		}
+		block, err = store.GetBlockByHash(hash)
+	} else {
+		slot, slotErr := strconv.ParseUint(id, 10, 64)
+		if slotErr != nil {
+			c.JSON(400, apiError("you must provide a block hash or slot number"))
+			return
+		}
+		block, err = store.GetBlockBySlot(slot)
+	}
+	if err != nil {
+		if errors.Is(err, blockstore.ErrBlockNotFound) {
+			c.JSON(404, apiError(err.Error()))
+			return
+		}
+		c.JSON(500, apiError(err.Error()))
+		return
+	}
+	if c.GetHeader("Accept") == "application/cbor" {
+		c.Data(200, "application/cbor", block.Cbor())
+		return
+	}
+
+	// Create response
+	resp := responseBlock{
+		Hash:             block.Hash(),
+		Slot:             block.SlotNumber(),
+		Height:           block.BlockNumber(),
+		Era:              block.Era().Name,
+		TransactionCount: len(block.Transactions()),
+		Cbor:             hex.EncodeToString(block.Cbor()),
+	}
+	c.JSON(200, resp)
+}
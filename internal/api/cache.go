@@ -0,0 +1,48 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/querycache"
+)
+
+// cachedJSON responds with a cached query result, or a 304 if the client already has it
+func cachedJSON(c *gin.Context, result querycache.Result, body any) {
+	c.Header("ETag", result.ETag)
+	// Clients may reuse the result, but should check with us that it's still current
+	c.Header("Cache-Control", "no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), result.ETag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// etagMatches returns whether an If-None-Match header matches an ETag. Weak comparison is fine
+// for GET requests
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, value := range strings.Split(ifNoneMatch, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" || strings.TrimPrefix(value, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/hex"
 	"net/http"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
 
 	"github.com/blinklabs-io/adder/event"
@@ -29,10 +30,12 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Browser clients send their API key as a subprotocol, along with this one for us to pick
+	Subprotocols: []string{auth.WebSocketProtocol},
 }
 
 func configureChainSyncRoutes(apiGroup *gin.RouterGroup) {
-	group := apiGroup.Group("/chainsync")
+	group := apiGroup.Group("/chainsync", requireScopes(auth.ScopeStream))
 	group.GET("/sync", handleChainSyncSync)
 }
 
@@ -48,10 +51,14 @@ type requestChainSyncSync struct {
 //	@Tags		chainsync
 //	@Success	101
 //	@Failure	400		{object}	responseApiError
+//	@Failure	401		{object}	responseApiError
+//	@Failure	403		{object}	responseApiError
+//	@Failure	429		{object}	responseApiError
 //	@Failure	500		{object}	responseApiError
 //	@Param		tip		query		bool	false	"whether to start from the current tip"
 //	@Param		slot	query		int		false	"slot to start sync at, should match hash"
 //	@Param		hash	query		string	false	"block hash to start sync at, should match slot"
+//	@Security	ApiKeyAuth
 //	@Router		/chainsync/sync [get]
 func handleChainSyncSync(c *gin.Context) {
 	// Get parameters
@@ -71,38 +78,9 @@ func handleChainSyncSync(c *gin.Context) {
 	}
 	// Setup event channel
 	eventChan := make(chan event.Event, 10)
-	connCfg := node.ConnectionConfig{
-		ChainSyncEventChan: eventChan,
-	}
-	// Connect to node
-	oConn, err := node.GetConnection(&connCfg)
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
-		return
-	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
+	// Leaving the intersect points empty starts the sync at the current tip
 	var intersectPoints []ocommon.Point
-	if req.Tip {
-		tip, err := oConn.ChainSync().Client.GetCurrentTip()
-		if err != nil {
-			c.JSON(500, apiError(err.Error()))
-			return
-		}
-		intersectPoints = []ocommon.Point{
-			tip.Point,
-		}
-	} else {
+	if !req.Tip {
 		hashBytes, err := hex.DecodeString(req.Hash)
 		if err != nil {
 			c.JSON(500, apiError(err.Error()))
@@ -112,11 +90,13 @@ func handleChainSyncSync(c *gin.Context) {
 			ocommon.NewPoint(req.Slot, hashBytes),
 		}
 	}
-	// Start the sync with the node
-	if err := oConn.ChainSync().Client.Sync(intersectPoints); err != nil {
-		c.JSON(500, apiError(err.Error()))
+	// Attach to the shared chain-sync
+	syncSub, err := node.SubscribeChainSync(eventChan, intersectPoints)
+	if err != nil {
+		nodeError(c, err)
 		return
 	}
+	defer syncSub.Close()
 	// Upgrade the connection
 	webConn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -125,8 +105,11 @@ func handleChainSyncSync(c *gin.Context) {
 	defer webConn.Close()
 	// Wait for events
 	for {
-		evt, ok := <-eventChan
-		if !ok {
+		var evt event.Event
+		select {
+		case evt = <-eventChan:
+		case <-syncSub.Done():
+			// We fell too far behind the chain-sync
 			return
 		}
 		if err := webConn.WriteJSON(evt); err != nil {
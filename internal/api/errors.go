@@ -0,0 +1,48 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/ratelimit"
+)
+
+// nodeError responds to a failed node operation. If the mini-protocol's bulkhead is full, the
+// client gets a 429 with a hint for when to retry. A requested ledger point that the node no
+// longer has is a 410, and one that isn't on the chain a 404
+func nodeError(c *gin.Context, err error) {
+	var bulkheadErr node.BulkheadFullError
+	if errors.As(err, &bulkheadErr) {
+		c.Header("Retry-After", ratelimit.RetryAfter(bulkheadErr.RetryAfter))
+		c.JSON(http.StatusTooManyRequests, apiError(err.Error()))
+		return
+	}
+	var tooOldErr node.PointTooOldError
+	if errors.As(err, &tooOldErr) {
+		c.JSON(http.StatusGone, apiError(err.Error()))
+		return
+	}
+	var notOnChainErr node.PointNotOnChainError
+	if errors.As(err, &notOnChainErr) {
+		c.JSON(http.StatusNotFound, apiError(err.Error()))
+		return
+	}
+	c.JSON(500, apiError(err.Error()))
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/utxorpc"
+)
+
+// How long the readiness check waits for the node
+const readyCheckTimeout = 5 * time.Second
+
+type responseLivez struct {
+	Status string `json:"status"`
+}
+
+type responseReadyz struct {
+	Ready   bool                `json:"ready"`
+	Node    responseReadyNode   `json:"node"`
+	Tip     responseReadyTip    `json:"tip"`
+	Utxorpc responseReadyListen `json:"utxorpc"`
+}
+
+type responseReadyNode struct {
+	Ok        bool                  `json:"ok"`
+	State     string                `json:"state"`
+	Upstreams []node.UpstreamStatus `json:"upstreams"`
+}
+
+type responseReadyTip struct {
+	Ok bool `json:"ok"`
+	// Skipped is true when the tip check is disabled
+	Skipped       bool       `json:"skipped,omitempty"`
+	Slot          uint64     `json:"slot"`
+	SlotTime      *time.Time `json:"slot_time,omitempty"`
+	LagSeconds    float64    `json:"lag_seconds"`
+	MaxLagSeconds uint       `json:"max_lag_seconds"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type responseReadyListen struct {
+	Ok bool `json:"ok"`
+	// Skipped is true when the listener isn't configured
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// handleLivez reports that the process is up and serving HTTP. It doesn't depend on the node, so
+// that a node outage doesn't get us restarted
+func handleLivez(c *gin.Context) {
+	c.JSON(http.StatusOK, responseLivez{Status: "ok"})
+}
+
+// handleReadyz reports whether we can serve requests: the node is reachable, its tip is close
+// to the wall-clock time, and the UTxO RPC listener is up if it's configured. It returns a 503 if
+// any check fails
+func handleReadyz(c *gin.Context) {
+	cfg := config.GetConfig()
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyCheckTimeout)
+	defer cancel()
+	resp := responseReadyz{
+		Node:    readyNode(),
+		Tip:     readyTip(ctx, cfg.Api.ReadyMaxTipLag),
+		Utxorpc: readyUtxorpc(cfg.Utxorpc),
+	}
+	resp.Ready = resp.Node.Ok && resp.Tip.Ok && resp.Utxorpc.Ok
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
+
+func readyNode() responseReadyNode {
+	state := node.GetState()
+	return responseReadyNode{
+		// A degraded node is still usable, just behind or flaky
+		Ok:        state == node.StateReady || state == node.StateDegraded,
+		State:     state.String(),
+		Upstreams: node.GetUpstreamStatus(),
+	}
+}
+
+func readyUtxorpc(cfg config.UtxorpcConfig) responseReadyListen {
+	if cfg.ListenPort == 0 {
+		return responseReadyListen{Ok: true, Skipped: true}
+	}
+	return responseReadyListen{Ok: utxorpc.Listening()}
+}
+
+func readyTip(ctx context.Context, maxLag uint) responseReadyTip {
+	ret := responseReadyTip{
+		Slot:          node.BestTipSlot(),
+		MaxLagSeconds: maxLag,
+	}
+	if maxLag == 0 {
+		ret.Ok = true
+		ret.Skipped = true
+		return ret
+	}
+	if ret.Slot == 0 {
+		ret.Error = "tip is not known yet"
+		return ret
+	}
+	slotTime, err := node.SlotTime(ctx, ret.Slot)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	ret.SlotTime = &slotTime
+	lag := time.Since(slotTime)
+	if lag < 0 {
+		lag = 0
+	}
+	ret.LagSeconds = lag.Seconds()
+	ret.Ok = lag <= time.Duration(maxLag)*time.Second
+	return ret
+}
@@ -16,25 +16,47 @@ package api
 
 import (
 	"encoding/hex"
+	"errors"
+	"net/http"
 
 	"github.com/blinklabs-io/gouroboros/ledger"
+	ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
 	"github.com/gin-gonic/gin"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/querycache"
 )
 
 func configureLocalStateQueryRoutes(apiGroup *gin.RouterGroup) {
-	group := apiGroup.Group("/localstatequery")
+	group := apiGroup.Group("/localstatequery", requireScopes(auth.ScopeQuery))
 	group.GET("/current-era", handleLocalStateQueryCurrentEra)
 	group.GET("/system-start", handleLocalStateQuerySystemStart)
 	group.GET("/tip", handleLocalStateQueryTip)
 	group.GET("/era-history", handleLocalStateQueryEraHistory)
 	group.GET("/protocol-params", handleLocalStateQueryProtocolParams)
+	group.POST("/batch", handleLocalStateQueryBatch)
 	// TODO: uncomment after this is fixed:
 	// - https://github.com/blinklabs-io/gouroboros/issues/584
 	// group.GET("/genesis-config", handleLocalStateQueryGenesisConfig)
 }
 
+// queryPoint returns the ledger point from the 'point' query parameter, or nil for the current
+// tip. It responds with a 400 if the parameter is invalid
+func queryPoint(c *gin.Context) (*ocommon.Point, bool) {
+	value := c.Query("point")
+	if value == "" {
+		return nil, true
+	}
+	point, err := node.ParsePoint(value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, apiError(err.Error()))
+		return nil, false
+	}
+	return point, true
+}
+
 type responseLocalStateQueryCurrentEra struct {
 	Id   uint8  `json:"id"`
 	Name string `json:"name"`
@@ -46,32 +68,38 @@ type responseLocalStateQueryCurrentEra struct {
 //	@Tags		localstatequery
 //	@Produce	json
 //	@Success	200	{object}	responseLocalStateQueryCurrentEra
+//	@Param		point	query	string	false	"ledger point to query at, as <slot>.<block hash>, defaults to the tip"
+//	@Failure	400	{object}	responseApiError
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	404	{object}	responseApiError
+//	@Failure	410	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localstatequery/current-era [get]
 func handleLocalStateQueryCurrentEra(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Get parameters
+	point, ok := queryPoint(c)
+	if !ok {
+		return
+	}
+	// Lease node connection
+	oConn, err := node.LeaseConnection(c.Request.Context())
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
+		return
+	}
+	defer oConn.Return()
+	// Acquire ledger state
+	client, err := oConn.AcquireLocalStateQueryAt(point)
+	if err != nil {
+		nodeError(c, err)
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
 
 	// Get era
-	eraNum, err := oConn.LocalStateQuery().Client.GetCurrentEra()
+	eraNum, err := client.GetCurrentEra()
 	if err != nil {
 		c.JSON(500, apiError(err.Error()))
 		return
@@ -98,44 +126,40 @@ type responseLocalStateQuerySystemStart struct {
 //	@Tags		localstatequery
 //	@Produce	json
 //	@Success	200	{object}	responseLocalStateQuerySystemStart
+//	@Success	304
+//	@Param		If-None-Match	header	string	false	"ETag of a result the client already has"
+//	@Param		point	query	string	false	"ledger point to query at, as <slot>.<block hash>, defaults to the tip"
+//	@Failure	400	{object}	responseApiError
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	404	{object}	responseApiError
+//	@Failure	410	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localstatequery/system-start [get]
 func handleLocalStateQuerySystemStart(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+	// Get parameters
+	point, ok := queryPoint(c)
+	if !ok {
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
 
 	// Get system start
-	result, err := oConn.LocalStateQuery().Client.GetSystemStart()
+	result, err := querycache.SystemStart(c.Request.Context(), point)
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
 		return
 	}
+	systemStart := result.Value.(*localstatequery.SystemStartResult)
 
 	// Create response
 	resp := responseLocalStateQuerySystemStart{
-		Year:        result.Year,
-		Day:         result.Day,
-		Picoseconds: result.Picoseconds,
+		Year:        systemStart.Year,
+		Day:         systemStart.Day,
+		Picoseconds: systemStart.Picoseconds,
 	}
-	c.JSON(200, resp)
+	cachedJSON(c, result, resp)
 }
 
 type responseLocalStateQueryTip struct {
@@ -152,66 +176,42 @@ type responseLocalStateQueryTip struct {
 //	@Tags		localstatequery
 //	@Produce	json
 //	@Success	200	{object}	responseLocalStateQueryTip
+//	@Param		point	query	string	false	"ledger point to query at, as <slot>.<block hash>, defaults to the tip"
+//	@Failure	400	{object}	responseApiError
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	404	{object}	responseApiError
+//	@Failure	410	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localstatequery/tip [get]
 func handleLocalStateQueryTip(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
-		return
-	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
-
-	// Get era
-	eraNum, err := oConn.LocalStateQuery().Client.GetCurrentEra()
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
-		return
-	}
-	era := ledger.GetEraById(uint8(eraNum))
-
-	// Get epochNo
-	epochNo, err := oConn.LocalStateQuery().Client.GetEpochNo()
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
-		return
-	}
-
-	// Get blockNo
-	blockNo, err := oConn.LocalStateQuery().Client.GetChainBlockNo()
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+	// Get parameters
+	point, ok := queryPoint(c)
+	if !ok {
 		return
 	}
 
-	// Get chain point (slot and hash)
-	point, err := oConn.LocalStateQuery().Client.GetChainPoint()
+	// Run the queries against the same ledger state, so that they all describe the same tip
+	snapshot, err := node.QueryBatch(
+		c.Request.Context(),
+		point,
+		[]string{node.QueryCurrentEra, node.QueryEpochNo, node.QueryBlockNo},
+	)
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
 		return
 	}
+	era := ledger.GetEraById(uint8(snapshot.Results[node.QueryCurrentEra].(int)))
 
 	// Create response
 	resp := responseLocalStateQueryTip{
 		Era:     era.Name,
-		EpochNo: epochNo,
-		BlockNo: blockNo,
-		Slot:    point.Slot,
-		Hash:    hex.EncodeToString(point.Hash),
+		EpochNo: snapshot.Results[node.QueryEpochNo].(int),
+		BlockNo: snapshot.Results[node.QueryBlockNo].(int64),
+		Slot:    snapshot.Point.Slot,
+		Hash:    hex.EncodeToString(snapshot.Point.Hash),
 	}
 	c.JSON(200, resp)
 }
@@ -228,41 +228,36 @@ type responseLocalStateQueryEraHistory struct {
 //	@Tags		localstatequery
 //	@Produce	json
 //	@Success	200	{object}	responseLocalStateQueryEraHistory
+//	@Success	304
+//	@Param		If-None-Match	header	string	false	"ETag of a result the client already has"
+//	@Param		point	query	string	false	"ledger point to query at, as <slot>.<block hash>, defaults to the tip"
+//	@Failure	400	{object}	responseApiError
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	404	{object}	responseApiError
+//	@Failure	410	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localstatequery/era-history [get]
 func handleLocalStateQueryEraHistory(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+	// Get parameters
+	point, ok := queryPoint(c)
+	if !ok {
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
 
 	// Get eraHistory
-	eraHistory, err := oConn.LocalStateQuery().Client.GetEraHistory()
+	result, err := querycache.EraHistory(c.Request.Context(), point)
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
 		return
 	}
 
 	// Create response
 	//resp := responseLocalStateQueryProtocolParams{
 	//}
-	c.JSON(200, eraHistory)
+	cachedJSON(c, result, result.Value)
 }
 
 // TODO: fill this in
@@ -277,41 +272,132 @@ type responseLocalStateQueryProtocolParams struct {
 //	@Tags		localstatequery
 //	@Produce	json
 //	@Success	200	{object}	responseLocalStateQueryProtocolParams
+//	@Success	304
+//	@Param		If-None-Match	header	string	false	"ETag of a result the client already has"
+//	@Param		point	query	string	false	"ledger point to query at, as <slot>.<block hash>, defaults to the tip"
+//	@Failure	400	{object}	responseApiError
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	404	{object}	responseApiError
+//	@Failure	410	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localstatequery/protocol-params [get]
 func handleLocalStateQueryProtocolParams(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
-	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+	// Get parameters
+	point, ok := queryPoint(c)
+	if !ok {
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
 
 	// Get protoParams
-	protoParams, err := oConn.LocalStateQuery().Client.GetCurrentProtocolParams()
+	result, err := querycache.ProtocolParams(c.Request.Context(), point)
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
 		return
 	}
 
 	// Create response
 	//resp := responseLocalStateQueryProtocolParams{
 	//}
-	c.JSON(200, protoParams)
+	cachedJSON(c, result, result.Value)
+}
+
+type requestLocalStateQueryBatch struct {
+	Queries []string `json:"queries" binding:"required,min=1"`
+	Point   string   `json:"point"`
+}
+
+type responseLocalStateQueryBatch struct {
+	Point   responseLocalStateQueryPoint `json:"point"`
+	Results map[string]any               `json:"results"`
+}
+
+type responseLocalStateQueryPoint struct {
+	Slot uint64 `json:"slot_no"`
+	Hash string `json:"hash"`
+}
+
+// handleLocalStateQueryBatch godoc
+//
+//	@Summary		Run several queries against the same ledger state
+//	@Description	Runs the queries against a single acquired ledger state, so that their results are consistent with each other. Queries can be current-era, system-start, epoch-no, block-no, era-history and protocol-params. The point, as <slot>.<block hash>, defaults to the tip
+//	@Tags			localstatequery
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		requestLocalStateQueryBatch	true	"Queries to run"
+//	@Success		200		{object}	responseLocalStateQueryBatch
+//	@Failure		400		{object}	responseApiError
+//	@Failure		401		{object}	responseApiError
+//	@Failure		403		{object}	responseApiError
+//	@Failure		429		{object}	responseApiError
+//	@Failure		500		{object}	responseApiError
+//	@Security		ApiKeyAuth
+//	@Router			/localstatequery/batch [post]
+func handleLocalStateQueryBatch(c *gin.Context) {
+	// Get parameters
+	var req requestLocalStateQueryBatch
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, apiError(err.Error()))
+		return
+	}
+
+	var point *ocommon.Point
+	if req.Point != "" {
+		var err error
+		point, err = node.ParsePoint(req.Point)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, apiError(err.Error()))
+			return
+		}
+	}
+
+	// Run queries
+	snapshot, err := node.QueryBatch(c.Request.Context(), point, req.Queries)
+	if err != nil {
+		var unknownErr node.UnknownQueryError
+		if errors.As(err, &unknownErr) {
+			c.JSON(http.StatusBadRequest, apiError(err.Error()))
+			return
+		}
+		nodeError(c, err)
+		return
+	}
+
+	// Create response
+	resp := responseLocalStateQueryBatch{
+		Point: responseLocalStateQueryPoint{
+			Slot: snapshot.Point.Slot,
+			Hash: hex.EncodeToString(snapshot.Point.Hash),
+		},
+		Results: make(map[string]any, len(snapshot.Results)),
+	}
+	for query, result := range snapshot.Results {
+		resp.Results[query] = batchResult(query, result)
+	}
+	c.JSON(200, resp)
+}
+
+// batchResult converts a query result to the same shape that the query's own endpoint returns
+func batchResult(query string, result any) any {
+	switch query {
+	case node.QueryCurrentEra:
+		era := ledger.GetEraById(uint8(result.(int)))
+		return responseLocalStateQueryCurrentEra{
+			Id:   era.Id,
+			Name: era.Name,
+		}
+	case node.QuerySystemStart:
+		systemStart := result.(*localstatequery.SystemStartResult)
+		return responseLocalStateQuerySystemStart{
+			Year:        systemStart.Year,
+			Day:         systemStart.Day,
+			Picoseconds: systemStart.Picoseconds,
+		}
+	default:
+		return result
+	}
 }
 
 // TODO: fill this in
@@ -326,34 +412,40 @@ type responseLocalStateQueryGenesisConfig struct {
 //	@Tags		localstatequery
 //	@Produce	json
 //	@Success	200	{object}	responseLocalStateQueryGenesisConfig
+//	@Param		point	query	string	false	"ledger point to query at, as <slot>.<block hash>, defaults to the tip"
+//	@Failure	400	{object}	responseApiError
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	404	{object}	responseApiError
+//	@Failure	410	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localstatequery/genesis-config [get]
 //
 //nolint:unused
 func handleLocalStateQueryGenesisConfig(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Get parameters
+	point, ok := queryPoint(c)
+	if !ok {
+		return
+	}
+	// Lease node connection
+	oConn, err := node.LeaseConnection(c.Request.Context())
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
+		return
+	}
+	defer oConn.Return()
+	// Acquire ledger state
+	client, err := oConn.AcquireLocalStateQueryAt(point)
+	if err != nil {
+		nodeError(c, err)
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
 
 	// Get genesisConfig
-	genesisConfig, err := oConn.LocalStateQuery().Client.GetGenesisConfig()
+	genesisConfig, err := client.GetGenesisConfig()
 	if err != nil {
 		c.JSON(500, apiError(err.Error()))
 		return
@@ -21,11 +21,12 @@ import (
 	"github.com/blinklabs-io/gouroboros/ledger"
 	"github.com/gin-gonic/gin"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
 )
 
 func configureLocalTxMonitorRoutes(apiGroup *gin.RouterGroup) {
-	group := apiGroup.Group("/localtxmonitor")
+	group := apiGroup.Group("/localtxmonitor", requireScopes(auth.ScopeMempool))
 	group.GET("/sizes", handleLocalTxMonitorSizes)
 	group.GET("/has_tx/:tx_hash", handleLocalTxMonitorHasTx)
 	group.GET("/txs", handleLocalTxMonitorTxs)
@@ -44,31 +45,28 @@ type responseLocalTxMonitorSizes struct {
 //	@Accept		json
 //	@Produce	json
 //	@Success	200	{object}	responseLocalTxMonitorSizes
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localtxmonitor/sizes [get]
 func handleLocalTxMonitorSizes(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Lease node connection
+	oConn, err := node.LeaseConnection(c.Request.Context())
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
+		return
+	}
+	defer oConn.Return()
+	// Acquire mempool snapshot
+	client, err := oConn.AcquireLocalTxMonitor()
+	if err != nil {
+		nodeError(c, err)
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalTxMonitor().Client.Start()
 	// Get sizes
-	capacity, size, txCount, err := oConn.LocalTxMonitor().Client.GetSizes()
+	capacity, size, txCount, err := client.GetSizes()
 	if err != nil {
 		c.JSON(500, apiError(err.Error()))
 		return
@@ -97,7 +95,11 @@ type responseLocalTxMonitorHasTx struct {
 //	@Accept		json
 //	@Produce	json
 //	@Success	200	{object}	responseLocalTxMonitorHasTx
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localtxmonitor/has_tx/{tx_hash} [get]
 func handleLocalTxMonitorHasTx(c *gin.Context) {
 	// Get parameters
@@ -106,33 +108,26 @@ func handleLocalTxMonitorHasTx(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, apiError(err.Error()))
 		return
 	}
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Lease node connection
+	oConn, err := node.LeaseConnection(c.Request.Context())
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
+		return
+	}
+	defer oConn.Return()
+	// Acquire mempool snapshot
+	client, err := oConn.AcquireLocalTxMonitor()
+	if err != nil {
+		nodeError(c, err)
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalTxMonitor().Client.Start()
 	// Make the call to the node
 	txHash, err := hex.DecodeString(req.TxHash)
 	if err != nil {
 		c.JSON(500, apiError(err.Error()))
 		return
 	}
-	hasTx, err := oConn.LocalTxMonitor().Client.HasTx(txHash)
+	hasTx, err := client.HasTx(txHash)
 	if err != nil {
 		c.JSON(500, apiError(err.Error()))
 		return
@@ -156,33 +151,30 @@ type responseLocalTxMonitorTxs struct {
 //	@Accept		json
 //	@Produce	json
 //	@Success	200	{object}	[]responseLocalTxMonitorTxs
+//	@Failure	401	{object}	responseApiError
+//	@Failure	403	{object}	responseApiError
+//	@Failure	429	{object}	responseApiError
 //	@Failure	500	{object}	responseApiError
+//	@Security	ApiKeyAuth
 //	@Router		/localtxmonitor/txs [get]
 func handleLocalTxMonitorTxs(c *gin.Context) {
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Lease node connection
+	oConn, err := node.LeaseConnection(c.Request.Context())
 	if err != nil {
-		c.JSON(500, apiError(err.Error()))
+		nodeError(c, err)
+		return
+	}
+	defer oConn.Return()
+	// Acquire mempool snapshot
+	client, err := oConn.AcquireLocalTxMonitor()
+	if err != nil {
+		nodeError(c, err)
 		return
 	}
-	// Async error handler
-	go func() {
-		err, ok := <-oConn.ErrorChan()
-		if !ok {
-			return
-		}
-		c.JSON(500, apiError(err.Error()))
-	}()
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalTxMonitor().Client.Start()
 	// Collect TX hashes
 	resp := []responseLocalTxMonitorTxs{}
 	for {
-		txRawBytes, err := oConn.LocalTxMonitor().Client.NextTx()
+		txRawBytes, err := client.NextTx()
 		if err != nil {
 			c.JSON(500, apiError(err.Error()))
 			return
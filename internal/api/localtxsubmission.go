@@ -18,16 +18,17 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/blinklabs-io/gouroboros/ledger"
 	"github.com/blinklabs-io/gouroboros/protocol/localtxsubmission"
-	"github.com/blinklabs-io/tx-submit-api/submit"
 	"github.com/gin-gonic/gin"
 
-	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
 	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
 )
 
 func configureLocalTxSubmissionRoutes(apiGroup *gin.RouterGroup) {
-	group := apiGroup.Group("/localtxsubmission")
+	group := apiGroup.Group("/localtxsubmission", requireScopes(auth.ScopeSubmit))
 	group.POST("/tx", handleLocalSubmitTx)
 }
 
@@ -39,12 +40,15 @@ func configureLocalTxSubmissionRoutes(apiGroup *gin.RouterGroup) {
 //	@Param			Content-Type	header		string	true	"Content type"	Enums(application/cbor)
 //	@Success		202				{object}	string	"Ok"
 //	@Failure		400				{object}	string	"Bad Request"
+//	@Failure		401				{object}	responseApiError
+//	@Failure		403				{object}	responseApiError
 //	@Failure		415				{object}	string	"Unsupported Media Type"
+//	@Failure		429				{object}	responseApiError
 //	@Failure		500				{object}	string	"Server Error"
+//	@Security		ApiKeyAuth
 //	@Router			/localtxsubmission/tx [post]
 func handleLocalSubmitTx(c *gin.Context) {
-	// First, initialize our configuration and loggers
-	cfg := config.GetConfig()
+	// First, initialize our logger
 	logger := logging.GetLogger()
 	// Check our headers for content-type
 	if c.ContentType() != "application/cbor" {
@@ -69,20 +73,37 @@ func handleLocalSubmitTx(c *gin.Context) {
 			logger.Errorf("failed to close request body: %s", err)
 		}
 	}
-	// Send TX
-	errorChan := make(chan error)
-	submitConfig := &submit.Config{
-		ErrorChan:    errorChan,
-		NetworkMagic: cfg.Node.NetworkMagic,
-		NodeAddress:  cfg.Node.Address,
-		NodePort:     cfg.Node.Port,
-		SocketPath:   cfg.Node.SocketPath,
-		Timeout:      cfg.Node.Timeout,
+	// Determine transaction type (era)
+	txType, err := ledger.DetermineTransactionType(txRawBytes)
+	if err != nil {
+		logger.Errorf("could not parse transaction to determine type: %s", err)
+		c.JSON(400, "could not parse transaction to determine type")
+		return
+	}
+	tx, err := ledger.NewTransactionFromCbor(txType, txRawBytes)
+	if err != nil {
+		logger.Errorf("failed to parse transaction CBOR: %s", err)
+		c.JSON(400, fmt.Sprintf("failed to parse transaction CBOR: %s", err))
+		return
+	}
+	// Lease node connection
+	oConn, err := node.LeaseConnection(c.Request.Context())
+	if err != nil {
+		logger.Errorf("failure communicating with node: %s", err)
+		c.JSON(500, "failure communicating with node")
+		return
 	}
-	txHash, err := submit.SubmitTx(submitConfig, txRawBytes)
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalTxSubmission()
 	if err != nil {
-		if c.GetHeader("Accept") == "application/cbor" {
-			txRejectErr := err.(localtxsubmission.TransactionRejectedError)
+		nodeError(c, err)
+		return
+	}
+	// Send TX
+	err = client.SubmitTx(uint16(txType), txRawBytes)
+	if err != nil {
+		txRejectErr, isRejectErr := err.(localtxsubmission.TransactionRejectedError)
+		if isRejectErr && c.GetHeader("Accept") == "application/cbor" {
 			c.Data(400, "application/cbor", txRejectErr.ReasonCbor)
 		} else {
 			if err.Error() != "" {
@@ -94,17 +115,8 @@ func handleLocalSubmitTx(c *gin.Context) {
 		// _ = ginmetrics.GetMonitor().GetMetric("tx_submit_fail_count").Inc(nil)
 		return
 	}
-	// Start async error handler
-	go func() {
-		err, ok := <-errorChan
-		if ok {
-			logger.Errorf("failure communicating with node: %s", err)
-			c.JSON(500, "failure communicating with node")
-			// _ = ginmetrics.GetMonitor().GetMetric("tx_submit_fail_count").Inc(nil)
-		}
-	}()
 	// Return transaction ID
-	c.JSON(202, txHash)
+	c.JSON(202, tx.Hash())
 	// Increment custom metric
 	// _ = ginmetrics.GetMonitor().GetMetric("tx_submit_count").Inc(nil)
 }
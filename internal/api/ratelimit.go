@@ -0,0 +1,48 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
+	"github.com/blinklabs-io/cardano-node-api/internal/ratelimit"
+)
+
+// rateLimit returns middleware that applies the per-key and per-IP rate limits. Requests with an
+// invalid key count against their IP address
+func rateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var keyName string
+		if keyStore := auth.GetKeyStore(); keyStore != nil {
+			if key := keyStore.Lookup(c.Request.Header); key != nil {
+				keyName = key.Name
+			}
+		}
+		// We use the peer address rather than trusting X-Forwarded-For, which anyone can set
+		allowed, retryAfter := ratelimit.Allow(keyName, c.RemoteIP())
+		if !allowed {
+			c.Header("Retry-After", ratelimit.RetryAfter(retryAfter))
+			c.AbortWithStatusJSON(
+				http.StatusTooManyRequests,
+				apiError("rate limit exceeded, try again later"),
+			)
+			return
+		}
+		c.Next()
+	}
+}
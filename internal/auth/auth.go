@@ -0,0 +1,333 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+// Scope is a set of operations that an API key is allowed to perform
+type Scope string
+
+const (
+	// ScopeQuery allows querying blocks, UTxOs and ledger state
+	ScopeQuery Scope = "query"
+	// ScopeMempool allows reading the mempool
+	ScopeMempool Scope = "mempool"
+	// ScopeSubmit allows submitting transactions
+	ScopeSubmit Scope = "submit"
+	// ScopeStream allows opening long-lived streams, like chain-sync
+	ScopeStream Scope = "stream"
+)
+
+var validScopes = map[Scope]bool{
+	ScopeQuery:   true,
+	ScopeMempool: true,
+	ScopeSubmit:  true,
+	ScopeStream:  true,
+}
+
+// HeaderApiKey is the header that an API key can be sent in, as an alternative to a bearer token
+const HeaderApiKey = "X-Api-Key"
+
+const (
+	// WebSocketProtocol is the websocket subprotocol that we accept. Browsers can't set headers on
+	// a websocket, so they offer it along with the API key as another subprotocol, and we pick
+	// it, so that the key isn't echoed back
+	WebSocketProtocol = "cardano-node-api"
+	// WebSocketKeyPrefix is the prefix of the subprotocol that carries an API key, which follows
+	// it in unpadded base64url, as subprotocols are limited to a few characters
+	WebSocketKeyPrefix = "api-key."
+)
+
+// How often we check the keys file for changes
+const reloadInterval = 10 * time.Second
+
+var (
+	// ErrMissingKey is returned when a request doesn't include an API key
+	ErrMissingKey = errors.New("missing API key")
+	// ErrInvalidKey is returned when a request includes an unknown API key
+	ErrInvalidKey = errors.New("invalid API key")
+)
+
+// ScopeError is returned when an API key is valid but lacks a scope needed for the request
+type ScopeError struct {
+	Key   *Key
+	Scope Scope
+}
+
+func (e ScopeError) Error() string {
+	return fmt.Sprintf("API key %s does not have the %s scope", e.Key.Name, e.Scope)
+}
+
+// Key is an API key and what it's allowed to do. The name identifies the key in logs
+type Key struct {
+	Name   string  `yaml:"name"`
+	Key    string  `yaml:"key"`
+	Scopes []Scope `yaml:"scopes"`
+}
+
+// HasScope returns whether the key has the given scope
+func (k *Key) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type keysFile struct {
+	Keys []Key `yaml:"keys"`
+}
+
+// KeyStore holds the API keys from the config and keys file, and reloads the keys file when it
+// changes
+type KeyStore struct {
+	cfg     config.AuthConfig
+	mutex   sync.RWMutex
+	keys    map[[sha256.Size]byte]*Key
+	modTime time.Time
+}
+
+var globalKeyStore *KeyStore
+
+// GetKeyStore returns the global key store, or nil if authentication isn't enabled
+func GetKeyStore() *KeyStore {
+	return globalKeyStore
+}
+
+// Start loads the API keys and starts watching the keys file for changes. Authentication is
+// only enabled if there are keys in the config or a keys file is configured
+func Start() error {
+	cfg := config.GetConfig()
+	if cfg.Auth.KeysFilePath == "" && len(cfg.Auth.Keys) == 0 {
+		return nil
+	}
+	s, err := NewKeyStore(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	globalKeyStore = s
+	if cfg.Auth.KeysFilePath != "" {
+		go s.watch()
+	}
+	return nil
+}
+
+// NewKeyStore creates a key store and loads the keys from the auth config
+func NewKeyStore(cfg config.AuthConfig) (*KeyStore, error) {
+	s := &KeyStore{
+		cfg: cfg,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Authorize checks the API key in the request headers, and that it has every given scope. It
+// returns the key, or an error if it's missing, unknown or lacks a scope
+func (s *KeyStore) Authorize(header http.Header, scopes ...Scope) (*Key, error) {
+	key := s.Lookup(header)
+	if key == nil {
+		if KeyFromHeader(header) == "" {
+			return nil, ErrMissingKey
+		}
+		return nil, ErrInvalidKey
+	}
+	for _, scope := range scopes {
+		if !key.HasScope(scope) {
+			return key, ScopeError{Key: key, Scope: scope}
+		}
+	}
+	return key, nil
+}
+
+// Lookup returns the key for the API key in the request headers, or nil if there isn't a known
+// one
+func (s *KeyStore) Lookup(header http.Header) *Key {
+	apiKey := KeyFromHeader(header)
+	if apiKey == "" {
+		return nil
+	}
+	// Looking up the hash avoids comparing the secret keys directly
+	hash := sha256.Sum256([]byte(apiKey))
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys[hash]
+}
+
+// KeyFromHeader returns the API key from a bearer token, the X-Api-Key header or, for websocket
+// upgrades only, the Sec-WebSocket-Protocol header
+func KeyFromHeader(header http.Header) string {
+	if apiKey := header.Get(HeaderApiKey); apiKey != "" {
+		return apiKey
+	}
+	authHeader := header.Get("Authorization")
+	if len(authHeader) > 7 && strings.EqualFold(authHeader[:7], "bearer ") {
+		return strings.TrimSpace(authHeader[7:])
+	}
+	if strings.EqualFold(header.Get("Upgrade"), "websocket") {
+		return keyFromWebSocketProtocols(header)
+	}
+	return ""
+}
+
+// keyFromWebSocketProtocols returns the API key from the subprotocols offered by a websocket
+// client
+func keyFromWebSocketProtocols(header http.Header) string {
+	for _, value := range header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			encodedKey, ok := strings.CutPrefix(strings.TrimSpace(protocol), WebSocketKeyPrefix)
+			if !ok {
+				continue
+			}
+			apiKey, err := base64.RawURLEncoding.DecodeString(encodedKey)
+			if err != nil || len(apiKey) == 0 {
+				continue
+			}
+			return string(apiKey)
+		}
+	}
+	return ""
+}
+
+// watch reloads the keys file whenever it changes. We keep using the old keys if the new ones
+// can't be loaded
+func (s *KeyStore) watch() {
+	logger := logging.GetLogger()
+	for {
+		time.Sleep(reloadInterval)
+		reloaded, err := s.reload()
+		if err != nil {
+			logger.Warnf("failed to reload API keys: %s", err)
+			continue
+		}
+		if reloaded {
+			logger.Infof("reloaded API keys from %s", s.cfg.KeysFilePath)
+		}
+	}
+}
+
+// reload loads the keys again if the keys file has changed, and returns whether it did
+func (s *KeyStore) reload() (bool, error) {
+	info, err := os.Stat(s.cfg.KeysFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to check API keys file: %s", err)
+	}
+	s.mutex.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *KeyStore) load() error {
+	var keys []Key
+	for i, keyDef := range s.cfg.Keys {
+		key, err := parseKey(keyDef)
+		if err != nil {
+			return fmt.Errorf("API key %d: %s", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	var modTime time.Time
+	if s.cfg.KeysFilePath != "" {
+		info, err := os.Stat(s.cfg.KeysFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read API keys file: %s", err)
+		}
+		modTime = info.ModTime()
+		buf, err := os.ReadFile(s.cfg.KeysFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read API keys file: %s", err)
+		}
+		var f keysFile
+		if err := yaml.UnmarshalStrict(buf, &f); err != nil {
+			return fmt.Errorf("failed to parse API keys file: %s", err)
+		}
+		keys = append(keys, f.Keys...)
+	}
+	keyMap := make(map[[sha256.Size]byte]*Key)
+	for i := range keys {
+		key := &keys[i]
+		if err := validateKey(key); err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(key.Key))
+		if _, ok := keyMap[hash]; ok {
+			return fmt.Errorf("duplicate API key %s", key.Name)
+		}
+		keyMap[hash] = key
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keyMap
+	s.modTime = modTime
+	return nil
+}
+
+// parseKey parses a key from the config, in the form name:scope|scope:key
+func parseKey(keyDef string) (Key, error) {
+	parts := strings.SplitN(keyDef, ":", 3)
+	if len(parts) != 3 {
+		// Don't include the definition in the error, as it may be the key itself
+		return Key{}, errors.New("invalid API key: expected name:scopes:key")
+	}
+	key := Key{
+		Name: parts[0],
+		Key:  parts[2],
+	}
+	for _, scope := range strings.Split(parts[1], "|") {
+		if scope != "" {
+			key.Scopes = append(key.Scopes, Scope(scope))
+		}
+	}
+	return key, nil
+}
+
+func validateKey(key *Key) error {
+	if key.Name == "" {
+		return errors.New("API key with no name")
+	}
+	if key.Key == "" {
+		return fmt.Errorf("API key %s is empty", key.Name)
+	}
+	for _, scope := range key.Scopes {
+		if !validScopes[scope] {
+			return fmt.Errorf("API key %s has unknown scope %q", key.Name, scope)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyDef  string
+		want    Key
+		wantErr bool
+	}{
+		{
+			name:   "scopes",
+			keyDef: "wallet:query|submit:s3cret",
+			want: Key{
+				Name:   "wallet",
+				Key:    "s3cret",
+				Scopes: []Scope{ScopeQuery, ScopeSubmit},
+			},
+		},
+		{
+			name:   "no scopes",
+			keyDef: "monitor::s3cret",
+			want:   Key{Name: "monitor", Key: "s3cret"},
+		},
+		{
+			name:   "colon in key",
+			keyDef: "wallet:query:s3c:ret",
+			want: Key{
+				Name:   "wallet",
+				Key:    "s3c:ret",
+				Scopes: []Scope{ScopeQuery},
+			},
+		},
+		{
+			name:    "bare key",
+			keyDef:  "s3cret",
+			wantErr: true,
+		},
+		{
+			name:    "missing scopes",
+			keyDef:  "s3cret:query",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := parseKey(test.keyDef)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				if strings.Contains(err.Error(), "s3cret") {
+					t.Fatalf("error includes the key: %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(key, test.want) {
+				t.Fatalf("got key %+v, wanted %+v", key, test.want)
+			}
+		})
+	}
+}
+
+func TestNewKeyStoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+	}{
+		{name: "malformed", keys: []string{"a:query:one", "s3cret"}},
+		{name: "unknown scope", keys: []string{"a:admin:s3cret"}},
+		{name: "empty key", keys: []string{"a:query:"}},
+		{name: "no name", keys: []string{":query:s3cret"}},
+		{name: "duplicate", keys: []string{"a:query:s3cret", "b:submit:s3cret"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewKeyStore(config.AuthConfig{Keys: test.keys})
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if strings.Contains(err.Error(), "s3cret") {
+				t.Fatalf("error includes the key: %s", err)
+			}
+		})
+	}
+}
+
+func TestKeyStoreAuthorize(t *testing.T) {
+	s, err := NewKeyStore(
+		config.AuthConfig{
+			Keys: []string{
+				"reader:query:read-key",
+				"streamer:query|stream:stream-key",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tests := []struct {
+		name     string
+		header   http.Header
+		scopes   []Scope
+		wantName string
+		wantErr  error
+	}{
+		{
+			name:     "bearer token",
+			header:   http.Header{"Authorization": {"Bearer read-key"}},
+			scopes:   []Scope{ScopeQuery},
+			wantName: "reader",
+		},
+		{
+			name:     "api key header",
+			header:   http.Header{HeaderApiKey: {"stream-key"}},
+			scopes:   []Scope{ScopeQuery, ScopeStream},
+			wantName: "streamer",
+		},
+		{
+			name: "websocket subprotocol",
+			header: http.Header{
+				"Upgrade":                {"websocket"},
+				"Sec-Websocket-Protocol": {WebSocketProtocol + ", " + WebSocketKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte("stream-key"))},
+			},
+			scopes:   []Scope{ScopeStream},
+			wantName: "streamer",
+		},
+		{
+			name: "websocket subprotocol in its own header",
+			header: http.Header{
+				"Upgrade": {"WebSocket"},
+				"Sec-Websocket-Protocol": {
+					WebSocketProtocol,
+					WebSocketKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte("stream-key")),
+				},
+			},
+			scopes:   []Scope{ScopeStream},
+			wantName: "streamer",
+		},
+		{
+			name: "websocket subprotocol without an upgrade",
+			header: http.Header{
+				"Sec-Websocket-Protocol": {WebSocketKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte("stream-key"))},
+			},
+			scopes:  []Scope{ScopeStream},
+			wantErr: ErrMissingKey,
+		},
+		{
+			name: "websocket subprotocol that isn't base64",
+			header: http.Header{
+				"Upgrade":                {"websocket"},
+				"Sec-Websocket-Protocol": {WebSocketKeyPrefix + "stream-key!"},
+			},
+			scopes:  []Scope{ScopeStream},
+			wantErr: ErrMissingKey,
+		},
+		{
+			name:    "missing key",
+			header:  http.Header{},
+			scopes:  []Scope{ScopeQuery},
+			wantErr: ErrMissingKey,
+		},
+		{
+			name:    "unknown key",
+			header:  http.Header{HeaderApiKey: {"other-key"}},
+			scopes:  []Scope{ScopeQuery},
+			wantErr: ErrInvalidKey,
+		},
+		{
+			name:     "missing scope",
+			header:   http.Header{"Authorization": {"bearer read-key"}},
+			scopes:   []Scope{ScopeQuery, ScopeStream},
+			wantName: "reader",
+			wantErr:  ScopeError{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := s.Authorize(test.header, test.scopes...)
+			switch wantErr := test.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			case ScopeError:
+				if !errors.As(err, &wantErr) {
+					t.Fatalf("got error %v, wanted a scope error", err)
+				}
+			default:
+				if !errors.Is(err, wantErr) {
+					t.Fatalf("got error %v, wanted %s", err, wantErr)
+				}
+			}
+			if test.wantName != "" && (key == nil || key.Name != test.wantName) {
+				t.Fatalf("got key %+v, wanted %s", key, test.wantName)
+			}
+		})
+	}
+}
+
+func TestKeyStoreReload(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	writeKeys := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(keysFile, []byte(content), 0o600); err != nil {
+			t.Fatalf("unexpected error writing keys file: %s", err)
+		}
+		// Move the modification time on explicitly, as writes can land within the same tick
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(keysFile, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error setting keys file time: %s", err)
+		}
+	}
+	writeKeys("keys:\n  - name: old\n    key: old-key\n    scopes: [query]\n")
+	s, err := NewKeyStore(
+		config.AuthConfig{
+			KeysFilePath: keysFile,
+			Keys:         []string{"static:query:static-key"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tests := []struct {
+		name         string
+		content      string
+		wantReloaded bool
+		wantErr      bool
+		wantKeys     map[string]bool
+	}{
+		{
+			name:     "unchanged",
+			wantKeys: map[string]bool{"old-key": true, "static-key": true},
+		},
+		{
+			name:         "new key",
+			content:      "keys:\n  - name: new\n    key: new-key\n    scopes: [submit]\n",
+			wantReloaded: true,
+			wantKeys:     map[string]bool{"old-key": false, "new-key": true, "static-key": true},
+		},
+		{
+			name:     "invalid file keeps old keys",
+			content:  "keys:\n  - name: bad\n    key: bad-key\n    scopes: [admin]\n",
+			wantErr:  true,
+			wantKeys: map[string]bool{"new-key": true, "bad-key": false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.content != "" {
+				writeKeys(test.content)
+			}
+			reloaded, err := s.reload()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wanted error %t", err, test.wantErr)
+			}
+			if reloaded != test.wantReloaded {
+				t.Fatalf("got reloaded %t, wanted %t", reloaded, test.wantReloaded)
+			}
+			for apiKey, want := range test.wantKeys {
+				found := s.Lookup(http.Header{HeaderApiKey: {apiKey}}) != nil
+				if found != want {
+					t.Fatalf("key %s: got found %t, wanted %t", apiKey, found, want)
+				}
+			}
+		})
+	}
+}
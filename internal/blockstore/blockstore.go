@@ -0,0 +1,539 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blinklabs-io/adder/event"
+	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+const (
+	// Blocks are keyed by slot and hash, so that they're ordered by slot
+	bucketBlocks = "blocks"
+	// Indexes from block hash, block height and transaction hash to the block key
+	bucketHashes  = "hashes"
+	bucketHeights = "heights"
+	bucketTxs     = "txs"
+	bucketMeta    = "meta"
+
+	metaKeyCount = "count"
+
+	// Number of recent blocks offered as intersect points when resuming
+	resumePoints = 10
+	// Delay before retrying to start the chain-sync
+	startRetryDelay = 10 * time.Second
+)
+
+// ErrBlockNotFound is returned when a block isn't in the block store
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockStore keeps blocks from chain-sync in an embedded on-disk database
+type BlockStore struct {
+	db        *bolt.DB
+	maxBlocks uint64
+	startSlot uint64
+	startHash []byte
+}
+
+var globalBlockStore *BlockStore
+
+// GetBlockStore returns the global block store, or nil if it's not enabled
+func GetBlockStore() *BlockStore {
+	return globalBlockStore
+}
+
+// Start opens the block store and starts feeding it from chain-sync. It does nothing if no
+// block store directory is configured
+func Start() error {
+	cfg := config.GetConfig()
+	if cfg.BlockStore.Directory == "" {
+		return nil
+	}
+	s, err := New(cfg.BlockStore)
+	if err != nil {
+		return err
+	}
+	globalBlockStore = s
+	s.registerMetrics()
+	go s.run()
+	return nil
+}
+
+// New opens (or creates) a block store in the configured directory
+func New(cfg config.BlockStoreConfig) (*BlockStore, error) {
+	startHash, err := hex.DecodeString(cfg.StartHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block store start hash: %s", err)
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create block store directory: %s", err)
+	}
+	db, err := bolt.Open(
+		filepath.Join(cfg.Directory, "blocks.db"),
+		0o600,
+		&bolt.Options{Timeout: time.Second},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block store: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucketBlocks, bucketHashes, bucketHeights, bucketTxs, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize block store: %s", err)
+	}
+	// Pruning would throw away the blocks after a configured starting point, which is the only
+	// reason to configure one
+	maxBlocks := cfg.MaxBlocks
+	if cfg.StartSlot > 0 {
+		maxBlocks = 0
+	}
+	s := &BlockStore{
+		db:        db,
+		maxBlocks: maxBlocks,
+		startSlot: cfg.StartSlot,
+		startHash: startHash,
+	}
+	return s, nil
+}
+
+// Close closes the underlying database
+func (s *BlockStore) Close() error {
+	return s.db.Close()
+}
+
+// GetBlockByHash returns the block with the given hash
+func (s *BlockStore) GetBlockByHash(hash []byte) (ledger.Block, error) {
+	return s.getBlockByIndex(bucketHashes, hash)
+}
+
+// GetBlockByHeight returns the block with the given block number
+func (s *BlockStore) GetBlockByHeight(height uint64) (ledger.Block, error) {
+	return s.getBlockByIndex(bucketHeights, uint64Bytes(height))
+}
+
+// GetTxBlock returns the block that includes the transaction with the given hash
+func (s *BlockStore) GetTxBlock(txHash []byte) (ledger.Block, error) {
+	return s.getBlockByIndex(bucketTxs, txHash)
+}
+
+// GetBlockBySlot returns the block in the given slot
+func (s *BlockStore) GetBlockBySlot(slot uint64) (ledger.Block, error) {
+	var block ledger.Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := uint64Bytes(slot)
+		k, v := tx.Bucket([]byte(bucketBlocks)).Cursor().Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return ErrBlockNotFound
+		}
+		var err error
+		block, err = decodeBlock(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetBlock returns the block at the given point
+func (s *BlockStore) GetBlock(point common.Point) (ledger.Block, error) {
+	var block ledger.Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bucketBlocks)).Get(blockKey(point.Slot, point.Hash))
+		if v == nil {
+			return ErrBlockNotFound
+		}
+		var err error
+		block, err = decodeBlock(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetBlocksFrom returns up to count blocks in slot order, starting with the first block at or
+// after the given slot
+func (s *BlockStore) GetBlocksFrom(slot uint64, count int) ([]ledger.Block, error) {
+	ret := []ledger.Block{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketBlocks)).Cursor()
+		for k, v := c.Seek(uint64Bytes(slot)); k != nil && len(ret) < count; k, v = c.Next() {
+			block, err := decodeBlock(v)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, block)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetBlocksAt returns up to count blocks in slot order, starting with the block at the given point
+func (s *BlockStore) GetBlocksAt(point common.Point, count int) ([]ledger.Block, error) {
+	ret := []ledger.Block{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketBlocks)).Cursor()
+		key := blockKey(point.Slot, point.Hash)
+		k, v := c.Seek(key)
+		if k == nil || !bytes.Equal(k, key) {
+			return ErrBlockNotFound
+		}
+		for ; k != nil && len(ret) < count; k, v = c.Next() {
+			block, err := decodeBlock(v)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, block)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Range returns the points of the oldest and newest blocks in the store
+func (s *BlockStore) Range() (common.Point, common.Point, error) {
+	var first, last common.Point
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketBlocks)).Cursor()
+		firstKey, _ := c.First()
+		lastKey, _ := c.Last()
+		if firstKey == nil {
+			return ErrBlockNotFound
+		}
+		first = keyPoint(firstKey)
+		last = keyPoint(lastKey)
+		return nil
+	})
+	return first, last, err
+}
+
+// Count returns the number of blocks in the store
+func (s *BlockStore) Count() uint64 {
+	var count uint64
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		count = getCount(tx)
+		return nil
+	})
+	return count
+}
+
+func (s *BlockStore) getBlockByIndex(bucket string, indexKey []byte) (ledger.Block, error) {
+	var block ledger.Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := tx.Bucket([]byte(bucket)).Get(indexKey)
+		if k == nil {
+			return ErrBlockNotFound
+		}
+		v := tx.Bucket([]byte(bucketBlocks)).Get(k)
+		if v == nil {
+			return ErrBlockNotFound
+		}
+		var err error
+		block, err = decodeBlock(v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// run follows the chain and keeps the store up to date. If an update fails, we stop the
+// chain-sync and resync from the last block we stored, rather than leave a hole in the store
+func (s *BlockStore) run() {
+	logger := logging.GetLogger()
+	for {
+		eventChan := make(chan event.Event, 10)
+		// The chain-sync takes care of reconnecting once it's started
+		session, err := node.StartChainSync(eventChan, s.intersectPoints())
+		if err != nil {
+			logger.Warnf(
+				"failed to start block store chain-sync, retrying in %s: %s",
+				startRetryDelay,
+				err,
+			)
+			time.Sleep(startRetryDelay)
+			continue
+		}
+		err = s.follow(eventChan)
+		session.Close()
+		logger.Errorf(
+			"failed to update block store, resyncing in %s: %s",
+			startRetryDelay,
+			err,
+		)
+		time.Sleep(startRetryDelay)
+	}
+}
+
+// follow applies chain-sync events to the store until one of them fails
+func (s *BlockStore) follow(eventChan chan event.Event) error {
+	for evt := range eventChan {
+		var err error
+		switch payload := evt.Payload.(type) {
+		case input_chainsync.BlockEvent:
+			err = s.addBlock(payload.Block)
+		case input_chainsync.RollbackEvent:
+			err = s.rollback(payload.SlotNumber)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("chain-sync ended")
+}
+
+// intersectPoints returns the points to start the chain-sync from. We resume after the most
+// recent blocks we have, or start from the configured starting point or the tip
+func (s *BlockStore) intersectPoints() []common.Point {
+	var ret []common.Point
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketBlocks)).Cursor()
+		for k, _ := c.Last(); k != nil && len(ret) < resumePoints; k, _ = c.Prev() {
+			ret = append(ret, keyPoint(k))
+		}
+		return nil
+	})
+	if s.startSlot > 0 {
+		ret = append(ret, common.NewPoint(s.startSlot, s.startHash))
+	}
+	return ret
+}
+
+func (s *BlockStore) addBlock(block ledger.Block) error {
+	blockType, err := blockTypeOf(block)
+	if err != nil {
+		return err
+	}
+	hash, err := hex.DecodeString(block.Hash())
+	if err != nil {
+		return err
+	}
+	key := blockKey(block.SlotNumber(), hash)
+	value := make([]byte, 0, 9+len(block.Cbor()))
+	value = append(value, byte(blockType))
+	value = append(value, uint64Bytes(block.BlockNumber())...)
+	value = append(value, block.Cbor()...)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(bucketBlocks))
+		count := getCount(tx)
+		if blocks.Get(key) == nil {
+			count++
+		}
+		if err := blocks.Put(key, value); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketHashes)).Put(hash, key); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketHeights)).Put(uint64Bytes(block.BlockNumber()), key); err != nil {
+			return err
+		}
+		for _, blockTx := range block.Transactions() {
+			txHash, err := hex.DecodeString(blockTx.Hash())
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(bucketTxs)).Put(txHash, key); err != nil {
+				return err
+			}
+		}
+		// Prune the oldest blocks
+		if s.maxBlocks > 0 {
+			c := blocks.Cursor()
+			for k, v := c.First(); k != nil && count > s.maxBlocks; k, v = c.First() {
+				if err := deleteBlock(tx, k, v); err != nil {
+					return err
+				}
+				count--
+			}
+		}
+		return putCount(tx, count)
+	})
+}
+
+// rollback removes all blocks after the given slot
+func (s *BlockStore) rollback(slot uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(bucketBlocks))
+		count := getCount(tx)
+		c := blocks.Cursor()
+		for k, v := c.Last(); k != nil && keyPoint(k).Slot > slot; k, v = c.Last() {
+			if err := deleteBlock(tx, k, v); err != nil {
+				return err
+			}
+			count--
+		}
+		return putCount(tx, count)
+	})
+}
+
+func (s *BlockStore) registerMetrics() {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "blockstore_blocks",
+			Help: "Number of blocks in the block store",
+		},
+		func() float64 { return float64(s.Count()) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "blockstore_tip_slot",
+			Help: "Slot of the newest block in the block store",
+		},
+		func() float64 {
+			_, last, err := s.Range()
+			if err != nil {
+				return 0
+			}
+			return float64(last.Slot)
+		},
+	)
+}
+
+func deleteBlock(tx *bolt.Tx, key []byte, value []byte) error {
+	point := keyPoint(key)
+	// Decode the block and copy the height before deleting, since the value is only valid until
+	// then
+	block, err := decodeBlock(value)
+	if err != nil {
+		return err
+	}
+	height := append([]byte{}, value[1:9]...)
+	if err := tx.Bucket([]byte(bucketBlocks)).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(bucketHashes)).Delete(point.Hash); err != nil {
+		return err
+	}
+	// Another block may have since been stored at the same height
+	heights := tx.Bucket([]byte(bucketHeights))
+	if bytes.Equal(heights.Get(height), blockKey(point.Slot, point.Hash)) {
+		if err := heights.Delete(height); err != nil {
+			return err
+		}
+	}
+	// A rolled back transaction may have since been stored in another block
+	txs := tx.Bucket([]byte(bucketTxs))
+	for _, blockTx := range block.Transactions() {
+		txHash, err := hex.DecodeString(blockTx.Hash())
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(txs.Get(txHash), blockKey(point.Slot, point.Hash)) {
+			if err := txs.Delete(txHash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func getCount(tx *bolt.Tx) uint64 {
+	v := tx.Bucket([]byte(bucketMeta)).Get([]byte(metaKeyCount))
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putCount(tx *bolt.Tx, count uint64) error {
+	return tx.Bucket([]byte(bucketMeta)).Put([]byte(metaKeyCount), uint64Bytes(count))
+}
+
+func decodeBlock(value []byte) (ledger.Block, error) {
+	if len(value) < 9 {
+		return nil, fmt.Errorf("invalid block record")
+	}
+	// The decoded block keeps a reference to its CBOR, and values from the database are only
+	// valid for the life of the transaction
+	blockCbor := append([]byte{}, value[9:]...)
+	return ledger.NewBlockFromCbor(uint(value[0]), blockCbor)
+}
+
+// blockTypeOf returns the block type needed to decode the block CBOR again
+func blockTypeOf(block ledger.Block) (uint, error) {
+	switch block.(type) {
+	case *ledger.ByronEpochBoundaryBlock:
+		return ledger.BlockTypeByronEbb, nil
+	case *ledger.ByronMainBlock:
+		return ledger.BlockTypeByronMain, nil
+	case *ledger.ShelleyBlock:
+		return ledger.BlockTypeShelley, nil
+	case *ledger.AllegraBlock:
+		return ledger.BlockTypeAllegra, nil
+	case *ledger.MaryBlock:
+		return ledger.BlockTypeMary, nil
+	case *ledger.AlonzoBlock:
+		return ledger.BlockTypeAlonzo, nil
+	case *ledger.BabbageBlock:
+		return ledger.BlockTypeBabbage, nil
+	case *ledger.ConwayBlock:
+		return ledger.BlockTypeConway, nil
+	default:
+		return 0, fmt.Errorf("unknown block type: %T", block)
+	}
+}
+
+func blockKey(slot uint64, hash []byte) []byte {
+	return append(uint64Bytes(slot), hash...)
+}
+
+func keyPoint(key []byte) common.Point {
+	return common.NewPoint(
+		binary.BigEndian.Uint64(key[:8]),
+		append([]byte{}, key[8:]...),
+	)
+}
+
+func uint64Bytes(val uint64) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, val)
+	return ret
+}
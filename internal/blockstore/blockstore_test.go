@@ -0,0 +1,477 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/adder/event"
+	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/cbor"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+// testBlockRef is the slot and height of a test block
+type testBlockRef struct {
+	slot   uint64
+	height uint64
+}
+
+// newTestBlock builds a minimal Shelley block, so that it can be stored and decoded again. It
+// has a transaction for each of the given IDs, which spends an output of a transaction whose hash
+// is filled with that ID
+func newTestBlock(t *testing.T, ref testBlockRef, txIds ...byte) ledger.Block {
+	t.Helper()
+	hash32 := make([]byte, 32)
+	txBodies := []any{}
+	txWitnesses := []any{}
+	for _, id := range txIds {
+		txBodies = append(
+			txBodies,
+			map[uint]any{
+				0: []any{[]any{bytes.Repeat([]byte{id}, 32), uint64(0)}},
+				1: []any{[]any{append([]byte{0x61}, bytes.Repeat([]byte{id}, 28)...), uint64(1000000)}},
+				2: uint64(200000),
+				3: uint64(1000),
+			},
+		)
+		txWitnesses = append(txWitnesses, map[uint]any{})
+	}
+	headerBody := []any{
+		ref.height,
+		ref.slot,
+		hash32,
+		hash32,
+		[]byte{},
+		[]any{[]byte{}, []byte{}},
+		[]any{[]byte{}, []byte{}},
+		uint64(0),
+		hash32,
+		[]byte{},
+		uint32(0),
+		uint32(0),
+		[]byte{},
+		uint64(2),
+		uint64(0),
+	}
+	blockCbor, err := cbor.Encode(
+		[]any{
+			[]any{headerBody, []byte{}},
+			txBodies,
+			txWitnesses,
+			map[uint]any{},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	block, err := ledger.NewBlockFromCbor(ledger.BlockTypeShelley, blockCbor)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return block
+}
+
+func newTestStore(t *testing.T, cfg config.BlockStoreConfig) *BlockStore {
+	t.Helper()
+	cfg.Directory = t.TempDir()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+// storedRefs returns the slot and height of every block in the store, in slot order
+func storedRefs(t *testing.T, s *BlockStore) []testBlockRef {
+	t.Helper()
+	blocks, err := s.GetBlocksFrom(0, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ret := []testBlockRef{}
+	for _, block := range blocks {
+		ret = append(ret, testBlockRef{block.SlotNumber(), block.BlockNumber()})
+	}
+	return ret
+}
+
+func TestBlockStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.BlockStoreConfig
+		blocks    []testBlockRef
+		rollback  *uint64
+		after     []testBlockRef
+		want      []testBlockRef
+		wantGone  []testBlockRef
+		wantCount uint64
+	}{
+		{
+			name:      "stored",
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {30, 3}},
+			want:      []testBlockRef{{10, 1}, {20, 2}, {30, 3}},
+			wantCount: 3,
+		},
+		{
+			name:      "stored again",
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {20, 2}},
+			want:      []testBlockRef{{10, 1}, {20, 2}},
+			wantCount: 2,
+		},
+		{
+			name:      "pruned",
+			cfg:       config.BlockStoreConfig{MaxBlocks: 2},
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {30, 3}, {40, 4}},
+			want:      []testBlockRef{{30, 3}, {40, 4}},
+			wantGone:  []testBlockRef{{10, 1}, {20, 2}},
+			wantCount: 2,
+		},
+		{
+			name: "not pruned after a start point",
+			cfg: config.BlockStoreConfig{
+				MaxBlocks: 2,
+				StartSlot: 5,
+				StartHash: fmt.Sprintf("%064x", 5),
+			},
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {30, 3}, {40, 4}},
+			want:      []testBlockRef{{10, 1}, {20, 2}, {30, 3}, {40, 4}},
+			wantCount: 4,
+		},
+		{
+			name:      "rolled back",
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {30, 3}},
+			rollback:  uint64Ptr(10),
+			want:      []testBlockRef{{10, 1}},
+			wantGone:  []testBlockRef{{20, 2}, {30, 3}},
+			wantCount: 1,
+		},
+		{
+			name:      "rolled back to the tip",
+			blocks:    []testBlockRef{{10, 1}, {20, 2}},
+			rollback:  uint64Ptr(20),
+			want:      []testBlockRef{{10, 1}, {20, 2}},
+			wantCount: 2,
+		},
+		{
+			name:      "fork at the same height",
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {30, 3}},
+			rollback:  uint64Ptr(10),
+			after:     []testBlockRef{{25, 2}},
+			want:      []testBlockRef{{10, 1}, {25, 2}},
+			wantGone:  []testBlockRef{{20, 2}, {30, 3}},
+			wantCount: 2,
+		},
+		{
+			name:      "pruned after a fork",
+			cfg:       config.BlockStoreConfig{MaxBlocks: 2},
+			blocks:    []testBlockRef{{10, 1}, {20, 2}, {30, 3}},
+			rollback:  uint64Ptr(20),
+			after:     []testBlockRef{{35, 3}, {40, 4}},
+			want:      []testBlockRef{{35, 3}, {40, 4}},
+			wantGone:  []testBlockRef{{10, 1}, {20, 2}, {30, 3}},
+			wantCount: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t, test.cfg)
+			for _, ref := range test.blocks {
+				if err := s.addBlock(newTestBlock(t, ref)); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if test.rollback != nil {
+				if err := s.rollback(*test.rollback); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			for _, ref := range test.after {
+				if err := s.addBlock(newTestBlock(t, ref)); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if got := storedRefs(t, s); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got blocks %v, wanted %v", got, test.want)
+			}
+			if s.Count() != test.wantCount {
+				t.Fatalf("got count %d, wanted %d", s.Count(), test.wantCount)
+			}
+			// Every stored block can be found through each index
+			for _, ref := range test.want {
+				block := newTestBlock(t, ref)
+				hash, _ := hex.DecodeString(block.Hash())
+				lookups := map[string]func() (ledger.Block, error){
+					"hash":   func() (ledger.Block, error) { return s.GetBlockByHash(hash) },
+					"height": func() (ledger.Block, error) { return s.GetBlockByHeight(ref.height) },
+					"slot":   func() (ledger.Block, error) { return s.GetBlockBySlot(ref.slot) },
+					"point": func() (ledger.Block, error) {
+						return s.GetBlock(common.NewPoint(ref.slot, hash))
+					},
+				}
+				for name, lookup := range lookups {
+					got, err := lookup()
+					if err != nil {
+						t.Fatalf("block %v by %s: unexpected error: %s", ref, name, err)
+					}
+					if got.Hash() != block.Hash() {
+						t.Fatalf("block %v by %s: got block %s, wanted %s", ref, name, got.Hash(), block.Hash())
+					}
+				}
+			}
+			// Blocks that were pruned or rolled back are gone from the indexes too
+			for _, ref := range test.wantGone {
+				hash, _ := hex.DecodeString(newTestBlock(t, ref).Hash())
+				if _, err := s.GetBlockByHash(hash); !errors.Is(err, ErrBlockNotFound) {
+					t.Fatalf("block %v by hash: got error %v, wanted %v", ref, err, ErrBlockNotFound)
+				}
+				if _, err := s.GetBlockBySlot(ref.slot); !errors.Is(err, ErrBlockNotFound) {
+					t.Fatalf("block %v by slot: got error %v, wanted %v", ref, err, ErrBlockNotFound)
+				}
+				if got, err := s.GetBlockByHeight(ref.height); err == nil && got.SlotNumber() == ref.slot {
+					t.Fatalf("block %v by height: still found", ref)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTxBlock(t *testing.T) {
+	type txBlock struct {
+		ref   testBlockRef
+		txIds []byte
+	}
+	tests := []struct {
+		name     string
+		cfg      config.BlockStoreConfig
+		blocks   []txBlock
+		rollback *uint64
+		after    []txBlock
+		// The slot of the block each transaction should be found in, with 0 for not found
+		want map[byte]uint64
+	}{
+		{
+			name: "found",
+			blocks: []txBlock{
+				{testBlockRef{10, 1}, []byte{0xa0}},
+				{testBlockRef{20, 2}, []byte{0xb0, 0xc0}},
+			},
+			want: map[byte]uint64{0xa0: 10, 0xb0: 20, 0xc0: 20, 0xd0: 0},
+		},
+		{
+			name: "pruned",
+			cfg:  config.BlockStoreConfig{MaxBlocks: 1},
+			blocks: []txBlock{
+				{testBlockRef{10, 1}, []byte{0xa0}},
+				{testBlockRef{20, 2}, []byte{0xb0}},
+			},
+			want: map[byte]uint64{0xa0: 0, 0xb0: 20},
+		},
+		{
+			name: "rolled back",
+			blocks: []txBlock{
+				{testBlockRef{10, 1}, []byte{0xa0}},
+				{testBlockRef{20, 2}, []byte{0xb0}},
+			},
+			rollback: uint64Ptr(10),
+			want:     map[byte]uint64{0xa0: 10, 0xb0: 0},
+		},
+		{
+			name: "in another block after a rollback",
+			blocks: []txBlock{
+				{testBlockRef{10, 1}, []byte{0xa0}},
+				{testBlockRef{20, 2}, []byte{0xb0}},
+			},
+			rollback: uint64Ptr(10),
+			after: []txBlock{
+				{testBlockRef{25, 2}, []byte{}},
+				{testBlockRef{30, 3}, []byte{0xb0}},
+			},
+			want: map[byte]uint64{0xa0: 10, 0xb0: 30},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t, test.cfg)
+			txHashes := map[byte][]byte{}
+			add := func(blocks []txBlock) {
+				for _, b := range blocks {
+					block := newTestBlock(t, b.ref, b.txIds...)
+					for i, blockTx := range block.Transactions() {
+						txHashes[b.txIds[i]], _ = hex.DecodeString(blockTx.Hash())
+					}
+					if err := s.addBlock(block); err != nil {
+						t.Fatalf("unexpected error: %s", err)
+					}
+				}
+			}
+			add(test.blocks)
+			if test.rollback != nil {
+				if err := s.rollback(*test.rollback); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			add(test.after)
+			for id, wantSlot := range test.want {
+				txHash, ok := txHashes[id]
+				if !ok {
+					txHash = bytes.Repeat([]byte{id}, 32)
+				}
+				block, err := s.GetTxBlock(txHash)
+				if wantSlot == 0 {
+					if !errors.Is(err, ErrBlockNotFound) {
+						t.Fatalf("tx %x: got error %v, wanted %v", id, err, ErrBlockNotFound)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("tx %x: unexpected error: %s", id, err)
+				}
+				if block.SlotNumber() != wantSlot {
+					t.Fatalf("tx %x: got block in slot %d, wanted %d", id, block.SlotNumber(), wantSlot)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockStoreRange(t *testing.T) {
+	s := newTestStore(t, config.BlockStoreConfig{})
+	if _, _, err := s.Range(); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("got error %v, wanted %v", err, ErrBlockNotFound)
+	}
+	refs := []testBlockRef{{10, 1}, {20, 2}, {30, 3}}
+	for _, ref := range refs {
+		if err := s.addBlock(newTestBlock(t, ref)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	first, last, err := s.Range()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if first.Slot != 10 || last.Slot != 30 {
+		t.Fatalf("got range %d-%d, wanted 10-30", first.Slot, last.Slot)
+	}
+	blocks, err := s.GetBlocksAt(last, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(blocks) != 1 || blocks[0].SlotNumber() != 30 {
+		t.Fatalf("got %d blocks from the last block, wanted just that one", len(blocks))
+	}
+	blocks, err = s.GetBlocksFrom(15, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(blocks) != 1 || blocks[0].SlotNumber() != 20 {
+		t.Fatalf("got %d blocks from slot 15, wanted the block in slot 20", len(blocks))
+	}
+	if _, err := s.GetBlocksAt(common.NewPoint(20, make([]byte, 32)), 5); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("got error %v for an unknown point, wanted %v", err, ErrBlockNotFound)
+	}
+}
+
+func TestIntersectPoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.BlockStoreConfig
+		blocks    []uint64
+		wantSlots []uint64
+	}{
+		{
+			name:      "tip",
+			wantSlots: []uint64{},
+		},
+		{
+			name: "configured start",
+			cfg: config.BlockStoreConfig{
+				StartSlot: 5,
+				StartHash: fmt.Sprintf("%064x", 5),
+			},
+			wantSlots: []uint64{5},
+		},
+		{
+			name:      "resume from most recent",
+			blocks:    []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			wantSlots: []uint64{12, 11, 10, 9, 8, 7, 6, 5, 4, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t, test.cfg)
+			for _, slot := range test.blocks {
+				if err := s.addBlock(newTestBlock(t, testBlockRef{slot, slot})); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			gotSlots := []uint64{}
+			for _, point := range s.intersectPoints() {
+				gotSlots = append(gotSlots, point.Slot)
+			}
+			if !reflect.DeepEqual(gotSlots, test.wantSlots) {
+				t.Fatalf("got intersect slots %v, wanted %v", gotSlots, test.wantSlots)
+			}
+		})
+	}
+}
+
+// failingBlock is a block that can't be stored
+type failingBlock struct {
+	ledger.Block
+}
+
+func TestFollowStopsOnFailure(t *testing.T) {
+	s := newTestStore(t, config.BlockStoreConfig{})
+	eventChan := make(chan event.Event, 3)
+	for _, block := range []ledger.Block{
+		newTestBlock(t, testBlockRef{10, 1}),
+		failingBlock{},
+		newTestBlock(t, testBlockRef{30, 3}),
+	} {
+		eventChan <- event.New(
+			"chainsync.block",
+			time.Now(),
+			nil,
+			input_chainsync.BlockEvent{Block: block},
+		)
+	}
+	if err := s.follow(eventChan); err == nil {
+		t.Fatalf("got no error for a block that couldn't be stored")
+	}
+	// Nothing after the failed block is stored, so that we resync from the last good block
+	if got := storedRefs(t, s); !reflect.DeepEqual(got, []testBlockRef{{10, 1}}) {
+		t.Fatalf("got blocks %v, wanted only the block before the failure", got)
+	}
+	if points := s.intersectPoints(); len(points) != 1 || points[0].Slot != 10 {
+		t.Fatalf("got intersect points %v, wanted the last good block", points)
+	}
+}
+
+func uint64Ptr(val uint64) *uint64 {
+	return &val
+}
@@ -24,12 +24,17 @@ import (
 )
 
 type Config struct {
-	Logging LoggingConfig `yaml:"logging"`
-	Api     ApiConfig     `yaml:"api"`
-	Metrics MetricsConfig `yaml:"metrics"`
-	Debug   DebugConfig   `yaml:"debug"`
-	Node    NodeConfig    `yaml:"node"`
-	Utxorpc UtxorpcConfig `yaml:"utxorpc"`
+	Logging    LoggingConfig    `yaml:"logging"`
+	Api        ApiConfig        `yaml:"api"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Debug      DebugConfig      `yaml:"debug"`
+	Node       NodeConfig       `yaml:"node"`
+	Utxorpc    UtxorpcConfig    `yaml:"utxorpc"`
+	BlockStore BlockStoreConfig `yaml:"blockStore"`
+	UtxoIndex  UtxoIndexConfig  `yaml:"utxoIndex"`
+	Tls        TlsConfig        `yaml:"tls"`
+	Auth       AuthConfig       `yaml:"auth"`
+	RateLimit  RateLimitConfig  `yaml:"rateLimit"`
 }
 
 type LoggingConfig struct {
@@ -38,8 +43,9 @@ type LoggingConfig struct {
 }
 
 type ApiConfig struct {
-	ListenAddress string `yaml:"address" envconfig:"API_LISTEN_ADDRESS"`
-	ListenPort    uint   `yaml:"port"    envconfig:"API_LISTEN_PORT"`
+	ListenAddress  string `yaml:"address"        envconfig:"API_LISTEN_ADDRESS"`
+	ListenPort     uint   `yaml:"port"           envconfig:"API_LISTEN_PORT"`
+	ReadyMaxTipLag uint   `yaml:"readyMaxTipLag" envconfig:"API_READY_MAX_TIP_LAG"`
 }
 
 type DebugConfig struct {
@@ -53,18 +59,89 @@ type MetricsConfig struct {
 }
 
 type NodeConfig struct {
-	Network      string `yaml:"network"      envconfig:"CARDANO_NETWORK"`
-	NetworkMagic uint32 `yaml:"networkMagic" envconfig:"CARDANO_NODE_NETWORK_MAGIC"`
-	Address      string `yaml:"address"      envconfig:"CARDANO_NODE_SOCKET_TCP_HOST"`
-	Port         uint   `yaml:"port"         envconfig:"CARDANO_NODE_SOCKET_TCP_PORT"`
-	QueryTimeout uint   `yaml:"queryTimeout" envconfig:"CARDANO_NODE_SOCKET_QUERY_TIMEOUT"`
-	SocketPath   string `yaml:"socketPath"   envconfig:"CARDANO_NODE_SOCKET_PATH"`
-	Timeout      uint   `yaml:"timeout"      envconfig:"CARDANO_NODE_SOCKET_TIMEOUT"`
+	Network             string              `yaml:"network"             envconfig:"CARDANO_NETWORK"`
+	NetworkMagic        uint32              `yaml:"networkMagic"        envconfig:"CARDANO_NODE_NETWORK_MAGIC"`
+	Address             string              `yaml:"address"             envconfig:"CARDANO_NODE_SOCKET_TCP_HOST"`
+	Port                uint                `yaml:"port"                envconfig:"CARDANO_NODE_SOCKET_TCP_PORT"`
+	QueryTimeout        uint                `yaml:"queryTimeout"        envconfig:"CARDANO_NODE_SOCKET_QUERY_TIMEOUT"`
+	SocketPath          string              `yaml:"socketPath"          envconfig:"CARDANO_NODE_SOCKET_PATH"`
+	Timeout             uint                `yaml:"timeout"             envconfig:"CARDANO_NODE_SOCKET_TIMEOUT"`
+	ReadyTimeout        uint                `yaml:"readyTimeout"        envconfig:"CARDANO_NODE_READY_TIMEOUT"`
+	Upstreams           []string            `yaml:"upstreams"           envconfig:"CARDANO_NODE_UPSTREAMS"`
+	UpstreamPolicy      string              `yaml:"upstreamPolicy"      envconfig:"CARDANO_NODE_UPSTREAM_POLICY"`
+	MaxTipLag           uint                `yaml:"maxTipLag"           envconfig:"CARDANO_NODE_MAX_TIP_LAG"`
+	ChainSyncBufferSize uint                `yaml:"chainSyncBufferSize" envconfig:"CARDANO_NODE_CHAINSYNC_BUFFER_SIZE"`
+	Pool                NodePoolConfig      `yaml:"pool"`
+	Reconnect           NodeReconnectConfig `yaml:"reconnect"`
+	Peer                NodePeerConfig      `yaml:"peer"`
+	Bulkhead            NodeBulkheadConfig  `yaml:"bulkhead"`
+}
+
+type NodePoolConfig struct {
+	Size                uint `yaml:"size"                envconfig:"CARDANO_NODE_POOL_SIZE"`
+	IdleTimeout         uint `yaml:"idleTimeout"         envconfig:"CARDANO_NODE_POOL_IDLE_TIMEOUT"`
+	HealthCheckInterval uint `yaml:"healthCheckInterval" envconfig:"CARDANO_NODE_POOL_HEALTH_CHECK_INTERVAL"`
+}
+
+type NodeReconnectConfig struct {
+	MinBackoff uint `yaml:"minBackoff" envconfig:"CARDANO_NODE_RECONNECT_MIN_BACKOFF"`
+	MaxBackoff uint `yaml:"maxBackoff" envconfig:"CARDANO_NODE_RECONNECT_MAX_BACKOFF"`
+}
+
+type NodeBulkheadConfig struct {
+	LocalStateQuery   uint `yaml:"localStateQuery"   envconfig:"CARDANO_NODE_BULKHEAD_LOCAL_STATE_QUERY"`
+	LocalTxMonitor    uint `yaml:"localTxMonitor"    envconfig:"CARDANO_NODE_BULKHEAD_LOCAL_TX_MONITOR"`
+	LocalTxSubmission uint `yaml:"localTxSubmission" envconfig:"CARDANO_NODE_BULKHEAD_LOCAL_TX_SUBMISSION"`
+	ChainSync         uint `yaml:"chainSync"         envconfig:"CARDANO_NODE_BULKHEAD_CHAINSYNC"`
+}
+
+type NodePeerConfig struct {
+	Address string `yaml:"address" envconfig:"CARDANO_NODE_PEER_ADDRESS"`
+	Port    uint   `yaml:"port"    envconfig:"CARDANO_NODE_PEER_PORT"`
 }
 
 type UtxorpcConfig struct {
-	ListenAddress string `yaml:"address" envconfig:"GRPC_LISTEN_ADDRESS"`
-	ListenPort    uint   `yaml:"port"    envconfig:"GRPC_LISTEN_PORT"`
+	ListenAddress       string   `yaml:"address"             envconfig:"GRPC_LISTEN_ADDRESS"`
+	ListenPort          uint     `yaml:"port"                envconfig:"GRPC_LISTEN_PORT"`
+	MempoolPollInterval uint     `yaml:"mempoolPollInterval" envconfig:"GRPC_MEMPOOL_POLL_INTERVAL"`
+	ConfirmationDepth   uint     `yaml:"confirmationDepth"   envconfig:"GRPC_CONFIRMATION_DEPTH"`
+	WaitForTxTimeout    uint     `yaml:"waitForTxTimeout"    envconfig:"GRPC_WAIT_FOR_TX_TIMEOUT"`
+	CorsAllowedOrigins  []string `yaml:"corsAllowedOrigins"  envconfig:"GRPC_CORS_ALLOWED_ORIGINS"`
+	CorsAllowedHeaders  []string `yaml:"corsAllowedHeaders"  envconfig:"GRPC_CORS_ALLOWED_HEADERS"`
+	CorsExposedHeaders  []string `yaml:"corsExposedHeaders"  envconfig:"GRPC_CORS_EXPOSED_HEADERS"`
+	CorsMaxAge          uint     `yaml:"corsMaxAge"          envconfig:"GRPC_CORS_MAX_AGE"`
+}
+
+type BlockStoreConfig struct {
+	Directory string `yaml:"directory" envconfig:"BLOCK_STORE_DIRECTORY"`
+	MaxBlocks uint64 `yaml:"maxBlocks" envconfig:"BLOCK_STORE_MAX_BLOCKS"`
+	StartSlot uint64 `yaml:"startSlot" envconfig:"BLOCK_STORE_START_SLOT"`
+	StartHash string `yaml:"startHash" envconfig:"BLOCK_STORE_START_HASH"`
+}
+
+type UtxoIndexConfig struct {
+	Directory string `yaml:"directory" envconfig:"UTXO_INDEX_DIRECTORY"`
+	StartSlot uint64 `yaml:"startSlot" envconfig:"UTXO_INDEX_START_SLOT"`
+	StartHash string `yaml:"startHash" envconfig:"UTXO_INDEX_START_HASH"`
+}
+
+type TlsConfig struct {
+	CertFilePath        string   `yaml:"certFilePath"        envconfig:"TLS_CERT_FILE_PATH"`
+	KeyFilePath         string   `yaml:"keyFilePath"         envconfig:"TLS_KEY_FILE_PATH"`
+	ClientCaFilePath    string   `yaml:"clientCaFilePath"    envconfig:"TLS_CLIENT_CA_FILE_PATH"`
+	ClientCertListeners []string `yaml:"clientCertListeners" envconfig:"TLS_CLIENT_CERT_LISTENERS"`
+}
+
+type AuthConfig struct {
+	KeysFilePath string   `yaml:"keysFilePath" envconfig:"AUTH_KEYS_FILE_PATH"`
+	Keys         []string `yaml:"keys"         envconfig:"AUTH_KEYS"`
+}
+
+type RateLimitConfig struct {
+	IpRequestsPerSecond  float64 `yaml:"ipRequestsPerSecond"  envconfig:"RATE_LIMIT_IP_REQUESTS_PER_SECOND"`
+	IpBurst              uint    `yaml:"ipBurst"              envconfig:"RATE_LIMIT_IP_BURST"`
+	KeyRequestsPerSecond float64 `yaml:"keyRequestsPerSecond" envconfig:"RATE_LIMIT_KEY_REQUESTS_PER_SECOND"`
+	KeyBurst             uint    `yaml:"keyBurst"             envconfig:"RATE_LIMIT_KEY_BURST"`
 }
 
 // Singleton config instance with default values
@@ -74,8 +151,9 @@ var globalConfig = &Config{
 		Healthchecks: false,
 	},
 	Api: ApiConfig{
-		ListenAddress: "",
-		ListenPort:    8080,
+		ListenAddress:  "",
+		ListenPort:     8080,
+		ReadyMaxTipLag: 600,
 	},
 	Debug: DebugConfig{
 		ListenAddress: "localhost",
@@ -86,14 +164,47 @@ var globalConfig = &Config{
 		ListenPort:    8081,
 	},
 	Node: NodeConfig{
-		Network:      "mainnet",
-		SocketPath:   "/node-ipc/node.socket",
-		QueryTimeout: 180,
-		Timeout:      5,
+		Network:             "mainnet",
+		SocketPath:          "/node-ipc/node.socket",
+		QueryTimeout:        180,
+		Timeout:             5,
+		ReadyTimeout:        5,
+		UpstreamPolicy:      "priority",
+		MaxTipLag:           120,
+		ChainSyncBufferSize: 100,
+		Pool: NodePoolConfig{
+			Size:                10,
+			IdleTimeout:         300,
+			HealthCheckInterval: 30,
+		},
+		Reconnect: NodeReconnectConfig{
+			MinBackoff: 1,
+			MaxBackoff: 60,
+		},
+		Bulkhead: NodeBulkheadConfig{
+			LocalStateQuery:   8,
+			LocalTxMonitor:    4,
+			LocalTxSubmission: 8,
+			ChainSync:         20,
+		},
 	},
 	Utxorpc: UtxorpcConfig{
-		ListenAddress: "",
-		ListenPort:    9090,
+		ListenAddress:       "",
+		ListenPort:          9090,
+		MempoolPollInterval: 1,
+		ConfirmationDepth:   10,
+		WaitForTxTimeout:    300,
+		CorsMaxAge:          7200,
+	},
+	BlockStore: BlockStoreConfig{
+		MaxBlocks: 2160,
+	},
+	Tls: TlsConfig{
+		ClientCertListeners: []string{"api", "utxorpc"},
+	},
+	RateLimit: RateLimitConfig{
+		IpBurst:  20,
+		KeyBurst: 20,
 	},
 }
 
@@ -127,6 +238,38 @@ func Load(configFile string) (*Config, error) {
 		}
 		globalConfig.Node.NetworkMagic = network.NetworkMagic
 	}
+	// Check block store starting point
+	if (globalConfig.BlockStore.StartSlot > 0) != (globalConfig.BlockStore.StartHash != "") {
+		return nil, fmt.Errorf(
+			"you must specify both the block store start slot and hash, or neither",
+		)
+	}
+	// Check UTxO index starting point
+	if (globalConfig.UtxoIndex.StartSlot > 0) != (globalConfig.UtxoIndex.StartHash != "") {
+		return nil, fmt.Errorf(
+			"you must specify both the UTxO index start slot and hash, or neither",
+		)
+	}
+	// Check TLS files
+	if (globalConfig.Tls.CertFilePath != "") != (globalConfig.Tls.KeyFilePath != "") {
+		return nil, fmt.Errorf(
+			"you must specify both the TLS certificate and key, or neither",
+		)
+	}
+	if globalConfig.Tls.ClientCaFilePath != "" && globalConfig.Tls.CertFilePath == "" {
+		return nil, fmt.Errorf(
+			"you must specify a TLS certificate and key to verify client certificates",
+		)
+	}
+	// Check upstream selection policy
+	switch globalConfig.Node.UpstreamPolicy {
+	case "priority", "round-robin", "least-loaded":
+	default:
+		return nil, fmt.Errorf(
+			"unknown upstream policy: %s",
+			globalConfig.Node.UpstreamPolicy,
+		)
+	}
 	return globalConfig, nil
 }
 
@@ -0,0 +1,164 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	ouroboros "github.com/blinklabs-io/gouroboros"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/blinklabs-io/gouroboros/protocol/blockfetch"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/blinklabs-io/gouroboros/protocol/txsubmission"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+// ErrBlockFetchNotConfigured is returned when a block is requested without a NtN peer configured
+var ErrBlockFetchNotConfigured = errors.New(
+	"block fetch requires a node-to-node peer to be configured",
+)
+
+// ErrBlockNotFound is returned when the NtN peer doesn't have a requested block
+var ErrBlockNotFound = errors.New("block not found")
+
+// noBlocksError is the error gOuroboros gives when the peer answers a block fetch with NoBlocks.
+// It isn't exported, so we can only go by its text
+const noBlocksError = "block(s) not found"
+
+// peerConnection is our shared node-to-node connection, which is created on first use and
+// replaced when it fails
+type peerConnection struct {
+	oConn    *ouroboros.Connection
+	doneChan chan struct{}
+}
+
+var peerMutex sync.Mutex
+var peer *peerConnection
+
+// BlockFetchEnabled returns whether a NtN peer is configured for BlockFetch
+func BlockFetchEnabled() bool {
+	cfg := config.GetConfig()
+	return cfg.Node.Peer.Address != "" && cfg.Node.Peer.Port > 0
+}
+
+// FetchBlock fetches the full block at the given point from the NtN peer
+func FetchBlock(point common.Point) (ledger.Block, error) {
+	p, err := getPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	block, err := p.oConn.BlockFetch().Client.GetBlock(point)
+	if err != nil {
+		if err.Error() == noBlocksError {
+			err = ErrBlockNotFound
+		}
+		return nil, fmt.Errorf(
+			"failed to fetch block at slot %d, hash %x: %w",
+			point.Slot,
+			point.Hash,
+			err,
+		)
+	}
+	return block, nil
+}
+
+func getPeerConnection() (*peerConnection, error) {
+	if !BlockFetchEnabled() {
+		return nil, ErrBlockFetchNotConfigured
+	}
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	if peer != nil {
+		return peer, nil
+	}
+	cfg := config.GetConfig()
+	address := net.JoinHostPort(
+		cfg.Node.Peer.Address,
+		fmt.Sprintf("%d", cfg.Node.Peer.Port),
+	)
+	conn, err := net.DialTimeout("tcp", address, ouroboros.DefaultConnectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failure connecting to peer via TCP: %s", err)
+	}
+	p := &peerConnection{
+		doneChan: make(chan struct{}),
+	}
+	oConn, err := ouroboros.NewConnection(
+		ouroboros.WithConnection(conn),
+		ouroboros.WithNetworkMagic(uint32(cfg.Node.NetworkMagic)),
+		ouroboros.WithNodeToNode(true),
+		ouroboros.WithKeepAlive(true),
+		ouroboros.WithBlockFetchConfig(buildBlockFetchConfig()),
+		ouroboros.WithTxSubmissionConfig(buildTxSubmissionConfig(p.doneChan)),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failure creating Ouroboros connection: %s", err)
+	}
+	p.oConn = oConn
+	peer = p
+	// Drop the connection when it fails, so that the next fetch reconnects
+	go func() {
+		err, ok := <-oConn.ErrorChan()
+		if ok {
+			logging.GetLogger().Warnf("peer connection failed: %s", err)
+		}
+		peerMutex.Lock()
+		if peer == p {
+			peer = nil
+		}
+		peerMutex.Unlock()
+		close(p.doneChan)
+		oConn.Close()
+		for range oConn.ErrorChan() {
+		}
+	}()
+	return p, nil
+}
+
+func buildBlockFetchConfig() blockfetch.Config {
+	cfg := config.GetConfig()
+	return blockfetch.NewConfig(
+		blockfetch.WithBlockTimeout(
+			time.Duration(cfg.Node.QueryTimeout) * time.Second,
+		),
+	)
+}
+
+// buildTxSubmissionConfig builds a TxSubmission config for the NtN peer. We never have any
+// transactions to offer, so blocking requests for TX IDs are held until the connection closes
+func buildTxSubmissionConfig(doneChan chan struct{}) txsubmission.Config {
+	return txsubmission.NewConfig(
+		txsubmission.WithRequestTxIdsFunc(
+			func(ctx txsubmission.CallbackContext, blocking bool, ack uint16, req uint16) ([]txsubmission.TxIdAndSize, error) {
+				if blocking {
+					<-doneChan
+				}
+				return []txsubmission.TxIdAndSize{}, nil
+			},
+		),
+		txsubmission.WithRequestTxsFunc(
+			func(ctx txsubmission.CallbackContext, txIds []txsubmission.TxId) ([]txsubmission.TxBody, error) {
+				return []txsubmission.TxBody{}, nil
+			},
+		),
+	)
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+// Mini-protocols with a bulkhead
+const (
+	ProtocolLocalStateQuery   = "local-state-query"
+	ProtocolLocalTxMonitor    = "local-tx-monitor"
+	ProtocolLocalTxSubmission = "local-tx-submission"
+	ProtocolChainSync         = "chain-sync"
+)
+
+// How long clients are told to wait before retrying when a bulkhead is full
+const bulkheadRetryAfter = time.Second
+
+// BulkheadFullError is returned when the maximum number of concurrent client operations for a
+// mini-protocol are already running
+type BulkheadFullError struct {
+	Protocol   string
+	RetryAfter time.Duration
+}
+
+func (e BulkheadFullError) Error() string {
+	return fmt.Sprintf("too many concurrent %s operations, try again later", e.Protocol)
+}
+
+// bulkhead limits the number of concurrent client operations for a mini-protocol, so that one
+// kind of request can't use up every connection to the node. It rejects operations when it's
+// full, rather than queueing them
+type bulkhead struct {
+	slots chan struct{}
+}
+
+var bulkheads map[string]*bulkhead
+var bulkheadsOnce sync.Once
+
+var (
+	bulkheadRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_bulkhead_rejections_total",
+			Help: "Total number of node operations rejected because the mini-protocol's bulkhead was full",
+		},
+		[]string{"protocol"},
+	)
+	bulkheadInUse = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_bulkhead_in_use",
+			Help: "Number of running node operations for the mini-protocol",
+		},
+		[]string{"protocol"},
+	)
+)
+
+// getBulkhead returns the bulkhead for a mini-protocol, or nil if it's unlimited
+func getBulkhead(protocol string) *bulkhead {
+	bulkheadsOnce.Do(func() {
+		bulkheads = newBulkheads(config.GetConfig().Node.Bulkhead)
+	})
+	return bulkheads[protocol]
+}
+
+// newBulkheads creates the bulkheads for the mini-protocols with a limit
+func newBulkheads(cfg config.NodeBulkheadConfig) map[string]*bulkhead {
+	ret := make(map[string]*bulkhead)
+	for protocol, size := range map[string]uint{
+		ProtocolLocalStateQuery:   cfg.LocalStateQuery,
+		ProtocolLocalTxMonitor:    cfg.LocalTxMonitor,
+		ProtocolLocalTxSubmission: cfg.LocalTxSubmission,
+		ProtocolChainSync:         cfg.ChainSync,
+	} {
+		if size == 0 {
+			continue
+		}
+		ret[protocol] = &bulkhead{
+			slots: make(chan struct{}, size),
+		}
+	}
+	return ret
+}
+
+// enterBulkhead takes a slot in the bulkhead for a mini-protocol. The returned function gives it
+// back
+func enterBulkhead(protocol string) (func(), error) {
+	b := getBulkhead(protocol)
+	if b == nil {
+		return func() {}, nil
+	}
+	select {
+	case b.slots <- struct{}{}:
+		bulkheadInUse.WithLabelValues(protocol).Inc()
+	default:
+		bulkheadRejections.WithLabelValues(protocol).Inc()
+		return nil, BulkheadFullError{
+			Protocol:   protocol,
+			RetryAfter: bulkheadRetryAfter,
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-b.slots
+			bulkheadInUse.WithLabelValues(protocol).Dec()
+		})
+	}, nil
+}
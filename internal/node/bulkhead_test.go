@@ -0,0 +1,125 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+func TestEnterBulkhead(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.NodeBulkheadConfig
+		protocols []string
+		wantFull  []bool
+	}{
+		{
+			name:      "unlimited",
+			protocols: []string{ProtocolLocalStateQuery, ProtocolLocalStateQuery, ProtocolLocalStateQuery},
+			wantFull:  []bool{false, false, false},
+		},
+		{
+			name:      "within limit",
+			cfg:       config.NodeBulkheadConfig{LocalStateQuery: 2},
+			protocols: []string{ProtocolLocalStateQuery, ProtocolLocalStateQuery},
+			wantFull:  []bool{false, false},
+		},
+		{
+			name:      "full",
+			cfg:       config.NodeBulkheadConfig{LocalStateQuery: 2},
+			protocols: []string{ProtocolLocalStateQuery, ProtocolLocalStateQuery, ProtocolLocalStateQuery},
+			wantFull:  []bool{false, false, true},
+		},
+		{
+			name: "separate per protocol",
+			cfg: config.NodeBulkheadConfig{
+				LocalStateQuery: 1,
+				LocalTxMonitor:  1,
+				ChainSync:       1,
+			},
+			protocols: []string{
+				ProtocolLocalStateQuery,
+				ProtocolLocalTxMonitor,
+				ProtocolChainSync,
+				ProtocolLocalTxSubmission,
+				ProtocolChainSync,
+			},
+			wantFull: []bool{false, false, false, false, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setBulkheads(t, test.cfg)
+			exits := []func(){}
+			for idx, protocol := range test.protocols {
+				exit, err := enterBulkhead(protocol)
+				if !test.wantFull[idx] {
+					if err != nil {
+						t.Fatalf("unexpected error entering %s bulkhead: %s", protocol, err)
+					}
+					exits = append(exits, exit)
+					continue
+				}
+				var bulkheadErr BulkheadFullError
+				if !errors.As(err, &bulkheadErr) {
+					t.Fatalf("got error %v entering %s bulkhead, wanted it to be full", err, protocol)
+				}
+				if bulkheadErr.Protocol != protocol || bulkheadErr.RetryAfter != bulkheadRetryAfter {
+					t.Fatalf("got error %#v", bulkheadErr)
+				}
+			}
+			// Giving a slot back more than once only frees it once
+			for _, exit := range exits {
+				exit()
+				exit()
+			}
+			for _, protocol := range test.protocols {
+				if inUse := bulkheadInUseCount(protocol); inUse != 0 {
+					t.Fatalf("%d %s bulkhead slots still in use", inUse, protocol)
+				}
+			}
+			// Every protocol can be entered again once the slots are given back
+			for _, protocol := range test.protocols {
+				exit, err := enterBulkhead(protocol)
+				if err != nil {
+					t.Fatalf("unexpected error entering %s bulkhead again: %s", protocol, err)
+				}
+				exit()
+			}
+		})
+	}
+}
+
+func TestBulkheadDoubleExit(t *testing.T) {
+	// A second exit from one slot mustn't give back a slot that someone else holds
+	setBulkheads(t, config.NodeBulkheadConfig{LocalTxSubmission: 2})
+	exit, err := enterBulkhead(ProtocolLocalTxSubmission)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	otherExit, err := enterBulkhead(ProtocolLocalTxSubmission)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer otherExit()
+	exit()
+	exit()
+	if inUse := bulkheadInUseCount(ProtocolLocalTxSubmission); inUse != 1 {
+		t.Fatalf("got %d bulkhead slots in use, wanted 1", inUse)
+	}
+}
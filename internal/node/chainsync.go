@@ -15,13 +15,20 @@
 package node
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
 
 	"github.com/blinklabs-io/adder/event"
 	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	ouroboros "github.com/blinklabs-io/gouroboros"
 	"github.com/blinklabs-io/gouroboros/ledger"
 	"github.com/blinklabs-io/gouroboros/protocol/chainsync"
 	"github.com/blinklabs-io/gouroboros/protocol/common"
@@ -86,19 +93,17 @@ func chainSyncRollForwardHandler(
 		switch v := blockData.(type) {
 		case ledger.Block:
 			block = v
-		/*
-			case ledger.BlockHeader:
-				blockSlot := v.SlotNumber()
-				blockHash, _ := hex.DecodeString(v.Hash())
-				oConn, err := GetConnection()
-				if err != nil {
-					return err
-				}
-				block, err = oConn.BlockFetch().Client.GetBlock(common.NewPoint(blockSlot, blockHash))
-				if err != nil {
-					return err
-				}
-		*/
+		case ledger.BlockHeader:
+			// We only got the header, so fetch the full block from our NtN peer
+			blockSlot := v.SlotNumber()
+			blockHash, err := hex.DecodeString(v.Hash())
+			if err != nil {
+				return err
+			}
+			block, err = FetchBlock(common.NewPoint(blockSlot, blockHash))
+			if err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("unknown block data")
 		}
@@ -112,3 +117,254 @@ func chainSyncRollForwardHandler(
 	}
 	return nil
 }
+
+const (
+	// Number of recent points kept as the cursor for resuming a chain-sync session
+	chainSyncCursorDepth = 10
+)
+
+// ChainSyncSession follows the chain on behalf of a long-lived stream. If the upstream node goes
+// away, the session reconnects, possibly to another upstream, and resumes from its cursor
+type ChainSyncSession struct {
+	eventChan chan event.Event
+	doneChan  chan struct{}
+	closeOnce sync.Once
+	cursor    []common.Point
+	resumed   bool
+}
+
+// StartChainSync starts a chain-sync from the given intersect points, or from the current tip if
+// none are given. Events are delivered on eventChan until the session is closed
+func StartChainSync(
+	eventChan chan event.Event,
+	intersectPoints []common.Point,
+) (*ChainSyncSession, error) {
+	s := &ChainSyncSession{
+		eventChan: eventChan,
+		doneChan:  make(chan struct{}),
+	}
+	syncEventChan := make(chan event.Event, 10)
+	oConn, err := GetConnection(
+		&ConnectionConfig{ChainSyncEventChan: syncEventChan},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(intersectPoints) == 0 {
+		tip, err := oConn.ChainSync().Client.GetCurrentTip()
+		if err != nil {
+			closeChainSyncConnection(oConn, syncEventChan)
+			return nil, err
+		}
+		intersectPoints = []common.Point{tip.Point}
+	}
+	if err := oConn.ChainSync().Client.Sync(intersectPoints); err != nil {
+		closeChainSyncConnection(oConn, syncEventChan)
+		return nil, err
+	}
+	s.cursor = append(s.cursor, intersectPoints...)
+	sort.Slice(s.cursor, func(i, j int) bool {
+		return s.cursor[i].Slot < s.cursor[j].Slot
+	})
+	go s.run(oConn, syncEventChan)
+	return s, nil
+}
+
+// Close stops the chain-sync and closes the underlying connection
+func (s *ChainSyncSession) Close() {
+	s.closeOnce.Do(func() {
+		close(s.doneChan)
+	})
+}
+
+func (s *ChainSyncSession) run(
+	oConn *ouroboros.Connection,
+	syncEventChan chan event.Event,
+) {
+	for {
+		select {
+		case <-s.doneChan:
+			closeChainSyncConnection(oConn, syncEventChan)
+			return
+		case evt := <-syncEventChan:
+			if !s.track(evt) {
+				continue
+			}
+			select {
+			case s.eventChan <- evt:
+			case <-s.doneChan:
+				closeChainSyncConnection(oConn, syncEventChan)
+				return
+			}
+		case err, ok := <-oConn.ErrorChan():
+			if !ok {
+				err = fmt.Errorf("connection closed")
+			}
+			logging.GetLogger().Warnf(
+				"chain-sync connection failed, resuming on another connection: %s",
+				err,
+			)
+			closeChainSyncConnection(oConn, syncEventChan)
+			oConn, syncEventChan = s.resume()
+			if oConn == nil {
+				return
+			}
+		}
+	}
+}
+
+// track updates the cursor from an event and returns whether the event should be passed along
+func (s *ChainSyncSession) track(evt event.Event) bool {
+	switch payload := evt.Payload.(type) {
+	case input_chainsync.BlockEvent:
+		blockHash, err := hex.DecodeString(payload.Block.Hash())
+		if err != nil {
+			return true
+		}
+		s.resumed = false
+		s.cursor = append(
+			s.cursor,
+			common.NewPoint(payload.Block.SlotNumber(), blockHash),
+		)
+		if len(s.cursor) > chainSyncCursorDepth {
+			s.cursor = s.cursor[len(s.cursor)-chainSyncCursorDepth:]
+		}
+	case input_chainsync.RollbackEvent:
+		blockHash, err := hex.DecodeString(payload.BlockHash)
+		if err != nil {
+			return true
+		}
+		point := common.NewPoint(payload.SlotNumber, blockHash)
+		// The node always starts by rolling back to the intersect point. After resuming,
+		// that's where the consumer already is, so we don't pass it along
+		if s.resumed && len(s.cursor) > 0 {
+			last := s.cursor[len(s.cursor)-1]
+			if last.Slot == point.Slot && bytes.Equal(last.Hash, point.Hash) {
+				s.resumed = false
+				return false
+			}
+		}
+		s.resumed = false
+		for len(s.cursor) > 0 && s.cursor[len(s.cursor)-1].Slot >= point.Slot {
+			s.cursor = s.cursor[:len(s.cursor)-1]
+		}
+		s.cursor = append(s.cursor, point)
+	}
+	return true
+}
+
+// resume reconnects with backoff and restarts the chain-sync from the cursor
+func (s *ChainSyncSession) resume() (*ouroboros.Connection, chan event.Event) {
+	cfg := config.GetConfig()
+	// Try the most recent points first
+	intersectPoints := make([]common.Point, 0, len(s.cursor))
+	for i := len(s.cursor) - 1; i >= 0; i-- {
+		intersectPoints = append(intersectPoints, s.cursor[i])
+	}
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-s.doneChan:
+			return nil, nil
+		case <-time.After(backoff(cfg.Node.Reconnect, attempt)):
+		}
+		syncEventChan := make(chan event.Event, 10)
+		oConn, err := GetConnection(
+			&ConnectionConfig{ChainSyncEventChan: syncEventChan},
+		)
+		if err != nil {
+			logging.GetLogger().Warnf("failed to resume chain-sync: %s", err)
+			continue
+		}
+		if err := oConn.ChainSync().Client.Sync(intersectPoints); err != nil {
+			logging.GetLogger().Warnf("failed to resume chain-sync: %s", err)
+			closeChainSyncConnection(oConn, syncEventChan)
+			continue
+		}
+		s.resumed = true
+		return oConn, syncEventChan
+	}
+}
+
+// closeChainSyncConnection closes a chain-sync connection. We keep draining its channels until it
+// has shut down, so that a handler blocked on sending an event can't hold up the shutdown
+func closeChainSyncConnection(
+	oConn *ouroboros.Connection,
+	syncEventChan chan event.Event,
+) {
+	go func() {
+		for {
+			select {
+			case <-syncEventChan:
+			case _, ok := <-oConn.ErrorChan():
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+	oConn.Close()
+}
+
+// WalkChain returns up to count blocks following the given point, using a chain-sync of its own.
+// It stops early if it reaches the tip, in which case atTip is true
+func WalkChain(
+	ctx context.Context,
+	point common.Point,
+	count int,
+) ([]ledger.Block, bool, error) {
+	exitBulkhead, err := enterBulkhead(ProtocolChainSync)
+	if err != nil {
+		return nil, false, err
+	}
+	defer exitBulkhead()
+	syncEventChan := make(chan event.Event, 10)
+	oConn, err := GetConnection(
+		&ConnectionConfig{ChainSyncEventChan: syncEventChan},
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer closeChainSyncConnection(oConn, syncEventChan)
+	tip, err := oConn.ChainSync().Client.GetCurrentTip()
+	if err != nil {
+		return nil, false, err
+	}
+	tipHash := hex.EncodeToString(tip.Point.Hash)
+	if point.Slot == tip.Point.Slot && hex.EncodeToString(point.Hash) == tipHash {
+		return []ledger.Block{}, true, nil
+	}
+	if err := oConn.ChainSync().Client.Sync([]common.Point{point}); err != nil {
+		return nil, false, err
+	}
+	cfg := config.GetConfig()
+	timeout := time.NewTimer(time.Duration(cfg.Node.QueryTimeout) * time.Second)
+	defer timeout.Stop()
+	blocks := []ledger.Block{}
+	for len(blocks) < count {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-timeout.C:
+			return nil, false, fmt.Errorf("timed out walking the chain")
+		case err, ok := <-oConn.ErrorChan():
+			if !ok {
+				err = fmt.Errorf("connection closed")
+			}
+			return nil, false, err
+		case evt := <-syncEventChan:
+			switch payload := evt.Payload.(type) {
+			case input_chainsync.BlockEvent:
+				blocks = append(blocks, payload.Block)
+				if payload.Block.Hash() == tipHash {
+					return blocks, true, nil
+				}
+			case input_chainsync.RollbackEvent:
+				// Drop anything we've collected past the rollback point
+				for len(blocks) > 0 && blocks[len(blocks)-1].SlotNumber() > payload.SlotNumber {
+					blocks = blocks[:len(blocks)-1]
+				}
+			}
+		}
+	}
+	return blocks, false, nil
+}
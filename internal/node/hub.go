@@ -0,0 +1,425 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blinklabs-io/adder/event"
+	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+// ErrChainSyncSubscriberTooSlow is returned when a subscriber falls so far behind that the
+// events it still needs have been dropped from the buffer
+var ErrChainSyncSubscriberTooSlow = errors.New(
+	"chain-sync subscriber fell too far behind",
+)
+
+// hubEntry is a chain-sync event in the hub's ring buffer along with the point it moves the
+// chain to
+type hubEntry struct {
+	evt  event.Event
+	slot uint64
+	hash string
+}
+
+// ChainSyncHub follows the chain from a single upstream connection and fans the events out to
+// any number of subscribers. Recent events are kept in a ring buffer, so that subscribers can
+// attach at any point that's still in it
+type ChainSyncHub struct {
+	mutex           sync.Mutex
+	session         *ChainSyncSession
+	eventChan       chan event.Event
+	buffer          []hubEntry
+	head            uint64
+	tip             *hubEntry
+	changedChan     chan struct{}
+	subscribers     atomic.Int64
+	slowSubscribers atomic.Uint64
+}
+
+var globalHub *ChainSyncHub
+var globalHubOnce sync.Once
+
+// GetChainSyncHub returns the global chain-sync hub, creating it on first use. The hub doesn't
+// connect to the node until the first subscriber attaches
+func GetChainSyncHub() *ChainSyncHub {
+	globalHubOnce.Do(func() {
+		cfg := config.GetConfig()
+		size := cfg.Node.ChainSyncBufferSize
+		if size == 0 {
+			size = 1
+		}
+		globalHub = &ChainSyncHub{
+			buffer:      make([]hubEntry, size),
+			changedChan: make(chan struct{}),
+		}
+		globalHub.registerMetrics()
+	})
+	return globalHub
+}
+
+// SubscribeChainSync attaches to the global chain-sync hub. See ChainSyncHub.Subscribe
+func SubscribeChainSync(
+	eventChan chan event.Event,
+	intersectPoints []common.Point,
+) (*ChainSyncSubscription, error) {
+	return GetChainSyncHub().Subscribe(eventChan, intersectPoints)
+}
+
+// Subscribe attaches a new subscriber, which receives events on eventChan until it's closed.
+// With no intersect points the subscriber starts at the tip. Otherwise it starts at the first
+// of the given points that is still in the buffer. If none of them are, the subscriber gets a
+// chain-sync of its own instead. Like a chain-sync with the node, each subscriber is first sent
+// a rollback to the point it starts from
+func (h *ChainSyncHub) Subscribe(
+	eventChan chan event.Event,
+	intersectPoints []common.Point,
+) (*ChainSyncSubscription, error) {
+	if err := h.start(); err != nil {
+		return nil, err
+	}
+	s := &ChainSyncSubscription{
+		hub:       h,
+		eventChan: eventChan,
+		doneChan:  make(chan struct{}),
+	}
+	h.mutex.Lock()
+	if len(intersectPoints) == 0 {
+		s.cursor = h.head
+		if h.tip != nil {
+			s.pending = newHubRollbackEvent(h.tip.slot, h.tip.hash)
+		}
+	} else {
+		found := false
+		for _, point := range intersectPoints {
+			if cursor, ok := h.findLocked(point); ok {
+				s.cursor = cursor
+				s.pending = newHubRollbackEvent(
+					point.Slot,
+					hex.EncodeToString(point.Hash),
+				)
+				found = true
+				break
+			}
+		}
+		if !found {
+			h.mutex.Unlock()
+			exitBulkhead, err := enterBulkhead(ProtocolChainSync)
+			if err != nil {
+				return nil, err
+			}
+			session, err := StartChainSync(eventChan, intersectPoints)
+			if err != nil {
+				exitBulkhead()
+				return nil, err
+			}
+			s.session = session
+			s.exitBulkhead = exitBulkhead
+			return s, nil
+		}
+	}
+	h.mutex.Unlock()
+	h.subscribers.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// SubscribeChainSyncRecent attaches to the global chain-sync hub, replaying recent blocks. See
+// ChainSyncHub.SubscribeRecent
+func SubscribeChainSyncRecent(
+	eventChan chan event.Event,
+	blocks uint64,
+) (*ChainSyncSubscription, error) {
+	return GetChainSyncHub().SubscribeRecent(eventChan, blocks)
+}
+
+// SubscribeRecent attaches a new subscriber that starts up to the given number of blocks behind
+// the tip, so that it sees blocks that arrived just before it subscribed. Fewer blocks are
+// replayed if the buffer doesn't have that many. The subscriber's Backlog is the number of events
+// it's sent before it reaches the tip
+func (h *ChainSyncHub) SubscribeRecent(
+	eventChan chan event.Event,
+	blocks uint64,
+) (*ChainSyncSubscription, error) {
+	if err := h.start(); err != nil {
+		return nil, err
+	}
+	s := &ChainSyncSubscription{
+		hub:       h,
+		eventChan: eventChan,
+		doneChan:  make(chan struct{}),
+	}
+	h.mutex.Lock()
+	s.cursor = h.recentLocked(blocks)
+	if s.cursor > h.oldestLocked() {
+		// Start from the point just before the first event we replay
+		prev := h.buffer[(s.cursor-1)%uint64(len(h.buffer))]
+		s.pending = newHubRollbackEvent(prev.slot, prev.hash)
+	} else if s.cursor < h.head {
+		// The oldest event in the buffer is as far back as we can go
+		oldest := h.buffer[s.cursor%uint64(len(h.buffer))]
+		s.pending = newHubRollbackEvent(oldest.slot, oldest.hash)
+		s.cursor++
+	}
+	s.backlog = h.head - s.cursor
+	if s.pending != nil {
+		s.backlog++
+	}
+	h.mutex.Unlock()
+	h.subscribers.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// recentLocked returns the cursor of the oldest of the given number of most recent block events
+// in the buffer
+func (h *ChainSyncHub) recentLocked(blocks uint64) uint64 {
+	cursor := h.head
+	for found := uint64(0); found < blocks && cursor > h.oldestLocked(); {
+		cursor--
+		entry := h.buffer[cursor%uint64(len(h.buffer))]
+		if _, ok := entry.evt.Payload.(input_chainsync.BlockEvent); ok {
+			found++
+		}
+	}
+	return cursor
+}
+
+// start connects the hub to the node if it's not already
+func (h *ChainSyncHub) start() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.session != nil {
+		return nil
+	}
+	eventChan := make(chan event.Event, 10)
+	session, err := StartChainSync(eventChan, nil)
+	if err != nil {
+		return err
+	}
+	h.session = session
+	h.eventChan = eventChan
+	go h.run()
+	return nil
+}
+
+func (h *ChainSyncHub) run() {
+	for evt := range h.eventChan {
+		entry := hubEntry{evt: evt}
+		switch payload := evt.Payload.(type) {
+		case input_chainsync.BlockEvent:
+			entry.slot = payload.Block.SlotNumber()
+			entry.hash = payload.Block.Hash()
+		case input_chainsync.RollbackEvent:
+			entry.slot = payload.SlotNumber
+			entry.hash = payload.BlockHash
+		default:
+			logging.GetLogger().Warnf(
+				"chain-sync hub ignoring unexpected event type: %s",
+				evt.Type,
+			)
+			continue
+		}
+		h.mutex.Lock()
+		h.buffer[h.head%uint64(len(h.buffer))] = entry
+		h.head++
+		h.tip = &entry
+		// Wake up any subscribers waiting on new events
+		close(h.changedChan)
+		h.changedChan = make(chan struct{})
+		h.mutex.Unlock()
+	}
+}
+
+// TipSlot returns the slot that the hub's last event moved the chain to, and false if it hasn't
+// seen any events yet
+func (h *ChainSyncHub) TipSlot() (uint64, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.tip == nil {
+		return 0, false
+	}
+	return h.tip.slot, true
+}
+
+// oldestLocked returns the sequence number of the oldest event still in the buffer
+func (h *ChainSyncHub) oldestLocked() uint64 {
+	size := uint64(len(h.buffer))
+	if h.head < size {
+		return 0
+	}
+	return h.head - size
+}
+
+// findLocked returns the cursor just after the most recent event that moved the chain to the
+// given point
+func (h *ChainSyncHub) findLocked(point common.Point) (uint64, bool) {
+	hash := hex.EncodeToString(point.Hash)
+	for seq := h.head; seq > h.oldestLocked(); seq-- {
+		entry := h.buffer[(seq-1)%uint64(len(h.buffer))]
+		if entry.slot == point.Slot && entry.hash == hash {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+// next returns the event at the given cursor. If there isn't one yet, it returns a channel
+// that is closed when there is
+func (h *ChainSyncHub) next(
+	cursor uint64,
+) (*event.Event, <-chan struct{}, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if cursor < h.oldestLocked() {
+		return nil, nil, ErrChainSyncSubscriberTooSlow
+	}
+	if cursor == h.head {
+		return nil, h.changedChan, nil
+	}
+	evt := h.buffer[cursor%uint64(len(h.buffer))].evt
+	return &evt, nil, nil
+}
+
+func (h *ChainSyncHub) registerMetrics() {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_chainsync_hub_subscribers",
+			Help: "Number of subscribers attached to the chain-sync hub",
+		},
+		func() float64 { return float64(h.subscribers.Load()) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_chainsync_hub_buffered_events",
+			Help: "Number of chain-sync events in the hub buffer",
+		},
+		func() float64 {
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+			return float64(h.head - h.oldestLocked())
+		},
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "node_chainsync_hub_slow_subscribers_total",
+			Help: "Total number of subscribers dropped for falling too far behind",
+		},
+		func() float64 { return float64(h.slowSubscribers.Load()) },
+	)
+}
+
+// ChainSyncSubscription is a subscriber attached to the chain-sync hub
+type ChainSyncSubscription struct {
+	hub     *ChainSyncHub
+	session *ChainSyncSession
+	// Gives back the bulkhead slot held by our own chain-sync session
+	exitBulkhead func()
+	eventChan    chan event.Event
+	doneChan     chan struct{}
+	closeOnce    sync.Once
+	cursor       uint64
+	pending      *event.Event
+	backlog      uint64
+	err          error
+}
+
+// Backlog returns the number of buffered events the subscriber was sent before any new ones,
+// when it was attached with SubscribeRecent
+func (s *ChainSyncSubscription) Backlog() uint64 {
+	return s.backlog
+}
+
+// Done returns a channel that is closed when the subscription ends, either because it was
+// closed or because it fell too far behind
+func (s *ChainSyncSubscription) Done() <-chan struct{} {
+	return s.doneChan
+}
+
+// Err returns the reason the subscription ended, if it wasn't closed by the caller. It should
+// only be called after Done is closed
+func (s *ChainSyncSubscription) Err() error {
+	return s.err
+}
+
+// Close detaches the subscriber
+func (s *ChainSyncSubscription) Close() {
+	s.closeOnce.Do(func() {
+		if s.session != nil {
+			s.session.Close()
+			s.exitBulkhead()
+		}
+		close(s.doneChan)
+	})
+}
+
+// run delivers events to the subscriber. Each subscriber reads from the buffer at its own pace,
+// so a slow one doesn't hold up the rest. It's dropped if it falls behind by more than the
+// size of the buffer
+func (s *ChainSyncSubscription) run() {
+	defer s.hub.subscribers.Add(-1)
+	for {
+		evt := s.pending
+		if evt == nil {
+			var waitChan <-chan struct{}
+			var err error
+			evt, waitChan, err = s.hub.next(s.cursor)
+			if err != nil {
+				logging.GetLogger().Warnf("dropping chain-sync subscriber: %s", err)
+				s.hub.slowSubscribers.Add(1)
+				s.err = err
+				s.Close()
+				return
+			}
+			if evt == nil {
+				select {
+				case <-waitChan:
+					continue
+				case <-s.doneChan:
+					return
+				}
+			}
+			s.cursor++
+		}
+		s.pending = nil
+		select {
+		case s.eventChan <- *evt:
+		case <-s.doneChan:
+			return
+		}
+	}
+}
+
+func newHubRollbackEvent(slot uint64, hash string) *event.Event {
+	hashBytes, _ := hex.DecodeString(hash)
+	evt := event.New(
+		"chainsync.rollback",
+		time.Now(),
+		nil,
+		input_chainsync.NewRollbackEvent(common.NewPoint(slot, hashBytes)),
+	)
+	return &evt
+}
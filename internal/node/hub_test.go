@@ -0,0 +1,354 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/adder/event"
+	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+// testBlock is just enough of a block for the hub
+type testBlock struct {
+	ledger.Block
+	slot uint64
+}
+
+func (b testBlock) SlotNumber() uint64 {
+	return b.slot
+}
+
+func (b testBlock) Hash() string {
+	return testHash(b.slot)
+}
+
+func testHash(slot uint64) string {
+	return fmt.Sprintf("%04x", slot)
+}
+
+func testPoint(slot uint64) common.Point {
+	hash, _ := hex.DecodeString(testHash(slot))
+	return common.NewPoint(slot, hash)
+}
+
+// hubEvent is a chain-sync event in a form that's easy to compare
+type hubEvent struct {
+	rollback bool
+	slot     uint64
+}
+
+func (e hubEvent) String() string {
+	if e.rollback {
+		return fmt.Sprintf("rollback %d", e.slot)
+	}
+	return fmt.Sprintf("block %d", e.slot)
+}
+
+func block(slot uint64) hubEvent {
+	return hubEvent{slot: slot}
+}
+
+func rollback(slot uint64) hubEvent {
+	return hubEvent{rollback: true, slot: slot}
+}
+
+func (e hubEvent) event() event.Event {
+	if e.rollback {
+		return *newHubRollbackEvent(e.slot, testHash(e.slot))
+	}
+	return event.New(
+		"chainsync.block",
+		time.Now(),
+		nil,
+		input_chainsync.BlockEvent{Block: testBlock{slot: e.slot}},
+	)
+}
+
+// newTestHub returns a hub with the given buffer size that's fed by the test rather than the
+// node
+func newTestHub(t *testing.T, size int, evts ...hubEvent) *ChainSyncHub {
+	h := &ChainSyncHub{
+		session:     &ChainSyncSession{},
+		eventChan:   make(chan event.Event),
+		buffer:      make([]hubEntry, size),
+		changedChan: make(chan struct{}),
+	}
+	go h.run()
+	t.Cleanup(func() {
+		close(h.eventChan)
+	})
+	pushHubEvents(t, h, evts...)
+	return h
+}
+
+// pushHubEvents feeds events to the hub and waits for them to be buffered
+func pushHubEvents(t *testing.T, h *ChainSyncHub, evts ...hubEvent) {
+	t.Helper()
+	h.mutex.Lock()
+	want := h.head + uint64(len(evts))
+	h.mutex.Unlock()
+	for _, evt := range evts {
+		h.eventChan <- evt.event()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		h.mutex.Lock()
+		head := h.head
+		h.mutex.Unlock()
+		if head == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hub only buffered %d of %d events", head, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readHubEvents reads the given number of events from a subscriber
+func readHubEvents(t *testing.T, eventChan chan event.Event, count int) []hubEvent {
+	t.Helper()
+	ret := []hubEvent{}
+	for i := 0; i < count; i++ {
+		select {
+		case evt := <-eventChan:
+			switch payload := evt.Payload.(type) {
+			case input_chainsync.BlockEvent:
+				ret = append(ret, block(payload.Block.SlotNumber()))
+			case input_chainsync.RollbackEvent:
+				ret = append(ret, rollback(payload.SlotNumber))
+			default:
+				t.Fatalf("unexpected event type: %s", evt.Type)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event, got %v", ret)
+		}
+	}
+	return ret
+}
+
+func TestChainSyncHubSubscribe(t *testing.T) {
+	// The buffer has wrapped, so block 10 has been dropped
+	buffered := []hubEvent{block(10), block(20), block(30), block(40), block(50)}
+	tests := []struct {
+		name   string
+		points []uint64
+		after  []hubEvent
+		want   []hubEvent
+	}{
+		{
+			name:  "tip",
+			after: []hubEvent{block(60)},
+			want:  []hubEvent{rollback(50), block(60)},
+		},
+		{
+			name:   "intersect in buffer",
+			points: []uint64{30},
+			want:   []hubEvent{rollback(30), block(40), block(50)},
+		},
+		{
+			name:   "first point in buffer",
+			points: []uint64{35, 20},
+			want:   []hubEvent{rollback(20), block(30), block(40), block(50)},
+		},
+		{
+			name:   "new events after intersect",
+			points: []uint64{50},
+			after:  []hubEvent{rollback(40), block(45)},
+			want:   []hubEvent{rollback(50), rollback(40), block(45)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, 4, buffered...)
+			points := []common.Point{}
+			for _, slot := range test.points {
+				points = append(points, testPoint(slot))
+			}
+			eventChan := make(chan event.Event)
+			s, err := h.Subscribe(eventChan, points)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer s.Close()
+			pushHubEvents(t, h, test.after...)
+			got := readHubEvents(t, eventChan, len(test.want))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got events %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChainSyncHubSubscribeFallback(t *testing.T) {
+	// With the chain-sync bulkhead full, we can tell that the subscriber went for a chain-sync of
+	// its own without it connecting to a node
+	setBulkheads(t, config.NodeBulkheadConfig{ChainSync: 1})
+	exitBulkhead, err := enterBulkhead(ProtocolChainSync)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer exitBulkhead()
+	h := newTestHub(t, 4, block(10), block(20), block(30), block(40), block(50))
+	_, err = h.Subscribe(make(chan event.Event), []common.Point{testPoint(10)})
+	var bulkheadErr BulkheadFullError
+	if !errors.As(err, &bulkheadErr) || bulkheadErr.Protocol != ProtocolChainSync {
+		t.Fatalf("got error %v, wanted a full chain-sync bulkhead", err)
+	}
+	if h.subscribers.Load() != 0 {
+		t.Fatalf("subscriber was attached to the hub")
+	}
+}
+
+func TestChainSyncHubSubscribeRecent(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		buffered []hubEvent
+		blocks   uint64
+		want     []hubEvent
+	}{
+		{
+			name:     "recent blocks",
+			size:     8,
+			buffered: []hubEvent{block(10), block(20), block(30)},
+			blocks:   2,
+			want:     []hubEvent{rollback(10), block(20), block(30)},
+		},
+		{
+			name:     "more blocks than buffered",
+			size:     8,
+			buffered: []hubEvent{block(10), block(20), block(30)},
+			blocks:   5,
+			want:     []hubEvent{rollback(10), block(20), block(30)},
+		},
+		{
+			name:     "wrapped buffer",
+			size:     3,
+			buffered: []hubEvent{block(10), block(20), block(30), block(40), block(50)},
+			blocks:   5,
+			want:     []hubEvent{rollback(30), block(40), block(50)},
+		},
+		{
+			name:     "no blocks",
+			size:     8,
+			buffered: []hubEvent{block(10), block(20), block(30)},
+			blocks:   0,
+			want:     []hubEvent{rollback(30)},
+		},
+		{
+			name:     "rollbacks aren't counted",
+			size:     8,
+			buffered: []hubEvent{block(10), block(20), rollback(10), block(15)},
+			blocks:   1,
+			want:     []hubEvent{rollback(10), block(15)},
+		},
+		{
+			name:     "rollbacks are replayed",
+			size:     8,
+			buffered: []hubEvent{block(10), block(20), rollback(10), block(15)},
+			blocks:   2,
+			want:     []hubEvent{rollback(10), block(20), rollback(10), block(15)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHub(t, test.size, test.buffered...)
+			eventChan := make(chan event.Event)
+			s, err := h.SubscribeRecent(eventChan, test.blocks)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer s.Close()
+			if s.Backlog() != uint64(len(test.want)) {
+				t.Fatalf("got backlog %d, wanted %d", s.Backlog(), len(test.want))
+			}
+			got := readHubEvents(t, eventChan, len(test.want))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got events %v, wanted %v", got, test.want)
+			}
+			// Nothing more until the hub gets a new event
+			pushHubEvents(t, h, block(60))
+			got = readHubEvents(t, eventChan, 1)
+			if got[0] != block(60) {
+				t.Fatalf("got event %v after the backlog, wanted %v", got[0], block(60))
+			}
+		})
+	}
+}
+
+func TestChainSyncHubSlowSubscriber(t *testing.T) {
+	h := newTestHub(t, 2, block(10))
+	eventChan := make(chan event.Event)
+	s, err := h.Subscribe(eventChan, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer s.Close()
+	// The subscriber is still on its first event while the buffer wraps past where it's at
+	pushHubEvents(t, h, block(20), block(30), block(40))
+	readHubEvents(t, eventChan, 1)
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("slow subscriber wasn't dropped")
+	}
+	if !errors.Is(s.Err(), ErrChainSyncSubscriberTooSlow) {
+		t.Fatalf("got error %v, wanted %v", s.Err(), ErrChainSyncSubscriberTooSlow)
+	}
+	if h.slowSubscribers.Load() != 1 {
+		t.Fatalf("got %d slow subscribers, wanted 1", h.slowSubscribers.Load())
+	}
+}
+
+func TestChainSyncHubTipSlot(t *testing.T) {
+	h := newTestHub(t, 4)
+	if _, ok := h.TipSlot(); ok {
+		t.Fatalf("got a tip before any events")
+	}
+	tests := []struct {
+		name     string
+		evts     []hubEvent
+		wantSlot uint64
+	}{
+		{
+			name:     "new blocks",
+			evts:     []hubEvent{block(10), block(20)},
+			wantSlot: 20,
+		},
+		{
+			name:     "rollback",
+			evts:     []hubEvent{rollback(10)},
+			wantSlot: 10,
+		},
+	}
+	for _, test := range tests {
+		pushHubEvents(t, h, test.evts...)
+		slot, ok := h.TipSlot()
+		if !ok || slot != test.wantSlot {
+			t.Fatalf("%s: got tip slot %d (%t), wanted %d", test.name, slot, ok, test.wantSlot)
+		}
+	}
+}
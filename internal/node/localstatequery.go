@@ -15,8 +15,15 @@
 package node
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/blinklabs-io/gouroboros/protocol/common"
 	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
 
 	"github.com/blinklabs-io/cardano-node-api/internal/config"
@@ -33,3 +40,160 @@ func buildLocalStateQueryConfig() localstatequery.Config {
 		),
 	)
 }
+
+// PointTooOldError is returned when acquiring a ledger state further back than the node keeps
+type PointTooOldError struct {
+	Point common.Point
+}
+
+func (e PointTooOldError) Error() string {
+	return fmt.Sprintf(
+		"point too old: the node no longer has the ledger state at %s",
+		FormatPoint(e.Point),
+	)
+}
+
+// PointNotOnChainError is returned when acquiring the ledger state at a point that isn't on the
+// node's chain, like a block that has been rolled back
+type PointNotOnChainError struct {
+	Point common.Point
+}
+
+func (e PointNotOnChainError) Error() string {
+	return fmt.Sprintf("point not on chain: %s", FormatPoint(e.Point))
+}
+
+// acquireError turns a failure to acquire a ledger state into one of our errors
+func acquireError(point *common.Point, err error) error {
+	if point == nil {
+		return err
+	}
+	var tooOldErr localstatequery.AcquireFailurePointTooOldError
+	if errors.As(err, &tooOldErr) {
+		return PointTooOldError{Point: *point}
+	}
+	var notOnChainErr localstatequery.AcquireFailurePointNotOnChainError
+	if errors.As(err, &notOnChainErr) {
+		return PointNotOnChainError{Point: *point}
+	}
+	return err
+}
+
+// ParsePoint parses a chain point given as <slot>.<block hash>
+func ParsePoint(value string) (*common.Point, error) {
+	slotStr, hashHex, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errors.New("invalid point: must be <slot>.<block hash>")
+	}
+	slot, err := strconv.ParseUint(slotStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid point slot: %s", err)
+	}
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid point hash: %s", err)
+	}
+	if len(hash) != 32 {
+		return nil, fmt.Errorf("invalid point hash: must be 32 bytes")
+	}
+	point := common.NewPoint(slot, hash)
+	return &point, nil
+}
+
+// FormatPoint formats a chain point as <slot>.<block hash>
+func FormatPoint(point common.Point) string {
+	return fmt.Sprintf("%d.%x", point.Slot, point.Hash)
+}
+
+// Names of the LocalStateQuery queries that can be run in a batch
+const (
+	QueryCurrentEra     = "current-era"
+	QuerySystemStart    = "system-start"
+	QueryEpochNo        = "epoch-no"
+	QueryBlockNo        = "block-no"
+	QueryEraHistory     = "era-history"
+	QueryProtocolParams = "protocol-params"
+)
+
+var batchQueries = map[string]func(client *localstatequery.Client) (any, error){
+	QueryCurrentEra: func(client *localstatequery.Client) (any, error) {
+		return client.GetCurrentEra()
+	},
+	QuerySystemStart: func(client *localstatequery.Client) (any, error) {
+		return client.GetSystemStart()
+	},
+	QueryEpochNo: func(client *localstatequery.Client) (any, error) {
+		return client.GetEpochNo()
+	},
+	QueryBlockNo: func(client *localstatequery.Client) (any, error) {
+		return client.GetChainBlockNo()
+	},
+	QueryEraHistory: func(client *localstatequery.Client) (any, error) {
+		return client.GetEraHistory()
+	},
+	QueryProtocolParams: func(client *localstatequery.Client) (any, error) {
+		return client.GetCurrentProtocolParams()
+	},
+}
+
+// UnknownQueryError is returned for a query that can't be run in a batch
+type UnknownQueryError struct {
+	Query string
+}
+
+func (e UnknownQueryError) Error() string {
+	return fmt.Sprintf("unknown query: %s", e.Query)
+}
+
+// QuerySnapshot is the results of a batch of queries run against the same ledger state
+type QuerySnapshot struct {
+	// Point is the chain point of the ledger state the queries ran against
+	Point common.Point
+	// Results are the raw query results, by query name
+	Results map[string]any
+}
+
+// QueryBatch acquires the ledger state at a point, or the current one if the point is nil, once
+// and runs all of the queries against it, so that the results agree with each other even if a
+// block arrives in the meantime
+func QueryBatch(
+	ctx context.Context,
+	point *common.Point,
+	queries []string,
+) (*QuerySnapshot, error) {
+	// Check the queries before we tie up a connection
+	for _, query := range queries {
+		if _, ok := batchQueries[query]; !ok {
+			return nil, UnknownQueryError{Query: query}
+		}
+	}
+	oConn, err := LeaseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalStateQueryAt(point)
+	if err != nil {
+		return nil, err
+	}
+	// The chain point query answers with the point of the acquired ledger state
+	acquiredPoint, err := client.GetChainPoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain point: %w", err)
+	}
+	ret := &QuerySnapshot{
+		Point:   *acquiredPoint,
+		Results: make(map[string]any, len(queries)),
+	}
+	for _, query := range queries {
+		if _, ok := ret.Results[query]; ok {
+			continue
+		}
+		result, err := batchQueries[query](client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to run query %s: %w", query, err)
+		}
+		ret.Results[query] = result
+	}
+	return ret, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"os"
+	"testing"
+
+	ouroboros "github.com/blinklabs-io/gouroboros"
+	"github.com/blinklabs-io/gouroboros/protocol"
+	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
+	ouroboros_mock "github.com/blinklabs-io/ouroboros-mock"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+func TestMain(m *testing.M) {
+	logging.Setup(&config.LoggingConfig{Level: "warn"})
+	os.Exit(m.Run())
+}
+
+// Conversation entries for acquiring and releasing the ledger tip. The tip is acquired by the
+// first query
+var (
+	mockLsqAcquire = ouroboros_mock.ConversationEntryInput{
+		ProtocolId:  localstatequery.ProtocolId,
+		MessageType: localstatequery.MessageTypeAcquireNoPoint,
+	}
+	mockLsqAcquired = ouroboros_mock.ConversationEntryOutput{
+		ProtocolId: localstatequery.ProtocolId,
+		IsResponse: true,
+		Messages:   []protocol.Message{localstatequery.NewMsgAcquired()},
+	}
+	mockLsqQuery = ouroboros_mock.ConversationEntryInput{
+		ProtocolId:  localstatequery.ProtocolId,
+		MessageType: localstatequery.MessageTypeQuery,
+	}
+	mockLsqResult = ouroboros_mock.ConversationEntryOutput{
+		ProtocolId: localstatequery.ProtocolId,
+		IsResponse: true,
+		Messages:   []protocol.Message{localstatequery.NewMsgResult([]byte{0x06})},
+	}
+	mockLsqRelease = ouroboros_mock.ConversationEntryInput{
+		ProtocolId:  localstatequery.ProtocolId,
+		MessageType: localstatequery.MessageTypeRelease,
+	}
+)
+
+// newMockConnection returns a NtC connection to a mock node, which runs the conversation after
+// the handshake. The test fails if the client strays from the conversation
+func newMockConnection(
+	t *testing.T,
+	conversation ...ouroboros_mock.ConversationEntry,
+) *ouroboros.Connection {
+	t.Helper()
+	mockConn := ouroboros_mock.NewConnection(
+		ouroboros_mock.ProtocolRoleClient,
+		append(
+			[]ouroboros_mock.ConversationEntry{
+				ouroboros_mock.ConversationEntryHandshakeRequestGeneric,
+				ouroboros_mock.ConversationEntryHandshakeNtCResponse,
+			},
+			conversation...,
+		),
+	)
+	mockErrChan := make(chan error, 1)
+	go func() {
+		err, ok := <-mockConn.(*ouroboros_mock.Connection).ErrorChan()
+		if ok {
+			mockErrChan <- err
+		}
+		close(mockErrChan)
+	}()
+	oConn, err := ouroboros.New(
+		ouroboros.WithConnection(mockConn),
+		ouroboros.WithNetworkMagic(ouroboros_mock.MockNetworkMagic),
+		ouroboros.WithNodeToNode(false),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error connecting to mock node: %s", err)
+	}
+	t.Cleanup(func() {
+		// Anything the mock node didn't like shows up by the end of the test
+		select {
+		case err, ok := <-mockErrChan:
+			if ok {
+				t.Errorf("mock node error: %s", err)
+			}
+		default:
+		}
+		oConn.Close()
+	})
+	return oConn
+}
+
+// setBulkheads replaces the bulkheads for the duration of a test
+func setBulkheads(t *testing.T, cfg config.NodeBulkheadConfig) {
+	bulkheadsOnce.Do(func() {})
+	prev := bulkheads
+	bulkheads = newBulkheads(cfg)
+	t.Cleanup(func() {
+		bulkheads = prev
+	})
+}
+
+// bulkheadInUseCount returns the number of slots in use in a mini-protocol's bulkhead
+func bulkheadInUseCount(protocol string) int {
+	b := getBulkhead(protocol)
+	if b == nil {
+		return 0
+	}
+	return len(b.slots)
+}
@@ -15,8 +15,8 @@
 package node
 
 import (
+	"errors"
 	"fmt"
-	"os"
 
 	"github.com/blinklabs-io/cardano-node-api/internal/config"
 
@@ -28,14 +28,42 @@ type ConnectionConfig struct {
 	ChainSyncEventChan chan event.Event
 }
 
+// GetConnection connects to a cardano-node. When multiple upstream nodes are configured, they
+// are tried in the order given by the upstream policy until one of them accepts the connection
 func GetConnection(connCfg *ConnectionConfig) (*ouroboros.Connection, error) {
+	oConn, _, err := connectUpstream(connCfg)
+	return oConn, err
+}
+
+// connectUpstream is GetConnection, which also returns the upstream that it connected to
+func connectUpstream(connCfg *ConnectionConfig) (*ouroboros.Connection, *upstream, error) {
+	candidates := selectUpstreams()
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("you must specify either the UNIX socket path or the address/port for your cardano-node")
+	}
+	var errs []error
+	for _, u := range candidates {
+		oConn, err := u.connect(buildConnectionOptions(connCfg)...)
+		if err != nil {
+			u.reportFailure()
+			if len(candidates) == 1 {
+				return nil, nil, err
+			}
+			errs = append(errs, fmt.Errorf("%s: %s", u.name, err))
+			continue
+		}
+		return oConn, u, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func buildConnectionOptions(connCfg *ConnectionConfig) []ouroboros.ConnectionOptionFunc {
 	// Make sure we always have a ConnectionConfig object
 	if connCfg == nil {
 		connCfg = &ConnectionConfig{}
 	}
 	cfg := config.GetConfig()
-	// Connect to cardano-node
-	oConn, err := ouroboros.NewConnection(
+	return []ouroboros.ConnectionOptionFunc{
 		ouroboros.WithNetworkMagic(uint32(cfg.Node.NetworkMagic)),
 		ouroboros.WithNodeToNode(false),
 		ouroboros.WithKeepAlive(true),
@@ -43,33 +71,5 @@ func GetConnection(connCfg *ConnectionConfig) (*ouroboros.Connection, error) {
 		ouroboros.WithLocalTxMonitorConfig(buildLocalTxMonitorConfig()),
 		ouroboros.WithLocalStateQueryConfig(buildLocalStateQueryConfig()),
 		ouroboros.WithLocalTxSubmissionConfig(buildLocalTxSubmissionConfig()),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failure creating Ouroboros connection: %s", err)
-	}
-
-	if cfg.Node.Address != "" && cfg.Node.Port > 0 {
-		// Connect to TCP port
-		if err := oConn.Dial("tcp", fmt.Sprintf("%s:%d", cfg.Node.Address, cfg.Node.Port)); err != nil {
-			return nil, fmt.Errorf(
-				"failure connecting to node via TCP: %s",
-				err,
-			)
-		}
-	} else if cfg.Node.SocketPath != "" {
-		// Check that node socket path exists
-		if _, err := os.Stat(cfg.Node.SocketPath); err != nil {
-			if os.IsNotExist(err) {
-				return nil, fmt.Errorf("node socket path does not exist: %s", cfg.Node.SocketPath)
-			} else {
-				return nil, fmt.Errorf("unknown error checking if node socket path exists: %s", err)
-			}
-		}
-		if err := oConn.Dial("unix", cfg.Node.SocketPath); err != nil {
-			return nil, fmt.Errorf("failure connecting to node via UNIX socket: %s", err)
-		}
-	} else {
-		return nil, fmt.Errorf("you must specify either the UNIX socket path or the address/port for your cardano-node")
 	}
-	return oConn, nil
 }
@@ -0,0 +1,475 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ouroboros "github.com/blinklabs-io/gouroboros"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
+	"github.com/blinklabs-io/gouroboros/protocol/localtxmonitor"
+	"github.com/blinklabs-io/gouroboros/protocol/localtxsubmission"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+// PooledConnection is an Ouroboros connection leased from the connection pool.
+// It must be handed back with Return when the caller is done with it
+type PooledConnection struct {
+	*ouroboros.Connection
+	pool        *Pool
+	lastUsed    time.Time
+	failedChan  chan struct{}
+	leased      bool
+	lsqAcquired bool
+	ltmAcquired bool
+	// The upstream that the connection is to, if we know it
+	upstream *upstream
+	// Functions that give back the bulkhead slots taken during the lease
+	bulkheadExits []func()
+}
+
+// AcquireLocalStateQuery acquires the current ledger tip and returns the LocalStateQuery client
+func (c *PooledConnection) AcquireLocalStateQuery() (*localstatequery.Client, error) {
+	return c.AcquireLocalStateQueryAt(nil)
+}
+
+// AcquireLocalStateQueryAt acquires the ledger state at a point, or the current ledger tip if
+// the point is nil, and returns the LocalStateQuery client. The node only keeps the ledger states
+// of the last k blocks
+func (c *PooledConnection) AcquireLocalStateQueryAt(
+	point *common.Point,
+) (*localstatequery.Client, error) {
+	if err := c.enterBulkhead(ProtocolLocalStateQuery); err != nil {
+		return nil, err
+	}
+	client := c.LocalStateQuery().Client
+	client.Start()
+	if err := acquire(client, point); err != nil {
+		return nil, acquireError(point, err)
+	}
+	c.lsqAcquired = true
+	return client, nil
+}
+
+// acquire acquires the ledger state at a point, or the current ledger tip if the point is nil.
+// The client can't be given a nil point, but it acquires the tip by itself before the first
+// query after a release, so a cheap query does that instead
+func acquire(client *localstatequery.Client, point *common.Point) error {
+	if point != nil {
+		return client.Acquire(point)
+	}
+	_, err := client.GetCurrentEra()
+	return err
+}
+
+// AcquireLocalTxMonitor acquires a fresh mempool snapshot and returns the LocalTxMonitor client
+func (c *PooledConnection) AcquireLocalTxMonitor() (*localtxmonitor.Client, error) {
+	if err := c.enterBulkhead(ProtocolLocalTxMonitor); err != nil {
+		return nil, err
+	}
+	client := c.LocalTxMonitor().Client
+	client.Start()
+	if err := client.Acquire(); err != nil {
+		return nil, err
+	}
+	c.ltmAcquired = true
+	return client, nil
+}
+
+// AcquireLocalTxSubmission returns the LocalTxSubmission client
+func (c *PooledConnection) AcquireLocalTxSubmission() (*localtxsubmission.Client, error) {
+	if err := c.enterBulkhead(ProtocolLocalTxSubmission); err != nil {
+		return nil, err
+	}
+	client := c.LocalTxSubmission().Client
+	client.Start()
+	return client, nil
+}
+
+// enterBulkhead takes a slot in the bulkhead for a mini-protocol until the connection is returned
+func (c *PooledConnection) enterBulkhead(protocol string) error {
+	exit, err := enterBulkhead(protocol)
+	if err != nil {
+		return err
+	}
+	c.bulkheadExits = append(c.bulkheadExits, exit)
+	return nil
+}
+
+// exitBulkheads gives back the bulkhead slots taken during the lease
+func (c *PooledConnection) exitBulkheads() {
+	for _, exit := range c.bulkheadExits {
+		exit()
+	}
+	c.bulkheadExits = nil
+}
+
+// Return hands the connection back to the pool
+func (c *PooledConnection) Return() {
+	c.pool.put(c)
+}
+
+// replaceable returns whether the connection is to an upstream that's lagging or not ready while
+// another upstream is healthy
+func (c *PooledConnection) replaceable() bool {
+	return c.upstream != nil && c.upstream.replaceable()
+}
+
+func (c *PooledConnection) failed() bool {
+	select {
+	case <-c.failedChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// release releases any ledger state or mempool snapshot acquired during the lease, so that the
+// next lease starts from fresh node state
+func (c *PooledConnection) release() error {
+	if c.lsqAcquired {
+		c.lsqAcquired = false
+		if err := c.LocalStateQuery().Client.Release(); err != nil {
+			return err
+		}
+	}
+	if c.ltmAcquired {
+		c.ltmAcquired = false
+		if err := c.LocalTxMonitor().Client.Release(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PoolStats is a point-in-time view of the connection pool
+type PoolStats struct {
+	Size                uint64 `json:"size"`
+	Idle                uint64 `json:"idle"`
+	InUse               uint64 `json:"in_use"`
+	Created             uint64 `json:"created"`
+	Closed              uint64 `json:"closed"`
+	LeaseErrors         uint64 `json:"lease_errors"`
+	HealthCheckFailures uint64 `json:"health_check_failures"`
+}
+
+// Pool maintains a set of Ouroboros connections to the node which are leased out to callers
+type Pool struct {
+	mutex               sync.Mutex
+	idle                []*PooledConnection
+	slots               chan struct{}
+	idleTimeout         time.Duration
+	healthCheckInterval time.Duration
+	created             atomic.Uint64
+	closed              atomic.Uint64
+	leaseErrors         atomic.Uint64
+	healthCheckFailures atomic.Uint64
+	// dial opens a new connection to the node, and returns the upstream it's to
+	dial func() (*ouroboros.Connection, *upstream, error)
+}
+
+var globalPool *Pool
+var globalPoolOnce sync.Once
+
+// GetPool returns the global connection pool, creating it on first use
+func GetPool() *Pool {
+	globalPoolOnce.Do(func() {
+		cfg := config.GetConfig()
+		globalPool = NewPool(cfg.Node.Pool)
+		globalPool.registerMetrics()
+	})
+	return globalPool
+}
+
+// LeaseConnection leases a connection from the global connection pool
+func LeaseConnection(ctx context.Context) (*PooledConnection, error) {
+	return GetPool().Lease(ctx)
+}
+
+// NewPool creates a connection pool and starts its maintenance loop
+func NewPool(cfg config.NodePoolConfig) *Pool {
+	size := cfg.Size
+	if size == 0 {
+		size = 1
+	}
+	p := &Pool{
+		slots:               make(chan struct{}, size),
+		idleTimeout:         time.Duration(cfg.IdleTimeout) * time.Second,
+		healthCheckInterval: time.Duration(cfg.HealthCheckInterval) * time.Second,
+		dial: func() (*ouroboros.Connection, *upstream, error) {
+			return connectUpstream(nil)
+		},
+	}
+	if p.healthCheckInterval > 0 {
+		go p.maintain()
+	}
+	return p
+}
+
+// Lease returns an idle connection from the pool or creates a new one. It blocks while
+// the maximum number of connections are leased, until one is returned or the context is done
+func (p *Pool) Lease(ctx context.Context) (*PooledConnection, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		p.leaseErrors.Add(1)
+		return nil, ctx.Err()
+	}
+	// Reuse an idle connection if we have one
+	for {
+		pc := p.popIdle()
+		if pc == nil {
+			break
+		}
+		// Move over to a better upstream if there is one, rather than keep using a lagging one
+		if pc.failed() || pc.replaceable() {
+			p.closeConnection(pc)
+			continue
+		}
+		pc.leased = true
+		pc.lastUsed = time.Now()
+		return pc, nil
+	}
+	// Give the node a chance to come back if it's restarting
+	if err := WaitForReady(ctx); err != nil {
+		<-p.slots
+		p.leaseErrors.Add(1)
+		return nil, err
+	}
+	// Create a new connection
+	pc, err := p.newConnection()
+	if err != nil {
+		<-p.slots
+		p.leaseErrors.Add(1)
+		return nil, err
+	}
+	pc.leased = true
+	return pc, nil
+}
+
+// Stats returns the current pool statistics
+func (p *Pool) Stats() PoolStats {
+	p.mutex.Lock()
+	idle := len(p.idle)
+	p.mutex.Unlock()
+	return PoolStats{
+		Size:                uint64(cap(p.slots)),
+		Idle:                uint64(idle),
+		InUse:               uint64(len(p.slots)),
+		Created:             p.created.Load(),
+		Closed:              p.closed.Load(),
+		LeaseErrors:         p.leaseErrors.Load(),
+		HealthCheckFailures: p.healthCheckFailures.Load(),
+	}
+}
+
+func (p *Pool) newConnection() (*PooledConnection, error) {
+	oConn, u, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	pc := &PooledConnection{
+		Connection: oConn,
+		pool:       p,
+		upstream:   u,
+		lastUsed:   time.Now(),
+		failedChan: make(chan struct{}),
+	}
+	// Watch for async connection errors. We also need to keep draining the error channel
+	// so that the connection can finish shutting down
+	go func() {
+		err, ok := <-oConn.ErrorChan()
+		if ok {
+			logging.GetLogger().Warnf("pooled node connection failed: %s", err)
+		}
+		close(pc.failedChan)
+		for range oConn.ErrorChan() {
+		}
+	}()
+	p.created.Add(1)
+	return pc, nil
+}
+
+func (p *Pool) put(pc *PooledConnection) {
+	if !pc.leased {
+		return
+	}
+	pc.leased = false
+	pc.exitBulkheads()
+	defer func() {
+		<-p.slots
+	}()
+	if pc.failed() {
+		p.closeConnection(pc)
+		return
+	}
+	if err := pc.release(); err != nil {
+		p.closeConnection(pc)
+		return
+	}
+	pc.lastUsed = time.Now()
+	p.mutex.Lock()
+	if len(p.idle) >= cap(p.slots) {
+		p.mutex.Unlock()
+		p.closeConnection(pc)
+		return
+	}
+	p.idle = append(p.idle, pc)
+	p.mutex.Unlock()
+}
+
+func (p *Pool) popIdle() *PooledConnection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	// Use the most recently returned connection so that older ones can age out
+	pc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return pc
+}
+
+func (p *Pool) closeConnection(pc *PooledConnection) {
+	pc.exitBulkheads()
+	pc.Close()
+	p.closed.Add(1)
+}
+
+// maintain periodically evicts idle connections and health checks the rest
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.checkIdle()
+	}
+}
+
+// checkIdle closes idle connections that have failed, timed out, are to an upstream we'd rather
+// not use or fail a health check
+func (p *Pool) checkIdle() {
+	// Take ownership of all idle connections while we check them
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+	keep := make([]*PooledConnection, 0, len(idle))
+	for _, pc := range idle {
+		if pc.failed() {
+			p.closeConnection(pc)
+			continue
+		}
+		if p.idleTimeout > 0 && time.Since(pc.lastUsed) > p.idleTimeout {
+			p.closeConnection(pc)
+			continue
+		}
+		if pc.replaceable() {
+			p.closeConnection(pc)
+			continue
+		}
+		if err := p.healthCheck(pc); err != nil {
+			logging.GetLogger().Warnf(
+				"pooled node connection failed health check: %s",
+				err,
+			)
+			p.healthCheckFailures.Add(1)
+			p.closeConnection(pc)
+			continue
+		}
+		keep = append(keep, pc)
+	}
+	p.mutex.Lock()
+	p.idle = append(p.idle, keep...)
+	p.mutex.Unlock()
+}
+
+// healthCheck verifies that the node still answers on the connection by acquiring and
+// releasing the ledger tip. It isn't a client operation, so it doesn't take a bulkhead slot
+func (p *Pool) healthCheck(pc *PooledConnection) error {
+	client := pc.LocalStateQuery().Client
+	client.Start()
+	if err := acquire(client, nil); err != nil {
+		return err
+	}
+	pc.lsqAcquired = true
+	if err := pc.release(); err != nil {
+		return err
+	}
+	if pc.failed() {
+		return fmt.Errorf("connection closed")
+	}
+	return nil
+}
+
+func (p *Pool) registerMetrics() {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_pool_size",
+			Help: "Maximum number of leased node connections",
+		},
+		func() float64 { return float64(p.Stats().Size) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_pool_connections_idle",
+			Help: "Number of idle node connections in the pool",
+		},
+		func() float64 { return float64(p.Stats().Idle) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_pool_connections_in_use",
+			Help: "Number of node connections currently leased",
+		},
+		func() float64 { return float64(p.Stats().InUse) },
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "node_pool_connections_created_total",
+			Help: "Total number of node connections created by the pool",
+		},
+		func() float64 { return float64(p.created.Load()) },
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "node_pool_connections_closed_total",
+			Help: "Total number of node connections closed by the pool",
+		},
+		func() float64 { return float64(p.closed.Load()) },
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "node_pool_lease_errors_total",
+			Help: "Total number of failed connection leases",
+		},
+		func() float64 { return float64(p.leaseErrors.Load()) },
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "node_pool_health_check_failures_total",
+			Help: "Total number of idle connections that failed a health check",
+		},
+		func() float64 { return float64(p.healthCheckFailures.Load()) },
+	)
+}
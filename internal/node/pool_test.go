@@ -0,0 +1,471 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ouroboros "github.com/blinklabs-io/gouroboros"
+	"github.com/blinklabs-io/gouroboros/protocol"
+	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
+	ouroboros_mock "github.com/blinklabs-io/ouroboros-mock"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+func TestPoolLease(t *testing.T) {
+	tests := []struct {
+		name string
+		// run leases from a pool of one connection, which it can dial from the mock connections
+		run         func(t *testing.T, p *Pool)
+		mockConns   int
+		wantCreated uint64
+		wantClosed  uint64
+		wantErrors  uint64
+	}{
+		{
+			name:      "reuses a returned connection",
+			mockConns: 1,
+			run: func(t *testing.T, p *Pool) {
+				first := leaseOne(t, p)
+				first.Return()
+				second := leaseOne(t, p)
+				if second != first {
+					t.Fatalf("did not reuse the returned connection")
+				}
+				second.Return()
+			},
+			wantCreated: 1,
+		},
+		{
+			name:      "waits for a free slot until the context is done",
+			mockConns: 1,
+			run: func(t *testing.T, p *Pool) {
+				pc := leaseOne(t, p)
+				defer pc.Return()
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				if _, err := p.Lease(ctx); !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("got error %v, wanted %v", err, context.DeadlineExceeded)
+				}
+			},
+			wantCreated: 1,
+			wantErrors:  1,
+		},
+		{
+			name:      "gives back the slot when dialing fails",
+			mockConns: 0,
+			run: func(t *testing.T, p *Pool) {
+				if _, err := p.Lease(context.Background()); err == nil {
+					t.Fatalf("did not get expected error")
+				}
+				if inUse := p.Stats().InUse; inUse != 0 {
+					t.Fatalf("failed lease left %d slots in use", inUse)
+				}
+			},
+			wantErrors: 1,
+		},
+		{
+			name:      "replaces a failed idle connection",
+			mockConns: 2,
+			run: func(t *testing.T, p *Pool) {
+				first := leaseOne(t, p)
+				first.Return()
+				first.Close()
+				waitForFailure(t, first)
+				second := leaseOne(t, p)
+				if second == first {
+					t.Fatalf("leased the failed connection")
+				}
+				second.Return()
+			},
+			wantCreated: 2,
+			wantClosed:  1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oConns := make([]*ouroboros.Connection, 0, test.mockConns)
+			for i := 0; i < test.mockConns; i++ {
+				oConns = append(oConns, newMockConnection(t))
+			}
+			p := newTestPool(1, oConns...)
+			test.run(t, p)
+			stats := p.Stats()
+			if stats.Created != test.wantCreated ||
+				stats.Closed != test.wantClosed ||
+				stats.LeaseErrors != test.wantErrors {
+				t.Fatalf(
+					"got %d created, %d closed and %d lease errors, wanted %d, %d and %d",
+					stats.Created,
+					stats.Closed,
+					stats.LeaseErrors,
+					test.wantCreated,
+					test.wantClosed,
+					test.wantErrors,
+				)
+			}
+		})
+	}
+}
+
+func TestPoolPut(t *testing.T) {
+	tests := []struct {
+		name         string
+		conversation []ouroboros_mock.ConversationEntry
+		// use does something with the leased connection before it's returned
+		use        func(t *testing.T, pc *PooledConnection)
+		wantIdle   uint64
+		wantClosed uint64
+	}{
+		{
+			name:     "keeps an unused connection",
+			use:      func(t *testing.T, pc *PooledConnection) {},
+			wantIdle: 1,
+		},
+		{
+			name: "releases acquired ledger state",
+			conversation: []ouroboros_mock.ConversationEntry{
+				mockLsqAcquire,
+				mockLsqAcquired,
+				mockLsqQuery,
+				mockLsqResult,
+				mockLsqRelease,
+			},
+			use: func(t *testing.T, pc *PooledConnection) {
+				if _, err := pc.AcquireLocalStateQuery(); err != nil {
+					t.Fatalf("unexpected error acquiring ledger state: %s", err)
+				}
+			},
+			wantIdle: 1,
+		},
+		{
+			name: "closes a failed connection",
+			use: func(t *testing.T, pc *PooledConnection) {
+				pc.Close()
+				waitForFailure(t, pc)
+			},
+			wantClosed: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPool(1, newMockConnection(t, test.conversation...))
+			pc := leaseOne(t, p)
+			test.use(t, pc)
+			pc.Return()
+			// Returning it again does nothing
+			pc.Return()
+			stats := p.Stats()
+			if stats.Idle != test.wantIdle || stats.Closed != test.wantClosed || stats.InUse != 0 {
+				t.Fatalf(
+					"got %d idle, %d closed and %d in use, wanted %d, %d and 0",
+					stats.Idle,
+					stats.Closed,
+					stats.InUse,
+					test.wantIdle,
+					test.wantClosed,
+				)
+			}
+		})
+	}
+}
+
+func TestPoolCheckIdle(t *testing.T) {
+	tests := []struct {
+		name         string
+		conversation []ouroboros_mock.ConversationEntry
+		idleTimeout  time.Duration
+		wantIdle     uint64
+		wantFailures uint64
+	}{
+		{
+			name: "keeps a healthy connection",
+			conversation: []ouroboros_mock.ConversationEntry{
+				mockLsqAcquire,
+				mockLsqAcquired,
+				mockLsqQuery,
+				mockLsqResult,
+				mockLsqRelease,
+			},
+			wantIdle: 1,
+		},
+		{
+			name: "closes a connection that fails its health check",
+			conversation: []ouroboros_mock.ConversationEntry{
+				mockLsqAcquire,
+				ouroboros_mock.ConversationEntryOutput{
+					ProtocolId: localstatequery.ProtocolId,
+					IsResponse: true,
+					Messages: []protocol.Message{
+						localstatequery.NewMsgFailure(localstatequery.AcquireFailurePointNotOnChain),
+					},
+				},
+			},
+			wantFailures: 1,
+		},
+		{
+			name:        "closes a connection that has been idle too long",
+			idleTimeout: time.Nanosecond,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPool(1, newMockConnection(t, test.conversation...))
+			p.idleTimeout = test.idleTimeout
+			leaseAll(t, p, 1)
+			time.Sleep(time.Millisecond)
+			p.checkIdle()
+			stats := p.Stats()
+			if stats.Idle != test.wantIdle || stats.HealthCheckFailures != test.wantFailures {
+				t.Fatalf(
+					"got %d idle and %d health check failures, wanted %d and %d",
+					stats.Idle,
+					stats.HealthCheckFailures,
+					test.wantIdle,
+					test.wantFailures,
+				)
+			}
+			if wantClosed := 1 - test.wantIdle; stats.Closed != wantClosed {
+				t.Fatalf("got %d closed, wanted %d", stats.Closed, wantClosed)
+			}
+		})
+	}
+}
+
+func TestPoolReplacesUpstream(t *testing.T) {
+	tests := []struct {
+		name string
+		// The upstream that the pooled connection is to, and the other one
+		state        State
+		tipSlot      uint64
+		otherState   State
+		otherTipSlot uint64
+		wantReplaced bool
+	}{
+		{
+			name:         "keeps a healthy upstream",
+			state:        StateReady,
+			tipSlot:      1200,
+			otherState:   StateReady,
+			otherTipSlot: 1200,
+		},
+		{
+			name:         "replaces a lagging upstream",
+			state:        StateReady,
+			tipSlot:      1000,
+			otherState:   StateReady,
+			otherTipSlot: 1200,
+			wantReplaced: true,
+		},
+		{
+			name:         "replaces a degraded upstream",
+			state:        StateDegraded,
+			tipSlot:      1200,
+			otherState:   StateReady,
+			otherTipSlot: 1200,
+			wantReplaced: true,
+		},
+		{
+			name:         "keeps a lagging upstream without a better one",
+			state:        StateReady,
+			tipSlot:      1000,
+			otherState:   StateDisconnected,
+			otherTipSlot: 1200,
+		},
+	}
+	healthCheck := []ouroboros_mock.ConversationEntry{
+		mockLsqAcquire,
+		mockLsqAcquired,
+		mockLsqQuery,
+		mockLsqResult,
+		mockLsqRelease,
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setNodeConfig(t, func(cfg *config.NodeConfig) {
+				cfg.MaxTipLag = 120
+			})
+			u := newUpstream(0, "a")
+			u.state = test.state
+			u.tipSlot = test.tipSlot
+			other := newUpstream(1, "b")
+			other.state = test.otherState
+			other.tipSlot = test.otherTipSlot
+			setUpstreams(t, u, other)
+			// newPool returns a pool whose connections are all to the upstream under test
+			newPool := func(oConns ...*ouroboros.Connection) *Pool {
+				p := newTestPool(1, oConns...)
+				dial := p.dial
+				p.dial = func() (*ouroboros.Connection, *upstream, error) {
+					oConn, _, err := dial()
+					return oConn, u, err
+				}
+				return p
+			}
+			t.Run("lease", func(t *testing.T) {
+				p := newPool(newMockConnection(t), newMockConnection(t))
+				first := leaseOne(t, p)
+				first.Return()
+				second := leaseOne(t, p)
+				defer second.Return()
+				if replaced := second != first; replaced != test.wantReplaced {
+					t.Fatalf("got replaced %t, wanted %t", replaced, test.wantReplaced)
+				}
+			})
+			t.Run("check idle", func(t *testing.T) {
+				p := newPool(newMockConnection(t, healthCheck...))
+				leaseAll(t, p, 1)
+				p.checkIdle()
+				if replaced := p.Stats().Idle == 0; replaced != test.wantReplaced {
+					t.Fatalf("got replaced %t, wanted %t", replaced, test.wantReplaced)
+				}
+				if p.Stats().HealthCheckFailures != 0 {
+					t.Fatalf("got %d health check failures, wanted none", p.Stats().HealthCheckFailures)
+				}
+			})
+		})
+	}
+}
+
+func TestPoolHealthCheckReleasesBulkhead(t *testing.T) {
+	setBulkheads(t, config.NodeBulkheadConfig{LocalStateQuery: 1})
+	healthCheck := []ouroboros_mock.ConversationEntry{
+		mockLsqAcquire,
+		mockLsqAcquired,
+		mockLsqQuery,
+		mockLsqResult,
+		mockLsqRelease,
+	}
+	p := newTestPool(
+		2,
+		newMockConnection(t, healthCheck...),
+		newMockConnection(t, healthCheck...),
+	)
+	ctx := context.Background()
+	leaseAll(t, p, 2)
+	// Health check both idle connections. With a single bulkhead slot, the second check fails if
+	// the first one keeps its slot
+	p.checkIdle()
+	stats := p.Stats()
+	if stats.HealthCheckFailures != 0 || stats.Idle != 2 {
+		t.Fatalf(
+			"health checks failed: %d failures, %d idle connections",
+			stats.HealthCheckFailures,
+			stats.Idle,
+		)
+	}
+	if inUse := bulkheadInUseCount(ProtocolLocalStateQuery); inUse != 0 {
+		t.Fatalf("health checks left %d bulkhead slots in use", inUse)
+	}
+	// A client lease can still take the only bulkhead slot
+	pc, err := p.Lease(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error leasing connection: %s", err)
+	}
+	if err := pc.enterBulkhead(ProtocolLocalStateQuery); err != nil {
+		t.Fatalf("unexpected error entering bulkhead: %s", err)
+	}
+	pc.Return()
+	if inUse := bulkheadInUseCount(ProtocolLocalStateQuery); inUse != 0 {
+		t.Fatalf("returned lease left %d bulkhead slots in use", inUse)
+	}
+}
+
+func TestPoolCloseConnectionReleasesBulkhead(t *testing.T) {
+	setBulkheads(t, config.NodeBulkheadConfig{LocalStateQuery: 1})
+	oConn := newMockConnection(
+		t,
+		mockLsqAcquire,
+		mockLsqAcquired,
+		mockLsqQuery,
+		mockLsqResult,
+	)
+	p := newTestPool(1, oConn)
+	pc, err := p.Lease(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error leasing connection: %s", err)
+	}
+	if _, err := pc.AcquireLocalStateQuery(); err != nil {
+		t.Fatalf("unexpected error acquiring ledger state: %s", err)
+	}
+	p.closeConnection(pc)
+	if inUse := bulkheadInUseCount(ProtocolLocalStateQuery); inUse != 0 {
+		t.Fatalf("closed connection left %d bulkhead slots in use", inUse)
+	}
+	exit, err := enterBulkhead(ProtocolLocalStateQuery)
+	if err != nil {
+		var bulkheadErr BulkheadFullError
+		if errors.As(err, &bulkheadErr) {
+			t.Fatalf("bulkhead is still full after closing the connection")
+		}
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exit()
+}
+
+// leaseAll leases the given number of connections at once and returns them, so that they're
+// all idle in the pool
+func leaseAll(t *testing.T, p *Pool, count int) {
+	t.Helper()
+	leased := make([]*PooledConnection, 0, count)
+	for i := 0; i < count; i++ {
+		pc, err := p.Lease(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error leasing connection: %s", err)
+		}
+		leased = append(leased, pc)
+	}
+	for _, pc := range leased {
+		pc.Return()
+	}
+}
+
+// leaseOne leases a connection, failing the test if it can't
+func leaseOne(t *testing.T, p *Pool) *PooledConnection {
+	t.Helper()
+	pc, err := p.Lease(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error leasing connection: %s", err)
+	}
+	return pc
+}
+
+// waitForFailure waits for the pool to notice that a connection has gone away
+func waitForFailure(t *testing.T, pc *PooledConnection) {
+	t.Helper()
+	select {
+	case <-pc.failedChan:
+	case <-time.After(time.Second):
+		t.Fatalf("connection was not marked as failed")
+	}
+}
+
+// newTestPool returns a pool without a maintenance loop that hands out the given connections
+func newTestPool(size uint, oConns ...*ouroboros.Connection) *Pool {
+	p := NewPool(config.NodePoolConfig{Size: size})
+	p.dial = func() (*ouroboros.Connection, *upstream, error) {
+		if len(oConns) == 0 {
+			return nil, nil, errors.New("no more mock connections")
+		}
+		oConn := oConns[0]
+		oConns = oConns[1:]
+		return oConn, nil, nil
+	}
+	return p
+}
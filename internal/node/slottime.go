@@ -0,0 +1,196 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
+)
+
+// How long we keep the system start and era history before asking the node again. The eras we
+// care about only change at a hard fork
+const slotTimeCacheTime = time.Hour
+
+// eraStart is when an era started, and how long its slots and epochs are
+type eraStart struct {
+	time        time.Time
+	slot        uint64
+	slotLength  time.Duration
+	epoch       uint64
+	epochLength uint64
+}
+
+var slotTimeMutex sync.Mutex
+var slotTimeEras []eraStart
+var slotTimeUpdated time.Time
+
+// SlotTime returns the wall-clock time at which a slot starts, using the system start and era
+// history from the node
+func SlotTime(ctx context.Context, slot uint64) (time.Time, error) {
+	eras, err := getEraStarts(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Find the last era that starts at or before the slot
+	for i := len(eras) - 1; i >= 0; i-- {
+		era := eras[i]
+		if slot < era.slot {
+			continue
+		}
+		return era.time.Add(time.Duration(slot-era.slot) * era.slotLength), nil
+	}
+	return time.Time{}, errors.New("slot is before the first era")
+}
+
+// TimeSlot returns the slot that a wall-clock time falls in, using the system start and era
+// history from the node
+func TimeSlot(ctx context.Context, t time.Time) (uint64, error) {
+	eras, err := getEraStarts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Find the last era that starts at or before the time
+	for i := len(eras) - 1; i >= 0; i-- {
+		era := eras[i]
+		if t.Before(era.time) {
+			continue
+		}
+		return era.slot + uint64(t.Sub(era.time)/era.slotLength), nil
+	}
+	return 0, errors.New("time is before the first era")
+}
+
+// SlotEpoch returns the epoch that a slot is in, using the era history from the node
+func SlotEpoch(ctx context.Context, slot uint64) (uint64, error) {
+	eras, err := getEraStarts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(eras) - 1; i >= 0; i-- {
+		era := eras[i]
+		if slot < era.slot {
+			continue
+		}
+		return era.epoch + (slot-era.slot)/era.epochLength, nil
+	}
+	return 0, errors.New("slot is before the first era")
+}
+
+func getEraStarts(ctx context.Context) ([]eraStart, error) {
+	slotTimeMutex.Lock()
+	eras := slotTimeEras
+	updated := slotTimeUpdated
+	slotTimeMutex.Unlock()
+	if eras != nil && time.Since(updated) < slotTimeCacheTime {
+		return eras, nil
+	}
+	// We don't hold the lock while we ask the node, as a caller waiting on it could be holding the
+	// pooled connection that we'd need
+	eras, err := fetchEraStarts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slotTimeMutex.Lock()
+	slotTimeEras = eras
+	slotTimeUpdated = time.Now()
+	slotTimeMutex.Unlock()
+	return eras, nil
+}
+
+// fetchEraStarts asks the node for the system start and era history
+func fetchEraStarts(ctx context.Context) ([]eraStart, error) {
+	oConn, err := LeaseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalStateQuery()
+	if err != nil {
+		return nil, err
+	}
+	systemStart, err := client.GetSystemStart()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system start: %s", err)
+	}
+	eraHistory, err := client.GetEraHistory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get era history: %s", err)
+	}
+	return newEraStarts(systemStart, eraHistory)
+}
+
+func newEraStarts(
+	systemStart *localstatequery.SystemStartResult,
+	eraHistory []localstatequery.EraHistoryResult,
+) ([]eraStart, error) {
+	// The system start is a year, a day of the year starting from 1, and picoseconds into the day
+	start := time.Date(systemStart.Year, time.January, 1, 0, 0, 0, 0, time.UTC).
+		AddDate(0, 0, systemStart.Day-1).
+		Add(time.Duration(systemStart.Picoseconds / 1000))
+	ret := make([]eraStart, 0, len(eraHistory))
+	for _, era := range eraHistory {
+		// Era start times are picoseconds since the system start, and slot lengths milliseconds
+		picoseconds, err := bigIntFromCbor(era.Begin.Timespan)
+		if err != nil {
+			return nil, fmt.Errorf("invalid era start time: %s", err)
+		}
+		nanoseconds := new(big.Int).Quo(picoseconds, big.NewInt(1000))
+		if !nanoseconds.IsInt64() {
+			return nil, fmt.Errorf("era start time out of range: %s", picoseconds)
+		}
+		if era.Params.SlotLength <= 0 {
+			return nil, fmt.Errorf("invalid slot length: %d", era.Params.SlotLength)
+		}
+		if era.Params.EpochLength <= 0 {
+			return nil, fmt.Errorf("invalid epoch length: %d", era.Params.EpochLength)
+		}
+		ret = append(
+			ret,
+			eraStart{
+				time:        start.Add(time.Duration(nanoseconds.Int64())),
+				slot:        uint64(era.Begin.SlotNo),
+				slotLength:  time.Duration(era.Params.SlotLength) * time.Millisecond,
+				epoch:       uint64(era.Begin.EpochNo),
+				epochLength: uint64(era.Params.EpochLength),
+			},
+		)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("empty era history")
+	}
+	return ret, nil
+}
+
+// bigIntFromCbor converts a decoded CBOR integer, which is a big.Int if it doesn't fit in 64 bits
+func bigIntFromCbor(value any) (*big.Int, error) {
+	switch v := value.(type) {
+	case uint64:
+		return new(big.Int).SetUint64(v), nil
+	case int64:
+		return big.NewInt(v), nil
+	case big.Int:
+		return &v, nil
+	case *big.Int:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unexpected type %T", value)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// setEraStarts replaces the cached era history for the rest of a test
+func setEraStarts(t *testing.T, eras []eraStart) {
+	t.Helper()
+	slotTimeMutex.Lock()
+	slotTimeEras = eras
+	slotTimeUpdated = time.Now()
+	slotTimeMutex.Unlock()
+	t.Cleanup(func() {
+		slotTimeMutex.Lock()
+		slotTimeEras = nil
+		slotTimeUpdated = time.Time{}
+		slotTimeMutex.Unlock()
+	})
+}
+
+func TestTimeSlot(t *testing.T) {
+	start := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	// A Byron-like era of 20s slots and 10 slot epochs, then 1s slots and 100 slot epochs
+	setEraStarts(
+		t,
+		[]eraStart{
+			{
+				time:        start,
+				slotLength:  20 * time.Second,
+				epochLength: 10,
+			},
+			{
+				time:        start.Add(400 * time.Second),
+				slot:        20,
+				slotLength:  time.Second,
+				epoch:       2,
+				epochLength: 100,
+			},
+		},
+	)
+	tests := []struct {
+		name      string
+		time      time.Time
+		wantSlot  uint64
+		wantEpoch uint64
+		wantErr   bool
+	}{
+		{
+			name:    "before the first era",
+			time:    start.Add(-time.Second),
+			wantErr: true,
+		},
+		{
+			name:      "first slot",
+			time:      start,
+			wantSlot:  0,
+			wantEpoch: 0,
+		},
+		{
+			name:      "within a slot",
+			time:      start.Add(219 * time.Second),
+			wantSlot:  10,
+			wantEpoch: 1,
+		},
+		{
+			name:      "start of the second era",
+			time:      start.Add(400 * time.Second),
+			wantSlot:  20,
+			wantEpoch: 2,
+		},
+		{
+			name:      "last slot of an epoch",
+			time:      start.Add(499 * time.Second),
+			wantSlot:  119,
+			wantEpoch: 2,
+		},
+		{
+			name:      "epoch boundary",
+			time:      start.Add(500 * time.Second),
+			wantSlot:  120,
+			wantEpoch: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			slot, err := TimeSlot(context.Background(), test.time)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("did not get expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if slot != test.wantSlot {
+				t.Fatalf("got slot %d, wanted %d", slot, test.wantSlot)
+			}
+			epoch, err := SlotEpoch(context.Background(), slot)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if epoch != test.wantEpoch {
+				t.Fatalf("got epoch %d, wanted %d", epoch, test.wantEpoch)
+			}
+			// The slot starts at or before the time
+			slotTime, err := SlotTime(context.Background(), slot)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if slotTime.After(test.time) {
+				t.Fatalf("slot %d starts at %s, after %s", slot, slotTime, test.time)
+			}
+		})
+	}
+}
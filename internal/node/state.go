@@ -0,0 +1,390 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ouroboros "github.com/blinklabs-io/gouroboros"
+	"github.com/blinklabs-io/gouroboros/protocol/chainsync"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+const (
+	// How often each node is probed while connected
+	stateProbeInterval = 10 * time.Second
+)
+
+// State is the state of our connection to the node
+type State int32
+
+const (
+	StateConnecting State = iota
+	StateReady
+	StateDegraded
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateReady:
+		return "ready"
+	case StateDegraded:
+		return "degraded"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// NodeNotReadyError is returned when the node does not become ready in time
+type NodeNotReadyError struct {
+	State State
+}
+
+func (e NodeNotReadyError) Error() string {
+	return fmt.Sprintf("node is not ready: %s", e.State)
+}
+
+var stateMutex sync.Mutex
+var stateStarted bool
+var stateChangedChan = make(chan struct{})
+var reconnects atomic.Uint64
+
+// Start begins tracking the state of each upstream node in the background, reconnecting with
+// backoff whenever a node goes away. It does not wait for the nodes to become ready
+func Start() {
+	stateMutex.Lock()
+	if stateStarted {
+		stateMutex.Unlock()
+		return
+	}
+	stateStarted = true
+	stateMutex.Unlock()
+	registerStateMetrics()
+	for _, u := range getUpstreams() {
+		go u.run()
+	}
+}
+
+// GetState returns the overall node connection state, which is the best state of any upstream
+func GetState() State {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return getStateLocked()
+}
+
+func getStateLocked() State {
+	best := bestTipSlotLocked()
+	ret := StateDisconnected
+	for _, u := range getUpstreams() {
+		state := u.state
+		if state == StateReady && u.behind(best) {
+			state = StateDegraded
+		}
+		switch {
+		case state == StateReady:
+			return StateReady
+		case state == StateDegraded:
+			ret = StateDegraded
+		case state == StateConnecting && ret == StateDisconnected:
+			ret = StateConnecting
+		}
+	}
+	return ret
+}
+
+// BestTipSlot returns the highest tip slot reported by any upstream, or 0 if we don't know one
+func BestTipSlot() uint64 {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return bestTipSlotLocked()
+}
+
+// BestTip returns the highest tip reported by any upstream, which has a slot of 0 if we don't
+// know one
+func BestTip() common.Point {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	var best common.Point
+	for _, u := range getUpstreams() {
+		if u.tipSlot > best.Slot {
+			best = common.NewPoint(u.tipSlot, u.tipHash)
+		}
+	}
+	return best
+}
+
+// TipSlot returns the slot of the newest tip we know of, or 0 if we don't know one. That's the
+// shared chain-sync's tip if it's running, as it moves with every block, unless an upstream has
+// reported a later one
+func TipSlot() uint64 {
+	slot := BestTipSlot()
+	if hubSlot, ok := GetChainSyncHub().TipSlot(); ok && hubSlot > slot {
+		slot = hubSlot
+	}
+	return slot
+}
+
+func bestTipSlotLocked() uint64 {
+	var best uint64
+	for _, u := range getUpstreams() {
+		if u.tipSlot > best {
+			best = u.tipSlot
+		}
+	}
+	return best
+}
+
+// WaitForReady waits up to the configured ready timeout for a node to be usable. It returns
+// immediately if state tracking has not been started
+func WaitForReady(ctx context.Context) error {
+	cfg := config.GetConfig()
+	ctx, cancel := context.WithTimeout(
+		ctx,
+		time.Duration(cfg.Node.ReadyTimeout)*time.Second,
+	)
+	defer cancel()
+	for {
+		stateMutex.Lock()
+		started := stateStarted
+		state := getStateLocked()
+		changedChan := stateChangedChan
+		stateMutex.Unlock()
+		if !started || state == StateReady || state == StateDegraded {
+			return nil
+		}
+		select {
+		case <-changedChan:
+		case <-ctx.Done():
+			return NodeNotReadyError{State: state}
+		}
+	}
+}
+
+// reportFailure marks a ready upstream as degraded after a failure outside of the state tracker
+func (u *upstream) reportFailure() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if u.state == StateReady {
+		u.setStateLocked(StateDegraded)
+	}
+}
+
+func (u *upstream) setState(state State) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	u.setStateLocked(state)
+}
+
+func (u *upstream) setStateLocked(state State) {
+	if u.state == state {
+		return
+	}
+	logging.GetLogger().Infof(
+		"node %s connection state changed from %s to %s",
+		u.name,
+		u.state,
+		state,
+	)
+	u.state = state
+	notifyStateChangedLocked()
+}
+
+func (u *upstream) setTip(point common.Point) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if u.tipSlot == point.Slot {
+		return
+	}
+	u.tipSlot = point.Slot
+	u.tipHash = point.Hash
+	// A new tip can change whether other upstreams are considered to be behind
+	notifyStateChangedLocked()
+}
+
+// notifyStateChangedLocked wakes up anything waiting on a state change
+func notifyStateChangedLocked() {
+	close(stateChangedChan)
+	stateChangedChan = make(chan struct{})
+}
+
+func (u *upstream) run() {
+	cfg := config.GetConfig()
+	attempt := 0
+	connectedBefore := false
+	for {
+		u.setState(StateConnecting)
+		oConn, err := u.connect(buildConnectionOptions(nil)...)
+		if err != nil {
+			u.setState(StateDisconnected)
+			delay := backoff(cfg.Node.Reconnect, attempt)
+			logging.GetLogger().Warnf(
+				"failed to connect to node %s, retrying in %s: %s",
+				u.name,
+				delay,
+				err,
+			)
+			attempt++
+			time.Sleep(delay)
+			continue
+		}
+		if connectedBefore {
+			reconnects.Add(1)
+		}
+		connectedBefore = true
+		attempt = 0
+		u.probe(oConn)
+		err = u.watch(oConn)
+		oConn.Close()
+		u.setState(StateDisconnected)
+		logging.GetLogger().Warnf("lost connection to node %s: %s", u.name, err)
+		time.Sleep(backoff(cfg.Node.Reconnect, attempt))
+	}
+}
+
+// watch probes the node over the given connection until it fails
+func (u *upstream) watch(oConn *ouroboros.Connection) error {
+	ticker := time.NewTicker(stateProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err, ok := <-oConn.ErrorChan():
+			if !ok {
+				return fmt.Errorf("connection closed")
+			}
+			return err
+		case <-ticker.C:
+			u.probe(oConn)
+		}
+	}
+}
+
+// probe checks that the node answers queries and records its current tip
+func (u *upstream) probe(oConn *ouroboros.Connection) {
+	client := oConn.LocalStateQuery().Client
+	err := acquire(client, nil)
+	if err == nil {
+		err = client.Release()
+	}
+	if err == nil {
+		var tip *chainsync.Tip
+		tip, err = oConn.ChainSync().Client.GetCurrentTip()
+		if err == nil {
+			u.setTip(tip.Point)
+		}
+	}
+	if err != nil {
+		logging.GetLogger().Warnf("node %s probe failed: %s", u.name, err)
+		u.setState(StateDegraded)
+	} else {
+		u.setState(StateReady)
+	}
+}
+
+// backoff returns an exponential backoff delay with jitter for the given attempt
+func backoff(cfg config.NodeReconnectConfig, attempt int) time.Duration {
+	minBackoff := time.Duration(cfg.MinBackoff) * time.Second
+	maxBackoff := time.Duration(cfg.MaxBackoff) * time.Second
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	delay := minBackoff
+	for i := 0; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	// Use "equal jitter" so that we always wait at least half of the delay
+	half := delay / 2
+	// #nosec G404 -- jitter does not need a secure random source
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func registerStateMetrics() {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_connection_state",
+			Help: "Node connection state (0=connecting, 1=ready, 2=degraded, 3=disconnected)",
+		},
+		func() float64 { return float64(GetState()) },
+	)
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "node_reconnects_total",
+			Help: "Total number of times the connection to the node was re-established",
+		},
+		func() float64 { return float64(reconnects.Load()) },
+	)
+	for _, u := range getUpstreams() {
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "node_upstream_state",
+				Help:        "Upstream node connection state (0=connecting, 1=ready, 2=degraded, 3=disconnected)",
+				ConstLabels: prometheus.Labels{"upstream": u.name},
+			},
+			func(u *upstream) func() float64 {
+				return func() float64 {
+					stateMutex.Lock()
+					defer stateMutex.Unlock()
+					return float64(u.state)
+				}
+			}(u),
+		)
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "node_upstream_tip_slot",
+				Help:        "Last known tip slot of the upstream node",
+				ConstLabels: prometheus.Labels{"upstream": u.name},
+			},
+			func(u *upstream) func() float64 {
+				return func() float64 {
+					stateMutex.Lock()
+					defer stateMutex.Unlock()
+					return float64(u.tipSlot)
+				}
+			}(u),
+		)
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "node_upstream_active_connections",
+				Help:        "Number of open connections to the upstream node",
+				ConstLabels: prometheus.Labels{"upstream": u.name},
+			},
+			func(u *upstream) func() float64 {
+				return func() float64 {
+					return float64(u.active.Load())
+				}
+			}(u),
+		)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.NodeReconnectConfig
+		attempt   int
+		wantDelay time.Duration
+	}{
+		{
+			name:      "first attempt",
+			cfg:       config.NodeReconnectConfig{MinBackoff: 1, MaxBackoff: 30},
+			wantDelay: time.Second,
+		},
+		{
+			name:      "doubles with each attempt",
+			cfg:       config.NodeReconnectConfig{MinBackoff: 1, MaxBackoff: 30},
+			attempt:   3,
+			wantDelay: 8 * time.Second,
+		},
+		{
+			name:      "capped at the maximum",
+			cfg:       config.NodeReconnectConfig{MinBackoff: 1, MaxBackoff: 30},
+			attempt:   10,
+			wantDelay: 30 * time.Second,
+		},
+		{
+			name:      "unset minimum",
+			cfg:       config.NodeReconnectConfig{MaxBackoff: 30},
+			attempt:   1,
+			wantDelay: 2 * time.Second,
+		},
+		{
+			name:      "maximum below the minimum",
+			cfg:       config.NodeReconnectConfig{MinBackoff: 5, MaxBackoff: 2},
+			attempt:   2,
+			wantDelay: 5 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The jitter keeps the delay between half and all of the backoff
+			for i := 0; i < 100; i++ {
+				delay := backoff(test.cfg, test.attempt)
+				if delay < test.wantDelay/2 || delay > test.wantDelay {
+					t.Fatalf(
+						"got delay %s, wanted between %s and %s",
+						delay,
+						test.wantDelay/2,
+						test.wantDelay,
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestGetState(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxTipLag uint
+		upstreams []*upstream
+		wantState State
+	}{
+		{
+			name:      "no upstreams",
+			wantState: StateDisconnected,
+		},
+		{
+			name: "ready",
+			upstreams: []*upstream{
+				{state: StateDisconnected},
+				{state: StateReady, tipSlot: 1000},
+			},
+			wantState: StateReady,
+		},
+		{
+			name:      "ready but behind",
+			maxTipLag: 120,
+			upstreams: []*upstream{
+				{state: StateReady, tipSlot: 1000},
+				{state: StateDegraded, tipSlot: 1200},
+			},
+			wantState: StateDegraded,
+		},
+		{
+			name:      "behind within the allowed lag",
+			maxTipLag: 120,
+			upstreams: []*upstream{
+				{state: StateReady, tipSlot: 1100},
+				{state: StateDegraded, tipSlot: 1200},
+			},
+			wantState: StateReady,
+		},
+		{
+			name: "lag check disabled",
+			upstreams: []*upstream{
+				{state: StateReady, tipSlot: 1000},
+				{state: StateDegraded, tipSlot: 100000},
+			},
+			wantState: StateReady,
+		},
+		{
+			name: "connecting",
+			upstreams: []*upstream{
+				{state: StateDisconnected},
+				{state: StateConnecting},
+			},
+			wantState: StateConnecting,
+		},
+		{
+			name: "disconnected",
+			upstreams: []*upstream{
+				{state: StateDisconnected},
+				{state: StateDisconnected},
+			},
+			wantState: StateDisconnected,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setNodeConfig(t, func(cfg *config.NodeConfig) {
+				cfg.MaxTipLag = test.maxTipLag
+			})
+			setUpstreams(t, test.upstreams...)
+			if state := GetState(); state != test.wantState {
+				t.Fatalf("got state %s, wanted %s", state, test.wantState)
+			}
+		})
+	}
+}
+
+func TestTipSlot(t *testing.T) {
+	setUpstreams(
+		t,
+		&upstream{state: StateReady, tipSlot: 1000},
+		&upstream{state: StateDisconnected, tipSlot: 1200},
+	)
+	// The shared chain-sync isn't running, so the best upstream tip is all we know
+	if slot := TipSlot(); slot != 1200 {
+		t.Fatalf("got tip slot %d, wanted 1200", slot)
+	}
+	setUpstreams(t)
+	if slot := TipSlot(); slot != 0 {
+		t.Fatalf("got tip slot %d without upstreams, wanted 0", slot)
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	tests := []struct {
+		name         string
+		started      bool
+		readyTimeout uint
+		state        State
+		// becomeReady makes the upstream ready while we wait
+		becomeReady bool
+		wantState   State
+		wantErr     bool
+	}{
+		{
+			name:      "state tracking not started",
+			state:     StateDisconnected,
+			wantState: StateDisconnected,
+		},
+		{
+			name:      "ready",
+			started:   true,
+			state:     StateReady,
+			wantState: StateReady,
+		},
+		{
+			name:      "degraded is good enough",
+			started:   true,
+			state:     StateDegraded,
+			wantState: StateDegraded,
+		},
+		{
+			name:         "becomes ready",
+			started:      true,
+			readyTimeout: 5,
+			state:        StateConnecting,
+			becomeReady:  true,
+			wantState:    StateReady,
+		},
+		{
+			name:      "times out",
+			started:   true,
+			state:     StateConnecting,
+			wantState: StateConnecting,
+			wantErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setNodeConfig(t, func(cfg *config.NodeConfig) {
+				cfg.ReadyTimeout = test.readyTimeout
+			})
+			u := &upstream{state: test.state}
+			setUpstreams(t, u)
+			setStateStarted(t, test.started)
+			if test.becomeReady {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					u.setState(StateReady)
+				}()
+			}
+			err := WaitForReady(context.Background())
+			if test.wantErr {
+				var notReadyErr NodeNotReadyError
+				if !errors.As(err, &notReadyErr) {
+					t.Fatalf("got error %v, wanted a NodeNotReadyError", err)
+				}
+				if notReadyErr.State != test.wantState {
+					t.Fatalf("got state %s in error, wanted %s", notReadyErr.State, test.wantState)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if state := GetState(); state != test.wantState {
+				t.Fatalf("got state %s, wanted %s", state, test.wantState)
+			}
+		})
+	}
+}
+
+// setUpstreams replaces the upstreams for the rest of a test
+func setUpstreams(t *testing.T, ups ...*upstream) {
+	t.Helper()
+	upstreamsOnce.Do(func() {})
+	stateMutex.Lock()
+	prev := upstreams
+	upstreams = ups
+	stateMutex.Unlock()
+	t.Cleanup(func() {
+		stateMutex.Lock()
+		upstreams = prev
+		stateMutex.Unlock()
+	})
+}
+
+// setStateStarted sets whether state tracking has been started for the rest of a test
+func setStateStarted(t *testing.T, started bool) {
+	t.Helper()
+	stateMutex.Lock()
+	prev := stateStarted
+	stateStarted = started
+	stateMutex.Unlock()
+	t.Cleanup(func() {
+		stateMutex.Lock()
+		stateStarted = prev
+		stateMutex.Unlock()
+	})
+}
+
+// setNodeConfig changes the node config for the rest of a test
+func setNodeConfig(t *testing.T, change func(cfg *config.NodeConfig)) {
+	t.Helper()
+	cfg := config.GetConfig()
+	prev := cfg.Node
+	change(&cfg.Node)
+	t.Cleanup(func() {
+		cfg.Node = prev
+	})
+}
@@ -0,0 +1,243 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ouroboros "github.com/blinklabs-io/gouroboros"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+// upstream is a single cardano-node we can connect to
+type upstream struct {
+	name     string
+	network  string
+	address  string
+	priority int
+	active   atomic.Int64
+	// These are protected by stateMutex
+	state   State
+	tipSlot uint64
+	tipHash []byte
+}
+
+// UpstreamStatus is a point-in-time view of an upstream node
+type UpstreamStatus struct {
+	Name              string `json:"name"`
+	State             string `json:"state"`
+	TipSlot           uint64 `json:"tip_slot"`
+	Behind            bool   `json:"behind"`
+	ActiveConnections int64  `json:"active_connections"`
+}
+
+var upstreams []*upstream
+var upstreamsOnce sync.Once
+var roundRobinCounter atomic.Uint64
+
+// getUpstreams returns the configured upstreams, building them from the config on first use
+func getUpstreams() []*upstream {
+	upstreamsOnce.Do(func() {
+		cfg := config.GetConfig()
+		if len(cfg.Node.Upstreams) > 0 {
+			for idx, entry := range cfg.Node.Upstreams {
+				upstreams = append(upstreams, newUpstream(idx, entry))
+			}
+		} else if cfg.Node.Address != "" && cfg.Node.Port > 0 {
+			upstreams = append(
+				upstreams,
+				newUpstream(
+					0,
+					fmt.Sprintf("%s:%d", cfg.Node.Address, cfg.Node.Port),
+				),
+			)
+		} else if cfg.Node.SocketPath != "" {
+			upstreams = append(
+				upstreams,
+				newUpstream(0, "unix:"+cfg.Node.SocketPath),
+			)
+		}
+	})
+	return upstreams
+}
+
+// newUpstream parses an upstream entry, which is either a TCP "host:port" or a UNIX socket
+// path. Socket paths can be given either as an absolute path or with a "unix:" prefix
+func newUpstream(priority int, entry string) *upstream {
+	u := &upstream{
+		name:     entry,
+		priority: priority,
+		state:    StateConnecting,
+	}
+	if strings.HasPrefix(entry, "unix:") {
+		u.network = "unix"
+		u.address = strings.TrimPrefix(entry, "unix:")
+	} else if strings.HasPrefix(entry, "/") {
+		u.network = "unix"
+		u.address = entry
+	} else {
+		u.network = "tcp"
+		u.address = entry
+	}
+	return u
+}
+
+// connect dials the upstream and performs the Ouroboros handshake
+func (u *upstream) connect(
+	options ...ouroboros.ConnectionOptionFunc,
+) (*ouroboros.Connection, error) {
+	if u.network == "unix" {
+		// Check that node socket path exists
+		if _, err := os.Stat(u.address); err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("node socket path does not exist: %s", u.address)
+			} else {
+				return nil, fmt.Errorf("unknown error checking if node socket path exists: %s", err)
+			}
+		}
+	}
+	conn, err := net.DialTimeout(
+		u.network,
+		u.address,
+		ouroboros.DefaultConnectTimeout,
+	)
+	if err != nil {
+		if u.network == "unix" {
+			return nil, fmt.Errorf("failure connecting to node via UNIX socket: %s", err)
+		}
+		return nil, fmt.Errorf("failure connecting to node via TCP: %s", err)
+	}
+	u.active.Add(1)
+	countedConn := &upstreamConn{Conn: conn, upstream: u}
+	options = append(options, ouroboros.WithConnection(countedConn))
+	oConn, err := ouroboros.NewConnection(options...)
+	if err != nil {
+		countedConn.Close()
+		return nil, fmt.Errorf("failure creating Ouroboros connection: %s", err)
+	}
+	return oConn, nil
+}
+
+func (u *upstream) status(bestTipSlot uint64) UpstreamStatus {
+	return UpstreamStatus{
+		Name:              u.name,
+		State:             u.state.String(),
+		TipSlot:           u.tipSlot,
+		Behind:            u.behind(bestTipSlot),
+		ActiveConnections: u.active.Load(),
+	}
+}
+
+// behind returns whether the upstream's tip lags the best known tip by more than the configured amount.
+// This must be called with stateMutex held
+func (u *upstream) behind(bestTipSlot uint64) bool {
+	cfg := config.GetConfig()
+	if cfg.Node.MaxTipLag == 0 || u.tipSlot == 0 {
+		return false
+	}
+	return bestTipSlot > u.tipSlot+uint64(cfg.Node.MaxTipLag)
+}
+
+// replaceable returns whether connections to the upstream should be replaced with ones to a
+// better upstream, because it's lagging or not ready while another upstream is healthy
+func (u *upstream) replaceable() bool {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	best := bestTipSlotLocked()
+	if u.state == StateReady && !u.behind(best) {
+		return false
+	}
+	for _, other := range getUpstreams() {
+		if other.state == StateReady && !other.behind(best) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamConn wraps a net.Conn to keep track of the number of open connections to an upstream
+type upstreamConn struct {
+	net.Conn
+	upstream  *upstream
+	closeOnce sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.upstream.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// GetUpstreamStatus returns the status of all configured upstreams
+func GetUpstreamStatus() []UpstreamStatus {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	best := bestTipSlotLocked()
+	ret := []UpstreamStatus{}
+	for _, u := range getUpstreams() {
+		ret = append(ret, u.status(best))
+	}
+	return ret
+}
+
+// selectUpstreams returns the upstreams in the order they should be tried. Healthy upstreams come
+// first, followed by degraded or lagging ones and then the rest, with each group ordered by the
+// configured policy
+func selectUpstreams() []*upstream {
+	cfg := config.GetConfig()
+	all := getUpstreams()
+	var healthy, degraded, other []*upstream
+	stateMutex.Lock()
+	best := bestTipSlotLocked()
+	for _, u := range all {
+		switch {
+		case u.state == StateReady && !u.behind(best):
+			healthy = append(healthy, u)
+		case u.state == StateReady || u.state == StateDegraded:
+			degraded = append(degraded, u)
+		default:
+			other = append(other, u)
+		}
+	}
+	stateMutex.Unlock()
+	ret := make([]*upstream, 0, len(all))
+	for _, group := range [][]*upstream{healthy, degraded, other} {
+		switch cfg.Node.UpstreamPolicy {
+		case "round-robin":
+			if len(group) > 1 {
+				offset := int(roundRobinCounter.Add(1) % uint64(len(group)))
+				group = append(group[offset:], group[:offset]...)
+			}
+		case "least-loaded":
+			sort.SliceStable(group, func(i, j int) bool {
+				return group[i].active.Load() < group[j].active.Load()
+			})
+		default:
+			sort.SliceStable(group, func(i, j int) bool {
+				return group[i].priority < group[j].priority
+			})
+		}
+		ret = append(ret, group...)
+	}
+	return ret
+}
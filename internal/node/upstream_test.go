@@ -0,0 +1,187 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+func TestNewUpstream(t *testing.T) {
+	tests := []struct {
+		entry       string
+		wantNetwork string
+		wantAddress string
+	}{
+		{
+			entry:       "node.example.com:3001",
+			wantNetwork: "tcp",
+			wantAddress: "node.example.com:3001",
+		},
+		{
+			entry:       "unix:/ipc/node.socket",
+			wantNetwork: "unix",
+			wantAddress: "/ipc/node.socket",
+		},
+		{
+			entry:       "/ipc/node.socket",
+			wantNetwork: "unix",
+			wantAddress: "/ipc/node.socket",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.entry, func(t *testing.T) {
+			u := newUpstream(2, test.entry)
+			if u.network != test.wantNetwork || u.address != test.wantAddress {
+				t.Fatalf(
+					"got %s %s, wanted %s %s",
+					u.network,
+					u.address,
+					test.wantNetwork,
+					test.wantAddress,
+				)
+			}
+			if u.name != test.entry || u.priority != 2 || u.state != StateConnecting {
+				t.Fatalf("got upstream %+v", u)
+			}
+		})
+	}
+}
+
+func TestSelectUpstreams(t *testing.T) {
+	// testUpstream describes an upstream by its name, state, tip and open connections
+	type testUpstream struct {
+		name    string
+		state   State
+		tipSlot uint64
+		active  int64
+	}
+	tests := []struct {
+		name      string
+		policy    string
+		maxTipLag uint
+		upstreams []testUpstream
+		want      []string
+	}{
+		{
+			name:   "priority order",
+			policy: "priority",
+			upstreams: []testUpstream{
+				{name: "a", state: StateReady},
+				{name: "b", state: StateReady},
+				{name: "c", state: StateReady},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name:   "healthy before degraded before the rest",
+			policy: "priority",
+			upstreams: []testUpstream{
+				{name: "a", state: StateDisconnected},
+				{name: "b", state: StateDegraded},
+				{name: "c", state: StateConnecting},
+				{name: "d", state: StateReady},
+			},
+			want: []string{"d", "b", "a", "c"},
+		},
+		{
+			name:      "lagging upstreams count as degraded",
+			policy:    "priority",
+			maxTipLag: 120,
+			upstreams: []testUpstream{
+				{name: "a", state: StateReady, tipSlot: 1000},
+				{name: "b", state: StateReady, tipSlot: 1200},
+			},
+			want: []string{"b", "a"},
+		},
+		{
+			name:   "least loaded",
+			policy: "least-loaded",
+			upstreams: []testUpstream{
+				{name: "a", state: StateReady, active: 3},
+				{name: "b", state: StateReady, active: 1},
+				{name: "c", state: StateReady, active: 2},
+				{name: "d", state: StateDegraded},
+			},
+			want: []string{"b", "c", "a", "d"},
+		},
+		{
+			name:   "unknown policy falls back to priority",
+			policy: "random",
+			upstreams: []testUpstream{
+				{name: "a", state: StateReady, active: 3},
+				{name: "b", state: StateReady},
+			},
+			want: []string{"a", "b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setNodeConfig(t, func(cfg *config.NodeConfig) {
+				cfg.UpstreamPolicy = test.policy
+				cfg.MaxTipLag = test.maxTipLag
+			})
+			ups := make([]*upstream, 0, len(test.upstreams))
+			for i, tu := range test.upstreams {
+				u := newUpstream(i, tu.name)
+				u.state = tu.state
+				u.tipSlot = tu.tipSlot
+				u.active.Store(tu.active)
+				ups = append(ups, u)
+			}
+			setUpstreams(t, ups...)
+			if got := upstreamNames(selectUpstreams()); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectUpstreamsRoundRobin(t *testing.T) {
+	setNodeConfig(t, func(cfg *config.NodeConfig) {
+		cfg.UpstreamPolicy = "round-robin"
+	})
+	setUpstreams(
+		t,
+		&upstream{name: "a", state: StateReady},
+		&upstream{name: "b", state: StateReady},
+		&upstream{name: "c", state: StateReady},
+		&upstream{name: "d", state: StateDisconnected},
+	)
+	// Each healthy upstream takes a turn at the front, and the rest keep their place after them
+	firsts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		got := upstreamNames(selectUpstreams())
+		if len(got) != 4 || got[3] != "d" {
+			t.Fatalf("got %v, wanted the disconnected upstream last", got)
+		}
+		firsts[got[0]]++
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if firsts[name] != 2 {
+			t.Fatalf("got first upstreams %v, wanted each healthy one twice", firsts)
+		}
+	}
+}
+
+func upstreamNames(ups []*upstream) []string {
+	ret := make([]string, 0, len(ups))
+	for _, u := range ups {
+		ret = append(ret, u.name)
+	}
+	return ret
+}
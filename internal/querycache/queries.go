@@ -0,0 +1,127 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package querycache
+
+import (
+	"context"
+
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/blinklabs-io/gouroboros/protocol/localstatequery"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+// ProtocolParams returns the protocol parameters at a point, or the current ones if the point is
+// nil. They only change at epoch boundaries
+func ProtocolParams(ctx context.Context, point *common.Point) (Result, error) {
+	return get(
+		ctx,
+		node.QueryProtocolParams,
+		ScopeEpoch,
+		point,
+		func(client *localstatequery.Client) (any, error) {
+			return client.GetCurrentProtocolParams()
+		},
+	)
+}
+
+// EraHistory returns the era history at a point, or the current one if the point is nil. It only
+// changes at epoch boundaries
+func EraHistory(ctx context.Context, point *common.Point) (Result, error) {
+	return get(
+		ctx,
+		node.QueryEraHistory,
+		ScopeEpoch,
+		point,
+		func(client *localstatequery.Client) (any, error) {
+			return client.GetEraHistory()
+		},
+	)
+}
+
+// SystemStart returns the system start, which never changes. The point is still acquired, so that
+// the query fails the same way as the others for a point the node doesn't have
+func SystemStart(ctx context.Context, point *common.Point) (Result, error) {
+	return get(
+		ctx,
+		node.QuerySystemStart,
+		ScopeForever,
+		point,
+		func(client *localstatequery.Client) (any, error) {
+			return client.GetSystemStart()
+		},
+	)
+}
+
+// get runs a query at a point, or through the cache for the current ledger state if the point
+// is nil. Results for a specific point aren't cached
+func get(
+	ctx context.Context,
+	query string,
+	scope Scope,
+	point *common.Point,
+	run func(client *localstatequery.Client) (any, error),
+) (Result, error) {
+	if point != nil {
+		value, err := runQuery(ctx, point, run)
+		if err != nil {
+			return Result{}, err
+		}
+		return newResult(value)
+	}
+	return Get(
+		ctx,
+		query,
+		scope,
+		func(ctx context.Context) (any, uint64, error) {
+			var epoch uint64
+			value, err := runQuery(
+				ctx,
+				nil,
+				func(client *localstatequery.Client) (any, error) {
+					// The epoch comes from the same acquired ledger state as the result
+					if scope == ScopeEpoch {
+						epochNo, err := client.GetEpochNo()
+						if err != nil {
+							return nil, err
+						}
+						epoch = uint64(epochNo)
+					}
+					return run(client)
+				},
+			)
+			return value, epoch, err
+		},
+	)
+}
+
+// runQuery runs a query against the ledger state at a point, or the current one if the point is
+// nil, on a pooled connection
+func runQuery(
+	ctx context.Context,
+	point *common.Point,
+	query func(client *localstatequery.Client) (any, error),
+) (any, error) {
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalStateQueryAt(point)
+	if err != nil {
+		return nil, err
+	}
+	return query(client)
+}
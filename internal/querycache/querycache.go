@@ -0,0 +1,198 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package querycache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+// Scope says how long a query result stays valid as the ledger tip moves
+type Scope int
+
+const (
+	// ScopeEpoch results change at epoch boundaries
+	ScopeEpoch Scope = iota
+	// ScopeForever results never change for a network
+	ScopeForever
+)
+
+// Result is a cached query result
+type Result struct {
+	Value any
+	// ETag identifies the value, for conditional requests
+	ETag string
+}
+
+type entry struct {
+	epoch  uint64
+	result Result
+}
+
+var (
+	mutex   sync.Mutex
+	entries = make(map[string]entry)
+	group   singleflight.Group
+)
+
+var (
+	hitsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "query_cache_hits_total",
+			Help: "Total number of LocalStateQuery results served from the cache, by query",
+		},
+		[]string{"query"},
+	)
+	missesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "query_cache_misses_total",
+			Help: "Total number of LocalStateQuery results fetched from the node, by query",
+		},
+		[]string{"query"},
+	)
+	coalescedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "query_cache_coalesced_total",
+			Help: "Total number of cache misses that shared a node query with a concurrent one, by query",
+		},
+		[]string{"query"},
+	)
+)
+
+// Get returns the result of a query, named as in the node package, for the current ledger tip,
+// from the cache if we have it. Otherwise it runs fetch, and concurrent calls for the same query
+// and epoch share a single run. Fetch returns the epoch of the ledger state it queried, and the
+// result is cached until the node's tip moves out of that epoch
+func Get(
+	ctx context.Context,
+	query string,
+	scope Scope,
+	fetch func(ctx context.Context) (any, uint64, error),
+) (Result, error) {
+	epoch, ok := currentEpoch(ctx, scope)
+	return getForEpoch(ctx, query, epoch, ok, fetch)
+}
+
+// getForEpoch returns the result of a query from the cache if we have one from the given epoch,
+// or otherwise runs fetch. Nothing is cached if ok is false
+func getForEpoch(
+	ctx context.Context,
+	query string,
+	epoch uint64,
+	ok bool,
+	fetch func(ctx context.Context) (any, uint64, error),
+) (Result, error) {
+	if ok {
+		mutex.Lock()
+		e, found := entries[query]
+		mutex.Unlock()
+		if found && e.epoch == epoch {
+			hitsTotal.WithLabelValues(query).Inc()
+			return e.result, nil
+		}
+	}
+	missesTotal.WithLabelValues(query).Inc()
+	// We don't share the caller's context with the other callers, so that one of them going away
+	// doesn't fail the rest
+	ret, err, shared := group.Do(
+		fmt.Sprintf("%s/%d/%t", query, epoch, ok),
+		func() (any, error) {
+			value, fetchedEpoch, err := fetch(context.WithoutCancel(ctx))
+			if err != nil {
+				return nil, err
+			}
+			result, err := newResult(value)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				mutex.Lock()
+				entries[query] = entry{epoch: fetchedEpoch, result: result}
+				mutex.Unlock()
+			}
+			return result, nil
+		},
+	)
+	if shared {
+		coalescedTotal.WithLabelValues(query).Inc()
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return ret.(Result), nil
+}
+
+// currentEpoch returns the epoch that cached results in the scope must come from to be served.
+// For the epoch scope it's the epoch of the node's tip, so that results are still cached while
+// the node is syncing or behind, and stop matching once we hear of the tip moving into a new
+// epoch. We only hear of a new tip so often, so we don't cache in the epoch just before the
+// wall-clock one, where the node could cross the boundary at any moment. It returns false if we
+// don't know the epoch well enough to cache
+func currentEpoch(ctx context.Context, scope Scope) (uint64, bool) {
+	switch scope {
+	case ScopeForever:
+		return 0, true
+	case ScopeEpoch:
+		slot := node.TipSlot()
+		if slot == 0 {
+			return 0, false
+		}
+		epoch, err := node.SlotEpoch(ctx, slot)
+		if err != nil {
+			return 0, false
+		}
+		wallClockSlot, err := node.TimeSlot(ctx, time.Now())
+		if err != nil {
+			return 0, false
+		}
+		wallClockEpoch, err := node.SlotEpoch(ctx, wallClockSlot)
+		if err != nil {
+			return 0, false
+		}
+		return epoch, cacheableEpoch(epoch, wallClockEpoch)
+	default:
+		return 0, false
+	}
+}
+
+// cacheableEpoch returns whether results can be cached while the node's tip is in the given
+// epoch
+func cacheableEpoch(tipEpoch uint64, wallClockEpoch uint64) bool {
+	return tipEpoch+1 != wallClockEpoch
+}
+
+func newResult(value any) (Result, error) {
+	// The ETag is a hash of the JSON representation, which is what REST clients see
+	data, err := json.Marshal(value)
+	if err != nil {
+		return Result{}, err
+	}
+	hash := sha256.Sum256(data)
+	return Result{
+		Value: value,
+		ETag:  fmt.Sprintf("%q", hex.EncodeToString(hash[:16])),
+	}, nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package querycache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetCache empties the cache at the end of a test
+func resetCache(t *testing.T) {
+	t.Cleanup(func() {
+		mutex.Lock()
+		entries = make(map[string]entry)
+		mutex.Unlock()
+	})
+}
+
+// cacheCall is a query through the cache, while the current epoch is epoch and the node is in
+// fetchedEpoch
+type cacheCall struct {
+	epoch        uint64
+	unknownEpoch bool
+	fetchedEpoch uint64
+	value        string
+	fetchErr     error
+	// What the call should return, and whether it should have asked the node
+	want      string
+	wantFetch bool
+}
+
+func TestGetForEpoch(t *testing.T) {
+	fetchErr := errors.New("node went away")
+	tests := []struct {
+		name  string
+		calls []cacheCall
+	}{
+		{
+			name: "cached within epoch",
+			calls: []cacheCall{
+				{epoch: 5, fetchedEpoch: 5, value: "a", want: "a", wantFetch: true},
+				{epoch: 5, fetchedEpoch: 5, value: "b", want: "a"},
+			},
+		},
+		{
+			name: "fetched again in a new epoch",
+			calls: []cacheCall{
+				{epoch: 5, fetchedEpoch: 5, value: "a", want: "a", wantFetch: true},
+				{epoch: 6, fetchedEpoch: 6, value: "b", want: "b", wantFetch: true},
+				{epoch: 6, fetchedEpoch: 6, value: "c", want: "b"},
+			},
+		},
+		{
+			name: "node still in the previous epoch",
+			calls: []cacheCall{
+				{epoch: 6, fetchedEpoch: 5, value: "a", want: "a", wantFetch: true},
+				{epoch: 6, fetchedEpoch: 6, value: "b", want: "b", wantFetch: true},
+				{epoch: 6, fetchedEpoch: 6, value: "c", want: "b"},
+			},
+		},
+		{
+			name: "unknown epoch",
+			calls: []cacheCall{
+				{unknownEpoch: true, value: "a", want: "a", wantFetch: true},
+				{unknownEpoch: true, value: "b", want: "b", wantFetch: true},
+				{epoch: 5, fetchedEpoch: 5, value: "c", want: "c", wantFetch: true},
+			},
+		},
+		{
+			name: "errors aren't cached",
+			calls: []cacheCall{
+				{epoch: 5, fetchErr: fetchErr, wantFetch: true},
+				{epoch: 5, fetchedEpoch: 5, value: "a", want: "a", wantFetch: true},
+				{epoch: 5, fetchedEpoch: 5, fetchErr: fetchErr, want: "a"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetCache(t)
+			for idx, call := range test.calls {
+				call := call
+				fetched := false
+				result, err := getForEpoch(
+					context.Background(),
+					"test",
+					call.epoch,
+					!call.unknownEpoch,
+					func(ctx context.Context) (any, uint64, error) {
+						fetched = true
+						if call.fetchErr != nil {
+							return nil, 0, call.fetchErr
+						}
+						return call.value, call.fetchedEpoch, nil
+					},
+				)
+				if fetched != call.wantFetch {
+					t.Fatalf("call %d: got fetch %t, wanted %t", idx, fetched, call.wantFetch)
+				}
+				if call.want == "" {
+					if !errors.Is(err, call.fetchErr) {
+						t.Fatalf("call %d: got error %v, wanted %v", idx, err, call.fetchErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("call %d: unexpected error: %s", idx, err)
+				}
+				if result.Value != call.want {
+					t.Fatalf("call %d: got %v, wanted %s", idx, result.Value, call.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheableEpoch(t *testing.T) {
+	tests := []struct {
+		name           string
+		tipEpoch       uint64
+		wallClockEpoch uint64
+		want           bool
+	}{
+		{
+			name:           "caught up",
+			tipEpoch:       5,
+			wallClockEpoch: 5,
+			want:           true,
+		},
+		{
+			name:           "at an epoch boundary",
+			tipEpoch:       4,
+			wallClockEpoch: 5,
+		},
+		{
+			name:           "syncing",
+			tipEpoch:       2,
+			wallClockEpoch: 5,
+			want:           true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cacheableEpoch(test.tipEpoch, test.wallClockEpoch); got != test.want {
+				t.Fatalf("got %t, wanted %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetForEpochCoalesced(t *testing.T) {
+	resetCache(t)
+	const callers = 5
+	var fetches atomic.Int32
+	var waiting sync.WaitGroup
+	waiting.Add(callers)
+	releaseChan := make(chan struct{})
+	fetch := func(ctx context.Context) (any, uint64, error) {
+		fetches.Add(1)
+		<-releaseChan
+		return "a", 5, nil
+	}
+	results := make([]Result, callers)
+	errs := make([]error, callers)
+	var done sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			waiting.Done()
+			// A caller going away doesn't fail the others
+			ctx, cancel := context.WithCancel(context.Background())
+			if i == 0 {
+				cancel()
+			} else {
+				defer cancel()
+			}
+			results[i], errs[i] = getForEpoch(ctx, "test", 5, true, fetch)
+		}(i)
+	}
+	// Give every caller time to join the running fetch before it finishes
+	waiting.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(releaseChan)
+	done.Wait()
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("got %d fetches, wanted 1", got)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: unexpected error: %s", i, errs[i])
+		}
+		if results[i].Value != "a" || results[i].ETag != results[0].ETag {
+			t.Fatalf("caller %d: got %v, wanted the shared result %v", i, results[i], results[0])
+		}
+	}
+}
+
+func TestGetForever(t *testing.T) {
+	resetCache(t)
+	fetches := 0
+	fetch := func(ctx context.Context) (any, uint64, error) {
+		fetches++
+		return map[string]int{"year": 2017}, 0, nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := Get(context.Background(), "test", ScopeForever, fetch); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("got %d fetches, wanted 1", fetches)
+	}
+}
+
+func TestNewResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        any
+		b        any
+		wantSame bool
+	}{
+		{
+			name:     "same value",
+			a:        map[string]int{"epoch": 5},
+			b:        map[string]int{"epoch": 5},
+			wantSame: true,
+		},
+		{
+			name: "different value",
+			a:    map[string]int{"epoch": 5},
+			b:    map[string]int{"epoch": 6},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := newResult(test.a)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			b, err := newResult(test.b)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if (a.ETag == b.ETag) != test.wantSame {
+				t.Fatalf("got ETags %s and %s", a.ETag, b.ETag)
+			}
+			// ETags are quoted, as they appear in the header
+			if len(a.ETag) != 34 || a.ETag[0] != '"' || a.ETag[33] != '"' {
+				t.Fatalf("got malformed ETag %s", a.ETag)
+			}
+		})
+	}
+	if _, err := newResult(make(chan int)); err == nil {
+		t.Fatalf("got no error for a value that can't be marshaled")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+// How often we drop the buckets of clients that have gone quiet
+const cleanupInterval = time.Minute
+
+var rejectionsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "Total number of requests rejected by rate limits, by the kind of limit",
+	},
+	[]string{"limit"},
+)
+
+// Limiter keeps a token bucket for each client
+type Limiter struct {
+	name    string
+	limit   rate.Limit
+	burst   int
+	mutex   sync.Mutex
+	clients map[string]*rate.Limiter
+}
+
+// NewLimiter creates a limiter that allows each client the given rate of requests, with bursts of
+// up to the given size
+func NewLimiter(name string, requestsPerSecond float64, burst uint) *Limiter {
+	if burst == 0 {
+		burst = 1
+	}
+	l := &Limiter{
+		name:    name,
+		limit:   rate.Limit(requestsPerSecond),
+		burst:   int(burst),
+		clients: make(map[string]*rate.Limiter),
+	}
+	go l.cleanup()
+	return l
+}
+
+// Allow takes a token from the client's bucket. If the bucket is empty, it returns false and how
+// long until the next token is available
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	limiter, ok := l.clients[client]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.clients[client] = limiter
+	}
+	l.mutex.Unlock()
+	now := time.Now()
+	r := limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		rejectionsTotal.WithLabelValues(l.name).Inc()
+		return false, delay
+	}
+	return true, 0
+}
+
+// cleanup periodically drops the buckets of clients whose buckets have refilled, since a full
+// bucket is the same as a new one
+func (l *Limiter) cleanup() {
+	for range time.Tick(cleanupInterval) {
+		now := time.Now()
+		l.mutex.Lock()
+		for client, limiter := range l.clients {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.clients, client)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+var ipLimiter, keyLimiter *Limiter
+var limitersOnce sync.Once
+
+func getLimiters() (*Limiter, *Limiter) {
+	limitersOnce.Do(func() {
+		cfg := config.GetConfig().RateLimit
+		if cfg.IpRequestsPerSecond > 0 {
+			ipLimiter = NewLimiter("ip", cfg.IpRequestsPerSecond, cfg.IpBurst)
+		}
+		if cfg.KeyRequestsPerSecond > 0 {
+			keyLimiter = NewLimiter("key", cfg.KeyRequestsPerSecond, cfg.KeyBurst)
+		}
+	})
+	return ipLimiter, keyLimiter
+}
+
+// Allow checks the configured rate limits for a request. Requests with a valid API key are
+// limited by the key's name, and the rest by IP address. If the request isn't allowed, it also
+// returns how long the client should wait before retrying
+func Allow(keyName string, ip string) (bool, time.Duration) {
+	ipLimiter, keyLimiter := getLimiters()
+	if keyName != "" {
+		if keyLimiter == nil {
+			return true, 0
+		}
+		return keyLimiter.Allow(keyName)
+	}
+	if ipLimiter == nil {
+		return true, 0
+	}
+	return ipLimiter.Allow(ip)
+}
+
+// RetryAfter formats a wait for the Retry-After header, rounded up to a whole number of seconds
+func RetryAfter(d time.Duration) string {
+	return fmt.Sprintf("%d", int64(math.Ceil(d.Seconds())))
+}
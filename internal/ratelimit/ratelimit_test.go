@@ -0,0 +1,106 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name              string
+		requestsPerSecond float64
+		burst             uint
+		requests          int
+		wantAllowed       int
+		wantMaxRetry      time.Duration
+	}{
+		{
+			name:              "within burst",
+			requestsPerSecond: 1,
+			burst:             3,
+			requests:          3,
+			wantAllowed:       3,
+		},
+		{
+			name:              "over burst",
+			requestsPerSecond: 1,
+			burst:             3,
+			requests:          5,
+			wantAllowed:       3,
+			wantMaxRetry:      time.Second,
+		},
+		{
+			name:              "default burst",
+			requestsPerSecond: 1,
+			requests:          2,
+			wantAllowed:       1,
+			wantMaxRetry:      time.Second,
+		},
+		{
+			name:              "slow refill",
+			requestsPerSecond: 0.1,
+			burst:             2,
+			requests:          3,
+			wantAllowed:       2,
+			wantMaxRetry:      10 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewLimiter("test", test.requestsPerSecond, test.burst)
+			allowed := 0
+			for i := 0; i < test.requests; i++ {
+				ok, retryAfter := l.Allow("client")
+				if ok {
+					if retryAfter != 0 {
+						t.Fatalf("got retry after %s for an allowed request", retryAfter)
+					}
+					allowed++
+					continue
+				}
+				if retryAfter <= 0 || retryAfter > test.wantMaxRetry {
+					t.Fatalf("got retry after %s, wanted up to %s", retryAfter, test.wantMaxRetry)
+				}
+			}
+			if allowed != test.wantAllowed {
+				t.Fatalf("got %d requests allowed, wanted %d", allowed, test.wantAllowed)
+			}
+			// Other clients have their own bucket
+			if ok, _ := l.Allow("other"); !ok {
+				t.Fatalf("other client was rate limited")
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "0"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{10 * time.Second, "10"},
+	}
+	for _, test := range tests {
+		if got := RetryAfter(test.wait); got != test.want {
+			t.Fatalf("got %q for %s, wanted %q", got, test.wait, test.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+// How often we check the certificate, key and client CA files for changes
+const reloadInterval = 10 * time.Second
+
+// Names of our listeners, for choosing which of them require client certificates
+const (
+	ListenerApi     = "api"
+	ListenerMetrics = "metrics"
+	ListenerUtxorpc = "utxorpc"
+)
+
+var listeners = []string{ListenerApi, ListenerMetrics, ListenerUtxorpc}
+
+// Reloader holds the server certificate and client CAs from the TLS config, and reloads them
+// when their files change, so that certificates can be rotated without a restart
+type Reloader struct {
+	cfg       config.TlsConfig
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+var globalReloader *Reloader
+
+// GetReloader returns the global reloader, or nil if TLS isn't enabled
+func GetReloader() *Reloader {
+	return globalReloader
+}
+
+// Start loads the TLS certificate and client CAs and starts watching them for changes. It does
+// nothing if no certificate is configured
+func Start() error {
+	cfg := config.GetConfig()
+	if cfg.Tls.CertFilePath == "" {
+		return nil
+	}
+	r, err := New(cfg.Tls)
+	if err != nil {
+		return err
+	}
+	globalReloader = r
+	go r.watch()
+	return nil
+}
+
+// New creates a reloader and loads the files from the TLS config
+func New(cfg config.TlsConfig) (*Reloader, error) {
+	for _, listener := range cfg.ClientCertListeners {
+		if !slices.Contains(listeners, listener) {
+			return nil, fmt.Errorf(
+				"unknown listener %q in TLS client certificate listeners, expected one of: %s",
+				listener,
+				strings.Join(listeners, ", "),
+			)
+		}
+	}
+	r := &Reloader{
+		cfg: cfg,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns a TLS config for the named listener. Client certificates are requested and
+// verified against the client CAs if the listener requires them. They're only optional during
+// the handshake, so that requireClientCert can let health checks through without one
+func (r *Reloader) Config(listener string) *tls.Config {
+	ret := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+	if r.RequiresClientCert(listener) {
+		// We verify the client certificate ourselves, so that we always use the latest CAs
+		ret.ClientAuth = tls.RequestClientCert
+		ret.VerifyPeerCertificate = r.verifyClientCertificate
+	}
+	return ret
+}
+
+// RequiresClientCert returns whether the named listener requires client certificates
+func (r *Reloader) RequiresClientCert(listener string) bool {
+	return r.cfg.ClientCaFilePath != "" &&
+		slices.Contains(r.cfg.ClientCertListeners, listener)
+}
+
+// requireClientCert wraps a handler to reject requests without a client certificate, except for
+// the paths starting with one of the exempt prefixes
+func requireClientCert(next http.Handler, exempt []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Certificates are verified during the handshake, so any we have here are good
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		for _, prefix := range exempt {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				next.ServeHTTP(w, req)
+				return
+			}
+		}
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+	})
+}
+
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) verifyClientCertificate(
+	rawCerts [][]byte,
+	_ [][]*x509.Certificate,
+) error {
+	// Whether a certificate is needed at all depends on the request, see requireClientCert
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return fmt.Errorf("failed to parse client certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	r.mutex.RLock()
+	clientCAs := r.clientCAs
+	r.mutex.RUnlock()
+	_, err := certs[0].Verify(
+		x509.VerifyOptions{
+			Roots:         clientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to verify client certificate: %s", err)
+	}
+	return nil
+}
+
+// watch reloads the files whenever one of them changes. We keep using the old ones if the new
+// ones can't be loaded, as they may be part way through being replaced
+func (r *Reloader) watch() {
+	logger := logging.GetLogger()
+	for {
+		time.Sleep(reloadInterval)
+		changed, err := r.filesChanged()
+		if err != nil {
+			logger.Warnf("failed to check TLS files: %s", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := r.load(); err != nil {
+			logger.Warnf("failed to reload TLS files: %s", err)
+			continue
+		}
+		logger.Infof("reloaded TLS certificate from %s", r.cfg.CertFilePath)
+	}
+}
+
+func (r *Reloader) files() []string {
+	ret := []string{r.cfg.CertFilePath, r.cfg.KeyFilePath}
+	if r.cfg.ClientCaFilePath != "" {
+		ret = append(ret, r.cfg.ClientCaFilePath)
+	}
+	return ret
+}
+
+func (r *Reloader) filesChanged() (bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Reloader) load() error {
+	// Get the modification times first, so that a change while we're loading is picked up by
+	// the next check
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFilePath, r.cfg.KeyFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %s", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCaFilePath != "" {
+		caPem, err := os.ReadFile(r.cfg.ClientCaFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CA file: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf(
+				"no certificates found in TLS client CA file %s",
+				r.cfg.ClientCaFilePath,
+			)
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// ListenAndServe serves HTTP on the server's address for the named listener, using TLS if it's
+// enabled. If the listener requires client certificates, requests for paths starting with one of
+// the exempt prefixes don't need one
+func ListenAndServe(server *http.Server, name string, exempt ...string) error {
+	if r := GetReloader(); r != nil {
+		r.configureServer(server, name, exempt)
+		// The certificate comes from our TLS config
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// Serve serves HTTP on an existing listener, like ListenAndServe
+func Serve(
+	server *http.Server,
+	listener net.Listener,
+	name string,
+	exempt ...string,
+) error {
+	if r := GetReloader(); r != nil {
+		r.configureServer(server, name, exempt)
+		// The certificate comes from our TLS config
+		return server.ServeTLS(listener, "", "")
+	}
+	return server.Serve(listener)
+}
+
+func (r *Reloader) configureServer(server *http.Server, name string, exempt []string) {
+	server.TLSConfig = r.Config(name)
+	if r.RequiresClientCert(name) {
+		server.Handler = requireClientCert(server.Handler, exempt)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+// testCert is a certificate and key, along with the CA that signed it
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by the given parent, or a self-signed CA if it's nil
+func newTestCert(t *testing.T, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %s", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writeFiles writes the certificate and key as PEM files and returns their paths
+func (c *testCert) writeFiles(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("unexpected error encoding key: %s", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certPath, certPem, 0o600); err != nil {
+		t.Fatalf("unexpected error writing certificate: %s", err)
+	}
+	if err := os.WriteFile(keyPath, keyPem, 0o600); err != nil {
+		t.Fatalf("unexpected error writing key: %s", err)
+	}
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestNewUnknownListener(t *testing.T) {
+	_, err := New(config.TlsConfig{ClientCertListeners: []string{"admin"}})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown listener")
+	}
+}
+
+func TestClientCertListeners(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, x509.ExtKeyUsageAny)
+	caPath, _ := ca.writeFiles(t, dir, "ca")
+	server := newTestCert(t, ca, x509.ExtKeyUsageServerAuth)
+	certPath, keyPath := server.writeFiles(t, dir, "server")
+	client := newTestCert(t, ca, x509.ExtKeyUsageClientAuth)
+	otherCa := newTestCert(t, nil, x509.ExtKeyUsageAny)
+	otherClient := newTestCert(t, otherCa, x509.ExtKeyUsageClientAuth)
+	r, err := New(
+		config.TlsConfig{
+			CertFilePath:        certPath,
+			KeyFilePath:         keyPath,
+			ClientCaFilePath:    caPath,
+			ClientCertListeners: []string{ListenerApi},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(ca.cert)
+	tests := []struct {
+		name       string
+		listener   string
+		path       string
+		clientCert *testCert
+		wantStatus int
+		wantErr    bool
+	}{
+		{
+			name:       "client certificate",
+			listener:   ListenerApi,
+			path:       "/api/localstatequery/tip",
+			clientCert: client,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no client certificate",
+			listener:   ListenerApi,
+			path:       "/api/localstatequery/tip",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "health check without client certificate",
+			listener:   ListenerApi,
+			path:       "/readyz",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "untrusted client certificate",
+			listener:   ListenerApi,
+			path:       "/readyz",
+			clientCert: otherClient,
+			wantErr:    true,
+		},
+		{
+			name:       "listener without client certificates",
+			listener:   ListenerMetrics,
+			path:       "/",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error listening: %s", err)
+			}
+			httpServer := &http.Server{
+				Handler:           http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+				ReadHeaderTimeout: 10 * time.Second,
+				ErrorLog:          log.New(io.Discard, "", 0),
+			}
+			r.configureServer(httpServer, test.listener, []string{"/readyz"})
+			go func() {
+				_ = httpServer.ServeTLS(listener, "", "")
+			}()
+			defer httpServer.Close()
+			clientTlsConfig := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				RootCAs:    serverCAs,
+			}
+			if test.clientCert != nil {
+				clientTlsConfig.Certificates = []tls.Certificate{
+					test.clientCert.tlsCertificate(),
+				}
+			}
+			httpClient := &http.Client{
+				Transport: &http.Transport{TLSClientConfig: clientTlsConfig},
+			}
+			resp, err := httpClient.Get("https://" + listener.Addr().String() + test.path)
+			if test.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("expected the request to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("got status %d, wanted %d", resp.StatusCode, test.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,676 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxoindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blinklabs-io/adder/event"
+	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/cbor"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	lcommon "github.com/blinklabs-io/gouroboros/ledger/common"
+	"github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+const (
+	// UTxOs are keyed by tx hash and output index
+	bucketUtxos = "utxos"
+	// Indexes from address, payment part, delegation part and policy ID to the UTxO key
+	bucketAddresses  = "addresses"
+	bucketPayment    = "payment"
+	bucketDelegation = "delegation"
+	bucketPolicies   = "policies"
+	// Undo records for recent blocks, keyed by slot and hash
+	bucketBlocks = "blocks"
+	bucketMeta   = "meta"
+
+	metaKeyCount  = "count"
+	metaKeyBlocks = "blocks"
+
+	// Output records start with the output type
+	outputTypeByron   = 0
+	outputTypeShelley = 1
+
+	// Number of blocks we keep undo records for. This matches the security parameter, which
+	// bounds how far the chain can roll back
+	rollbackDepth = 2160
+	// Number of recent blocks offered as intersect points when resuming
+	resumePoints = 10
+	// Delay before retrying to start the chain-sync
+	startRetryDelay = 10 * time.Second
+)
+
+// ErrUtxoNotFound is returned when a UTxO isn't in the index
+var ErrUtxoNotFound = errors.New("UTxO not found")
+
+// Utxo is an unspent output from the index
+type Utxo struct {
+	TxHash []byte
+	Index  uint32
+	Output ledger.TransactionOutput
+}
+
+// UtxoIndex keeps the UTxO set, as seen from chain-sync, in an embedded on-disk database. It's
+// indexed by address, payment part, delegation part and policy ID
+type UtxoIndex struct {
+	db        *bolt.DB
+	startSlot uint64
+	startHash []byte
+}
+
+var globalUtxoIndex *UtxoIndex
+
+// GetUtxoIndex returns the global UTxO index, or nil if it's not enabled
+func GetUtxoIndex() *UtxoIndex {
+	return globalUtxoIndex
+}
+
+// Start opens the UTxO index and starts feeding it from chain-sync. It does nothing if no UTxO
+// index directory is configured
+func Start() error {
+	cfg := config.GetConfig()
+	if cfg.UtxoIndex.Directory == "" {
+		return nil
+	}
+	idx, err := New(cfg.UtxoIndex)
+	if err != nil {
+		return err
+	}
+	globalUtxoIndex = idx
+	idx.registerMetrics()
+	go idx.run()
+	return nil
+}
+
+// New opens (or creates) a UTxO index in the configured directory
+func New(cfg config.UtxoIndexConfig) (*UtxoIndex, error) {
+	startHash, err := hex.DecodeString(cfg.StartHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UTxO index start hash: %s", err)
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create UTxO index directory: %s", err)
+	}
+	db, err := bolt.Open(
+		filepath.Join(cfg.Directory, "utxos.db"),
+		0o600,
+		&bolt.Options{Timeout: time.Second},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UTxO index: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucketUtxos, bucketAddresses, bucketPayment, bucketDelegation, bucketPolicies, bucketBlocks, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize UTxO index: %s", err)
+	}
+	idx := &UtxoIndex{
+		db:        db,
+		startSlot: cfg.StartSlot,
+		startHash: startHash,
+	}
+	return idx, nil
+}
+
+// Close closes the underlying database
+func (i *UtxoIndex) Close() error {
+	return i.db.Close()
+}
+
+// GetUtxo returns the UTxO with the given tx hash and output index
+func (i *UtxoIndex) GetUtxo(txHash []byte, index uint32) (*Utxo, error) {
+	var ret *Utxo
+	err := i.db.View(func(tx *bolt.Tx) error {
+		key := utxoKey(txHash, index)
+		v := tx.Bucket([]byte(bucketUtxos)).Get(key)
+		if v == nil {
+			return ErrUtxoNotFound
+		}
+		var err error
+		ret, err = decodeUtxo(key, v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetUtxosByAddress returns the UTxOs at the given address
+func (i *UtxoIndex) GetUtxosByAddress(address []byte) ([]*Utxo, error) {
+	return i.getUtxosByIndex(bucketAddresses, addressIndexPrefix(address))
+}
+
+// GetUtxosByPaymentPart returns the UTxOs at addresses with the given payment part
+func (i *UtxoIndex) GetUtxosByPaymentPart(paymentPart []byte) ([]*Utxo, error) {
+	return i.getUtxosByIndex(bucketPayment, paymentPart)
+}
+
+// GetUtxosByDelegationPart returns the UTxOs at addresses with the given delegation part
+func (i *UtxoIndex) GetUtxosByDelegationPart(delegationPart []byte) ([]*Utxo, error) {
+	return i.getUtxosByIndex(bucketDelegation, delegationPart)
+}
+
+// GetUtxosByPolicy returns the UTxOs holding assets with the given policy ID
+func (i *UtxoIndex) GetUtxosByPolicy(policyId []byte) ([]*Utxo, error) {
+	return i.getUtxosByIndex(bucketPolicies, policyId)
+}
+
+// Tip returns the point of the newest block in the index
+func (i *UtxoIndex) Tip() (common.Point, error) {
+	var ret common.Point
+	err := i.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte(bucketBlocks)).Cursor().Last()
+		if k == nil {
+			return errors.New("UTxO index is empty")
+		}
+		ret = keyPoint(k)
+		return nil
+	})
+	return ret, err
+}
+
+// Count returns the number of UTxOs in the index
+func (i *UtxoIndex) Count() uint64 {
+	var count uint64
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		count = getCount(tx)
+		return nil
+	})
+	return count
+}
+
+// getUtxosByIndex returns the UTxOs for every index entry with the given prefix. Index keys are
+// the prefix followed by the UTxO key
+func (i *UtxoIndex) getUtxosByIndex(bucket string, prefix []byte) ([]*Utxo, error) {
+	ret := []*Utxo{}
+	err := i.db.View(func(tx *bolt.Tx) error {
+		utxos := tx.Bucket([]byte(bucketUtxos))
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			key := k[len(prefix):]
+			if len(key) != utxoKeyLen {
+				continue
+			}
+			v := utxos.Get(key)
+			if v == nil {
+				continue
+			}
+			utxo, err := decodeUtxo(key, v)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, utxo)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// run follows the chain and keeps the index up to date. If an update fails, we stop the
+// chain-sync and resync from the last block we indexed, rather than miss its outputs
+func (i *UtxoIndex) run() {
+	logger := logging.GetLogger()
+	for {
+		eventChan := make(chan event.Event, 10)
+		// The chain-sync takes care of reconnecting once it's started
+		session, err := node.StartChainSync(eventChan, i.intersectPoints())
+		if err != nil {
+			logger.Warnf(
+				"failed to start UTxO index chain-sync, retrying in %s: %s",
+				startRetryDelay,
+				err,
+			)
+			time.Sleep(startRetryDelay)
+			continue
+		}
+		err = i.follow(eventChan)
+		session.Close()
+		logger.Errorf(
+			"failed to update UTxO index, resyncing in %s: %s",
+			startRetryDelay,
+			err,
+		)
+		time.Sleep(startRetryDelay)
+	}
+}
+
+// follow applies chain-sync events to the index until one of them fails
+func (i *UtxoIndex) follow(eventChan chan event.Event) error {
+	for evt := range eventChan {
+		var err error
+		switch payload := evt.Payload.(type) {
+		case input_chainsync.BlockEvent:
+			err = i.addBlock(payload.Block)
+		case input_chainsync.RollbackEvent:
+			err = i.rollback(payload.SlotNumber)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("chain-sync ended")
+}
+
+// intersectPoints returns the points to start the chain-sync from. We resume after the most
+// recent blocks we have, or start from the configured starting point or the beginning of the
+// chain
+func (i *UtxoIndex) intersectPoints() []common.Point {
+	var ret []common.Point
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketBlocks)).Cursor()
+		for k, _ := c.Last(); k != nil && len(ret) < resumePoints; k, _ = c.Prev() {
+			ret = append(ret, keyPoint(k))
+		}
+		return nil
+	})
+	if i.startSlot > 0 {
+		ret = append(ret, common.NewPoint(i.startSlot, i.startHash))
+	} else {
+		ret = append(ret, common.NewPointOrigin())
+	}
+	return ret
+}
+
+// undoRecord holds what a block changed, so that it can be rolled back
+type undoRecord struct {
+	cbor.StructAsArray
+	Produced [][]byte
+	Spent    []spentUtxo
+}
+
+type spentUtxo struct {
+	cbor.StructAsArray
+	Key   []byte
+	Value []byte
+}
+
+func (i *UtxoIndex) addBlock(block ledger.Block) error {
+	hash, err := hex.DecodeString(block.Hash())
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		count := getCount(tx)
+		blockCount := getMeta(tx, metaKeyBlocks)
+		undo := undoRecord{
+			Produced: [][]byte{},
+			Spent:    []spentUtxo{},
+		}
+		for _, blockTx := range block.Transactions() {
+			for _, input := range blockTx.Consumed() {
+				key := utxoKey(input.Id().Bytes(), input.Index())
+				v := tx.Bucket([]byte(bucketUtxos)).Get(key)
+				// The output may be from before our starting point
+				if v == nil {
+					continue
+				}
+				value := append([]byte{}, v...)
+				if err := deleteUtxo(tx, key, value); err != nil {
+					return err
+				}
+				undo.Spent = append(undo.Spent, spentUtxo{Key: key, Value: value})
+				count--
+			}
+			txHash, err := hex.DecodeString(blockTx.Hash())
+			if err != nil {
+				return err
+			}
+			for _, utxo := range ProducedOutputs(blockTx) {
+				key := utxoKey(txHash, utxo.Index)
+				value, err := encodeOutput(utxo.Output)
+				if err != nil {
+					return err
+				}
+				if err := putUtxo(tx, key, value, utxo.Output); err != nil {
+					return err
+				}
+				undo.Produced = append(undo.Produced, key)
+				count++
+			}
+		}
+		undoCbor, err := cbor.Encode(&undo)
+		if err != nil {
+			return err
+		}
+		blocks := tx.Bucket([]byte(bucketBlocks))
+		key := blockKey(block.SlotNumber(), hash)
+		if blocks.Get(key) == nil {
+			blockCount++
+		}
+		if err := blocks.Put(key, undoCbor); err != nil {
+			return err
+		}
+		// Drop undo records for blocks that can no longer be rolled back
+		c := blocks.Cursor()
+		for k, _ := c.First(); k != nil && blockCount > rollbackDepth; k, _ = c.First() {
+			if err := blocks.Delete(k); err != nil {
+				return err
+			}
+			blockCount--
+		}
+		if err := putMeta(tx, metaKeyBlocks, blockCount); err != nil {
+			return err
+		}
+		return putMeta(tx, metaKeyCount, count)
+	})
+}
+
+// rollback undoes all blocks after the given slot
+func (i *UtxoIndex) rollback(slot uint64) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		count := getCount(tx)
+		blockCount := getMeta(tx, metaKeyBlocks)
+		blocks := tx.Bucket([]byte(bucketBlocks))
+		c := blocks.Cursor()
+		for k, v := c.Last(); k != nil && keyPoint(k).Slot > slot; k, v = c.Last() {
+			var undo undoRecord
+			if _, err := cbor.Decode(v, &undo); err != nil {
+				return fmt.Errorf("failed to decode undo record: %s", err)
+			}
+			// Outputs spent by the block are restored before removing the ones it produced,
+			// since an output can be both produced and spent within the same block
+			for _, spent := range undo.Spent {
+				output, err := decodeOutput(spent.Value)
+				if err != nil {
+					return err
+				}
+				if err := putUtxo(tx, spent.Key, spent.Value, output); err != nil {
+					return err
+				}
+				count++
+			}
+			utxos := tx.Bucket([]byte(bucketUtxos))
+			for _, key := range undo.Produced {
+				v := utxos.Get(key)
+				if v == nil {
+					continue
+				}
+				if err := deleteUtxo(tx, key, append([]byte{}, v...)); err != nil {
+					return err
+				}
+				count--
+			}
+			if err := blocks.Delete(k); err != nil {
+				return err
+			}
+			blockCount--
+		}
+		if err := putMeta(tx, metaKeyBlocks, blockCount); err != nil {
+			return err
+		}
+		return putMeta(tx, metaKeyCount, count)
+	})
+}
+
+func (i *UtxoIndex) registerMetrics() {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "utxoindex_utxos",
+			Help: "Number of UTxOs in the UTxO index",
+		},
+		func() float64 { return float64(i.Count()) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "utxoindex_tip_slot",
+			Help: "Slot of the newest block in the UTxO index",
+		},
+		func() float64 {
+			tip, err := i.Tip()
+			if err != nil {
+				return 0
+			}
+			return float64(tip.Slot)
+		},
+	)
+}
+
+// ProducedOutputs returns the outputs a transaction adds to the UTxO set along with their output
+// indexes. For a transaction that failed script validation, that's only its collateral return,
+// which is numbered after the regular outputs
+func ProducedOutputs(tx ledger.Transaction) []Utxo {
+	ret := []Utxo{}
+	for _, utxo := range tx.Produced() {
+		ret = append(
+			ret,
+			Utxo{
+				Index:  utxo.Id.Index(),
+				Output: utxo.Output,
+			},
+		)
+	}
+	return ret
+}
+
+// AddressParts returns the payment and delegation parts of a raw Shelley address. Parts that
+// the address doesn't have are returned as nil
+func AddressParts(addr []byte) ([]byte, []byte) {
+	if len(addr) < lcommon.AddressHashSize+1 {
+		return nil, nil
+	}
+	addrType := (addr[0] & lcommon.AddressHeaderTypeMask) >> 4
+	payload := addr[1:]
+	switch addrType {
+	case lcommon.AddressTypeKeyKey,
+		lcommon.AddressTypeScriptKey,
+		lcommon.AddressTypeKeyScript,
+		lcommon.AddressTypeScriptScript:
+		if len(payload) < 2*lcommon.AddressHashSize {
+			return payload[:lcommon.AddressHashSize], nil
+		}
+		return payload[:lcommon.AddressHashSize], payload[lcommon.AddressHashSize : 2*lcommon.AddressHashSize]
+	case lcommon.AddressTypeKeyPointer,
+		lcommon.AddressTypeScriptPointer,
+		lcommon.AddressTypeKeyNone,
+		lcommon.AddressTypeScriptNone:
+		return payload[:lcommon.AddressHashSize], nil
+	case lcommon.AddressTypeNoneKey, lcommon.AddressTypeNoneScript:
+		return nil, payload[:lcommon.AddressHashSize]
+	default:
+		// Byron addresses don't have separate parts
+		return nil, nil
+	}
+}
+
+// putUtxo stores a UTxO along with its index entries
+func putUtxo(tx *bolt.Tx, key []byte, value []byte, output ledger.TransactionOutput) error {
+	if err := tx.Bucket([]byte(bucketUtxos)).Put(key, value); err != nil {
+		return err
+	}
+	for bucket, indexKey := range indexKeys(key, output) {
+		for _, k := range indexKey {
+			if err := tx.Bucket([]byte(bucket)).Put(k, []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteUtxo removes a UTxO along with its index entries
+func deleteUtxo(tx *bolt.Tx, key []byte, value []byte) error {
+	output, err := decodeOutput(value)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(bucketUtxos)).Delete(key); err != nil {
+		return err
+	}
+	for bucket, indexKey := range indexKeys(key, output) {
+		for _, k := range indexKey {
+			if err := tx.Bucket([]byte(bucket)).Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexKeys returns the index entries for a UTxO, by bucket
+func indexKeys(key []byte, output ledger.TransactionOutput) map[string][][]byte {
+	ret := make(map[string][][]byte)
+	addr := output.Address().Bytes()
+	ret[bucketAddresses] = [][]byte{indexKey(addressIndexPrefix(addr), key)}
+	paymentPart, delegationPart := AddressParts(addr)
+	if paymentPart != nil {
+		ret[bucketPayment] = [][]byte{indexKey(paymentPart, key)}
+	}
+	if delegationPart != nil {
+		ret[bucketDelegation] = [][]byte{indexKey(delegationPart, key)}
+	}
+	if assets := output.Assets(); assets != nil {
+		for _, policyId := range assets.Policies() {
+			ret[bucketPolicies] = append(
+				ret[bucketPolicies],
+				indexKey(policyId.Bytes(), key),
+			)
+		}
+	}
+	return ret
+}
+
+// addressIndexPrefix length-prefixes an address, since (Byron) addresses vary in length
+func addressIndexPrefix(addr []byte) []byte {
+	ret := make([]byte, 2, 2+len(addr))
+	binary.BigEndian.PutUint16(ret, uint16(len(addr)))
+	return append(ret, addr...)
+}
+
+func indexKey(prefix []byte, key []byte) []byte {
+	ret := make([]byte, 0, len(prefix)+len(key))
+	ret = append(ret, prefix...)
+	return append(ret, key...)
+}
+
+// encodeOutput prefixes the output CBOR with its type, since Byron outputs decode differently
+func encodeOutput(output ledger.TransactionOutput) ([]byte, error) {
+	outputType := byte(outputTypeShelley)
+	if _, ok := output.(*ledger.ByronTransactionOutput); ok {
+		outputType = outputTypeByron
+	}
+	outputCbor := output.Cbor()
+	if len(outputCbor) == 0 {
+		// Shelley and Mary outputs don't keep their original CBOR
+		var err error
+		outputCbor, err = cbor.Encode(output)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret := make([]byte, 0, 1+len(outputCbor))
+	ret = append(ret, outputType)
+	return append(ret, outputCbor...), nil
+}
+
+func decodeOutput(value []byte) (ledger.TransactionOutput, error) {
+	if len(value) < 2 {
+		return nil, fmt.Errorf("invalid UTxO record")
+	}
+	// The decoded output keeps a reference to its CBOR, and values from the database are only
+	// valid for the life of the transaction
+	outputCbor := append([]byte{}, value[1:]...)
+	if value[0] == outputTypeByron {
+		var output ledger.ByronTransactionOutput
+		if _, err := cbor.Decode(outputCbor, &output); err != nil {
+			return nil, err
+		}
+		return &output, nil
+	}
+	var output ledger.BabbageTransactionOutput
+	if _, err := cbor.Decode(outputCbor, &output); err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+func decodeUtxo(key []byte, value []byte) (*Utxo, error) {
+	output, err := decodeOutput(value)
+	if err != nil {
+		return nil, err
+	}
+	return &Utxo{
+		TxHash: append([]byte{}, key[:32]...),
+		Index:  binary.BigEndian.Uint32(key[32:]),
+		Output: output,
+	}, nil
+}
+
+// utxoKeyLen is the length of a tx hash followed by an output index
+const utxoKeyLen = 36
+
+func utxoKey(txHash []byte, index uint32) []byte {
+	ret := make([]byte, 0, utxoKeyLen)
+	ret = append(ret, txHash...)
+	return binary.BigEndian.AppendUint32(ret, index)
+}
+
+func getCount(tx *bolt.Tx) uint64 {
+	return getMeta(tx, metaKeyCount)
+}
+
+func getMeta(tx *bolt.Tx, key string) uint64 {
+	v := tx.Bucket([]byte(bucketMeta)).Get([]byte(key))
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putMeta(tx *bolt.Tx, key string, val uint64) error {
+	return tx.Bucket([]byte(bucketMeta)).Put([]byte(key), uint64Bytes(val))
+}
+
+func blockKey(slot uint64, hash []byte) []byte {
+	return append(uint64Bytes(slot), hash...)
+}
+
+func keyPoint(key []byte) common.Point {
+	return common.NewPoint(
+		binary.BigEndian.Uint64(key[:8]),
+		append([]byte{}, key[8:]...),
+	)
+}
+
+func uint64Bytes(val uint64) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, val)
+	return ret
+}
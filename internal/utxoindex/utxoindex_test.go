@@ -0,0 +1,533 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxoindex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/adder/event"
+	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/cbor"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	lcommon "github.com/blinklabs-io/gouroboros/ledger/common"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+var (
+	testPaymentPart    = bytes.Repeat([]byte{0x11}, lcommon.AddressHashSize)
+	testDelegationPart = bytes.Repeat([]byte{0x22}, lcommon.AddressHashSize)
+	testPolicyId       = bytes.Repeat([]byte{0x33}, lcommon.AddressHashSize)
+	// A base address with both parts, and an enterprise address with only a payment part
+	testBaseAddr       = append(append([]byte{0x01}, testPaymentPart...), testDelegationPart...)
+	testEnterpriseAddr = append([]byte{0x61}, testPaymentPart...)
+)
+
+// testBlock is just enough of a block for the index
+type testBlock struct {
+	ledger.Block
+	slot uint64
+	txs  []ledger.Transaction
+}
+
+func (b testBlock) SlotNumber() uint64 {
+	return b.slot
+}
+
+func (b testBlock) Hash() string {
+	return fmt.Sprintf("%064x", b.slot)
+}
+
+func (b testBlock) Transactions() []ledger.Transaction {
+	return b.txs
+}
+
+// testTx is just enough of a transaction for the index
+type testTx struct {
+	ledger.Transaction
+	id               byte
+	inputs           []ledger.TransactionInput
+	outputs          []ledger.TransactionOutput
+	collateralReturn ledger.TransactionOutput
+	invalid          bool
+}
+
+func (tx testTx) Hash() string {
+	return hex.EncodeToString(testTxHash(tx.id))
+}
+
+func (tx testTx) IsValid() bool {
+	return !tx.invalid
+}
+
+func (tx testTx) Consumed() []ledger.TransactionInput {
+	return tx.inputs
+}
+
+func (tx testTx) Outputs() []ledger.TransactionOutput {
+	return tx.outputs
+}
+
+func (tx testTx) Produced() []ledger.Utxo {
+	if tx.invalid {
+		return []ledger.Utxo{
+			{
+				Id:     ledger.NewShelleyTransactionInput(tx.Hash(), len(tx.outputs)),
+				Output: tx.collateralReturn,
+			},
+		}
+	}
+	ret := []ledger.Utxo{}
+	for idx, output := range tx.outputs {
+		ret = append(
+			ret,
+			ledger.Utxo{
+				Id:     ledger.NewShelleyTransactionInput(tx.Hash(), idx),
+				Output: output,
+			},
+		)
+	}
+	return ret
+}
+
+func testTxHash(id byte) []byte {
+	return bytes.Repeat([]byte{id}, 32)
+}
+
+// testInput spends the given output of the transaction with the given ID
+func testInput(id byte, index uint32) ledger.TransactionInput {
+	return ledger.ShelleyTransactionInput{
+		TxId:        ledger.NewBlake2b256(testTxHash(id)),
+		OutputIndex: index,
+	}
+}
+
+// testOutput decodes an output to the given address, with a token under the test policy if
+// withAsset is set
+func testOutput(t *testing.T, addr []byte, withAsset bool) ledger.TransactionOutput {
+	t.Helper()
+	var amount any = uint64(2000000)
+	if withAsset {
+		amount = []any{
+			uint64(2000000),
+			map[cbor.ByteString]map[cbor.ByteString]uint64{
+				cbor.NewByteString(testPolicyId): {
+					cbor.NewByteString([]byte("token")): 1,
+				},
+			},
+		}
+	}
+	outputCbor, err := cbor.Encode([]any{addr, amount})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var output ledger.BabbageTransactionOutput
+	if _, err := cbor.Decode(outputCbor, &output); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return &output
+}
+
+// utxoRef names a UTxO by transaction ID and output index, for comparing
+type utxoRef struct {
+	id    byte
+	index uint32
+}
+
+func utxoRefs(t *testing.T, utxos []*Utxo) []utxoRef {
+	t.Helper()
+	ret := []utxoRef{}
+	for _, utxo := range utxos {
+		ret = append(ret, utxoRef{id: utxo.TxHash[0], index: utxo.Index})
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		if ret[a].id != ret[b].id {
+			return ret[a].id < ret[b].id
+		}
+		return ret[a].index < ret[b].index
+	})
+	return ret
+}
+
+func newTestIndex(t *testing.T) *UtxoIndex {
+	t.Helper()
+	idx, err := New(config.UtxoIndexConfig{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() {
+		idx.Close()
+	})
+	return idx
+}
+
+func TestUtxoIndex(t *testing.T) {
+	// Block 10 produces a base address output with a token and an enterprise address output
+	block10 := func(t *testing.T) testBlock {
+		return testBlock{
+			slot: 10,
+			txs: []ledger.Transaction{
+				testTx{
+					id: 0xa0,
+					outputs: []ledger.TransactionOutput{
+						testOutput(t, testBaseAddr, true),
+						testOutput(t, testEnterpriseAddr, false),
+					},
+				},
+			},
+		}
+	}
+	// Block 20 spends the token output, and produces an output that's spent in the same block
+	block20 := func(t *testing.T) testBlock {
+		return testBlock{
+			slot: 20,
+			txs: []ledger.Transaction{
+				testTx{
+					id:     0xb0,
+					inputs: []ledger.TransactionInput{testInput(0xa0, 0)},
+					outputs: []ledger.TransactionOutput{
+						testOutput(t, testEnterpriseAddr, false),
+						testOutput(t, testBaseAddr, true),
+					},
+				},
+				testTx{
+					id:      0xc0,
+					inputs:  []ledger.TransactionInput{testInput(0xb0, 1)},
+					outputs: []ledger.TransactionOutput{testOutput(t, testBaseAddr, false)},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name       string
+		blocks     func(t *testing.T) []testBlock
+		rollback   *uint64
+		want       []utxoRef
+		wantPolicy []utxoRef
+		wantTip    uint64
+	}{
+		{
+			name: "produced",
+			blocks: func(t *testing.T) []testBlock {
+				return []testBlock{block10(t)}
+			},
+			want:       []utxoRef{{0xa0, 0}, {0xa0, 1}},
+			wantPolicy: []utxoRef{{0xa0, 0}},
+			wantTip:    10,
+		},
+		{
+			name: "spent",
+			blocks: func(t *testing.T) []testBlock {
+				return []testBlock{block10(t), block20(t)}
+			},
+			want:       []utxoRef{{0xa0, 1}, {0xb0, 0}, {0xc0, 0}},
+			wantPolicy: []utxoRef{},
+			wantTip:    20,
+		},
+		{
+			name: "spent from before the start",
+			blocks: func(t *testing.T) []testBlock {
+				return []testBlock{
+					{
+						slot: 10,
+						txs: []ledger.Transaction{
+							testTx{
+								id:      0xa0,
+								inputs:  []ledger.TransactionInput{testInput(0x99, 0)},
+								outputs: []ledger.TransactionOutput{testOutput(t, testEnterpriseAddr, false)},
+							},
+						},
+					},
+				}
+			},
+			want:       []utxoRef{{0xa0, 0}},
+			wantPolicy: []utxoRef{},
+			wantTip:    10,
+		},
+		{
+			name: "failed script validation",
+			blocks: func(t *testing.T) []testBlock {
+				return []testBlock{
+					{
+						slot: 10,
+						txs: []ledger.Transaction{
+							testTx{
+								id:      0xa0,
+								invalid: true,
+								outputs: []ledger.TransactionOutput{
+									testOutput(t, testBaseAddr, true),
+									testOutput(t, testBaseAddr, true),
+								},
+								collateralReturn: testOutput(t, testEnterpriseAddr, false),
+							},
+						},
+					},
+				}
+			},
+			want:       []utxoRef{{0xa0, 2}},
+			wantPolicy: []utxoRef{},
+			wantTip:    10,
+		},
+		{
+			name: "rolled back",
+			blocks: func(t *testing.T) []testBlock {
+				return []testBlock{block10(t), block20(t)}
+			},
+			rollback:   uint64Ptr(10),
+			want:       []utxoRef{{0xa0, 0}, {0xa0, 1}},
+			wantPolicy: []utxoRef{{0xa0, 0}},
+			wantTip:    10,
+		},
+		{
+			name: "rolled back to before the start",
+			blocks: func(t *testing.T) []testBlock {
+				return []testBlock{block10(t), block20(t)}
+			},
+			rollback:   uint64Ptr(5),
+			want:       []utxoRef{},
+			wantPolicy: []utxoRef{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idx := newTestIndex(t)
+			for _, block := range test.blocks(t) {
+				if err := idx.addBlock(block); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if test.rollback != nil {
+				if err := idx.rollback(*test.rollback); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if idx.Count() != uint64(len(test.want)) {
+				t.Fatalf("got count %d, wanted %d", idx.Count(), len(test.want))
+			}
+			for _, ref := range test.want {
+				if _, err := idx.GetUtxo(testTxHash(ref.id), ref.index); err != nil {
+					t.Fatalf("failed to get UTxO %x#%d: %s", ref.id, ref.index, err)
+				}
+			}
+			// Every UTxO is at one of the addresses, which share a payment part
+			byBase, err := idx.GetUtxosByAddress(testBaseAddr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			byEnterprise, err := idx.GetUtxosByAddress(testEnterpriseAddr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := utxoRefs(t, append(byBase, byEnterprise...)); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got UTxOs by address %v, wanted %v", got, test.want)
+			}
+			byPayment, err := idx.GetUtxosByPaymentPart(testPaymentPart)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := utxoRefs(t, byPayment); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got UTxOs by payment part %v, wanted %v", got, test.want)
+			}
+			byDelegation, err := idx.GetUtxosByDelegationPart(testDelegationPart)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got, want := utxoRefs(t, byDelegation), utxoRefs(t, byBase); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got UTxOs by delegation part %v, wanted %v", got, want)
+			}
+			byPolicy, err := idx.GetUtxosByPolicy(testPolicyId)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := utxoRefs(t, byPolicy); !reflect.DeepEqual(got, test.wantPolicy) {
+				t.Fatalf("got UTxOs by policy %v, wanted %v", got, test.wantPolicy)
+			}
+			tip, err := idx.Tip()
+			if test.wantTip == 0 {
+				if err == nil {
+					t.Fatalf("got tip %d, wanted an empty index", tip.Slot)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tip.Slot != test.wantTip {
+				t.Fatalf("got tip %d, wanted %d", tip.Slot, test.wantTip)
+			}
+		})
+	}
+}
+
+func TestUtxoIndexNotFound(t *testing.T) {
+	idx := newTestIndex(t)
+	_, err := idx.GetUtxo(testTxHash(0xa0), 0)
+	if !errors.Is(err, ErrUtxoNotFound) {
+		t.Fatalf("got error %v, wanted %v", err, ErrUtxoNotFound)
+	}
+}
+
+func TestIntersectPoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.UtxoIndexConfig
+		blocks    []uint64
+		wantSlots []uint64
+	}{
+		{
+			name:      "origin",
+			wantSlots: []uint64{0},
+		},
+		{
+			name: "configured start",
+			cfg: config.UtxoIndexConfig{
+				StartSlot: 5,
+				StartHash: fmt.Sprintf("%064x", 5),
+			},
+			wantSlots: []uint64{5},
+		},
+		{
+			name:      "resume",
+			blocks:    []uint64{10, 20, 30},
+			wantSlots: []uint64{30, 20, 10, 0},
+		},
+		{
+			name:      "resume from most recent",
+			blocks:    []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			wantSlots: []uint64{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.cfg
+			cfg.Directory = t.TempDir()
+			idx, err := New(cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer idx.Close()
+			for _, slot := range test.blocks {
+				if err := idx.addBlock(testBlock{slot: slot}); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			gotSlots := []uint64{}
+			for _, point := range idx.intersectPoints() {
+				gotSlots = append(gotSlots, point.Slot)
+			}
+			if !reflect.DeepEqual(gotSlots, test.wantSlots) {
+				t.Fatalf("got intersect slots %v, wanted %v", gotSlots, test.wantSlots)
+			}
+		})
+	}
+}
+
+// badHashBlock is a block that can't be indexed
+type badHashBlock struct {
+	testBlock
+}
+
+func (b badHashBlock) Hash() string {
+	return "not hex"
+}
+
+func TestFollowStopsOnFailure(t *testing.T) {
+	idx := newTestIndex(t)
+	eventChan := make(chan event.Event, 3)
+	for _, block := range []ledger.Block{
+		testBlock{slot: 10},
+		badHashBlock{testBlock{slot: 20}},
+		testBlock{slot: 30},
+	} {
+		eventChan <- event.New(
+			"chainsync.block",
+			time.Now(),
+			nil,
+			input_chainsync.BlockEvent{Block: block},
+		)
+	}
+	if err := idx.follow(eventChan); err == nil {
+		t.Fatalf("got no error for a block that couldn't be indexed")
+	}
+	// Nothing after the failed block is indexed, so that we resync from the last good block
+	tip, err := idx.Tip()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tip.Slot != 10 {
+		t.Fatalf("got tip slot %d, wanted the last good block", tip.Slot)
+	}
+}
+
+func TestAddressParts(t *testing.T) {
+	tests := []struct {
+		name           string
+		addr           []byte
+		wantPayment    []byte
+		wantDelegation []byte
+	}{
+		{
+			name:           "base",
+			addr:           testBaseAddr,
+			wantPayment:    testPaymentPart,
+			wantDelegation: testDelegationPart,
+		},
+		{
+			name:        "enterprise",
+			addr:        testEnterpriseAddr,
+			wantPayment: testPaymentPart,
+		},
+		{
+			name:        "pointer",
+			addr:        append(append([]byte{0x41}, testPaymentPart...), 0x01, 0x02, 0x03),
+			wantPayment: testPaymentPart,
+		},
+		{
+			name:           "reward",
+			addr:           append([]byte{0xe1}, testDelegationPart...),
+			wantDelegation: testDelegationPart,
+		},
+		{
+			name: "byron",
+			addr: append([]byte{0x82}, testPaymentPart...),
+		},
+		{
+			name: "too short",
+			addr: []byte{0x01, 0x02},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payment, delegation := AddressParts(test.addr)
+			if !bytes.Equal(payment, test.wantPayment) {
+				t.Fatalf("got payment part %x, wanted %x", payment, test.wantPayment)
+			}
+			if !bytes.Equal(delegation, test.wantDelegation) {
+				t.Fatalf("got delegation part %x, wanted %x", delegation, test.wantDelegation)
+			}
+		})
+	}
+}
+
+func uint64Ptr(val uint64) *uint64 {
+	return &val
+}
@@ -16,8 +16,16 @@ package utxorpc
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 
+	connect "connectrpc.com/connect"
+	connectcors "connectrpc.com/cors"
+	"connectrpc.com/grpchealth"
+	"connectrpc.com/grpcreflect"
+	"github.com/rs/cors"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit/submitconnect"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/sync/syncconnect"
@@ -25,31 +33,115 @@ import (
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
 	"github.com/blinklabs-io/cardano-node-api/internal/config"
+	"github.com/blinklabs-io/cardano-node-api/internal/tlsconfig"
 )
 
+// Start serves the UTxO RPC services
 func Start(cfg *config.Config) error {
+	options := []connect.HandlerOption{
+		interceptors(cfg.Logging.Healthchecks),
+	}
+	mux := newServiceMux(options...)
+	// Health checks for load balancers, reporting on our connection to the node
+	mux.Handle(
+		grpchealth.NewHandler(newHealthChecker(serviceNames...), options...),
+	)
+	// Server reflection for tools like grpcurl
+	reflector := grpcreflect.NewStaticReflector(serviceNames...)
+	mux.Handle(grpcreflect.NewHandlerV1(reflector, options...))
+	mux.Handle(grpcreflect.NewHandlerV1Alpha(reflector, options...))
+	// The connect handlers speak gRPC, gRPC-Web and Connect, over HTTP/1.1 or HTTP/2, so
+	// browsers only need CORS to call us directly
+	var handler http.Handler = mux
+	if len(cfg.Utxorpc.CorsAllowedOrigins) > 0 {
+		handler = withCors(cfg.Utxorpc, handler)
+	}
+	if tlsconfig.GetReloader() == nil {
+		// Use h2c so we can serve HTTP/2 without TLS
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", cfg.Utxorpc.ListenAddress, cfg.Utxorpc.ListenPort),
+		Handler:           handler,
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	listening.Store(true)
+	defer listening.Store(false)
+	// Load balancers probe health without a client certificate
+	return tlsconfig.Serve(
+		server,
+		listener,
+		tlsconfig.ListenerUtxorpc,
+		"/"+grpchealth.HealthV1ServiceName+"/",
+	)
+}
+
+// serviceNames are the UTxO RPC services we serve
+var serviceNames = []string{
+	queryconnect.QueryServiceName,
+	submitconnect.SubmitServiceName,
+	syncconnect.SyncServiceName,
+	watchconnect.WatchServiceName,
+}
+
+// newServiceMux returns a mux with the handlers for the UTxO RPC services
+func newServiceMux(options ...connect.HandlerOption) *http.ServeMux {
 	mux := http.NewServeMux()
 	queryPath, queryHandler := queryconnect.NewQueryServiceHandler(
 		&queryServiceServer{},
+		options...,
 	)
 	submitPath, submitHandler := submitconnect.NewSubmitServiceHandler(
 		&submitServiceServer{},
+		options...,
 	)
-	syncPath, syncHandler := syncconnect.NewChainSyncServiceHandler(
-		&chainSyncServiceServer{},
+	syncPath, syncHandler := syncconnect.NewSyncServiceHandler(
+		&syncServiceServer{},
+		options...,
 	)
 	watchPath, watchHandler := watchconnect.NewWatchServiceHandler(
 		&watchServiceServer{},
+		options...,
 	)
 	mux.Handle(queryPath, queryHandler)
 	mux.Handle(submitPath, submitHandler)
 	mux.Handle(syncPath, syncHandler)
 	mux.Handle(watchPath, watchHandler)
-	err := http.ListenAndServe(
-		fmt.Sprintf("%s:%d", cfg.Utxorpc.ListenAddress, cfg.Utxorpc.ListenPort),
-		// Use h2c so we can serve HTTP/2 without TLS
-		h2c.NewHandler(mux, &http2.Server{}),
+	return mux
+}
+
+var listening atomic.Bool
+
+// Listening returns whether the UTxO RPC listener is up
+func Listening() bool {
+	return listening.Load()
+}
+
+// withCors wraps a handler with CORS handling for the configured origins. The headers used by
+// the gRPC-Web and Connect protocols, for API keys and for ledger points are always allowed and
+// exposed, along with any extra ones from the config
+func withCors(cfg config.UtxorpcConfig, handler http.Handler) http.Handler {
+	allowedHeaders := append(
+		connectcors.AllowedHeaders(),
+		"Authorization",
+		auth.HeaderApiKey,
+		ledgerPointHeader,
 	)
-	return err
+	allowedHeaders = append(allowedHeaders, cfg.CorsAllowedHeaders...)
+	exposedHeaders := append(connectcors.ExposedHeaders(), missingTxoRefsHeader)
+	exposedHeaders = append(exposedHeaders, cfg.CorsExposedHeaders...)
+	c := cors.New(cors.Options{
+		AllowedOrigins: cfg.CorsAllowedOrigins,
+		AllowedMethods: connectcors.AllowedMethods(),
+		AllowedHeaders: allowedHeaders,
+		ExposedHeaders: exposedHeaders,
+		MaxAge:         int(cfg.CorsMaxAge),
+	})
+	return c.Handler(handler)
 }
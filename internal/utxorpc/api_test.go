@@ -0,0 +1,165 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	query "github.com/utxorpc/go-codegen/utxorpc/v1alpha/query"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// requestRecorder is an interceptor that keeps the request messages the handlers get
+type requestRecorder struct {
+	received chan proto.Message
+}
+
+func (r *requestRecorder) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if msg, ok := req.Any().(proto.Message); ok {
+			r.received <- msg
+		}
+		return next(ctx, req)
+	}
+}
+
+func (r *requestRecorder) WrapStreamingClient(
+	next connect.StreamingClientFunc,
+) connect.StreamingClientFunc {
+	return next
+}
+
+// WrapStreamingHandler reads the request of a stream itself and ends the stream, since streams
+// need the node
+func (r *requestRecorder) WrapStreamingHandler(
+	next connect.StreamingHandlerFunc,
+) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		method, ok := conn.Spec().Schema.(protoreflect.MethodDescriptor)
+		if !ok {
+			return connect.NewError(connect.CodeInternal, errors.New("missing method schema"))
+		}
+		msgType, err := protoregistry.GlobalTypes.FindMessageByName(method.Input().FullName())
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+		msg := msgType.New().Interface()
+		if err := conn.Receive(msg); err != nil {
+			return err
+		}
+		r.received <- msg
+		return connect.NewError(connect.CodeUnavailable, errors.New("no node in tests"))
+	}
+}
+
+// newTestServer serves the UTxO RPC services over HTTP/2, so that every protocol works
+func newTestServer(t *testing.T) (*httptest.Server, *requestRecorder) {
+	t.Helper()
+	recorder := &requestRecorder{received: make(chan proto.Message, 1)}
+	server := httptest.NewUnstartedServer(
+		newServiceMux(connect.WithInterceptors(recorder)),
+	)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, recorder
+}
+
+// clientProtocols are the protocols clients can call us with
+var clientProtocols = []struct {
+	name    string
+	options []connect.ClientOption
+}{
+	{name: "connect"},
+	{name: "grpc", options: []connect.ClientOption{connect.WithGRPC()}},
+	{name: "grpc-web", options: []connect.ClientOption{connect.WithGRPCWeb()}},
+}
+
+func TestServeWithoutRevisionHeader(t *testing.T) {
+	server, recorder := newTestServer(t)
+	paymentPart := []byte{0x11, 0x22}
+	predicate := &query.UtxoPredicate{
+		Match: &query.AnyUtxoPattern{
+			UtxoPattern: &query.AnyUtxoPattern_Cardano{
+				Cardano: &cardano.TxOutputPattern{
+					Address: &cardano.AddressPattern{
+						PaymentPart: paymentPart,
+					},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		name        string
+		req         *query.SearchUtxosRequest
+		wantCode    connect.Code
+		wantMessage string
+	}{
+		{
+			name: "invalid start token",
+			req: &query.SearchUtxosRequest{
+				Predicate:  predicate,
+				StartToken: "bogus",
+			},
+			wantCode:    connect.CodeInvalidArgument,
+			wantMessage: "invalid start token",
+		},
+		{
+			name: "no UTxO index",
+			req: &query.SearchUtxosRequest{
+				Predicate:  predicate,
+				MaxItems:   10,
+				StartToken: txoRefKey([]byte{0x01}, 2),
+			},
+			wantCode:    connect.CodeFailedPrecondition,
+			wantMessage: "requires the UTxO index",
+		},
+	}
+	for _, protocol := range clientProtocols {
+		protocol := protocol
+		// The generated v0.10 client, which doesn't know about spec revisions at all
+		client := queryconnect.NewQueryServiceClient(
+			server.Client(),
+			server.URL,
+			protocol.options...,
+		)
+		for _, test := range tests {
+			test := test
+			t.Run(protocol.name+"/"+test.name, func(t *testing.T) {
+				req := connect.NewRequest(test.req)
+				_, err := client.SearchUtxos(context.Background(), req)
+				if code := connect.CodeOf(err); code != test.wantCode {
+					t.Fatalf("got code %s, wanted %s: %v", code, test.wantCode, err)
+				}
+				if !strings.Contains(err.Error(), test.wantMessage) {
+					t.Fatalf("got error %q, wanted it to contain %q", err, test.wantMessage)
+				}
+				received := <-recorder.received
+				if !proto.Equal(received, test.req) {
+					t.Fatalf("handler got %v, wanted %v", received, test.req)
+				}
+			})
+		}
+	}
+}
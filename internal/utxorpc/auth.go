@@ -0,0 +1,126 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/grpchealth"
+	"connectrpc.com/grpcreflect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit/submitconnect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/sync/syncconnect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch/watchconnect"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
+)
+
+// procedureScopes lists the scopes an API key needs for each procedure. Server streams also
+// need the stream scope. Procedures that aren't listed here or in publicProcedures are denied
+var procedureScopes = map[string][]auth.Scope{
+	queryconnect.QueryServiceReadParamsProcedure:     {auth.ScopeQuery},
+	queryconnect.QueryServiceReadUtxosProcedure:      {auth.ScopeQuery},
+	queryconnect.QueryServiceSearchUtxosProcedure:    {auth.ScopeQuery},
+	queryconnect.QueryServiceReadDataProcedure:       {auth.ScopeQuery},
+	submitconnect.SubmitServiceEvalTxProcedure:       {auth.ScopeSubmit},
+	submitconnect.SubmitServiceSubmitTxProcedure:     {auth.ScopeSubmit},
+	submitconnect.SubmitServiceWaitForTxProcedure:    {auth.ScopeSubmit, auth.ScopeStream},
+	submitconnect.SubmitServiceReadMempoolProcedure:  {auth.ScopeMempool},
+	submitconnect.SubmitServiceWatchMempoolProcedure: {auth.ScopeMempool, auth.ScopeStream},
+	syncconnect.SyncServiceFetchBlockProcedure:       {auth.ScopeQuery},
+	syncconnect.SyncServiceDumpHistoryProcedure:      {auth.ScopeQuery},
+	syncconnect.SyncServiceFollowTipProcedure:        {auth.ScopeStream},
+	watchconnect.WatchServiceWatchTxProcedure:        {auth.ScopeStream},
+}
+
+// publicProcedures are the procedures that don't need a key: health checks and reflection
+var publicProcedures = map[string]bool{
+	"/" + grpchealth.HealthV1ServiceName + "/Check":                       true,
+	"/" + grpchealth.HealthV1ServiceName + "/Watch":                       true,
+	"/" + grpcreflect.ReflectV1ServiceName + "/ServerReflectionInfo":      true,
+	"/" + grpcreflect.ReflectV1AlphaServiceName + "/ServerReflectionInfo": true,
+}
+
+// authInterceptor rejects requests whose API key doesn't have the scopes for the procedure. It
+// does nothing when authentication isn't enabled
+type authInterceptor struct{}
+
+func (i *authInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if err := authorize(auth.GetKeyStore(), req.Spec(), req.Header()); err != nil {
+			return nil, err
+		}
+		return next(ctx, req)
+	}
+}
+
+func (i *authInterceptor) WrapStreamingClient(
+	next connect.StreamingClientFunc,
+) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *authInterceptor) WrapStreamingHandler(
+	next connect.StreamingHandlerFunc,
+) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		if err := authorize(auth.GetKeyStore(), conn.Spec(), conn.RequestHeader()); err != nil {
+			return err
+		}
+		return next(ctx, conn)
+	}
+}
+
+// authorize checks that the request has an API key with the scopes for the procedure. Every
+// request is allowed when there's no key store
+func authorize(keyStore *auth.KeyStore, spec connect.Spec, header http.Header) error {
+	if keyStore == nil {
+		return nil
+	}
+	if publicProcedures[spec.Procedure] {
+		return nil
+	}
+	scopes, ok := procedureScopes[spec.Procedure]
+	if !ok {
+		return connect.NewError(
+			connect.CodePermissionDenied,
+			fmt.Errorf("procedure %s is not allowed", spec.Procedure),
+		)
+	}
+	if _, err := keyStore.Authorize(header, scopes...); err != nil {
+		var scopeErr auth.ScopeError
+		if errors.As(err, &scopeErr) {
+			return connect.NewError(connect.CodePermissionDenied, err)
+		}
+		return connect.NewError(connect.CodeUnauthenticated, err)
+	}
+	return nil
+}
+
+// apiKeyName returns the name of the API key in the request headers, for logging
+func apiKeyName(header http.Header) string {
+	keyStore := auth.GetKeyStore()
+	if keyStore == nil {
+		return ""
+	}
+	if key := keyStore.Lookup(header); key != nil {
+		return key.Name
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"net/http"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit/submitconnect"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/auth"
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
+)
+
+func TestAuthorize(t *testing.T) {
+	keyStore, err := auth.NewKeyStore(
+		config.AuthConfig{Keys: []string{"reader:query:read-key"}},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	withKey := http.Header{auth.HeaderApiKey: {"read-key"}}
+	tests := []struct {
+		name      string
+		keyStore  *auth.KeyStore
+		procedure string
+		header    http.Header
+		wantCode  connect.Code
+	}{
+		{
+			name:      "auth disabled",
+			procedure: "/unknown.Service/Method",
+		},
+		{
+			name:      "health check",
+			keyStore:  keyStore,
+			procedure: "/grpc.health.v1.Health/Check",
+			header:    http.Header{},
+		},
+		{
+			name:      "reflection",
+			keyStore:  keyStore,
+			procedure: "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+			header:    http.Header{},
+		},
+		{
+			name:      "allowed",
+			keyStore:  keyStore,
+			procedure: queryconnect.QueryServiceReadParamsProcedure,
+			header:    withKey,
+		},
+		{
+			name:      "missing key",
+			keyStore:  keyStore,
+			procedure: queryconnect.QueryServiceReadParamsProcedure,
+			header:    http.Header{},
+			wantCode:  connect.CodeUnauthenticated,
+		},
+		{
+			name:      "missing scope",
+			keyStore:  keyStore,
+			procedure: submitconnect.SubmitServiceSubmitTxProcedure,
+			header:    withKey,
+			wantCode:  connect.CodePermissionDenied,
+		},
+		{
+			name:      "unlisted procedure",
+			keyStore:  keyStore,
+			procedure: "/unknown.Service/Method",
+			header:    withKey,
+			wantCode:  connect.CodePermissionDenied,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := authorize(
+				test.keyStore,
+				connect.Spec{Procedure: test.procedure},
+				test.header,
+			)
+			if test.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if code := connect.CodeOf(err); code != test.wantCode {
+				t.Fatalf("got code %s, wanted %s", code, test.wantCode)
+			}
+		})
+	}
+}
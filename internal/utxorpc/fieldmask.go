@@ -0,0 +1,122 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// fieldMaskTree is a field mask split into its path components. An empty tree selects the whole
+// message. Every method that takes a field mask projects its responses through one of these
+type fieldMaskTree map[string]fieldMaskTree
+
+// newFieldMaskTree builds the tree for a field mask. Paths are relative to the chain-specific
+// message (block, transaction, output or params), and may also be given relative to the any-chain
+// wrapper around it with a "cardano." prefix
+func newFieldMaskTree(fieldMask *fieldmaskpb.FieldMask) fieldMaskTree {
+	tree := fieldMaskTree{}
+	for _, path := range fieldMask.GetPaths() {
+		if path == "cardano" {
+			// The whole chain-specific message
+			return fieldMaskTree{}
+		}
+		tree.add(strings.TrimPrefix(path, "cardano."))
+	}
+	return tree
+}
+
+// newMempoolFieldMaskTree builds the tree for a field mask over mempool records. These carry the
+// parsed transaction in a field of their own, so the "cardano" prefix is a path like any other
+func newMempoolFieldMaskTree(fieldMask *fieldmaskpb.FieldMask) fieldMaskTree {
+	tree := fieldMaskTree{}
+	for _, path := range fieldMask.GetPaths() {
+		tree.add(path)
+	}
+	return tree
+}
+
+// add adds a dot-separated path to the tree
+func (t fieldMaskTree) add(path string) {
+	names := strings.Split(path, ".")
+	node := t
+	for i, name := range names {
+		// A shorter path selects everything below it
+		if i == len(names)-1 {
+			node[name] = fieldMaskTree{}
+			break
+		}
+		child, ok := node[name]
+		if ok && len(child) == 0 {
+			break
+		}
+		if !ok {
+			child = fieldMaskTree{}
+			node[name] = child
+		}
+		node = child
+	}
+}
+
+// selects returns whether a top-level field is selected
+func (t fieldMaskTree) selects(name string) bool {
+	if len(t) == 0 {
+		return true
+	}
+	_, ok := t[name]
+	return ok
+}
+
+// apply clears every field of the message that isn't selected
+func (t fieldMaskTree) apply(msg proto.Message) {
+	if msg == nil || len(t) == 0 {
+		return
+	}
+	t.applyReflect(msg.ProtoReflect())
+}
+
+func (t fieldMaskTree) applyReflect(msg protoreflect.Message) {
+	if len(t) == 0 {
+		return
+	}
+	var cleared []protoreflect.FieldDescriptor
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		child, ok := t[string(fd.Name())]
+		if !ok {
+			cleared = append(cleared, fd)
+			return true
+		}
+		if len(child) == 0 || fd.Message() == nil || fd.IsMap() {
+			return true
+		}
+		if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				child.applyReflect(list.Get(i).Message())
+			}
+			return true
+		}
+		child.applyReflect(v.Message())
+		return true
+	})
+	for _, fd := range cleared {
+		msg.Clear(fd)
+	}
+	// Unknown fields can't be matched against the mask
+	msg.SetUnknown(nil)
+}
@@ -0,0 +1,372 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	query "github.com/utxorpc/go-codegen/utxorpc/v1alpha/query"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
+	submit "github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit"
+	sync "github.com/utxorpc/go-codegen/utxorpc/v1alpha/sync"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/sync/syncconnect"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func testBlock() *cardano.Block {
+	return &cardano.Block{
+		Header: &cardano.BlockHeader{
+			Slot:   1234,
+			Hash:   []byte{0xab, 0xcd},
+			Height: 56,
+		},
+		Body: &cardano.BlockBody{
+			Tx: []*cardano.Tx{
+				testTx([]byte{0x01}),
+				testTx([]byte{0x02}),
+			},
+		},
+	}
+}
+
+func testTx(hash []byte) *cardano.Tx {
+	return &cardano.Tx{
+		Inputs: []*cardano.TxInput{
+			{TxHash: []byte{0x99}, OutputIndex: 1},
+		},
+		Outputs: []*cardano.TxOutput{
+			testTxOutput(),
+		},
+		Fee:        170000,
+		Successful: true,
+		Hash:       hash,
+	}
+}
+
+func testTxOutput() *cardano.TxOutput {
+	return &cardano.TxOutput{
+		Address: []byte{0x61, 0x11},
+		Coin:    2000000,
+		Datum: &cardano.Datum{
+			Hash: []byte{0x22},
+		},
+		Assets: []*cardano.Multiasset{
+			{
+				PolicyId: []byte{0x33},
+				Assets: []*cardano.Asset{
+					{Name: []byte("token"), OutputCoin: 1},
+				},
+			},
+		},
+	}
+}
+
+// wireFields marshals a message and returns the numbers of the top-level fields on the wire
+func wireFields(t *testing.T, msg proto.Message) map[protowire.Number]bool {
+	t.Helper()
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling message: %s", err)
+	}
+	ret := make(map[protowire.Number]bool)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("unexpected error parsing message: %s", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			t.Fatalf("unexpected error parsing message: %s", protowire.ParseError(n))
+		}
+		b = b[n:]
+		ret[num] = true
+	}
+	return ret
+}
+
+// checkWireFields checks that exactly the named fields of a message are on the wire
+func checkWireFields(t *testing.T, msg proto.Message, names ...string) {
+	t.Helper()
+	fields := msg.ProtoReflect().Descriptor().Fields()
+	expected := make(map[protowire.Number]bool)
+	for _, name := range names {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			t.Fatalf("unknown field %q in %s", name, msg.ProtoReflect().Descriptor().FullName())
+		}
+		expected[fd.Number()] = true
+	}
+	actual := wireFields(t, msg)
+	for num := range actual {
+		if !expected[num] {
+			t.Errorf(
+				"field %s of %s should be masked, but is on the wire",
+				fields.ByNumber(num).Name(),
+				msg.ProtoReflect().Descriptor().FullName(),
+			)
+		}
+	}
+	for num := range expected {
+		if !actual[num] {
+			t.Errorf(
+				"field %s of %s should be selected, but isn't on the wire",
+				fields.ByNumber(num).Name(),
+				msg.ProtoReflect().Descriptor().FullName(),
+			)
+		}
+	}
+}
+
+func TestFieldMaskEmpty(t *testing.T) {
+	block := testBlock()
+	newFieldMaskTree(nil).apply(block)
+	if !proto.Equal(block, testBlock()) {
+		t.Fatalf("an empty field mask changed the message")
+	}
+	newFieldMaskTree(&fieldmaskpb.FieldMask{}).apply(block)
+	if !proto.Equal(block, testBlock()) {
+		t.Fatalf("an empty field mask changed the message")
+	}
+}
+
+func TestFieldMaskBlock(t *testing.T) {
+	block := testBlock()
+	mask := newFieldMaskTree(
+		&fieldmaskpb.FieldMask{
+			Paths: []string{"header.hash", "body.tx.hash", "body.tx.outputs"},
+		},
+	)
+	anyChainBlock := &sync.AnyChainBlock{
+		Chain: &sync.AnyChainBlock_Cardano{
+			Cardano: block,
+		},
+	}
+	mask.apply(block)
+	checkWireFields(t, block, "header", "body")
+	checkWireFields(t, block.GetHeader(), "hash")
+	for _, tx := range block.GetBody().GetTx() {
+		checkWireFields(t, tx, "outputs", "hash")
+		// A path selects everything below it
+		for _, output := range tx.GetOutputs() {
+			checkWireFields(t, output, "address", "coin", "assets", "datum")
+		}
+	}
+	// The masked fields are gone from the whole response too
+	b, err := proto.Marshal(anyChainBlock)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling message: %s", err)
+	}
+	var decoded sync.AnyChainBlock
+	if err := proto.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("unexpected error unmarshaling message: %s", err)
+	}
+	decodedBlock := decoded.GetCardano()
+	if decodedBlock.GetHeader().GetSlot() != 0 || decodedBlock.GetHeader().GetHeight() != 0 {
+		t.Errorf("masked header fields were decoded: %v", decodedBlock.GetHeader())
+	}
+	for _, tx := range decodedBlock.GetBody().GetTx() {
+		if len(tx.GetInputs()) > 0 || tx.GetFee() != 0 || tx.GetSuccessful() {
+			t.Errorf("masked transaction fields were decoded: %v", tx)
+		}
+	}
+}
+
+func TestFieldMaskTx(t *testing.T) {
+	tx := testTx([]byte{0x01})
+	newFieldMaskTree(
+		&fieldmaskpb.FieldMask{
+			Paths: []string{"hash", "outputs.address", "outputs.coin"},
+		},
+	).apply(tx)
+	checkWireFields(t, tx, "outputs", "hash")
+	checkWireFields(t, tx.GetOutputs()[0], "address", "coin")
+}
+
+func TestFieldMaskTxOutput(t *testing.T) {
+	testDefs := []struct {
+		paths    []string
+		expected []string
+	}{
+		{
+			paths:    []string{"coin"},
+			expected: []string{"coin"},
+		},
+		// Paths can be relative to the any-chain wrapper
+		{
+			paths:    []string{"cardano.address", "datum"},
+			expected: []string{"address", "datum"},
+		},
+		{
+			paths:    []string{"cardano"},
+			expected: []string{"address", "coin", "assets", "datum"},
+		},
+		// A shorter path wins over a longer one, in either order
+		{
+			paths:    []string{"assets.policy_id", "assets"},
+			expected: []string{"assets"},
+		},
+		{
+			paths:    []string{"assets", "assets.policy_id"},
+			expected: []string{"assets"},
+		},
+		// Paths that don't match anything select nothing
+		{
+			paths:    []string{"bogus"},
+			expected: []string{},
+		},
+	}
+	for _, testDef := range testDefs {
+		output := testTxOutput()
+		newFieldMaskTree(&fieldmaskpb.FieldMask{Paths: testDef.paths}).apply(output)
+		checkWireFields(t, output, testDef.expected...)
+		if len(output.GetAssets()) > 0 {
+			checkWireFields(t, output.GetAssets()[0], "policy_id", "assets")
+		}
+	}
+}
+
+func TestFieldMaskTxInMempool(t *testing.T) {
+	txInMempool := &submit.TxInMempool{
+		Ref:         []byte{0x01},
+		NativeBytes: []byte{0x84, 0xa0},
+		Stage:       submit.Stage_STAGE_MEMPOOL,
+		ParsedState: &submit.TxInMempool_Cardano{
+			Cardano: testTx([]byte{0x01}),
+		},
+	}
+	newMempoolFieldMaskTree(
+		&fieldmaskpb.FieldMask{Paths: []string{"stage", "cardano.hash"}},
+	).apply(txInMempool)
+	checkWireFields(t, txInMempool, "stage", "cardano")
+	checkWireFields(t, txInMempool.GetCardano(), "hash")
+}
+
+func TestFieldMaskUnknownFields(t *testing.T) {
+	output := testTxOutput()
+	output.ProtoReflect().SetUnknown(
+		protowire.AppendVarint(protowire.AppendTag(nil, 100, protowire.VarintType), 1),
+	)
+	newFieldMaskTree(&fieldmaskpb.FieldMask{Paths: []string{"coin"}}).apply(output)
+	checkWireFields(t, output, "coin")
+}
+
+func TestFieldMaskParams(t *testing.T) {
+	params, err := newProtocolParams(
+		ledger.BabbageProtocolParameters{
+			MinFeeA:     44,
+			MinFeeB:     155381,
+			MaxTxSize:   16384,
+			KeyDeposit:  2000000,
+			PoolDeposit: 500000000,
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testDefs := []struct {
+		paths    []string
+		expected []protowire.Number
+	}{
+		{
+			paths:    nil,
+			expected: []protowire.Number{2, 3, 4, 7, 8, 15},
+		},
+		{
+			paths:    []string{"min_fee_coefficient", "cardano.max_tx_size"},
+			expected: []protowire.Number{2, 3},
+		},
+		{
+			paths:    []string{"pool_deposit"},
+			expected: []protowire.Number{8},
+		},
+	}
+	for _, testDef := range testDefs {
+		msg, err := params.Utxorpc(&fieldmaskpb.FieldMask{Paths: testDef.paths})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		actual := wireFields(t, msg)
+		if len(actual) != len(testDef.expected) {
+			t.Errorf(
+				"did not get expected fields for mask %v: got %v, expected %v",
+				testDef.paths,
+				actual,
+				testDef.expected,
+			)
+			continue
+		}
+		for _, num := range testDef.expected {
+			if !actual[num] {
+				t.Errorf(
+					"field %d should be selected by mask %v, but isn't on the wire",
+					num,
+					testDef.paths,
+				)
+			}
+		}
+	}
+}
+
+func TestFieldMaskJSONCodec(t *testing.T) {
+	server, recorder := newTestServer(t)
+	for _, protocol := range clientProtocols {
+		protocol := protocol
+		options := append(protocol.options, connect.WithProtoJSON())
+		t.Run(protocol.name+"/ReadUtxos", func(t *testing.T) {
+			client := queryconnect.NewQueryServiceClient(server.Client(), server.URL, options...)
+			// The hash is invalid, so that the request fails before it needs the node
+			req := &query.ReadUtxosRequest{
+				Keys:      []*query.TxoRef{{Hash: []byte{0x01}}},
+				FieldMask: &fieldmaskpb.FieldMask{Paths: []string{"coin"}},
+			}
+			_, err := client.ReadUtxos(context.Background(), connect.NewRequest(req))
+			if code := connect.CodeOf(err); code != connect.CodeInvalidArgument {
+				t.Fatalf("got code %s, wanted %s: %v", code, connect.CodeInvalidArgument, err)
+			}
+			received := <-recorder.received
+			if !proto.Equal(received, req) {
+				t.Fatalf("handler got %v, wanted %v", received, req)
+			}
+		})
+		t.Run(protocol.name+"/FollowTip", func(t *testing.T) {
+			client := syncconnect.NewSyncServiceClient(server.Client(), server.URL, options...)
+			req := &sync.FollowTipRequest{
+				FieldMask: &fieldmaskpb.FieldMask{Paths: []string{"header.hash", "body.tx.hash"}},
+			}
+			stream, err := client.FollowTip(context.Background(), connect.NewRequest(req))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer stream.Close()
+			for stream.Receive() {
+			}
+			if code := connect.CodeOf(stream.Err()); code != connect.CodeUnavailable {
+				t.Fatalf("got code %s, wanted %s: %v", code, connect.CodeUnavailable, stream.Err())
+			}
+			received := <-recorder.received
+			if !proto.Equal(received, req) {
+				t.Fatalf("handler got %v, wanted %v", received, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"fmt"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/grpchealth"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+// healthChecker reports our services as serving while we have a usable connection to the node
+type healthChecker struct {
+	services map[string]bool
+}
+
+func newHealthChecker(services ...string) *healthChecker {
+	c := &healthChecker{
+		services: make(map[string]bool),
+	}
+	for _, service := range services {
+		c.services[service] = true
+	}
+	return c
+}
+
+// Check implements grpchealth.Checker. An empty service name asks about the whole server
+func (c *healthChecker) Check(
+	_ context.Context,
+	req *grpchealth.CheckRequest,
+) (*grpchealth.CheckResponse, error) {
+	if req.Service != "" && !c.services[req.Service] {
+		return nil, connect.NewError(
+			connect.CodeNotFound,
+			fmt.Errorf("unknown service %s", req.Service),
+		)
+	}
+	// Every service needs the node. A degraded node is still usable, just behind or flaky
+	switch node.GetState() {
+	case node.StateReady, node.StateDegraded:
+		return &grpchealth.CheckResponse{Status: grpchealth.StatusServing}, nil
+	default:
+		return &grpchealth.CheckResponse{Status: grpchealth.StatusNotServing}, nil
+	}
+}
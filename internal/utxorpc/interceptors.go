@@ -0,0 +1,288 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/grpchealth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/logging"
+)
+
+// interceptors returns the interceptor chain for our handlers, outermost first. Logging and
+// metrics sit outside rate limits, authentication and panic recovery, so that they see rejected
+// requests and recovered panics
+func interceptors(logHealthchecks bool) connect.Option {
+	return connect.WithInterceptors(
+		&loggingInterceptor{logHealthchecks: logHealthchecks},
+		&metricsInterceptor{},
+		&limitInterceptor{},
+		&authInterceptor{},
+		&recoverInterceptor{},
+	)
+}
+
+type requestLoggerKey struct{}
+
+// requestLogger returns the logger for the request, which carries the procedure and peer
+func requestLogger(ctx context.Context) *zap.SugaredLogger {
+	if logger, ok := ctx.Value(requestLoggerKey{}).(*zap.SugaredLogger); ok {
+		return logger
+	}
+	return logging.GetLogger()
+}
+
+// loggingInterceptor writes an access log entry for each request, and gives handlers a logger
+// for the request
+type loggingInterceptor struct {
+	logHealthchecks bool
+}
+
+func (i *loggingInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		start := time.Now()
+		keyName := apiKeyName(req.Header())
+		ctx, logger := i.newRequestLogger(ctx, req.Spec(), req.Peer(), keyName)
+		logger.Debugw("request", "message", req.Any())
+		resp, err := next(ctx, req)
+		i.logRequest(req.Spec(), req.Peer(), keyName, start, err)
+		return resp, err
+	}
+}
+
+func (i *loggingInterceptor) WrapStreamingClient(
+	next connect.StreamingClientFunc,
+) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *loggingInterceptor) WrapStreamingHandler(
+	next connect.StreamingHandlerFunc,
+) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		start := time.Now()
+		keyName := apiKeyName(conn.RequestHeader())
+		ctx, logger := i.newRequestLogger(ctx, conn.Spec(), conn.Peer(), keyName)
+		conn = &loggingHandlerConn{
+			StreamingHandlerConn: conn,
+			logger:               logger,
+		}
+		err := next(ctx, conn)
+		i.logRequest(conn.Spec(), conn.Peer(), keyName, start, err)
+		return err
+	}
+}
+
+func (i *loggingInterceptor) newRequestLogger(
+	ctx context.Context,
+	spec connect.Spec,
+	peer connect.Peer,
+	keyName string,
+) (context.Context, *zap.SugaredLogger) {
+	logger := logging.GetLogger().With(
+		"procedure", spec.Procedure,
+		"peer", peer.Addr,
+	)
+	if keyName != "" {
+		logger = logger.With("api_key", keyName)
+	}
+	return context.WithValue(ctx, requestLoggerKey{}, logger), logger
+}
+
+func (i *loggingInterceptor) logRequest(
+	spec connect.Spec,
+	peer connect.Peer,
+	keyName string,
+	start time.Time,
+	err error,
+) {
+	if !i.logHealthchecks && isHealthcheck(spec) {
+		return
+	}
+	accessLogger := logging.GetAccessLogger()
+	fields := []zap.Field{
+		zap.String("procedure", spec.Procedure),
+		zap.String("peer", peer.Addr),
+		zap.String("protocol", peer.Protocol),
+		zap.String("code", requestCode(err)),
+		zap.Duration("latency", time.Since(start)),
+	}
+	if keyName != "" {
+		fields = append(fields, zap.String("api_key", keyName))
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+		accessLogger.Warn("request failed", fields...)
+		return
+	}
+	accessLogger.Info("request", fields...)
+}
+
+// loggingHandlerConn logs each message received on a stream
+type loggingHandlerConn struct {
+	connect.StreamingHandlerConn
+	logger *zap.SugaredLogger
+}
+
+func (c *loggingHandlerConn) Receive(msg any) error {
+	if err := c.StreamingHandlerConn.Receive(msg); err != nil {
+		return err
+	}
+	c.logger.Debugw("request", "message", msg)
+	return nil
+}
+
+// isHealthcheck returns whether the request is a gRPC health check
+func isHealthcheck(spec connect.Spec) bool {
+	return strings.HasPrefix(spec.Procedure, "/"+grpchealth.HealthV1ServiceName+"/")
+}
+
+// requestCode returns the status code of a request, as used in logs and metrics
+func requestCode(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return connect.CodeOf(err).String()
+}
+
+var (
+	requestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "utxorpc_requests_total",
+			Help: "Total number of UTxO RPC requests, by procedure and status code",
+		},
+		[]string{"procedure", "code"},
+	)
+	requestErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "utxorpc_request_errors_total",
+			Help: "Total number of failed UTxO RPC requests, by procedure and status code",
+		},
+		[]string{"procedure", "code"},
+	)
+	requestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "utxorpc_request_duration_seconds",
+			Help: "Duration of UTxO RPC requests, including the whole life of streams",
+			// Unary requests mostly take milliseconds, while streams can stay open for days
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 12),
+		},
+		[]string{"procedure"},
+	)
+	panicsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "utxorpc_panics_total",
+			Help: "Total number of panics recovered in UTxO RPC handlers",
+		},
+	)
+)
+
+// metricsInterceptor records the latency and outcome of each request
+type metricsInterceptor struct{}
+
+func (i *metricsInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		start := time.Now()
+		resp, err := next(ctx, req)
+		observeRequest(req.Spec(), start, err)
+		return resp, err
+	}
+}
+
+func (i *metricsInterceptor) WrapStreamingClient(
+	next connect.StreamingClientFunc,
+) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *metricsInterceptor) WrapStreamingHandler(
+	next connect.StreamingHandlerFunc,
+) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		start := time.Now()
+		err := next(ctx, conn)
+		observeRequest(conn.Spec(), start, err)
+		return err
+	}
+}
+
+func observeRequest(spec connect.Spec, start time.Time, err error) {
+	code := requestCode(err)
+	requestsTotal.WithLabelValues(spec.Procedure, code).Inc()
+	if err != nil {
+		requestErrorsTotal.WithLabelValues(spec.Procedure, code).Inc()
+	}
+	requestDuration.WithLabelValues(spec.Procedure).Observe(time.Since(start).Seconds())
+}
+
+// recoverInterceptor turns a panic in a handler into an internal error, so that one bad request
+// can't take the server down
+type recoverInterceptor struct{}
+
+func (i *recoverInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (resp connect.AnyResponse, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				resp = nil
+				err = handlePanic(ctx, r)
+			}
+		}()
+		return next(ctx, req)
+	}
+}
+
+func (i *recoverInterceptor) WrapStreamingClient(
+	next connect.StreamingClientFunc,
+) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *recoverInterceptor) WrapStreamingHandler(
+	next connect.StreamingHandlerFunc,
+) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = handlePanic(ctx, r)
+			}
+		}()
+		return next(ctx, conn)
+	}
+}
+
+func handlePanic(ctx context.Context, r any) error {
+	// net/http uses this panic to abort a response, so we let it through
+	if err, ok := r.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+		panic(r)
+	}
+	panicsTotal.Inc()
+	requestLogger(ctx).Errorw(
+		"panic in handler",
+		"panic", r,
+		"stack", string(debug.Stack()),
+	)
+	return connect.NewError(connect.CodeInternal, fmt.Errorf("internal error"))
+}
@@ -0,0 +1,463 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/blinklabs-io/gouroboros/cbor"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	lcommon "github.com/blinklabs-io/gouroboros/ledger/common"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// exUnits is a pair of execution unit values
+type exUnits struct {
+	steps  uint64
+	memory uint64
+}
+
+// protocolParams are the protocol parameters of any era, in the shape of the UTxO RPC PParams
+// message. Parameters that don't exist in an era are left unset
+type protocolParams struct {
+	coinsPerUtxoByte           uint64
+	maxTxSize                  uint64
+	minFeeCoefficient          uint64
+	minFeeConstant             uint64
+	maxBlockBodySize           uint64
+	maxBlockHeaderSize         uint64
+	stakeKeyDeposit            uint64
+	poolDeposit                uint64
+	poolRetirementEpochBound   uint64
+	desiredNumberOfPools       uint64
+	poolInfluence              *big.Rat
+	monetaryExpansion          *big.Rat
+	treasuryExpansion          *big.Rat
+	minPoolCost                uint64
+	protocolMajor              uint64
+	protocolMinor              uint64
+	maxValueSize               uint64
+	collateralPercentage       uint64
+	maxCollateralInputs        uint64
+	costModels                 map[uint64][]int64
+	priceSteps                 *big.Rat
+	priceMemory                *big.Rat
+	maxExUnitsPerTx            *exUnits
+	maxExUnitsPerBlock         *exUnits
+	minFeeScriptRefCostPerByte *big.Rat
+	poolVotingThresholds       []*big.Rat
+	drepVotingThresholds       []*big.Rat
+	minCommitteeSize           uint64
+	committeeTermLimit         uint64
+	govActionValidityPeriod    uint64
+	govActionDeposit           uint64
+	drepDeposit                uint64
+	drepInactivityPeriod       uint64
+}
+
+// newProtocolParams converts the result of a current protocol parameters query
+func newProtocolParams(params any) (*protocolParams, error) {
+	switch p := params.(type) {
+	case ledger.ShelleyProtocolParameters:
+		return newShelleyProtocolParams(p), nil
+	case ledger.AllegraProtocolParameters:
+		return newShelleyProtocolParams(p.ShelleyProtocolParameters), nil
+	case ledger.MaryProtocolParameters:
+		return newShelleyProtocolParams(p.ShelleyProtocolParameters), nil
+	case ledger.AlonzoProtocolParameters:
+		// The coins per UTxO are per 8-byte word in Alonzo
+		ret := newShelleyProtocolParams(p.ShelleyProtocolParameters)
+		ret.minPoolCost = p.MinPoolCost
+		ret.coinsPerUtxoByte = p.AdaPerUtxoByte / 8
+		ret.maxValueSize = uint64(p.MaxValueSize)
+		ret.collateralPercentage = uint64(p.CollateralPercentage)
+		ret.maxCollateralInputs = uint64(p.MaxCollateralInputs)
+		ret.setPlutusParams(p.CostModels, p.ExecutionCosts, p.MaxTxExUnits, p.MaxBlockExUnits)
+		return ret, nil
+	case ledger.BabbageProtocolParameters:
+		return newBabbageProtocolParams(p), nil
+	case ledger.ConwayProtocolParameters:
+		return newConwayProtocolParams(p), nil
+	default:
+		return nil, fmt.Errorf("unsupported protocol parameters type: %T", params)
+	}
+}
+
+func newShelleyProtocolParams(p ledger.ShelleyProtocolParameters) *protocolParams {
+	return &protocolParams{
+		minFeeCoefficient:        uint64(p.MinFeeA),
+		minFeeConstant:           uint64(p.MinFeeB),
+		maxBlockBodySize:         uint64(p.MaxBlockBodySize),
+		maxTxSize:                uint64(p.MaxTxSize),
+		maxBlockHeaderSize:       uint64(p.MaxBlockHeaderSize),
+		stakeKeyDeposit:          uint64(p.KeyDeposit),
+		poolDeposit:              uint64(p.PoolDeposit),
+		poolRetirementEpochBound: uint64(p.MaxEpoch),
+		desiredNumberOfPools:     uint64(p.NOpt),
+		poolInfluence:            ratOrNil(p.A0),
+		monetaryExpansion:        ratOrNil(p.Rho),
+		treasuryExpansion:        ratOrNil(p.Tau),
+		protocolMajor:            uint64(p.ProtocolMajor),
+		protocolMinor:            uint64(p.ProtocolMinor),
+	}
+}
+
+func newBabbageProtocolParams(p ledger.BabbageProtocolParameters) *protocolParams {
+	ret := &protocolParams{
+		minFeeCoefficient:        uint64(p.MinFeeA),
+		minFeeConstant:           uint64(p.MinFeeB),
+		maxBlockBodySize:         uint64(p.MaxBlockBodySize),
+		maxTxSize:                uint64(p.MaxTxSize),
+		maxBlockHeaderSize:       uint64(p.MaxBlockHeaderSize),
+		stakeKeyDeposit:          uint64(p.KeyDeposit),
+		poolDeposit:              uint64(p.PoolDeposit),
+		poolRetirementEpochBound: uint64(p.MaxEpoch),
+		desiredNumberOfPools:     uint64(p.NOpt),
+		poolInfluence:            ratOrNil(p.A0),
+		monetaryExpansion:        ratOrNil(p.Rho),
+		treasuryExpansion:        ratOrNil(p.Tau),
+		protocolMajor:            uint64(p.ProtocolMajor),
+		protocolMinor:            uint64(p.ProtocolMinor),
+		minPoolCost:              p.MinPoolCost,
+		coinsPerUtxoByte:         p.AdaPerUtxoByte,
+		maxValueSize:             uint64(p.MaxValueSize),
+		collateralPercentage:     uint64(p.CollateralPercentage),
+		maxCollateralInputs:      uint64(p.MaxCollateralInputs),
+	}
+	ret.setPlutusParams(p.CostModels, p.ExecutionCosts, p.MaxTxExUnits, p.MaxBlockExUnits)
+	return ret
+}
+
+func newConwayProtocolParams(p ledger.ConwayProtocolParameters) *protocolParams {
+	ret := &protocolParams{
+		minFeeCoefficient:          uint64(p.MinFeeA),
+		minFeeConstant:             uint64(p.MinFeeB),
+		maxBlockBodySize:           uint64(p.MaxBlockBodySize),
+		maxTxSize:                  uint64(p.MaxTxSize),
+		maxBlockHeaderSize:         uint64(p.MaxBlockHeaderSize),
+		stakeKeyDeposit:            uint64(p.KeyDeposit),
+		poolDeposit:                uint64(p.PoolDeposit),
+		poolRetirementEpochBound:   uint64(p.MaxEpoch),
+		desiredNumberOfPools:       uint64(p.NOpt),
+		poolInfluence:              ratOrNil(p.A0),
+		monetaryExpansion:          ratOrNil(p.Rho),
+		treasuryExpansion:          ratOrNil(p.Tau),
+		protocolMajor:              uint64(p.ProtocolVersion.Major),
+		protocolMinor:              uint64(p.ProtocolVersion.Minor),
+		minPoolCost:                p.MinPoolCost,
+		coinsPerUtxoByte:           p.AdaPerUtxoByte,
+		maxValueSize:               uint64(p.MaxValueSize),
+		collateralPercentage:       uint64(p.CollateralPercentage),
+		maxCollateralInputs:        uint64(p.MaxCollateralInputs),
+		minCommitteeSize:           uint64(p.MinCommitteeSize),
+		committeeTermLimit:         p.CommitteeTermLimit,
+		govActionValidityPeriod:    p.GovActionValidityPeriod,
+		govActionDeposit:           p.GovActionDeposit,
+		drepDeposit:                p.DRepDeposit,
+		drepInactivityPeriod:       p.DRepInactivityPeriod,
+		minFeeScriptRefCostPerByte: ratOrNil(p.MinFeeRefScriptCostPerByte),
+	}
+	ret.setPlutusParams(p.CostModels, p.ExecutionCosts, p.MaxTxExUnits, p.MaxBlockExUnits)
+	pool := p.PoolVotingThresholds
+	for _, threshold := range []cbor.Rat{
+		pool.MotionNoConfidence,
+		pool.CommitteeNormal,
+		pool.CommitteeNoConfidence,
+		pool.HardForkInitiation,
+		pool.PpSecurityGroup,
+	} {
+		ret.poolVotingThresholds = append(ret.poolVotingThresholds, ratOrNil(&threshold))
+	}
+	drep := p.DRepVotingThresholds
+	for _, threshold := range []cbor.Rat{
+		drep.MotionNoConfidence,
+		drep.CommitteeNormal,
+		drep.CommitteeNoConfidence,
+		drep.UpdateToConstitution,
+		drep.HardForkInitiation,
+		drep.PpNetworkGroup,
+		drep.PpEconomicGroup,
+		drep.PpTechnicalGroup,
+		drep.PpGovGroup,
+		drep.TreasuryWithdrawal,
+	} {
+		ret.drepVotingThresholds = append(ret.drepVotingThresholds, ratOrNil(&threshold))
+	}
+	return ret
+}
+
+// setPlutusParams sets the cost models, execution prices and execution unit limits from Alonzo on
+func (p *protocolParams) setPlutusParams(
+	costModels map[uint][]int64,
+	prices lcommon.ExUnitPrice,
+	maxTxExUnits lcommon.ExUnit,
+	maxBlockExUnits lcommon.ExUnit,
+) {
+	p.costModels = make(map[uint64][]int64)
+	for version, values := range costModels {
+		p.costModels[uint64(version)] = values
+	}
+	p.priceMemory = ratOrNil(prices.MemPrice)
+	p.priceSteps = ratOrNil(prices.StepPrice)
+	p.maxExUnitsPerTx = newExUnits(maxTxExUnits)
+	p.maxExUnitsPerBlock = newExUnits(maxBlockExUnits)
+}
+
+// newExUnits returns nil for unset execution units, so that they're left out of the message
+func newExUnits(e lcommon.ExUnit) *exUnits {
+	if e.Mem == 0 && e.Steps == 0 {
+		return nil
+	}
+	return &exUnits{
+		memory: uint64(e.Mem),
+		steps:  uint64(e.Steps),
+	}
+}
+
+func ratOrNil(r *cbor.Rat) *big.Rat {
+	if r == nil {
+		return nil
+	}
+	return r.Rat
+}
+
+// pparamsField is a field of the UTxO RPC PParams message
+type pparamsField struct {
+	name   string
+	num    protowire.Number
+	append func(b []byte, num protowire.Number, p *protocolParams) ([]byte, error)
+}
+
+// pparamsFields lists the fields of the PParams message from the UTxO RPC spec, including the
+// ones that our generated code predates
+var pparamsFields = []pparamsField{
+	{"coins_per_utxo_byte", 1, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.coinsPerUtxoByte), nil
+	}},
+	{"max_tx_size", 2, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.maxTxSize), nil
+	}},
+	{"min_fee_coefficient", 3, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.minFeeCoefficient), nil
+	}},
+	{"min_fee_constant", 4, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.minFeeConstant), nil
+	}},
+	{"max_block_body_size", 5, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.maxBlockBodySize), nil
+	}},
+	{"max_block_header_size", 6, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.maxBlockHeaderSize), nil
+	}},
+	{"stake_key_deposit", 7, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.stakeKeyDeposit), nil
+	}},
+	{"pool_deposit", 8, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.poolDeposit), nil
+	}},
+	{"pool_retirement_epoch_bound", 9, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.poolRetirementEpochBound), nil
+	}},
+	{"desired_number_of_pools", 10, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.desiredNumberOfPools), nil
+	}},
+	{"pool_influence", 11, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendRat(b, n, p.poolInfluence)
+	}},
+	{"monetary_expansion", 12, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendRat(b, n, p.monetaryExpansion)
+	}},
+	{"treasury_expansion", 13, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendRat(b, n, p.treasuryExpansion)
+	}},
+	{"min_pool_cost", 14, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.minPoolCost), nil
+	}},
+	{"protocol_version", 15, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		var msg []byte
+		msg = appendUint(msg, 1, p.protocolMajor)
+		msg = appendUint(msg, 2, p.protocolMinor)
+		return appendMessage(b, n, msg), nil
+	}},
+	{"max_value_size", 16, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.maxValueSize), nil
+	}},
+	{"collateral_percentage", 17, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.collateralPercentage), nil
+	}},
+	{"max_collateral_inputs", 18, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.maxCollateralInputs), nil
+	}},
+	{"cost_models", 19, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		if len(p.costModels) == 0 {
+			return b, nil
+		}
+		// The cost models are keyed by Plutus version, starting from 0 for PlutusV1
+		var msg []byte
+		for version := uint64(0); version < 3; version++ {
+			values, ok := p.costModels[version]
+			if !ok {
+				continue
+			}
+			var packed []byte
+			for _, value := range values {
+				packed = protowire.AppendVarint(packed, uint64(value))
+			}
+			var costModel []byte
+			costModel = protowire.AppendTag(costModel, 1, protowire.BytesType)
+			costModel = protowire.AppendBytes(costModel, packed)
+			msg = appendMessage(msg, protowire.Number(version+1), costModel)
+		}
+		return appendMessage(b, n, msg), nil
+	}},
+	{"prices", 20, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		if p.priceSteps == nil && p.priceMemory == nil {
+			return b, nil
+		}
+		msg, err := appendRat(nil, 1, p.priceSteps)
+		if err != nil {
+			return nil, err
+		}
+		msg, err = appendRat(msg, 2, p.priceMemory)
+		if err != nil {
+			return nil, err
+		}
+		return appendMessage(b, n, msg), nil
+	}},
+	{"max_execution_units_per_transaction", 21, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendExUnits(b, n, p.maxExUnitsPerTx), nil
+	}},
+	{"max_execution_units_per_block", 22, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendExUnits(b, n, p.maxExUnitsPerBlock), nil
+	}},
+	{"min_fee_script_ref_cost_per_byte", 23, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendRat(b, n, p.minFeeScriptRefCostPerByte)
+	}},
+	{"pool_voting_thresholds", 24, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendThresholds(b, n, p.poolVotingThresholds)
+	}},
+	{"drep_voting_thresholds", 25, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendThresholds(b, n, p.drepVotingThresholds)
+	}},
+	{"min_committee_size", 26, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.minCommitteeSize), nil
+	}},
+	{"committee_term_limit", 27, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.committeeTermLimit), nil
+	}},
+	{"governance_action_validity_period", 28, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.govActionValidityPeriod), nil
+	}},
+	{"governance_action_deposit", 29, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.govActionDeposit), nil
+	}},
+	{"drep_deposit", 30, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.drepDeposit), nil
+	}},
+	{"drep_inactivity_period", 31, func(b []byte, n protowire.Number, p *protocolParams) ([]byte, error) {
+		return appendUint(b, n, p.drepInactivityPeriod), nil
+	}},
+}
+
+// Utxorpc returns the parameters as a UTxO RPC PParams message, limited to the fields in the
+// field mask if there is one. The Conway governance fields are newer than the PParams message in
+// our generated code, so they're carried as unknown fields, which clients of later spec
+// revisions decode
+func (p *protocolParams) Utxorpc(fieldMask *fieldmaskpb.FieldMask) (*cardano.PParams, error) {
+	mask := newFieldMaskTree(fieldMask)
+	var b []byte
+	for _, field := range pparamsFields {
+		if !mask.selects(field.name) {
+			continue
+		}
+		var err error
+		b, err = field.append(b, field.num, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %s", field.name, err)
+		}
+	}
+	ret := &cardano.PParams{}
+	if err := proto.Unmarshal(b, ret); err != nil {
+		return nil, fmt.Errorf("failed to encode protocol parameters: %s", err)
+	}
+	return ret, nil
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// appendRat appends a RationalNumber message. Its numerator is an int32 and its denominator a
+// uint32, so values that don't fit are an error rather than being wrapped
+func appendRat(b []byte, num protowire.Number, r *big.Rat) ([]byte, error) {
+	if r == nil {
+		return b, nil
+	}
+	if !r.Num().IsInt64() || r.Num().Int64() < math.MinInt32 || r.Num().Int64() > math.MaxInt32 ||
+		!r.Denom().IsUint64() || r.Denom().Uint64() > math.MaxUint32 {
+		return nil, fmt.Errorf("rational %s doesn't fit in a RationalNumber", r.String())
+	}
+	var msg []byte
+	if r.Num().Sign() != 0 {
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(int32(r.Num().Int64())))
+	}
+	msg = appendUint(msg, 2, r.Denom().Uint64())
+	return appendMessage(b, num, msg), nil
+}
+
+// appendExUnits appends an ExUnits message
+func appendExUnits(b []byte, num protowire.Number, units *exUnits) []byte {
+	if units == nil {
+		return b
+	}
+	var msg []byte
+	msg = appendUint(msg, 1, units.steps)
+	msg = appendUint(msg, 2, units.memory)
+	return appendMessage(b, num, msg)
+}
+
+// appendThresholds appends a VotingThresholds message
+func appendThresholds(b []byte, num protowire.Number, thresholds []*big.Rat) ([]byte, error) {
+	if len(thresholds) == 0 {
+		return b, nil
+	}
+	var msg []byte
+	for _, threshold := range thresholds {
+		if threshold == nil {
+			threshold = new(big.Rat)
+		}
+		var err error
+		msg, err = appendRat(msg, 1, threshold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return appendMessage(b, num, msg), nil
+}
@@ -0,0 +1,386 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/blinklabs-io/gouroboros/cbor"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	lcommon "github.com/blinklabs-io/gouroboros/ledger/common"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// conwayProtocolParamsHex is a current protocol parameters query result with the mainnet
+// parameters from the start of the Conway era. The cost models are cut short to keep it readable
+const conwayProtocolParamsHex = "81981f182c1a00025ef51a0001600019400019044c1a001e84801a1dcd6500121901f4d81e82030ad81e82031903e8d8" +
+	"1e8201058209011a0a21fe801910d6a3008a1a0003236119032c01011903e819023b00011903e8195e71018a1a000323" +
+	"6119032c01011903e819023b00011903e8195e71028a1a000189b41901a401011903e818ad00011903e819ea3582d81e" +
+	"82190241192710d81e821902d11a00989680821a00d59f801b00000002540be400821a03b20b801b00000004a817c800" +
+	"19138818960385d81e8218331864d81e8218331864d81e8218331864d81e8218331864d81e82183318648ad81e821843" +
+	"1864d81e820305d81e820305d81e820304d81e820305d81e8218431864d81e8218431864d81e8218431864d81e820304" +
+	"d81e8218431864071892061b000000174876e8001a1dcd650014d81e820f01"
+
+func TestConwayProtocolParams(t *testing.T) {
+	data, err := hex.DecodeString(conwayProtocolParamsHex)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// This is how the query client decodes the parameters in the Conway era
+	result := []ledger.ConwayProtocolParameters{}
+	if _, err := cbor.Decode(data, &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	params, err := newProtocolParams(result[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg, err := params.Utxorpc(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got := &cardano.PParams{}
+	if err := proto.Unmarshal(raw, got); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := &cardano.PParams{
+		CoinsPerUtxoByte:         4310,
+		MaxTxSize:                16384,
+		MinFeeCoefficient:        44,
+		MinFeeConstant:           155381,
+		MaxBlockBodySize:         90112,
+		MaxBlockHeaderSize:       1100,
+		StakeKeyDeposit:          2000000,
+		PoolDeposit:              500000000,
+		PoolRetirementEpochBound: 18,
+		DesiredNumberOfPools:     500,
+		PoolInfluence:            &cardano.RationalNumber{Numerator: 3, Denominator: 10},
+		MonetaryExpansion:        &cardano.RationalNumber{Numerator: 3, Denominator: 1000},
+		TreasuryExpansion:        &cardano.RationalNumber{Numerator: 1, Denominator: 5},
+		MinPoolCost:              170000000,
+		ProtocolVersion:          &cardano.ProtocolVersion{Major: 9, Minor: 1},
+		MaxValueSize:             5000,
+		CollateralPercentage:     150,
+		MaxCollateralInputs:      3,
+		CostModels: &cardano.CostModels{
+			PlutusV1: &cardano.CostModel{
+				Values: []int64{205665, 812, 1, 1, 1000, 571, 0, 1, 1000, 24177},
+			},
+			PlutusV2: &cardano.CostModel{
+				Values: []int64{205665, 812, 1, 1, 1000, 571, 0, 1, 1000, 24177},
+			},
+			PlutusV3: &cardano.CostModel{
+				Values: []int64{100788, 420, 1, 1, 1000, 173, 0, 1, 1000, 59957},
+			},
+		},
+		Prices: &cardano.ExPrices{
+			Steps:  &cardano.RationalNumber{Numerator: 721, Denominator: 10000000},
+			Memory: &cardano.RationalNumber{Numerator: 577, Denominator: 10000},
+		},
+		MaxExecutionUnitsPerTransaction: &cardano.ExUnits{
+			Steps:  10000000000,
+			Memory: 14000000,
+		},
+		MaxExecutionUnitsPerBlock: &cardano.ExUnits{
+			Steps:  20000000000,
+			Memory: 62000000,
+		},
+	}
+	gotMsg := got.ProtoReflect()
+	wantMsg := want.ProtoReflect()
+	fields := wantMsg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		gotField := gotMsg.New()
+		if gotMsg.Has(fd) {
+			gotField.Set(fd, gotMsg.Get(fd))
+		}
+		wantField := wantMsg.New()
+		if wantMsg.Has(fd) {
+			wantField.Set(fd, wantMsg.Get(fd))
+		}
+		if !proto.Equal(gotField.Interface(), wantField.Interface()) {
+			t.Errorf("%s: got %v, wanted %v", fd.Name(), gotField, wantField)
+		}
+	}
+
+	// The governance parameters are newer than the v0.10 spec, so we read them off the wire
+	governance := map[protowire.Number][]byte{}
+	b := got.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("unexpected error: %s", protowire.ParseError(n))
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			t.Fatalf("unexpected error: %s", protowire.ParseError(n))
+		}
+		governance[num] = b[:n]
+		b = b[n:]
+	}
+	wantUints := map[protowire.Number]uint64{
+		26: 7,
+		27: 146,
+		28: 6,
+		29: 100000000000,
+		30: 500000000,
+		31: 20,
+	}
+	for num, wantValue := range wantUints {
+		value, n := protowire.ConsumeVarint(governance[num])
+		if n < 0 || value != wantValue {
+			t.Errorf("field %d: got %d, wanted %d", num, value, wantValue)
+		}
+	}
+	minFeeRefScript := &cardano.RationalNumber{}
+	if err := unmarshalBytesField(governance[23], minFeeRefScript); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !proto.Equal(minFeeRefScript, &cardano.RationalNumber{Numerator: 15, Denominator: 1}) {
+		t.Errorf("min_fee_script_ref_cost_per_byte: got %v", minFeeRefScript)
+	}
+	wantThresholds := map[protowire.Number][]*big.Rat{
+		24: {
+			big.NewRat(51, 100),
+			big.NewRat(51, 100),
+			big.NewRat(51, 100),
+			big.NewRat(51, 100),
+			big.NewRat(51, 100),
+		},
+		25: {
+			big.NewRat(67, 100),
+			big.NewRat(3, 5),
+			big.NewRat(3, 5),
+			big.NewRat(3, 4),
+			big.NewRat(3, 5),
+			big.NewRat(67, 100),
+			big.NewRat(67, 100),
+			big.NewRat(67, 100),
+			big.NewRat(3, 4),
+			big.NewRat(67, 100),
+		},
+	}
+	for num, wantValues := range wantThresholds {
+		values := thresholdValues(t, governance[num])
+		if len(values) != len(wantValues) {
+			t.Errorf("field %d: got %d thresholds, wanted %d", num, len(values), len(wantValues))
+			continue
+		}
+		for i, value := range values {
+			if value.Cmp(wantValues[i]) != 0 {
+				t.Errorf("field %d threshold %d: got %s, wanted %s", num, i, value, wantValues[i])
+			}
+		}
+	}
+}
+
+// unmarshalBytesField unmarshals the value of a length-delimited field
+func unmarshalBytesField(b []byte, msg proto.Message) error {
+	value, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return protowire.ParseError(n)
+	}
+	return proto.Unmarshal(value, msg)
+}
+
+// thresholdValues returns the thresholds in the value of a VotingThresholds field
+func thresholdValues(t *testing.T, b []byte) []*big.Rat {
+	t.Helper()
+	msg, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		t.Fatalf("unexpected error: %s", protowire.ParseError(n))
+	}
+	var ret []*big.Rat
+	for len(msg) > 0 {
+		_, _, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			t.Fatalf("unexpected error: %s", protowire.ParseError(n))
+		}
+		msg = msg[n:]
+		threshold := &cardano.RationalNumber{}
+		if err := unmarshalBytesField(msg, threshold); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		_, n = protowire.ConsumeBytes(msg)
+		msg = msg[n:]
+		ret = append(ret, big.NewRat(int64(threshold.Numerator), int64(threshold.Denominator)))
+	}
+	return ret
+}
+
+func TestEraProtocolParams(t *testing.T) {
+	shelley := ledger.ShelleyProtocolParameters{
+		MinFeeA:       44,
+		MinFeeB:       155381,
+		A0:            &cbor.Rat{Rat: big.NewRat(3, 10)},
+		ProtocolMajor: 6,
+	}
+	tests := []struct {
+		name   string
+		params any
+		want   *cardano.PParams
+	}{
+		{
+			name:   "shelley",
+			params: shelley,
+			want: &cardano.PParams{
+				MinFeeCoefficient: 44,
+				MinFeeConstant:    155381,
+				PoolInfluence:     &cardano.RationalNumber{Numerator: 3, Denominator: 10},
+				ProtocolVersion:   &cardano.ProtocolVersion{Major: 6},
+			},
+		},
+		{
+			name: "alonzo",
+			params: ledger.AlonzoProtocolParameters{
+				MaryProtocolParameters: ledger.MaryProtocolParameters{
+					AllegraProtocolParameters: ledger.AllegraProtocolParameters{
+						ShelleyProtocolParameters: shelley,
+					},
+				},
+				MinPoolCost:          340000000,
+				AdaPerUtxoByte:       34482,
+				MaxValueSize:         5000,
+				CollateralPercentage: 150,
+				MaxCollateralInputs:  3,
+			},
+			want: &cardano.PParams{
+				CoinsPerUtxoByte:     4310,
+				MinFeeCoefficient:    44,
+				MinFeeConstant:       155381,
+				PoolInfluence:        &cardano.RationalNumber{Numerator: 3, Denominator: 10},
+				MinPoolCost:          340000000,
+				ProtocolVersion:      &cardano.ProtocolVersion{Major: 6},
+				MaxValueSize:         5000,
+				CollateralPercentage: 150,
+				MaxCollateralInputs:  3,
+			},
+		},
+		{
+			name: "babbage",
+			params: ledger.BabbageProtocolParameters{
+				MinFeeA:        44,
+				ProtocolMajor:  8,
+				AdaPerUtxoByte: 4310,
+				CostModels: map[uint][]int64{
+					0: {205665, 812},
+					1: {205665, -1},
+				},
+				ExecutionCosts: lcommon.ExUnitPrice{
+					MemPrice:  &cbor.Rat{Rat: big.NewRat(577, 10000)},
+					StepPrice: &cbor.Rat{Rat: big.NewRat(721, 10000000)},
+				},
+				MaxTxExUnits:    lcommon.ExUnit{Mem: 14000000, Steps: 10000000000},
+				MaxBlockExUnits: lcommon.ExUnit{Mem: 62000000, Steps: 20000000000},
+			},
+			want: &cardano.PParams{
+				CoinsPerUtxoByte:  4310,
+				MinFeeCoefficient: 44,
+				ProtocolVersion:   &cardano.ProtocolVersion{Major: 8},
+				CostModels: &cardano.CostModels{
+					PlutusV1: &cardano.CostModel{Values: []int64{205665, 812}},
+					PlutusV2: &cardano.CostModel{Values: []int64{205665, -1}},
+				},
+				Prices: &cardano.ExPrices{
+					Steps:  &cardano.RationalNumber{Numerator: 721, Denominator: 10000000},
+					Memory: &cardano.RationalNumber{Numerator: 577, Denominator: 10000},
+				},
+				MaxExecutionUnitsPerTransaction: &cardano.ExUnits{
+					Steps:  10000000000,
+					Memory: 14000000,
+				},
+				MaxExecutionUnitsPerBlock: &cardano.ExUnits{
+					Steps:  20000000000,
+					Memory: 62000000,
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := newProtocolParams(test.params)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			msg, err := params.Utxorpc(nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			raw, err := proto.Marshal(msg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := &cardano.PParams{}
+			if err := proto.Unmarshal(raw, got); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !proto.Equal(got, test.want) {
+				t.Fatalf("got %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAppendRatRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   *big.Rat
+		wantErr bool
+	}{
+		{name: "in range", value: big.NewRat(577, 10000)},
+		{name: "negative", value: big.NewRat(-1, 2)},
+		{name: "smallest numerator", value: big.NewRat(-(1 << 31), 1)},
+		{name: "largest denominator", value: big.NewRat(1, 1<<32-1)},
+		{name: "numerator too large", value: big.NewRat(1<<31, 1), wantErr: true},
+		{name: "denominator too large", value: big.NewRat(1, 1<<32+1), wantErr: true},
+		{
+			name:    "numerator beyond int64",
+			value:   new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), 80)),
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := appendRat(nil, 1, test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("did not get expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := &cardano.RationalNumber{}
+			if err := unmarshalBytesField(b[1:], got); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			value := big.NewRat(int64(got.Numerator), int64(got.Denominator))
+			if value.Cmp(test.value) != 0 {
+				t.Fatalf("got %s, wanted %s", value, test.value)
+			}
+		})
+	}
+}
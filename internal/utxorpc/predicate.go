@@ -0,0 +1,406 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/blinklabs-io/gouroboros/ledger"
+	lcommon "github.com/blinklabs-io/gouroboros/ledger/common"
+	ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	query "github.com/utxorpc/go-codegen/utxorpc/v1alpha/query"
+	submit "github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit"
+	watch "github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/utxoindex"
+)
+
+// outputResolver looks up the output spent by a transaction input. It returns nil if the
+// output isn't known
+type outputResolver func(input ledger.TransactionInput) ledger.TransactionOutput
+
+// txPredicate is a transaction predicate. The watch and submit modules each have their own
+// (identical) predicate message, which we convert to this so that they can share the matching
+type txPredicate struct {
+	match *cardano.TxPattern
+	not   []*txPredicate
+	allOf []*txPredicate
+	anyOf []*txPredicate
+}
+
+// newWatchTxPredicate converts a WatchTx predicate. It returns nil for a nil predicate
+func newWatchTxPredicate(predicate *watch.TxPredicate) *txPredicate {
+	if predicate == nil {
+		return nil
+	}
+	ret := &txPredicate{
+		match: predicate.GetMatch().GetCardano(),
+	}
+	for _, p := range predicate.GetNot() {
+		ret.not = append(ret.not, newWatchTxPredicate(p))
+	}
+	for _, p := range predicate.GetAllOf() {
+		ret.allOf = append(ret.allOf, newWatchTxPredicate(p))
+	}
+	for _, p := range predicate.GetAnyOf() {
+		ret.anyOf = append(ret.anyOf, newWatchTxPredicate(p))
+	}
+	return ret
+}
+
+// newSubmitTxPredicate converts a WatchMempool predicate. It returns nil for a nil predicate
+func newSubmitTxPredicate(predicate *submit.TxPredicate) *txPredicate {
+	if predicate == nil {
+		return nil
+	}
+	ret := &txPredicate{
+		match: predicate.GetMatch().GetCardano(),
+	}
+	for _, p := range predicate.GetNot() {
+		ret.not = append(ret.not, newSubmitTxPredicate(p))
+	}
+	for _, p := range predicate.GetAllOf() {
+		ret.allOf = append(ret.allOf, newSubmitTxPredicate(p))
+	}
+	for _, p := range predicate.GetAnyOf() {
+		ret.anyOf = append(ret.anyOf, newSubmitTxPredicate(p))
+	}
+	return ret
+}
+
+// matches evaluates the predicate. A predicate matches when its pattern matches, none of its
+// "not" predicates match, all of its "all_of" predicates match and, if there are any, at least
+// one of its "any_of" predicates matches. A nil predicate matches everything
+func (p *txPredicate) matches(
+	tx ledger.Transaction,
+	resolve outputResolver,
+) bool {
+	if p == nil {
+		return true
+	}
+	if !matchTxPattern(p.match, tx, resolve) {
+		return false
+	}
+	for _, pred := range p.not {
+		if pred.matches(tx, resolve) {
+			return false
+		}
+	}
+	for _, pred := range p.allOf {
+		if !pred.matches(tx, resolve) {
+			return false
+		}
+	}
+	if len(p.anyOf) > 0 {
+		for _, pred := range p.anyOf {
+			if pred.matches(tx, resolve) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// needsConsumed returns whether evaluating the predicate needs the outputs spent by a
+// transaction, which have to be looked up in the ledger
+func (p *txPredicate) needsConsumed() bool {
+	if p == nil {
+		return false
+	}
+	if p.match.GetConsumes() != nil ||
+		p.match.GetHasAddress() != nil ||
+		p.match.GetMovesAsset() != nil {
+		return true
+	}
+	for _, preds := range [][]*txPredicate{p.not, p.allOf, p.anyOf} {
+		for _, pred := range preds {
+			if pred.needsConsumed() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchUtxoPredicate evaluates a SearchUtxos predicate against an output, with the same rules
+// as a transaction predicate
+func matchUtxoPredicate(
+	predicate *query.UtxoPredicate,
+	output ledger.TransactionOutput,
+) bool {
+	if predicate == nil {
+		return true
+	}
+	if !matchOutputPattern(predicate.GetMatch().GetCardano(), output) {
+		return false
+	}
+	for _, p := range predicate.GetNot() {
+		if matchUtxoPredicate(p, output) {
+			return false
+		}
+	}
+	for _, p := range predicate.GetAllOf() {
+		if !matchUtxoPredicate(p, output) {
+			return false
+		}
+	}
+	if len(predicate.GetAnyOf()) > 0 {
+		for _, p := range predicate.GetAnyOf() {
+			if matchUtxoPredicate(p, output) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchTxPattern checks a transaction against every criteria set in the pattern
+func matchTxPattern(
+	pattern *cardano.TxPattern,
+	tx ledger.Transaction,
+	resolve outputResolver,
+) bool {
+	if pattern == nil {
+		return true
+	}
+	consumed := resolveConsumed(tx, resolve)
+	produced := []ledger.TransactionOutput{}
+	for _, utxo := range tx.Produced() {
+		produced = append(produced, utxo.Output)
+	}
+	if p := pattern.GetConsumes(); p != nil {
+		if !anyOutputMatches(p, consumed) {
+			return false
+		}
+	}
+	if p := pattern.GetProduces(); p != nil {
+		if !anyOutputMatches(p, produced) {
+			return false
+		}
+	}
+	if p := pattern.GetHasAddress(); p != nil {
+		found := false
+		for _, output := range append(consumed, produced...) {
+			if matchAddressPattern(p, output.Address()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p := pattern.GetMovesAsset(); p != nil {
+		found := false
+		for _, output := range append(consumed, produced...) {
+			if matchAssetPattern(p, output.Assets()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p := pattern.GetMintsAsset(); p != nil {
+		if !matchAssetPattern(p, tx.AssetMint()) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOutputPattern checks a transaction output against the address and asset patterns
+func matchOutputPattern(
+	pattern *cardano.TxOutputPattern,
+	output ledger.TransactionOutput,
+) bool {
+	if pattern == nil {
+		return true
+	}
+	if p := pattern.GetAddress(); p != nil {
+		if !matchAddressPattern(p, output.Address()) {
+			return false
+		}
+	}
+	if p := pattern.GetAsset(); p != nil {
+		if !matchAssetPattern(p, output.Assets()) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAddressPattern checks an address against the exact address or its payment and
+// delegation parts
+func matchAddressPattern(pattern *cardano.AddressPattern, addr ledger.Address) bool {
+	addrBytes := addr.Bytes()
+	if exact := pattern.GetExactAddress(); len(exact) > 0 {
+		if !bytes.Equal(exact, addrBytes) {
+			return false
+		}
+	}
+	paymentPart, delegationPart := utxoindex.AddressParts(addrBytes)
+	if payment := pattern.GetPaymentPart(); len(payment) > 0 {
+		if !bytes.Equal(payment, paymentPart) {
+			return false
+		}
+	}
+	if delegation := pattern.GetDelegationPart(); len(delegation) > 0 {
+		if !bytes.Equal(delegation, delegationPart) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAssetPattern checks whether any asset matches the policy ID and asset name in the pattern
+func matchAssetPattern[T ledger.MultiAssetTypeOutput | ledger.MultiAssetTypeMint](
+	pattern *cardano.AssetPattern,
+	assets *lcommon.MultiAsset[T],
+) bool {
+	if assets == nil {
+		return false
+	}
+	for _, policyId := range assets.Policies() {
+		if len(pattern.GetPolicyId()) > 0 &&
+			!bytes.Equal(pattern.GetPolicyId(), policyId.Bytes()) {
+			continue
+		}
+		for _, assetName := range assets.Assets(policyId) {
+			if len(pattern.GetAssetName()) > 0 &&
+				!bytes.Equal(pattern.GetAssetName(), assetName) {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func anyOutputMatches(
+	pattern *cardano.TxOutputPattern,
+	outputs []ledger.TransactionOutput,
+) bool {
+	for _, output := range outputs {
+		if matchOutputPattern(pattern, output) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConsumed returns the outputs spent by a transaction, as far as they can be resolved
+func resolveConsumed(
+	tx ledger.Transaction,
+	resolve outputResolver,
+) []ledger.TransactionOutput {
+	ret := []ledger.TransactionOutput{}
+	if resolve == nil {
+		return ret
+	}
+	for _, input := range tx.Consumed() {
+		if output := resolve(input); output != nil {
+			ret = append(ret, output)
+		}
+	}
+	return ret
+}
+
+// resolvedOutputs holds the outputs spent by a set of transactions, keyed by tx hash and index
+type resolvedOutputs map[string]ledger.TransactionOutput
+
+func resolvedOutputKey(txHash string, index uint32) string {
+	return fmt.Sprintf("%s#%d", txHash, index)
+}
+
+func (r resolvedOutputs) resolve(input ledger.TransactionInput) ledger.TransactionOutput {
+	return r[resolvedOutputKey(input.Id().String(), input.Index())]
+}
+
+// producedOutputs returns the outputs produced by the given transactions
+func producedOutputs(txs []ledger.Transaction) resolvedOutputs {
+	ret := make(resolvedOutputs)
+	for _, tx := range txs {
+		for _, utxo := range utxoindex.ProducedOutputs(tx) {
+			ret[resolvedOutputKey(tx.Hash(), utxo.Index)] = utxo.Output
+		}
+	}
+	return ret
+}
+
+// resolveInputs looks up the outputs spent by the given transactions in the ledger state at the
+// given point, or at the tip if it's nil. Outputs produced by the transactions themselves are
+// resolved without asking the node, since a transaction can spend an output from earlier in the
+// same block or from another transaction in the mempool
+func resolveInputs(
+	ctx context.Context,
+	point *ocommon.Point,
+	txs []ledger.Transaction,
+) (resolvedOutputs, error) {
+	ret := producedOutputs(txs)
+	txIns := []ledger.TransactionInput{}
+	for _, tx := range txs {
+		for _, input := range tx.Consumed() {
+			key := resolvedOutputKey(input.Id().String(), input.Index())
+			if _, ok := ret[key]; ok {
+				continue
+			}
+			txIns = append(txIns, input)
+		}
+	}
+	if len(txIns) == 0 {
+		return ret, nil
+	}
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalStateQueryAt(point)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(txIns); start += readUtxosBatchSize {
+		end := min(start+readUtxosBatchSize, len(txIns))
+		utxos, err := client.GetUTxOByTxIn(txIns[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for utxoId, utxo := range utxos.Results {
+			output := utxo
+			ret[resolvedOutputKey(utxoId.Hash.String(), uint32(utxoId.Idx))] = &output
+		}
+	}
+	return ret, nil
+}
+
+// unresolvable returns whether a failure to resolve inputs should leave them unresolved rather
+// than ending the stream. That's the case when the node no longer has the ledger state we need,
+// or when it's too busy to ask
+func unresolvable(err error) bool {
+	var tooOldErr node.PointTooOldError
+	var notOnChainErr node.PointNotOnChainError
+	return skipPoll(err) ||
+		errors.As(err, &tooOldErr) ||
+		errors.As(err, &notOnChainErr)
+}
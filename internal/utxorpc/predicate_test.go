@@ -0,0 +1,234 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/blinklabs-io/gouroboros/ledger"
+	lcommon "github.com/blinklabs-io/gouroboros/ledger/common"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	watch "github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch"
+)
+
+// predicateTx is a transaction with just enough to be matched against a predicate
+type predicateTx struct {
+	ledger.Transaction
+	hash     []byte
+	consumed []ledger.TransactionInput
+	produced []ledger.TransactionOutput
+}
+
+func (t predicateTx) Hash() string                        { return hex.EncodeToString(t.hash) }
+func (t predicateTx) IsValid() bool                       { return true }
+func (t predicateTx) Outputs() []ledger.TransactionOutput { return t.produced }
+func (t predicateTx) Consumed() []ledger.TransactionInput { return t.consumed }
+
+func (t predicateTx) Produced() []ledger.Utxo {
+	ret := []ledger.Utxo{}
+	for idx, output := range t.produced {
+		ret = append(
+			ret,
+			ledger.Utxo{
+				Id:     ledger.NewShelleyTransactionInput(t.Hash(), idx),
+				Output: output,
+			},
+		)
+	}
+	return ret
+}
+
+func (t predicateTx) AssetMint() *lcommon.MultiAsset[lcommon.MultiAssetTypeMint] {
+	return nil
+}
+
+// testAddress returns a base address with payment and delegation parts filled with the given
+// bytes
+func testAddress(t *testing.T, payment byte, delegation byte) ledger.Address {
+	t.Helper()
+	addr, err := ledger.NewAddressFromParts(
+		ledger.AddressTypeKeyKey,
+		1,
+		bytes.Repeat([]byte{payment}, lcommon.AddressHashSize),
+		bytes.Repeat([]byte{delegation}, lcommon.AddressHashSize),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error building address: %s", err)
+	}
+	return addr
+}
+
+func testOutput(addr ledger.Address) ledger.TransactionOutput {
+	return &ledger.BabbageTransactionOutput{
+		OutputAddress: addr,
+		OutputAmount:  ledger.MaryTransactionOutputValue{Amount: 2000000},
+	}
+}
+
+func testInput(hash []byte, index uint32) ledger.TransactionInput {
+	return ledger.ShelleyTransactionInput{
+		TxId:        ledger.NewBlake2b256(hash),
+		OutputIndex: index,
+	}
+}
+
+func testPredicate(pattern *cardano.TxPattern) *watch.TxPredicate {
+	return &watch.TxPredicate{
+		Match: &watch.AnyChainTxPattern{
+			Chain: &watch.AnyChainTxPattern_Cardano{Cardano: pattern},
+		},
+	}
+}
+
+func TestTxPredicateMatches(t *testing.T) {
+	alice := testAddress(t, 0x01, 0x02)
+	bob := testAddress(t, 0x03, 0x04)
+	aliceOnly := &cardano.AddressPattern{ExactAddress: alice.Bytes()}
+	bobPayment := &cardano.AddressPattern{PaymentPart: bytes.Repeat([]byte{0x03}, lcommon.AddressHashSize)}
+	// A transaction that spends an output at Alice's address and pays Bob
+	spentHash := bytes.Repeat([]byte{0xaa}, 32)
+	tx := predicateTx{
+		hash:     bytes.Repeat([]byte{0xbb}, 32),
+		consumed: []ledger.TransactionInput{testInput(spentHash, 1)},
+		produced: []ledger.TransactionOutput{testOutput(bob)},
+	}
+	resolved := resolvedOutputs{
+		resolvedOutputKey(hex.EncodeToString(spentHash), 1): testOutput(alice),
+	}
+	tests := []struct {
+		name       string
+		predicate  *watch.TxPredicate
+		resolve    outputResolver
+		wantMatch  bool
+		wantLookup bool
+	}{
+		{
+			name:      "no predicate",
+			predicate: nil,
+			wantMatch: true,
+		},
+		{
+			name:      "produces",
+			predicate: testPredicate(&cardano.TxPattern{Produces: &cardano.TxOutputPattern{Address: bobPayment}}),
+			wantMatch: true,
+		},
+		{
+			name:      "produces other address",
+			predicate: testPredicate(&cardano.TxPattern{Produces: &cardano.TxOutputPattern{Address: aliceOnly}}),
+			wantMatch: false,
+		},
+		{
+			name:       "consumes resolved input",
+			predicate:  testPredicate(&cardano.TxPattern{Consumes: &cardano.TxOutputPattern{Address: aliceOnly}}),
+			resolve:    resolved.resolve,
+			wantMatch:  true,
+			wantLookup: true,
+		},
+		{
+			name:       "consumes unresolved input",
+			predicate:  testPredicate(&cardano.TxPattern{Consumes: &cardano.TxOutputPattern{Address: aliceOnly}}),
+			wantMatch:  false,
+			wantLookup: true,
+		},
+		{
+			name:       "has address of resolved input",
+			predicate:  testPredicate(&cardano.TxPattern{HasAddress: aliceOnly}),
+			resolve:    resolved.resolve,
+			wantMatch:  true,
+			wantLookup: true,
+		},
+		{
+			name:       "has address of output",
+			predicate:  testPredicate(&cardano.TxPattern{HasAddress: bobPayment}),
+			wantMatch:  true,
+			wantLookup: true,
+		},
+		{
+			name: "not",
+			predicate: &watch.TxPredicate{
+				Not: []*watch.TxPredicate{
+					testPredicate(&cardano.TxPattern{HasAddress: aliceOnly}),
+				},
+			},
+			resolve:    resolved.resolve,
+			wantMatch:  false,
+			wantLookup: true,
+		},
+		{
+			name: "all of",
+			predicate: &watch.TxPredicate{
+				AllOf: []*watch.TxPredicate{
+					testPredicate(&cardano.TxPattern{Consumes: &cardano.TxOutputPattern{Address: aliceOnly}}),
+					testPredicate(&cardano.TxPattern{Produces: &cardano.TxOutputPattern{Address: aliceOnly}}),
+				},
+			},
+			resolve:    resolved.resolve,
+			wantMatch:  false,
+			wantLookup: true,
+		},
+		{
+			name: "any of",
+			predicate: &watch.TxPredicate{
+				AnyOf: []*watch.TxPredicate{
+					testPredicate(&cardano.TxPattern{Produces: &cardano.TxOutputPattern{Address: aliceOnly}}),
+					testPredicate(&cardano.TxPattern{Produces: &cardano.TxOutputPattern{Address: bobPayment}}),
+				},
+			},
+			wantMatch: true,
+		},
+		{
+			name: "any of with none matching",
+			predicate: &watch.TxPredicate{
+				AnyOf: []*watch.TxPredicate{
+					testPredicate(&cardano.TxPattern{Produces: &cardano.TxOutputPattern{Address: aliceOnly}}),
+				},
+			},
+			wantMatch: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pred := newWatchTxPredicate(test.predicate)
+			if match := pred.matches(tx, test.resolve); match != test.wantMatch {
+				t.Fatalf("got match %t, wanted %t", match, test.wantMatch)
+			}
+			if lookup := pred.needsConsumed(); lookup != test.wantLookup {
+				t.Fatalf("got needsConsumed %t, wanted %t", lookup, test.wantLookup)
+			}
+		})
+	}
+}
+
+func TestProducedOutputsResolveChainedTx(t *testing.T) {
+	addr := testAddress(t, 0x05, 0x06)
+	first := predicateTx{
+		hash:     bytes.Repeat([]byte{0x01}, 32),
+		produced: []ledger.TransactionOutput{testOutput(addr), testOutput(addr)},
+	}
+	second := predicateTx{
+		hash:     bytes.Repeat([]byte{0x02}, 32),
+		consumed: []ledger.TransactionInput{testInput(first.hash, 1), testInput(first.hash, 2)},
+	}
+	resolved := producedOutputs([]ledger.Transaction{first, second})
+	consumed := resolveConsumed(second, resolved.resolve)
+	if len(consumed) != 1 {
+		t.Fatalf("got %d resolved inputs, wanted 1", len(consumed))
+	}
+	if !bytes.Equal(consumed[0].Address().Bytes(), addr.Bytes()) {
+		t.Fatalf("resolved input has the wrong address")
+	}
+}
@@ -15,18 +15,26 @@
 package utxorpc
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
 	connect "connectrpc.com/connect"
 	"github.com/blinklabs-io/gouroboros/ledger"
-	// ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
+	ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
 	query "github.com/utxorpc/go-codegen/utxorpc/v1alpha/query"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
 
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/querycache"
+	"github.com/blinklabs-io/cardano-node-api/internal/utxoindex"
 )
 
 // queryServiceServer implements the WatchService API
@@ -41,49 +49,108 @@ func (s *queryServiceServer) ReadParams(
 ) (*connect.Response[query.ReadParamsResponse], error) {
 
 	fieldMask := req.Msg.GetFieldMask()
-	log.Printf("Got a ReadParams request with fieldMask %v", fieldMask)
-	resp := &query.ReadParamsResponse{}
-
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	atPoint, err := requestLedgerPoint(req.Header())
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
+	resp := &query.ReadParamsResponse{}
 
 	// Get protoParams
-	protoParams, err := oConn.LocalStateQuery().Client.GetCurrentProtocolParams()
+	protoParams, err := querycache.ProtocolParams(ctx, atPoint)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return nil, err
+		return nil, ledgerPointError(err)
 	}
 
 	// Get chain point (slot and hash)
-	point, err := oConn.LocalStateQuery().Client.GetChainPoint()
+	var point ocommon.Point
+	if atPoint != nil {
+		point = *atPoint
+	} else {
+		point, err = ledgerTip(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	params, err := newProtocolParams(protoParams.Value)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
+	cardanoParams, err := params.Utxorpc(fieldMask)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
 	var acp query.AnyChainParams
-	// var acpc query.AnyChainParams_Cardano
-	acpc := &query.AnyChainParams_Cardano{}
-	log.Printf("protocol parameters: %v", protoParams)
-	// acpc.Cardano = protoParams.Utxorpc()
+	acpc := &query.AnyChainParams_Cardano{
+		Cardano: cardanoParams,
+	}
 	resp.LedgerTip = &query.ChainPoint{
 		Slot: point.Slot,
 		Hash: point.Hash,
 	}
-	// acp.Params = &acpc
 	acp.Params = acpc
 	resp.Values = &acp
 	return connect.NewResponse(resp), nil
 }
 
+// ledgerTip returns the tip we're tracking, or asks the node if we don't know it yet
+func ledgerTip(ctx context.Context) (ocommon.Point, error) {
+	if point := node.BestTip(); point.Slot > 0 {
+		return point, nil
+	}
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return ocommon.Point{}, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalStateQuery()
+	if err != nil {
+		return ocommon.Point{}, err
+	}
+	point, err := client.GetChainPoint()
+	if err != nil {
+		return ocommon.Point{}, err
+	}
+	return *point, nil
+}
+
+// ledgerPointHeader is the request header for querying the ledger state at a recent point rather
+// than the tip, as <slot>.<block hash>. The UTxO RPC spec doesn't have a request field for it
+const ledgerPointHeader = "Ledger-Point"
+
+// requestLedgerPoint returns the ledger point from the request headers, or nil for the tip
+func requestLedgerPoint(header http.Header) (*ocommon.Point, error) {
+	value := header.Get(ledgerPointHeader)
+	if value == "" {
+		return nil, nil
+	}
+	point, err := node.ParsePoint(value)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return point, nil
+}
+
+// ledgerPointError turns a failure to acquire the requested ledger point into an error with a
+// matching code
+func ledgerPointError(err error) error {
+	var tooOldErr node.PointTooOldError
+	if errors.As(err, &tooOldErr) {
+		return connect.NewError(connect.CodeOutOfRange, err)
+	}
+	var notOnChainErr node.PointNotOnChainError
+	if errors.As(err, &notOnChainErr) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+	return err
+}
+
+// readUtxosBatchSize is the maximum number of UTxOs looked up in a single LocalStateQuery
+const readUtxosBatchSize = 1000
+
+// missingTxoRefsHeader is the response header listing the requested UTxOs that weren't found,
+// as comma-separated <tx hash>#<output index>
+const missingTxoRefsHeader = "Missing-Txo-Refs"
+
 // ReadUtxos
 func (s *queryServiceServer) ReadUtxos(
 	ctx context.Context,
@@ -91,68 +158,137 @@ func (s *queryServiceServer) ReadUtxos(
 ) (*connect.Response[query.ReadUtxosResponse], error) {
 
 	keys := req.Msg.GetKeys() // []*TxoRef
-	log.Printf("Got a ReadUtxos request with keys %v", keys)
-	resp := &query.ReadUtxosResponse{}
-
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	fieldMask := req.Msg.GetFieldMask()
+	mask := newFieldMaskTree(fieldMask)
+	atPoint, err := requestLedgerPoint(req.Header())
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
+	resp := &query.ReadUtxosResponse{}
 
 	// Setup our query input
 	var tmpTxIns []ledger.TransactionInput
+	seen := make(map[string]bool)
 	for _, txo := range keys {
-		// txo.Hash, txo.Index
+		if len(txo.GetHash()) != len(ledger.Blake2b256{}) {
+			return nil, connect.NewError(
+				connect.CodeInvalidArgument,
+				fmt.Errorf("invalid tx hash: %x", txo.GetHash()),
+			)
+		}
+		key := txoRefKey(txo.GetHash(), txo.GetIndex())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
 		tmpTxIn := ledger.ShelleyTransactionInput{
-			TxId:        ledger.Blake2b256(txo.Hash),
-			OutputIndex: uint32(txo.Index),
+			TxId:        ledger.Blake2b256(txo.GetHash()),
+			OutputIndex: txo.GetIndex(),
 		}
 		tmpTxIns = append(tmpTxIns, tmpTxIn)
 	}
 
-	// Get UTxOs
-	utxos, err := oConn.LocalStateQuery().Client.GetUTxOByTxIn(tmpTxIns)
+	// Lease node connection
+	oConn, err := node.LeaseConnection(ctx)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
+	defer oConn.Return()
+	// Acquire ledger state
+	client, err := oConn.AcquireLocalStateQueryAt(atPoint)
+	if err != nil {
+		return nil, ledgerPointError(err)
+	}
+
+	// Get UTxOs, in batches so that large requests don't make for huge queries. All of the
+	// batches run against the same acquired ledger state
+	found := make(map[string]ledger.BabbageTransactionOutput)
+	for start := 0; start < len(tmpTxIns); start += readUtxosBatchSize {
+		end := min(start+readUtxosBatchSize, len(tmpTxIns))
+		utxos, err := client.GetUTxOByTxIn(tmpTxIns[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for utxoId, utxo := range utxos.Results {
+			found[txoRefKey(utxoId.Hash.Bytes(), uint32(utxoId.Idx))] = utxo
+		}
+	}
 
 	// Get chain point (slot and hash)
-	point, err := oConn.LocalStateQuery().Client.GetChainPoint()
+	point, err := client.GetChainPoint()
 	if err != nil {
-		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
 
+	// Build our items in request order
+	var missing []string
 	for _, txo := range keys {
-		for utxoId, utxo := range utxos.Results {
-			var aud query.AnyUtxoData
-			var audc query.AnyUtxoData_Cardano
-			aud.TxoRef = txo
-			txHash := hex.EncodeToString(txo.Hash)
-			if utxoId.Hash.String() == txHash &&
-				uint32(utxoId.Idx) == txo.Index {
-				aud.NativeBytes = utxo.Cbor()
-				audc.Cardano = utxo.Utxorpc()
-				aud.ParsedState = &audc
-			}
-			resp.Items = append(resp.Items, &aud)
+		key := txoRefKey(txo.GetHash(), txo.GetIndex())
+		utxo, ok := found[key]
+		if !ok {
+			missing = append(missing, key)
+			continue
 		}
+		parsed := utxo.Utxorpc()
+		mask.apply(parsed)
+		resp.Items = append(
+			resp.Items,
+			&query.AnyUtxoData{
+				TxoRef:      txo,
+				NativeBytes: utxo.Cbor(),
+				ParsedState: &query.AnyUtxoData_Cardano{
+					Cardano: parsed,
+				},
+			},
+		)
 	}
 	resp.LedgerTip = &query.ChainPoint{
 		Slot: point.Slot,
 		Hash: point.Hash,
 	}
-	return connect.NewResponse(resp), nil
+	ret := connect.NewResponse(resp)
+	if len(missing) > 0 {
+		requestLogger(ctx).Debugw("UTxOs not found", "refs", missing)
+		ret.Header().Set(missingTxoRefsHeader, strings.Join(missing, ","))
+	}
+	return ret, nil
+}
+
+// txoRefKey returns the <tx hash>#<output index> form of a UTxO reference
+func txoRefKey(hash []byte, index uint32) string {
+	return fmt.Sprintf("%x#%d", hash, index)
+}
+
+// parseTxoRefKey parses the <tx hash>#<output index> form of a UTxO reference
+func parseTxoRefKey(key string) ([]byte, uint32, error) {
+	hashHex, indexStr, ok := strings.Cut(key, "#")
+	if !ok {
+		return nil, 0, fmt.Errorf("missing output index")
+	}
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err := strconv.ParseUint(indexStr, 10, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash, uint32(index), nil
+}
+
+// compareTxoRefs orders UTxO references by tx hash and then output index
+func compareTxoRefs(hashA []byte, indexA uint32, hashB []byte, indexB uint32) int {
+	if c := bytes.Compare(hashA, hashB); c != 0 {
+		return c
+	}
+	return cmp.Compare(indexA, indexB)
 }
 
+const (
+	defaultSearchUtxosMaxItems = 100
+	maxSearchUtxosMaxItems     = 1000
+)
+
 // SearchUtxos
 func (s *queryServiceServer) SearchUtxos(
 	ctx context.Context,
@@ -160,70 +296,260 @@ func (s *queryServiceServer) SearchUtxos(
 ) (*connect.Response[query.SearchUtxosResponse], error) {
 
 	predicate := req.Msg.GetPredicate() // UtxoPredicate
-	log.Printf("Got a SearchUtxos request with predicate %v", predicate)
+	fieldMask := req.Msg.GetFieldMask()
+	maxItems := req.Msg.GetMaxItems()
+	startToken := req.Msg.GetStartToken()
+	mask := newFieldMaskTree(fieldMask)
+	atPoint, err := requestLedgerPoint(req.Header())
+	if err != nil {
+		return nil, err
+	}
 	resp := &query.SearchUtxosResponse{}
 
 	if predicate == nil {
-		return nil, fmt.Errorf("ERROR: empty predicate: %v", predicate)
-	}
-	addresses := []ledger.Address{}
-	addressPattern := predicate.GetMatch().GetCardano().GetAddress()
-	if addressPattern != nil {
-		if addressPattern.GetExactAddress() != nil {
-			address, err := ledger.NewAddress(
-				hex.EncodeToString(addressPattern.GetExactAddress()),
+		return nil, connect.NewError(
+			connect.CodeInvalidArgument,
+			fmt.Errorf("ERROR: empty predicate: %v", predicate),
+		)
+	}
+	if maxItems <= 0 {
+		maxItems = defaultSearchUtxosMaxItems
+	}
+	maxItems = min(maxItems, maxSearchUtxosMaxItems)
+	var startHash []byte
+	var startIndex uint32
+	if startToken != "" {
+		startHash, startIndex, err = parseTxoRefKey(startToken)
+		if err != nil {
+			return nil, connect.NewError(
+				connect.CodeInvalidArgument,
+				fmt.Errorf("invalid start token: %s", err),
 			)
-			if err != nil {
-				return nil, err
-			}
-			addresses = append(addresses, address)
 		}
-		// TODO: GetPaymentPart() GetDelegationPart()
 	}
 
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Work out where to find the UTxOs that can match
+	lookups, ok := utxoLookups(predicate)
+	if !ok {
+		return nil, connect.NewError(
+			connect.CodeInvalidArgument,
+			fmt.Errorf(
+				"predicate must match on an address, payment part, delegation part or policy ID",
+			),
+		)
+	}
+	var utxos []*utxoindex.Utxo
+	var point *ocommon.Point
+	if addresses, ok := lookupAddresses(lookups); ok {
+		// The node can look up exact addresses for us
+		utxos, point, err = searchUtxosByAddress(ctx, atPoint, addresses)
+	} else if atPoint != nil {
+		return nil, connect.NewError(
+			connect.CodeInvalidArgument,
+			fmt.Errorf(
+				"the %s header is only supported for searches by address, the UTxO index only has the tip",
+				ledgerPointHeader,
+			),
+		)
+	} else if index := utxoindex.GetUtxoIndex(); index != nil {
+		utxos, point, err = searchUtxoIndex(index, lookups)
+	} else {
+		return nil, connect.NewError(
+			connect.CodeFailedPrecondition,
+			fmt.Errorf(
+				"searching by payment part, delegation part or asset requires the UTxO index",
+			),
+		)
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-	// Start client
-	oConn.LocalStateQuery().Client.Start()
+
+	// Filter and sort the UTxOs, so that we can page through them
+	matches := []*utxoindex.Utxo{}
+	for _, utxo := range utxos {
+		if matchUtxoPredicate(predicate, utxo.Output) {
+			matches = append(matches, utxo)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return compareTxoRefs(matches[i].TxHash, matches[i].Index, matches[j].TxHash, matches[j].Index) < 0
+	})
+	for _, utxo := range matches {
+		if startToken != "" &&
+			compareTxoRefs(utxo.TxHash, utxo.Index, startHash, startIndex) <= 0 {
+			continue
+		}
+		if len(resp.Items) == int(maxItems) {
+			last := resp.Items[len(resp.Items)-1].GetTxoRef()
+			resp.NextToken = txoRefKey(last.GetHash(), last.GetIndex())
+			break
+		}
+		parsed := utxo.Output.Utxorpc()
+		mask.apply(parsed)
+		resp.Items = append(
+			resp.Items,
+			&query.AnyUtxoData{
+				TxoRef: &query.TxoRef{
+					Hash:  utxo.TxHash,
+					Index: utxo.Index,
+				},
+				NativeBytes: utxo.Output.Cbor(),
+				ParsedState: &query.AnyUtxoData_Cardano{
+					Cardano: parsed,
+				},
+			},
+		)
+	}
+	resp.LedgerTip = &query.ChainPoint{
+		Slot: point.Slot,
+		Hash: point.Hash,
+	}
+	return connect.NewResponse(resp), nil
+}
+
+// utxoLookup is one way of finding candidate UTxOs: by exact address, payment part, delegation
+// part or policy ID
+type utxoLookup struct {
+	address        []byte
+	paymentPart    []byte
+	delegationPart []byte
+	policyId       []byte
+}
+
+// utxoLookups returns lookups that together find every UTxO the predicate can match. It returns
+// false if the predicate isn't narrow enough for that
+func utxoLookups(predicate *query.UtxoPredicate) ([]utxoLookup, bool) {
+	if pattern := predicate.GetMatch().GetCardano(); pattern != nil {
+		addressPattern := pattern.GetAddress()
+		switch {
+		case len(addressPattern.GetExactAddress()) > 0:
+			return []utxoLookup{{address: addressPattern.GetExactAddress()}}, true
+		case len(addressPattern.GetPaymentPart()) > 0:
+			return []utxoLookup{{paymentPart: addressPattern.GetPaymentPart()}}, true
+		case len(addressPattern.GetDelegationPart()) > 0:
+			return []utxoLookup{{delegationPart: addressPattern.GetDelegationPart()}}, true
+		case len(pattern.GetAsset().GetPolicyId()) > 0:
+			return []utxoLookup{{policyId: pattern.GetAsset().GetPolicyId()}}, true
+		}
+	}
+	// Any of the predicates that must all match will do
+	for _, p := range predicate.GetAllOf() {
+		if lookups, ok := utxoLookups(p); ok {
+			return lookups, true
+		}
+	}
+	// Otherwise we need to be able to find the matches for each alternative
+	if len(predicate.GetAnyOf()) == 0 {
+		return nil, false
+	}
+	var ret []utxoLookup
+	for _, p := range predicate.GetAnyOf() {
+		lookups, ok := utxoLookups(p)
+		if !ok {
+			return nil, false
+		}
+		ret = append(ret, lookups...)
+	}
+	return ret, true
+}
+
+// lookupAddresses returns the addresses to look up if all of the lookups are by exact address
+func lookupAddresses(lookups []utxoLookup) ([]ledger.Address, bool) {
+	ret := []ledger.Address{}
+	for _, lookup := range lookups {
+		if lookup.address == nil {
+			return nil, false
+		}
+		address, err := ledger.NewAddress(hex.EncodeToString(lookup.address))
+		if err != nil {
+			return nil, false
+		}
+		ret = append(ret, address)
+	}
+	return ret, true
+}
+
+// searchUtxosByAddress gets the UTxOs at the given addresses from the node
+func searchUtxosByAddress(
+	ctx context.Context,
+	atPoint *ocommon.Point,
+	addresses []ledger.Address,
+) ([]*utxoindex.Utxo, *ocommon.Point, error) {
+	// Lease node connection
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer oConn.Return()
+	// Acquire ledger state
+	client, err := oConn.AcquireLocalStateQueryAt(atPoint)
+	if err != nil {
+		return nil, nil, ledgerPointError(err)
+	}
 
 	// Get UTxOs
-	utxos, err := oConn.LocalStateQuery().Client.GetUTxOByAddress(addresses)
+	utxos, err := client.GetUTxOByAddress(addresses)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Get chain point (slot and hash)
-	point, err := oConn.LocalStateQuery().Client.GetChainPoint()
+	point, err := client.GetChainPoint()
 	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return nil, err
+		return nil, nil, err
 	}
 
+	ret := []*utxoindex.Utxo{}
 	for utxoId, utxo := range utxos.Results {
-		var aud query.AnyUtxoData
-		var audc query.AnyUtxoData_Cardano
-		aud.TxoRef = &query.TxoRef{
-			Hash:  utxoId.Hash.Bytes(),
-			Index: uint32(utxoId.Idx),
+		utxo := utxo
+		ret = append(
+			ret,
+			&utxoindex.Utxo{
+				TxHash: utxoId.Hash.Bytes(),
+				Index:  uint32(utxoId.Idx),
+				Output: &utxo,
+			},
+		)
+	}
+	return ret, point, nil
+}
+
+// searchUtxoIndex gets the UTxOs for the lookups from the UTxO index
+func searchUtxoIndex(
+	index *utxoindex.UtxoIndex,
+	lookups []utxoLookup,
+) ([]*utxoindex.Utxo, *ocommon.Point, error) {
+	ret := []*utxoindex.Utxo{}
+	seen := make(map[string]bool)
+	for _, lookup := range lookups {
+		var utxos []*utxoindex.Utxo
+		var err error
+		switch {
+		case lookup.address != nil:
+			utxos, err = index.GetUtxosByAddress(lookup.address)
+		case lookup.paymentPart != nil:
+			utxos, err = index.GetUtxosByPaymentPart(lookup.paymentPart)
+		case lookup.delegationPart != nil:
+			utxos, err = index.GetUtxosByDelegationPart(lookup.delegationPart)
+		case lookup.policyId != nil:
+			utxos, err = index.GetUtxosByPolicy(lookup.policyId)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, utxo := range utxos {
+			key := txoRefKey(utxo.TxHash, utxo.Index)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			ret = append(ret, utxo)
 		}
-		aud.NativeBytes = utxo.Cbor()
-		audc.Cardano = utxo.Utxorpc()
-		aud.ParsedState = &audc
-		resp.Items = append(resp.Items, &aud)
 	}
-	resp.LedgerTip = &query.ChainPoint{
-		Slot: point.Slot,
-		Hash: point.Hash,
+	point, err := index.Tip()
+	if err != nil {
+		return nil, nil, err
 	}
-	return connect.NewResponse(resp), nil
+	return ret, &point, nil
 }
-
-// StreamUtxos
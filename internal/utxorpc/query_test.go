@@ -0,0 +1,97 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	query "github.com/utxorpc/go-codegen/utxorpc/v1alpha/query"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/query/queryconnect"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestSearchUtxosJSONCodec(t *testing.T) {
+	server, recorder := newTestServer(t)
+	predicate := &query.UtxoPredicate{
+		Match: &query.AnyUtxoPattern{
+			UtxoPattern: &query.AnyUtxoPattern_Cardano{
+				Cardano: &cardano.TxOutputPattern{
+					Asset: &cardano.AssetPattern{
+						PolicyId: []byte{0x33},
+					},
+				},
+			},
+		},
+	}
+	fieldMask := &fieldmaskpb.FieldMask{Paths: []string{"address", "coin"}}
+	tests := []struct {
+		name        string
+		req         *query.SearchUtxosRequest
+		wantCode    connect.Code
+		wantMessage string
+	}{
+		{
+			name: "paging and field mask",
+			req: &query.SearchUtxosRequest{
+				Predicate:  predicate,
+				FieldMask:  fieldMask,
+				MaxItems:   25,
+				StartToken: txoRefKey([]byte{0xab, 0xcd}, 3),
+			},
+			wantCode:    connect.CodeFailedPrecondition,
+			wantMessage: "requires the UTxO index",
+		},
+		{
+			name: "invalid start token",
+			req: &query.SearchUtxosRequest{
+				Predicate:  predicate,
+				MaxItems:   25,
+				StartToken: "abcd",
+			},
+			wantCode:    connect.CodeInvalidArgument,
+			wantMessage: "invalid start token",
+		},
+	}
+	for _, protocol := range clientProtocols {
+		protocol := protocol
+		client := queryconnect.NewQueryServiceClient(
+			server.Client(),
+			server.URL,
+			append(protocol.options, connect.WithProtoJSON())...,
+		)
+		for _, test := range tests {
+			test := test
+			t.Run(protocol.name+"/"+test.name, func(t *testing.T) {
+				_, err := client.SearchUtxos(context.Background(), connect.NewRequest(test.req))
+				if code := connect.CodeOf(err); code != test.wantCode {
+					t.Fatalf("got code %s, wanted %s: %v", code, test.wantCode, err)
+				}
+				if !strings.Contains(err.Error(), test.wantMessage) {
+					t.Fatalf("got error %q, wanted it to contain %q", err, test.wantMessage)
+				}
+				// The paging fields and the field mask are decoded from JSON too
+				received := <-recorder.received
+				if !proto.Equal(received, test.req) {
+					t.Fatalf("handler got %v, wanted %v", received, test.req)
+				}
+			})
+		}
+	}
+}
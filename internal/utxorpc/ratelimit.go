@@ -0,0 +1,104 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+	"github.com/blinklabs-io/cardano-node-api/internal/ratelimit"
+)
+
+// limitInterceptor applies the per-key and per-IP rate limits, and turns node bulkhead
+// rejections into ResourceExhausted errors. Both carry a hint for when to retry. Health checks
+// aren't rate limited, so that load balancers polling often don't take a server out of service
+type limitInterceptor struct{}
+
+func (i *limitInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if err := checkRateLimit(req.Spec(), req.Peer(), req.Header()); err != nil {
+			return nil, err
+		}
+		resp, err := next(ctx, req)
+		return resp, limitError(err)
+	}
+}
+
+func (i *limitInterceptor) WrapStreamingClient(
+	next connect.StreamingClientFunc,
+) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *limitInterceptor) WrapStreamingHandler(
+	next connect.StreamingHandlerFunc,
+) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		err := checkRateLimit(conn.Spec(), conn.Peer(), conn.RequestHeader())
+		if err != nil {
+			return err
+		}
+		return limitError(next(ctx, conn))
+	}
+}
+
+func checkRateLimit(spec connect.Spec, peer connect.Peer, header http.Header) error {
+	if isHealthcheck(spec) {
+		return nil
+	}
+	ip := peer.Addr
+	if host, _, err := net.SplitHostPort(peer.Addr); err == nil {
+		ip = host
+	}
+	allowed, retryAfter := ratelimit.Allow(apiKeyName(header), ip)
+	if !allowed {
+		return resourceExhausted(
+			fmt.Errorf("rate limit exceeded, try again later"),
+			retryAfter,
+		)
+	}
+	return nil
+}
+
+// limitError turns a node bulkhead rejection into a ResourceExhausted error
+func limitError(err error) error {
+	var bulkheadErr node.BulkheadFullError
+	if errors.As(err, &bulkheadErr) {
+		return resourceExhausted(err, bulkheadErr.RetryAfter)
+	}
+	return err
+}
+
+// resourceExhausted returns a ResourceExhausted error with the retry delay as both standard
+// RetryInfo error details and a Retry-After header
+func resourceExhausted(err error, retryAfter time.Duration) error {
+	connectErr := connect.NewError(connect.CodeResourceExhausted, err)
+	if detail, err := connect.NewErrorDetail(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+	); err == nil {
+		connectErr.AddDetail(detail)
+	}
+	connectErr.Meta().Set("Retry-After", ratelimit.RetryAfter(retryAfter))
+	return connectErr
+}
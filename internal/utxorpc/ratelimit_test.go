@@ -0,0 +1,93 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+func TestLimitError(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantCode      connect.Code
+		wantRetry     time.Duration
+		wantRetryHint string
+	}{
+		{
+			name: "bulkhead full",
+			err: fmt.Errorf(
+				"failed to lease connection: %w",
+				node.BulkheadFullError{
+					Protocol:   node.ProtocolLocalStateQuery,
+					RetryAfter: 1500 * time.Millisecond,
+				},
+			),
+			wantCode:      connect.CodeResourceExhausted,
+			wantRetry:     1500 * time.Millisecond,
+			wantRetryHint: "2",
+		},
+		{
+			name:     "other failure",
+			err:      connect.NewError(connect.CodeNotFound, errors.New("not found")),
+			wantCode: connect.CodeNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := limitError(test.err)
+			if code := connect.CodeOf(err); code != test.wantCode {
+				t.Fatalf("got code %s, wanted %s", code, test.wantCode)
+			}
+			if test.wantRetryHint == "" {
+				if err != test.err {
+					t.Fatalf("got error %v, wanted it passed on unchanged", err)
+				}
+				return
+			}
+			var connectErr *connect.Error
+			if !errors.As(err, &connectErr) {
+				t.Fatalf("got error %v, wanted a connect error", err)
+			}
+			if got := connectErr.Meta().Get("Retry-After"); got != test.wantRetryHint {
+				t.Fatalf("got Retry-After %q, wanted %q", got, test.wantRetryHint)
+			}
+			var retryInfo *errdetails.RetryInfo
+			for _, detail := range connectErr.Details() {
+				value, err := detail.Value()
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if info, ok := value.(*errdetails.RetryInfo); ok {
+					retryInfo = info
+				}
+			}
+			if retryInfo == nil || retryInfo.GetRetryDelay().AsDuration() != test.wantRetry {
+				t.Fatalf("got retry info %v, wanted a delay of %s", retryInfo, test.wantRetry)
+			}
+		})
+	}
+	if err := limitError(nil); err != nil {
+		t.Fatalf("got error %v for a successful call", err)
+	}
+}
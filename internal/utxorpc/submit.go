@@ -15,20 +15,26 @@
 package utxorpc
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"sort"
+	"time"
 
 	connect "connectrpc.com/connect"
 	"github.com/blinklabs-io/adder/event"
 	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/cbor"
 	"github.com/blinklabs-io/gouroboros/ledger"
-	ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
 	submit "github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit/submitconnect"
 	"golang.org/x/crypto/blake2b"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/blockstore"
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
 )
 
@@ -45,18 +51,18 @@ func (s *submitServiceServer) SubmitTx(
 
 	// txRawList
 	txRawList := req.Msg.GetTx() // []*AnyChainTx
-	log.Printf("Got a SubmitTx request with %d transactions", len(txRawList))
 	resp := &submit.SubmitTxResponse{}
 
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// Lease node connection
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalTxSubmission()
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
 
 	// Loop through the transactions and submit each
 	errorList := make([]error, len(txRawList))
@@ -79,7 +85,7 @@ func (s *submitServiceServer) SubmitTx(
 			continue
 		}
 		// Submit the transaction
-		err = oConn.LocalTxSubmission().Client.SubmitTx(
+		err = client.SubmitTx(
 			uint16(txType),
 			txRawBytes,
 		)
@@ -97,6 +103,7 @@ func (s *submitServiceServer) SubmitTx(
 			continue
 		}
 		resp.Ref = append(resp.Ref, txHexBytes)
+		recordSubmittedTx(tx.Hash())
 	}
 	if hasError {
 		return connect.NewResponse(resp), fmt.Errorf("%v", errorList)
@@ -112,140 +119,201 @@ func (s *submitServiceServer) WaitForTx(
 ) error {
 
 	ref := req.Msg.GetRef() // [][]byte
-	log.Printf("Got a WaitForTx request with %d transactions", len(ref))
+
+	cfg := config.GetConfig()
+	tracker := newTxTracker(ref, uint64(cfg.Utxorpc.ConfirmationDepth))
 
 	// Setup event channel
 	eventChan := make(chan event.Event, 10)
-	connCfg := node.ConnectionConfig{
-		ChainSyncEventChan: eventChan,
-	}
-	// Connect to node
-	oConn, err := node.GetConnection(&connCfg)
+
+	// Start the sync with the node as far back as the chain-sync buffer goes, so that we see the
+	// blocks of transactions that made it on chain before we were called
+	syncSub, err := node.SubscribeChainSyncRecent(eventChan, math.MaxUint64)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
+	defer syncSub.Close()
+	backlog := syncSub.Backlog()
 
-	// Get our starting point
-	var point ocommon.Point
-	tip, err := oConn.ChainSync().Client.GetCurrentTip()
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return err
+	pollInterval := time.Duration(cfg.Utxorpc.MempoolPollInterval) * time.Second
+	if pollInterval == 0 {
+		pollInterval = time.Second
 	}
-	point = tip.Point
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lostTimeout := time.Duration(cfg.Utxorpc.WaitForTxTimeout) * time.Second
 
-	// Start the sync with the node
-	err = oConn.ChainSync().Client.Sync([]ocommon.Point{point})
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return err
+	// sendUpdates sends any stage changes and returns true once every transaction is confirmed
+	sendUpdates := func() (bool, error) {
+		for _, resp := range tracker.updates() {
+			if err := stream.Send(resp); err != nil {
+				return false, err
+			}
+			requestLogger(ctx).Debugw(
+				"transaction stage changed",
+				"hash", hex.EncodeToString(resp.Ref),
+				"stage", resp.Stage.String(),
+			)
+		}
+		return tracker.done(), nil
 	}
 
-	// Wait for events
-	for {
-		evt, ok := <-eventChan
-		if !ok {
-			log.Printf("ERROR: channel closed")
-			return fmt.Errorf("ERROR: channel closed")
+	// caughtUp looks for anything the replay didn't find, once it's over, so that clients get the
+	// current stage
+	caughtUp := func() error {
+		checkBlockStore(ctx, tracker)
+		if err := checkMempool(ctx, tracker); err != nil && !skipPoll(err) {
+			return err
+		}
+		return nil
+	}
+	if backlog == 0 {
+		if err := caughtUp(); err != nil {
+			return err
 		}
+		if done, err := sendUpdates(); done || err != nil {
+			return err
+		}
+	}
 
-		switch v := evt.Payload.(type) {
-		case input_chainsync.TransactionEvent:
-			for _, r := range ref {
-				resp := &submit.WaitForTxResponse{}
-				resp.Ref = r
-				resp.Stage = submit.Stage_STAGE_UNSPECIFIED
-				tc := evt.Context.(input_chainsync.TransactionContext)
-				// taken from gOuroboros generateTransactionHash
-				tmpHash, err := blake2b.New256(nil)
-				if err != nil {
-					return err
-				}
-				tmpHash.Write(r)
-				txHash := hex.EncodeToString(tmpHash.Sum(nil))
-				// Compare against our event's hash
-				if txHash == v.Transaction.Hash() {
-					resp.Stage = submit.Stage_STAGE_CONFIRMED
-					// Send it!
-					err = stream.Send(resp)
-					if err != nil {
+	// Wait for events
+	for {
+		select {
+		case evt := <-eventChan:
+			switch v := evt.Payload.(type) {
+			case input_chainsync.BlockEvent:
+				tracker.applyBlock(v.Block)
+			case input_chainsync.RollbackEvent:
+				tracker.rollback(v.SlotNumber)
+				// Rolled back transactions are probably back in the mempool
+				if backlog == 0 {
+					if err := checkMempool(ctx, tracker); err != nil && !skipPoll(err) {
 						return err
 					}
-					log.Printf(
-						"transaction: id: %d, hash: %s",
-						tc.TransactionIdx,
-						tc.TransactionHash,
+				}
+			}
+			// We don't report anything until the replay is over, as the stages it goes through
+			// are out of date
+			if backlog > 0 {
+				backlog--
+				if backlog > 0 {
+					continue
+				}
+				if err := caughtUp(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if backlog > 0 {
+				continue
+			}
+			if err := checkMempool(ctx, tracker); err != nil && !skipPoll(err) {
+				return err
+			}
+			if lostTimeout > 0 {
+				if tx := tracker.lost(lostTimeout); tx != nil {
+					return connect.NewError(
+						connect.CodeNotFound,
+						fmt.Errorf(
+							"transaction %s not found in the mempool or on chain",
+							tx.hash,
+						),
 					)
 				}
 			}
+		case <-syncSub.Done():
+			return syncSub.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if done, err := sendUpdates(); done || err != nil {
+			return err
+		}
+	}
+}
+
+// checkMempool updates which of the tracked transactions are in the node's mempool, using a
+// fresh snapshot on a pooled connection
+func checkMempool(ctx context.Context, tracker *txTracker) error {
+	pending := tracker.pendingMempool()
+	if len(pending) == 0 {
+		return nil
+	}
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalTxMonitor()
+	if err != nil {
+		return err
+	}
+	for _, tx := range pending {
+		hasTx, err := client.HasTx(tx.ref)
+		if err != nil {
+			return err
+		}
+		tracker.setInMempool(tx, hasTx)
+	}
+	return nil
+}
+
+// checkBlockStore marks the tracked transactions that the block store has in a block. This finds
+// transactions that made it on chain before the blocks we replayed, as long as the block store
+// is enabled and still has their blocks
+func checkBlockStore(ctx context.Context, tracker *txTracker) {
+	store := blockstore.GetBlockStore()
+	if store == nil {
+		return
+	}
+	for _, tx := range tracker.pendingMempool() {
+		block, err := store.GetTxBlock(tx.ref)
+		if err != nil {
+			if !errors.Is(err, blockstore.ErrBlockNotFound) {
+				requestLogger(ctx).Warnw(
+					"failed to look up transaction in the block store",
+					"hash", tx.hash,
+					"error", err,
+				)
+			}
+			continue
 		}
+		tracker.applyStoredBlock(block)
 	}
 }
 
-// ReadMempool
+// skipPoll returns whether a failed mempool poll can wait for the next tick rather than ending
+// the stream. Streams poll for a long time, so they shouldn't give up when the node is busy
+func skipPoll(err error) bool {
+	var bulkheadErr node.BulkheadFullError
+	return errors.As(err, &bulkheadErr)
+}
+
+// ReadMempool returns the transactions in the mempool
 func (s *submitServiceServer) ReadMempool(
 	ctx context.Context,
 	req *connect.Request[submit.ReadMempoolRequest],
 ) (*connect.Response[submit.ReadMempoolResponse], error) {
-
-	// This is GetTxs until https://github.com/utxorpc/spec/pull/95
-	txim := req.Msg.GetTxs() // []*TxInMempool
-	log.Printf("Got a ReadMempool request with %d transactions", len(txim))
-	resp := &submit.ReadMempoolResponse{}
-
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	snapshot, err := readMempoolSnapshot(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
-
-	// Start LocalTxMonitor client
-	oConn.LocalTxMonitor().Client.Start()
-
-	// Collect TX hashes from the mempool
-	mempool := []*submit.TxInMempool{}
-	for {
-		txRawBytes, err := oConn.LocalTxMonitor().Client.NextTx()
+	resp := &submit.ReadMempoolResponse{}
+	for _, raw := range snapshot {
+		tx, err := parseTx(raw)
 		if err != nil {
-			log.Printf("ERROR: %s", err)
-			return nil, err
+			return nil, connect.NewError(connect.CodeInternal, err)
 		}
-		// No transactions in mempool
-		if txRawBytes == nil {
-			break
-		}
-		var act submit.AnyChainTx
-		var actr submit.AnyChainTx_Raw
-		actr.Raw = txRawBytes
-		act.Type = &actr
-		record := &submit.TxInMempool{
-			Tx:    &act,
-			Stage: submit.Stage_STAGE_MEMPOOL,
-		}
-		mempool = append(mempool, record)
-	}
-
-	// Check each requested Tx against our mempool
-	for _, txi := range txim {
-		txi.Stage = submit.Stage_STAGE_UNSPECIFIED
-		for _, tx := range mempool {
-			if txi.Stage == submit.Stage_STAGE_MEMPOOL {
-				break
-			}
-			if txi.Tx.String() == tx.Tx.String() {
-				txi.Stage = submit.Stage_STAGE_MEMPOOL
-			}
+		item, err := newTxInMempool(raw, tx, submit.Stage_STAGE_MEMPOOL)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
 		}
-		resp.Stage = append(resp.Stage, txi.Stage)
+		resp.Items = append(resp.Items, item)
 	}
+	// The snapshot doesn't keep the mempool order, so at least keep ours stable
+	sort.Slice(resp.Items, func(i, j int) bool {
+		return bytes.Compare(resp.Items[i].Ref, resp.Items[j].Ref) < 0
+	})
 	return connect.NewResponse(resp), nil
 }
 
@@ -257,84 +325,296 @@ func (s *submitServiceServer) WatchMempool(
 ) error {
 
 	predicate := req.Msg.GetPredicate() // Predicate
+	txPred := newSubmitTxPredicate(predicate)
 	fieldMask := req.Msg.GetFieldMask()
-	log.Printf(
-		"Got a WatchMempool request with predicate %v and fieldMask %v",
-		predicate,
-		fieldMask,
-	)
-
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
+	// The paths are relative to TxInMempool
+	mask := newMempoolFieldMaskTree(fieldMask)
+
+	// Follow the chain, so that we can tell confirmed transactions from evicted ones
+	eventChan := make(chan event.Event, 10)
+	syncSub, err := node.SubscribeChainSync(eventChan, nil)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
+	defer syncSub.Close()
+
+	cfg := config.GetConfig()
+	pollInterval := time.Duration(cfg.Utxorpc.MempoolPollInterval) * time.Second
+	if pollInterval == 0 {
+		pollInterval = time.Second
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	// Transactions in the last mempool snapshot, so that each one is only parsed and matched once
+	view := newMempoolView()
+	// Transactions we've sent, keyed by hash
+	sent := make(map[string]*mempoolTx)
+	// Transactions that have left the mempool without showing up in a block yet, along with the
+	// number of polls we've been waiting for them
+	removed := make(map[string]int)
 
-	// Start clients
-	oConn.LocalTxMonitor().Client.Start()
+	sendStage := func(tx *mempoolTx, stage submit.Stage) error {
+		item, err := newTxInMempool(tx.raw, tx.tx, stage)
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+		resp := &submit.WatchMempoolResponse{
+			Tx: item,
+		}
+		mask.apply(resp.Tx)
+		return stream.Send(resp)
+	}
 
-	// Collect TX hashes from the mempool
-	needsAcquire := false
 	for {
-		if needsAcquire {
-			err = oConn.LocalTxMonitor().Client.Acquire()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-syncSub.Done():
+			return syncSub.Err()
+		case evt := <-eventChan:
+			be, ok := evt.Payload.(input_chainsync.BlockEvent)
+			if !ok {
+				continue
+			}
+			for _, tx := range be.Block.Transactions() {
+				record, ok := sent[tx.Hash()]
+				if !ok {
+					continue
+				}
+				record.confirmed = true
+				// The transaction already left the mempool, so we were just waiting for this
+				if _, ok := removed[tx.Hash()]; ok {
+					if err := sendStage(record, submit.Stage_STAGE_CONFIRMED); err != nil {
+						return err
+					}
+					delete(removed, tx.Hash())
+					delete(sent, tx.Hash())
+				}
+			}
+		case <-ticker.C:
+			snapshot, err := readMempoolSnapshot(ctx)
 			if err != nil {
-				log.Printf("ERROR: %s", err)
+				if skipPoll(err) {
+					continue
+				}
 				return err
 			}
-		}
-		txRawBytes, err := oConn.LocalTxMonitor().Client.NextTx()
-		if err != nil {
-			log.Printf("ERROR: %s", err)
-			return err
-		}
-		// No transactions in mempool, release and continue
-		if txRawBytes == nil {
-			err := oConn.LocalTxMonitor().Client.Release()
+			added, err := view.update(snapshot)
 			if err != nil {
-				log.Printf("ERROR: %s", err)
 				return err
 			}
-			needsAcquire = true
-			continue
+			resolve, err := resolveMempoolInputs(ctx, txPred, view, added)
+			if err != nil {
+				return err
+			}
+			// Send any new transactions that match our predicate
+			for _, tx := range added {
+				if !txPred.matches(tx.tx, resolve) {
+					continue
+				}
+				if err := sendStage(tx, submit.Stage_STAGE_MEMPOOL); err != nil {
+					return err
+				}
+				sent[tx.hash] = tx
+			}
+			// Report transactions that have left the mempool
+			for hash, tx := range sent {
+				if _, ok := snapshot[hash]; ok {
+					delete(removed, hash)
+					continue
+				}
+				if tx.confirmed {
+					if err := sendStage(tx, submit.Stage_STAGE_CONFIRMED); err != nil {
+						return err
+					}
+					delete(removed, hash)
+					delete(sent, hash)
+					continue
+				}
+				// The block including it may not have reached us yet, so we wait a few polls
+				// before deciding that it was evicted. There's no stage for dropped transactions,
+				// so they're reported as unspecified
+				removed[hash]++
+				if removed[hash] > mempoolEvictionPolls {
+					if err := sendStage(tx, submit.Stage_STAGE_UNSPECIFIED); err != nil {
+						return err
+					}
+					delete(removed, hash)
+					delete(sent, hash)
+				}
+			}
 		}
+	}
+}
 
-		txType, err := ledger.DetermineTransactionType(txRawBytes)
+// mempoolEvictionPolls is the number of polls a transaction can be missing from the mempool
+// without appearing in a block before we report it as evicted
+const mempoolEvictionPolls = 3
+
+// mempoolTx is a transaction seen in the mempool
+type mempoolTx struct {
+	hash      string
+	raw       []byte
+	tx        ledger.Transaction
+	confirmed bool
+}
+
+// mempoolView is the set of transactions in the last mempool snapshot. Transactions are parsed
+// when they first show up, and forgotten when they leave the mempool
+type mempoolView struct {
+	seen  map[string]*mempoolTx
+	parse func(raw []byte) (ledger.Transaction, error)
+}
+
+func newMempoolView() *mempoolView {
+	return &mempoolView{
+		seen:  make(map[string]*mempoolTx),
+		parse: parseTx,
+	}
+}
+
+// update replaces the view with a new snapshot of raw transactions, keyed by hash, and returns
+// the transactions that weren't in the previous one
+func (v *mempoolView) update(snapshot map[string][]byte) ([]*mempoolTx, error) {
+	seen := make(map[string]*mempoolTx, len(snapshot))
+	added := []*mempoolTx{}
+	for hash, raw := range snapshot {
+		if tx, ok := v.seen[hash]; ok {
+			seen[hash] = tx
+			continue
+		}
+		tx, err := v.parse(raw)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		tx, err := ledger.NewTransactionFromCbor(txType, txRawBytes)
+		record := &mempoolTx{
+			hash: hash,
+			raw:  raw,
+			tx:   tx,
+		}
+		seen[hash] = record
+		added = append(added, record)
+	}
+	v.seen = seen
+	return added, nil
+}
+
+// transactions returns every transaction in the view
+func (v *mempoolView) transactions() []ledger.Transaction {
+	ret := make([]ledger.Transaction, 0, len(v.seen))
+	for _, tx := range v.seen {
+		ret = append(ret, tx.tx)
+	}
+	return ret
+}
+
+// resolveMempoolInputs returns a resolver for the outputs spent by the transactions just added
+// to the mempool, if the predicate needs them. They're looked up in the ledger at the tip, or
+// among the outputs of other transactions in the mempool
+func resolveMempoolInputs(
+	ctx context.Context,
+	txPred *txPredicate,
+	view *mempoolView,
+	added []*mempoolTx,
+) (outputResolver, error) {
+	if !txPred.needsConsumed() || len(added) == 0 {
+		return nil, nil
+	}
+	mempoolOutputs := producedOutputs(view.transactions())
+	pending := make([]ledger.Transaction, 0, len(added))
+	for _, tx := range added {
+		pending = append(pending, tx.tx)
+	}
+	resolved, err := resolveInputs(ctx, nil, pending)
+	if err != nil {
+		if !unresolvable(err) {
+			return nil, err
+		}
+		requestLogger(ctx).Warnw(
+			"matching mempool transactions without the outputs they spend",
+			"error", err,
+		)
+		return mempoolOutputs.resolve, nil
+	}
+	return func(input ledger.TransactionInput) ledger.TransactionOutput {
+		if output := resolved.resolve(input); output != nil {
+			return output
+		}
+		return mempoolOutputs.resolve(input)
+	}, nil
+}
+
+// readMempoolSnapshot acquires a fresh mempool snapshot on a pooled connection and returns its
+// raw transactions, keyed by hash. The transactions aren't parsed, so that callers can skip the
+// ones they've already seen
+func readMempoolSnapshot(ctx context.Context) (map[string][]byte, error) {
+	oConn, err := node.LeaseConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer oConn.Return()
+	client, err := oConn.AcquireLocalTxMonitor()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte)
+	for {
+		txRawBytes, err := client.NextTx()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		cTx := tx.Utxorpc() // *cardano.Tx
-		resp := &submit.WatchMempoolResponse{}
-		var act submit.AnyChainTx
-		var actr submit.AnyChainTx_Raw
-		actr.Raw = txRawBytes
-		act.Type = &actr
-		record := &submit.TxInMempool{
-			Tx:    &act,
-			Stage: submit.Stage_STAGE_MEMPOOL,
+		if txRawBytes == nil {
+			break
 		}
-		resp.Tx = record
-		if record.Tx.String() == cTx.String() {
-			if predicate == nil {
-				err := stream.Send(resp)
-				if err != nil {
-					return err
-				}
-			} else {
-				// TODO: filter from all Predicate types
-				err := stream.Send(resp)
-				if err != nil {
-					return err
-				}
-			}
+		hash, err := rawTxHash(txRawBytes)
+		if err != nil {
+			return nil, err
 		}
+		ret[hash] = txRawBytes
+	}
+	return ret, nil
+}
+
+// rawTxHash returns the hash of a raw transaction, which is the hash of its body, without
+// parsing the rest of it
+func rawTxHash(txRawBytes []byte) (string, error) {
+	var parts []cbor.RawMessage
+	if _, err := cbor.Decode(txRawBytes, &parts); err != nil {
+		return "", fmt.Errorf("failed to decode transaction: %s", err)
+	}
+	if len(parts) == 0 {
+		return "", errors.New("failed to decode transaction: empty transaction")
+	}
+	hash := blake2b.Sum256(parts[0])
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// parseTx parses a raw transaction of any era
+// newTxInMempool builds a mempool record for a transaction
+func newTxInMempool(
+	raw []byte,
+	tx ledger.Transaction,
+	stage submit.Stage,
+) (*submit.TxInMempool, error) {
+	ref, err := hex.DecodeString(tx.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return &submit.TxInMempool{
+		Ref:         ref,
+		NativeBytes: raw,
+		Stage:       stage,
+		ParsedState: &submit.TxInMempool_Cardano{
+			Cardano: tx.Utxorpc(),
+		},
+	}, nil
+}
+
+func parseTx(txRawBytes []byte) (ledger.Transaction, error) {
+	txType, err := ledger.DetermineTransactionType(txRawBytes)
+	if err != nil {
+		return nil, err
 	}
+	return ledger.NewTransactionFromCbor(txType, txRawBytes)
 }
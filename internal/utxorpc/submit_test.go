@@ -0,0 +1,140 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/blinklabs-io/gouroboros/cbor"
+	"github.com/blinklabs-io/gouroboros/ledger"
+)
+
+// testRawTx returns a minimal Alonzo-style transaction spending the first output of a
+// transaction whose hash repeats the given byte
+func testRawTx(t *testing.T, inputHash byte) []byte {
+	t.Helper()
+	addr := append([]byte{0x61}, bytes.Repeat([]byte{0x11}, 28)...)
+	body := map[uint]any{
+		0: []any{[]any{bytes.Repeat([]byte{inputHash}, 32), uint64(0)}},
+		1: []any{[]any{addr, uint64(2000000)}},
+		2: uint64(170000),
+	}
+	raw, err := cbor.Encode([]any{body, map[uint]any{}, true, nil})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return raw
+}
+
+func TestRawTxHash(t *testing.T) {
+	raw := testRawTx(t, 0xaa)
+	tx, err := parseTx(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hash, err := rawTxHash(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if hash != tx.Hash() {
+		t.Fatalf("got hash %s, wanted %s", hash, tx.Hash())
+	}
+	if _, err := rawTxHash([]byte{0x80}); err == nil {
+		t.Fatalf("got no error for an empty transaction")
+	}
+}
+
+func TestMempoolView(t *testing.T) {
+	parsed := []string{}
+	view := newMempoolView()
+	view.parse = func(raw []byte) (ledger.Transaction, error) {
+		parsed = append(parsed, string(raw))
+		return fakeTx{hash: string(raw)}, nil
+	}
+	snapshot := func(hashes ...string) map[string][]byte {
+		ret := make(map[string][]byte)
+		for _, hash := range hashes {
+			ret[hash] = []byte(hash)
+		}
+		return ret
+	}
+	steps := []struct {
+		name       string
+		snapshot   map[string][]byte
+		wantAdded  []string
+		wantParsed []string
+	}{
+		{
+			name:       "first snapshot",
+			snapshot:   snapshot("a", "b"),
+			wantAdded:  []string{"a", "b"},
+			wantParsed: []string{"a", "b"},
+		},
+		{
+			name:       "unchanged",
+			snapshot:   snapshot("a", "b"),
+			wantAdded:  []string{},
+			wantParsed: []string{},
+		},
+		{
+			name:       "added and removed",
+			snapshot:   snapshot("b", "c"),
+			wantAdded:  []string{"c"},
+			wantParsed: []string{"c"},
+		},
+		{
+			name:       "back after leaving",
+			snapshot:   snapshot("a", "b", "c"),
+			wantAdded:  []string{"a"},
+			wantParsed: []string{"a"},
+		},
+		{
+			name:       "empty",
+			snapshot:   snapshot(),
+			wantAdded:  []string{},
+			wantParsed: []string{},
+		},
+	}
+	for _, step := range steps {
+		parsed = []string{}
+		added, err := view.update(step.snapshot)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.name, err)
+		}
+		gotAdded := []string{}
+		for _, tx := range added {
+			gotAdded = append(gotAdded, tx.hash)
+		}
+		sort.Strings(gotAdded)
+		sort.Strings(parsed)
+		if !reflect.DeepEqual(gotAdded, step.wantAdded) {
+			t.Fatalf("%s: got added %v, wanted %v", step.name, gotAdded, step.wantAdded)
+		}
+		if !reflect.DeepEqual(parsed, step.wantParsed) {
+			t.Fatalf("%s: got parsed %v, wanted %v", step.name, parsed, step.wantParsed)
+		}
+		if len(view.transactions()) != len(step.snapshot) {
+			t.Fatalf(
+				"%s: view has %d transactions, wanted %d",
+				step.name,
+				len(view.transactions()),
+				len(step.snapshot),
+			)
+		}
+	}
+}
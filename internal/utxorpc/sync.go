@@ -17,224 +17,277 @@ package utxorpc
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 
 	connect "connectrpc.com/connect"
 	"github.com/blinklabs-io/adder/event"
 	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/blinklabs-io/gouroboros/protocol/chainsync"
 	ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
 	sync "github.com/utxorpc/go-codegen/utxorpc/v1alpha/sync"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/sync/syncconnect"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/blockstore"
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
 )
 
-// chainSyncServiceServer implements the ChainSyncService API
-type chainSyncServiceServer struct {
-	syncconnect.UnimplementedChainSyncServiceHandler
+const (
+	// Page size for DumpHistory when the request doesn't give one, and the most we'll return
+	defaultDumpHistoryMaxItems = 100
+	maxDumpHistoryMaxItems     = 1000
+)
+
+// syncServiceServer implements the SyncService API
+type syncServiceServer struct {
+	syncconnect.UnimplementedSyncServiceHandler
 }
 
 // FetchBlock
-func (s *chainSyncServiceServer) FetchBlock(
+func (s *syncServiceServer) FetchBlock(
 	ctx context.Context,
 	req *connect.Request[sync.FetchBlockRequest],
 ) (*connect.Response[sync.FetchBlockResponse], error) {
 	ref := req.Msg.GetRef() // BlockRef
 	fieldMask := req.Msg.GetFieldMask()
-	log.Printf(
-		"Got a FetchBlock request with ref %v and fieldMask %v",
-		ref,
-		fieldMask,
-	)
-
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
+	mask := newFieldMaskTree(fieldMask)
 
 	resp := &sync.FetchBlockResponse{}
-	// Start client
 	var points []ocommon.Point
 	if len(ref) > 0 {
 		for _, blockRef := range ref {
 			blockIdx := blockRef.GetIndex()
 			blockHash := blockRef.GetHash()
-			hash, _ := hex.DecodeString(string(blockHash))
 			slot := uint64(blockIdx)
-			point := ocommon.NewPoint(slot, hash)
+			point := ocommon.NewPoint(slot, blockHash)
 			points = append(points, point)
 		}
 	} else {
+		// Lease node connection
+		oConn, err := node.LeaseConnection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer oConn.Return()
 		tip, err := oConn.ChainSync().Client.GetCurrentTip()
 		if err != nil {
 			return nil, err
 		}
-		point := tip.Point
-		points = append(points, point)
+		points = append(points, tip.Point)
+	}
+	for _, point := range points {
+		requestLogger(ctx).Debugw(
+			"fetching block",
+			"slot", point.Slot,
+			"hash", hex.EncodeToString(point.Hash),
+		)
+		block, err := fetchBlock(point)
+		if err != nil {
+			return nil, fetchBlockError(err)
+		}
+		resp.Block = append(resp.Block, newAnyChainBlock(block, mask))
 	}
-	log.Printf("points: %v", points)
-	// TODO: replace with something that works NtC
-	// for _, point := range points {
-	// 	log.Printf("Point Slot: %d, Hash: %x\n", point.Slot, point.Hash)
-	// 	block, err := oConn.BlockFetch().Client.GetBlock(
-	// 		ocommon.NewPoint(point.Slot, point.Hash),
-	// 	)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	var acb sync.AnyChainBlock
-	// 	var acbc sync.AnyChainBlock_Cardano
-	// 	ret := NewBlockFromBlock(block)
-	// 	acbc.Cardano = &ret
-	// 	acb.Chain = &acbc
-	// 	resp.Block = append(resp.Block, &acb)
-	// }
 
 	return connect.NewResponse(resp), nil
 }
 
 // DumpHistory
-func (s *chainSyncServiceServer) DumpHistory(
+func (s *syncServiceServer) DumpHistory(
 	ctx context.Context,
 	req *connect.Request[sync.DumpHistoryRequest],
 ) (*connect.Response[sync.DumpHistoryResponse], error) {
 	startToken := req.Msg.GetStartToken() // BlockRef
 	maxItems := req.Msg.GetMaxItems()
 	fieldMask := req.Msg.GetFieldMask()
-	log.Printf(
-		"Got a DumpHistory request with token %v and maxItems %d and fieldMask %v",
-		startToken,
-		maxItems,
-		fieldMask,
-	)
+	mask := newFieldMaskTree(fieldMask)
 
-	// Connect to node
-	oConn, err := node.GetConnection(nil)
-	if err != nil {
-		return nil, err
+	if maxItems == 0 {
+		maxItems = defaultDumpHistoryMaxItems
+	} else if maxItems > maxDumpHistoryMaxItems {
+		maxItems = maxDumpHistoryMaxItems
 	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
 
-	resp := &sync.DumpHistoryResponse{}
-	// Start client
-	log.Printf("startToken: %#v\n", startToken)
-	var startPoint ocommon.Point
+	// Each page starts at the start token, or at the beginning of the available history
+	var startPoint *ocommon.Point
 	if startToken != nil {
-		log.Printf("startToken != nil\n")
-		blockRef := startToken
-		blockIdx := blockRef.GetIndex()
-		blockHash := blockRef.GetHash()
-		hash, _ := hex.DecodeString(string(blockHash))
-		slot := uint64(blockIdx)
-		startPoint = ocommon.NewPoint(slot, hash)
-	} else {
-		log.Printf("getting tip\n")
-		tip, err := oConn.ChainSync().Client.GetCurrentTip()
+		point := ocommon.NewPoint(startToken.GetIndex(), startToken.GetHash())
+		startPoint = &point
+	}
+
+	// We get one block more than the page, which is where the next page starts. Blocks come from
+	// the block store if it has our starting point, otherwise we walk the chain from the node
+	var blocks []ledger.Block
+	var err error
+	if store := blockstore.GetBlockStore(); store != nil {
+		blocks, err = dumpHistoryFromBlockStore(store, startPoint, int(maxItems)+1)
+		if err != nil && !errors.Is(err, blockstore.ErrBlockNotFound) {
+			return nil, err
+		}
+	}
+	if blocks == nil {
+		blocks, err = dumpHistoryFromNode(ctx, startPoint, int(maxItems)+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &sync.DumpHistoryResponse{}
+	if len(blocks) > int(maxItems) {
+		point, err := blockPoint(blocks[maxItems])
 		if err != nil {
 			return nil, err
 		}
-		startPoint = tip.Point
+		resp.NextToken = &sync.BlockRef{
+			Index: point.Slot,
+			Hash:  point.Hash,
+		}
+		blocks = blocks[:maxItems]
+	}
+	for _, block := range blocks {
+		resp.Block = append(resp.Block, newAnyChainBlock(block, mask))
+	}
+
+	return connect.NewResponse(resp), nil
+}
+
+// fetchBlock returns the block at the given point from the block store, falling back to the NtN
+// peer if the block store doesn't have it
+func fetchBlock(point ocommon.Point) (ledger.Block, error) {
+	store := blockstore.GetBlockStore()
+	if store != nil {
+		block, err := store.GetBlock(point)
+		if err == nil {
+			return block, nil
+		}
+		if !errors.Is(err, blockstore.ErrBlockNotFound) || !node.BlockFetchEnabled() {
+			return nil, err
+		}
+	}
+	return node.FetchBlock(point)
+}
+
+// fetchBlockError returns the error for a block we couldn't fetch, with a code that tells a
+// missing block apart from having nowhere to fetch it from
+func fetchBlockError(err error) error {
+	if errors.Is(err, node.ErrBlockFetchNotConfigured) {
+		return connect.NewError(connect.CodeFailedPrecondition, err)
+	}
+	if errors.Is(err, blockstore.ErrBlockNotFound) || errors.Is(err, node.ErrBlockNotFound) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+	return err
+}
+
+// dumpHistoryFromBlockStore returns up to count blocks from the block store, starting at the
+// start point if there is one
+func dumpHistoryFromBlockStore(
+	store *blockstore.BlockStore,
+	startPoint *ocommon.Point,
+	count int,
+) ([]ledger.Block, error) {
+	if startPoint != nil {
+		return store.GetBlocksAt(*startPoint, count)
 	}
-	log.Printf(
-		"startPoint slot %d, hash %x\n",
-		startPoint.Slot,
-		startPoint.Hash,
-	)
-	// TODO: why is this giving us 0?
-	start, end, err := oConn.ChainSync().Client.GetAvailableBlockRange(
-		[]ocommon.Point{startPoint},
-	)
+	blocks, err := store.GetBlocksFrom(0, count)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Start:     slot %d, hash %x\n", start.Slot, start.Hash)
-	log.Printf("End (tip): slot %d, hash %x\n", end.Slot, end.Hash)
+	if len(blocks) == 0 {
+		return nil, blockstore.ErrBlockNotFound
+	}
+	return blocks, nil
+}
 
-	return connect.NewResponse(resp), nil
+// dumpHistoryFromNode returns up to count blocks from the node, starting at the start point if
+// there is one or the origin otherwise. A chain-sync only gives us the blocks after a point, so
+// the block at the start point is fetched on its own
+func dumpHistoryFromNode(
+	ctx context.Context,
+	startPoint *ocommon.Point,
+	count int,
+) ([]ledger.Block, error) {
+	if startPoint == nil {
+		blocks, _, err := node.WalkChain(ctx, ocommon.NewPointOrigin(), count)
+		return blocks, err
+	}
+	startBlock, err := fetchBlock(*startPoint)
+	if err != nil {
+		return nil, fetchBlockError(err)
+	}
+	blocks, _, err := node.WalkChain(ctx, *startPoint, count-1)
+	if err != nil {
+		return nil, err
+	}
+	return append([]ledger.Block{startBlock}, blocks...), nil
 }
 
 // FollowTip
-func (s *chainSyncServiceServer) FollowTip(
+func (s *syncServiceServer) FollowTip(
 	ctx context.Context,
 	req *connect.Request[sync.FollowTipRequest],
 	stream *connect.ServerStream[sync.FollowTipResponse],
 ) error {
 	intersect := req.Msg.GetIntersect() // []*BlockRef
-	log.Printf("Got a FollowTip request with intersect %v", intersect)
+	fieldMask := req.Msg.GetFieldMask()
+	mask := newFieldMaskTree(fieldMask)
 
 	// Setup event channel
 	eventChan := make(chan event.Event, 10)
-	connCfg := node.ConnectionConfig{
-		ChainSyncEventChan: eventChan,
-	}
-	// Connect to node
-	oConn, err := node.GetConnection(&connCfg)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
 
-	// Get our starting point
-	var point ocommon.Point
-	if len(intersect) > 0 {
-		for _, blockRef := range intersect {
-			blockIdx := blockRef.GetIndex()
-			blockHash := blockRef.GetHash()
-			log.Printf("BlockRef: idx: %d, hash: %x", blockIdx, blockHash)
-			hash, _ := hex.DecodeString(string(blockHash))
-			slot := uint64(blockIdx)
-			point = ocommon.NewPoint(slot, hash)
-		}
-	} else {
-		tip, _ := oConn.ChainSync().Client.GetCurrentTip()
-		point = tip.Point
+	// Get our intersect points. We start from the tip if none are given
+	var points []ocommon.Point
+	for _, blockRef := range intersect {
+		blockIdx := blockRef.GetIndex()
+		blockHash := blockRef.GetHash()
+		requestLogger(ctx).Debugw(
+			"intersect point",
+			"slot", blockIdx,
+			"hash", hex.EncodeToString(blockHash),
+		)
+		points = append(points, ocommon.NewPoint(blockIdx, blockHash))
 	}
 
 	// Start the sync with the node
-	err = oConn.ChainSync().Client.Sync([]ocommon.Point{point})
+	syncSub, err := node.SubscribeChainSync(eventChan, points)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
+		if errors.Is(err, chainsync.IntersectNotFoundError) {
+			return connect.NewError(connect.CodeNotFound, err)
+		}
 		return err
 	}
+	defer syncSub.Close()
+
+	// Recently applied blocks, so that we can send them back with Undo on a rollback
+	cfg := config.GetConfig()
+	undoDepth := int(cfg.Node.ChainSyncBufferSize)
+	var recentBlocks []ledger.Block
+	// The point before the oldest of our recent blocks
+	var basePoint *ocommon.Point
 
 	// Wait for events
 	for {
-		evt, ok := <-eventChan
-		if !ok {
-			log.Printf("ERROR: channel closed")
-			return fmt.Errorf("ERROR: channel closed")
+		var evt event.Event
+		select {
+		case evt = <-eventChan:
+		case <-syncSub.Done():
+			return syncSub.Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
 		switch evt.Type {
 		case "chainsync.block":
-			resp := &sync.FollowTipResponse{}
 			// Get event context to get the block chain information
 			context := evt.Context
 			if context == nil {
-				log.Printf("ERROR: empty block context")
 				return fmt.Errorf("ERROR: empty block context")
 			}
 			bc := context.(input_chainsync.BlockContext)
 			// Get event payload to get the block data
 			payload := evt.Payload
 			if payload == nil {
-				log.Printf(
-					"ERROR: empty payload: block: %d, slot: %d",
-					bc.BlockNumber,
-					bc.SlotNumber,
-				)
 				return fmt.Errorf(
 					"ERROR: empty payload: block: %d, slot: %d",
 					bc.BlockNumber,
@@ -244,23 +297,96 @@ func (s *chainSyncServiceServer) FollowTip(
 			be := payload.(input_chainsync.BlockEvent)
 			block := be.Block // gOuroboros Block
 
-			var acb sync.AnyChainBlock
-			var acbc sync.AnyChainBlock_Cardano
-			acbc.Cardano = block.Utxorpc()
-			acb.Chain = &acbc
-			var ftra sync.FollowTipResponse_Apply
-			ftra.Apply = &acb
-			resp.Action = &ftra
-			err = stream.Send(resp)
+			resp := &sync.FollowTipResponse{
+				Action: &sync.FollowTipResponse_Apply{
+					Apply: newAnyChainBlock(block, mask),
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			recentBlocks = append(recentBlocks, block)
+			if len(recentBlocks) > undoDepth {
+				evicted := recentBlocks[0]
+				recentBlocks = recentBlocks[1:]
+				point, err := blockPoint(evicted)
+				if err != nil {
+					return err
+				}
+				basePoint = &point
+			}
+			// Log event
+			requestLogger(ctx).Debugw(
+				"block",
+				"slot", block.SlotNumber(),
+				"hash", block.Hash(),
+			)
+		case "chainsync.rollback":
+			re := evt.Payload.(input_chainsync.RollbackEvent)
+			hash, err := hex.DecodeString(re.BlockHash)
 			if err != nil {
 				return err
 			}
+			point := ocommon.NewPoint(re.SlotNumber, hash)
+			// Undo each rolled back block, newest first
+			for len(recentBlocks) > 0 && recentBlocks[len(recentBlocks)-1].SlotNumber() > point.Slot {
+				block := recentBlocks[len(recentBlocks)-1]
+				recentBlocks = recentBlocks[:len(recentBlocks)-1]
+				resp := &sync.FollowTipResponse{
+					Action: &sync.FollowTipResponse_Undo{
+						Undo: newAnyChainBlock(block, mask),
+					},
+				}
+				if err := stream.Send(resp); err != nil {
+					return err
+				}
+			}
+			// We can't undo blocks we no longer have, so we tell the client to reset to the
+			// rollback point instead. This is also how the client finds out which of its
+			// intersect points we started from
+			if len(recentBlocks) == 0 && (basePoint == nil || basePoint.Slot > point.Slot) {
+				resp := &sync.FollowTipResponse{
+					Action: &sync.FollowTipResponse_Reset_{
+						Reset_: &sync.BlockRef{
+							Index: point.Slot,
+							Hash:  point.Hash,
+						},
+					},
+				}
+				if err := stream.Send(resp); err != nil {
+					return err
+				}
+			}
+			if len(recentBlocks) == 0 {
+				basePoint = &point
+			}
 			// Log event
-			log.Printf(
-				"block: slot: %d, hash: %s",
-				block.SlotNumber(),
-				block.Hash(),
+			requestLogger(ctx).Debugw(
+				"rollback",
+				"slot", re.SlotNumber,
+				"hash", re.BlockHash,
 			)
 		}
 	}
 }
+
+// newAnyChainBlock wraps a block for a UTxO RPC response, keeping only the fields selected by
+// the field mask
+func newAnyChainBlock(block ledger.Block, mask fieldMaskTree) *sync.AnyChainBlock {
+	parsed := block.Utxorpc()
+	mask.apply(parsed)
+	return &sync.AnyChainBlock{
+		Chain: &sync.AnyChainBlock_Cardano{
+			Cardano: parsed,
+		},
+	}
+}
+
+// blockPoint returns the chain point of a block
+func blockPoint(block ledger.Block) (ocommon.Point, error) {
+	hash, err := hex.DecodeString(block.Hash())
+	if err != nil {
+		return ocommon.Point{}, err
+	}
+	return ocommon.NewPoint(block.SlotNumber(), hash), nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	connect "connectrpc.com/connect"
+
+	"github.com/blinklabs-io/cardano-node-api/internal/blockstore"
+	"github.com/blinklabs-io/cardano-node-api/internal/node"
+)
+
+func TestFetchBlockError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode connect.Code
+	}{
+		{
+			name:     "block fetch not configured",
+			err:      node.ErrBlockFetchNotConfigured,
+			wantCode: connect.CodeFailedPrecondition,
+		},
+		{
+			name:     "not in the block store",
+			err:      blockstore.ErrBlockNotFound,
+			wantCode: connect.CodeNotFound,
+		},
+		{
+			name:     "peer doesn't have the block",
+			err:      fmt.Errorf("failed to fetch block: %w", node.ErrBlockNotFound),
+			wantCode: connect.CodeNotFound,
+		},
+		{
+			name:     "other failure",
+			err:      errors.New("connection reset"),
+			wantCode: connect.CodeUnknown,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fetchBlockError(test.err)
+			if code := connect.CodeOf(err); code != test.wantCode {
+				t.Fatalf("got code %s, wanted %s", code, test.wantCode)
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, which doesn't wrap %v", err, test.err)
+			}
+		})
+	}
+}
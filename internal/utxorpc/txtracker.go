@@ -0,0 +1,250 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/blinklabs-io/gouroboros/ledger"
+	submit "github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit"
+)
+
+// submittedTxTTL is how long we remember that a transaction was accepted by SubmitTx
+const submittedTxTTL = 1 * time.Hour
+
+// trackedBlocksMax is the number of recent blocks a txTracker remembers for working out the tip
+// after a rollback. Rollbacks can't go back further than the security parameter
+const trackedBlocksMax = 2160
+
+// submittedTxs holds the hashes of transactions recently accepted by the node through SubmitTx,
+// along with when they were submitted
+var submittedTxs = struct {
+	sync.Mutex
+	txs map[string]time.Time
+}{
+	txs: make(map[string]time.Time),
+}
+
+// recordSubmittedTx remembers that the node acknowledged a transaction
+func recordSubmittedTx(hash string) {
+	submittedTxs.Lock()
+	defer submittedTxs.Unlock()
+	now := time.Now()
+	for k, v := range submittedTxs.txs {
+		if now.Sub(v) > submittedTxTTL {
+			delete(submittedTxs.txs, k)
+		}
+	}
+	submittedTxs.txs[hash] = now
+}
+
+// wasTxSubmitted returns whether a transaction was recently acknowledged through SubmitTx
+func wasTxSubmitted(hash string) bool {
+	submittedTxs.Lock()
+	defer submittedTxs.Unlock()
+	submitted, ok := submittedTxs.txs[hash]
+	return ok && time.Since(submitted) <= submittedTxTTL
+}
+
+// trackedTx is the state of a transaction followed by a txTracker
+type trackedTx struct {
+	ref       []byte
+	hash      string
+	stage     submit.Stage
+	inMempool bool
+	inBlock   bool
+	// Whether it's left the mempool or a block without being confirmed since, so it's out on the
+	// network
+	onNetwork   bool
+	blockSlot   uint64
+	blockHeight uint64
+	lastSeen    time.Time
+}
+
+// trackedBlock is the point of a block seen by a txTracker
+type trackedBlock struct {
+	slot   uint64
+	height uint64
+}
+
+// txTracker follows a set of transactions through the mempool and onto the chain. The stage of
+// each transaction is derived from what we've seen of it: acknowledged when it was submitted
+// through us, in the mempool when the node's mempool has it, on the network once it's left the
+// mempool (or its block was rolled back) without being confirmed, and confirmed once it's in a
+// block. A confirmed transaction is followed until its block is deep enough, so that we can still
+// report it going back to an earlier stage if its block is rolled back
+type txTracker struct {
+	depth     uint64
+	tipHeight uint64
+	blocks    []trackedBlock
+	txs       []*trackedTx
+	byHash    map[string]*trackedTx
+}
+
+func newTxTracker(refs [][]byte, depth uint64) *txTracker {
+	if depth == 0 {
+		depth = 1
+	}
+	t := &txTracker{
+		depth:  depth,
+		byHash: make(map[string]*trackedTx),
+	}
+	for _, ref := range refs {
+		hash := hex.EncodeToString(ref)
+		if _, ok := t.byHash[hash]; ok {
+			continue
+		}
+		tx := &trackedTx{
+			ref:      ref,
+			hash:     hash,
+			stage:    submit.Stage_STAGE_UNSPECIFIED,
+			lastSeen: time.Now(),
+		}
+		t.txs = append(t.txs, tx)
+		t.byHash[hash] = tx
+	}
+	return t
+}
+
+// pendingMempool returns the transactions that aren't on chain, for checking against the mempool
+func (t *txTracker) pendingMempool() []*trackedTx {
+	ret := []*trackedTx{}
+	for _, tx := range t.txs {
+		if !tx.inBlock {
+			ret = append(ret, tx)
+		}
+	}
+	return ret
+}
+
+// setInMempool records whether a transaction is in the node's mempool. One that's no longer
+// there has been passed on to the network
+func (t *txTracker) setInMempool(tx *trackedTx, inMempool bool) {
+	if tx.inMempool && !inMempool {
+		tx.onNetwork = true
+	}
+	tx.inMempool = inMempool
+}
+
+// applyBlock records any of our transactions in the block and moves the tip
+func (t *txTracker) applyBlock(block ledger.Block) {
+	t.tipHeight = block.BlockNumber()
+	t.blocks = append(
+		t.blocks,
+		trackedBlock{slot: block.SlotNumber(), height: block.BlockNumber()},
+	)
+	if len(t.blocks) > trackedBlocksMax {
+		t.blocks = t.blocks[len(t.blocks)-trackedBlocksMax:]
+	}
+	t.applyStoredBlock(block)
+}
+
+// applyStoredBlock records any of our transactions in a block that we looked up, rather than
+// followed, so it doesn't move the tip
+func (t *txTracker) applyStoredBlock(block ledger.Block) {
+	for _, blockTx := range block.Transactions() {
+		tx, ok := t.byHash[blockTx.Hash()]
+		if !ok {
+			continue
+		}
+		tx.inBlock = true
+		tx.inMempool = false
+		tx.blockSlot = block.SlotNumber()
+		tx.blockHeight = block.BlockNumber()
+	}
+}
+
+// rollback moves the tip back to the block at the given slot and forgets any of our
+// transactions in the blocks after it
+func (t *txTracker) rollback(slot uint64) {
+	// The tip is now just below the oldest block that was rolled back
+	for i, block := range t.blocks {
+		if block.slot > slot {
+			t.tipHeight = block.height - 1
+			t.blocks = t.blocks[:i]
+			break
+		}
+	}
+	for _, tx := range t.txs {
+		if tx.inBlock && tx.blockSlot > slot {
+			tx.inBlock = false
+			tx.onNetwork = true
+		}
+	}
+}
+
+// lost returns the first transaction that we haven't seen in the mempool or on chain for longer
+// than the given timeout, if there is one
+func (t *txTracker) lost(timeout time.Duration) *trackedTx {
+	now := time.Now()
+	for _, tx := range t.txs {
+		if tx.inMempool || tx.inBlock {
+			tx.lastSeen = now
+			continue
+		}
+		if now.Sub(tx.lastSeen) > timeout {
+			return tx
+		}
+	}
+	return nil
+}
+
+// updates returns a response for each transaction whose stage has changed since the last call
+func (t *txTracker) updates() []*submit.WaitForTxResponse {
+	ret := []*submit.WaitForTxResponse{}
+	for _, tx := range t.txs {
+		stage := t.stage(tx)
+		if stage == tx.stage {
+			continue
+		}
+		tx.stage = stage
+		ret = append(
+			ret,
+			&submit.WaitForTxResponse{
+				Ref:   tx.ref,
+				Stage: stage,
+			},
+		)
+	}
+	return ret
+}
+
+// done returns whether all of our transactions are confirmed and their blocks are deep enough
+func (t *txTracker) done() bool {
+	for _, tx := range t.txs {
+		if !tx.inBlock || t.tipHeight+1 < tx.blockHeight+t.depth {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *txTracker) stage(tx *trackedTx) submit.Stage {
+	if tx.inBlock {
+		return submit.Stage_STAGE_CONFIRMED
+	}
+	if tx.inMempool {
+		return submit.Stage_STAGE_MEMPOOL
+	}
+	if tx.onNetwork {
+		return submit.Stage_STAGE_NETWORK
+	}
+	if wasTxSubmitted(tx.hash) {
+		return submit.Stage_STAGE_ACKNOWLEDGED
+	}
+	return submit.Stage_STAGE_UNSPECIFIED
+}
@@ -0,0 +1,319 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/blinklabs-io/gouroboros/ledger"
+	submit "github.com/utxorpc/go-codegen/utxorpc/v1alpha/submit"
+)
+
+// fakeBlock is a block with just enough to be followed by a txTracker
+type fakeBlock struct {
+	ledger.Block
+	slot   uint64
+	height uint64
+	txs    []ledger.Transaction
+}
+
+func (b fakeBlock) SlotNumber() uint64                 { return b.slot }
+func (b fakeBlock) BlockNumber() uint64                { return b.height }
+func (b fakeBlock) Transactions() []ledger.Transaction { return b.txs }
+
+// fakeTx is a transaction with just a hash
+type fakeTx struct {
+	ledger.Transaction
+	hash string
+}
+
+func (t fakeTx) Hash() string { return t.hash }
+
+func newFakeBlock(height uint64, refs ...[]byte) fakeBlock {
+	b := fakeBlock{slot: height * 20, height: height}
+	for _, ref := range refs {
+		b.txs = append(b.txs, fakeTx{hash: hex.EncodeToString(ref)})
+	}
+	return b
+}
+
+func TestTxTrackerStages(t *testing.T) {
+	ref := []byte{0x01, 0x02}
+	type step struct {
+		name      string
+		apply     func(*txTracker)
+		wantStage submit.Stage
+		wantDone  bool
+	}
+	tests := []struct {
+		name  string
+		depth uint64
+		steps []step
+	}{
+		{
+			name:  "mempool to confirmed",
+			depth: 3,
+			steps: []step{
+				{
+					name:      "unknown",
+					apply:     func(*txTracker) {},
+					wantStage: submit.Stage_STAGE_UNSPECIFIED,
+				},
+				{
+					name:      "in mempool",
+					apply:     func(tr *txTracker) { tr.setInMempool(tr.txs[0], true) },
+					wantStage: submit.Stage_STAGE_MEMPOOL,
+				},
+				{
+					name:      "in block",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(10, ref)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+				},
+				{
+					name:      "not deep enough",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(11)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+				},
+				{
+					name:      "deep enough",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(12)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+					wantDone:  true,
+				},
+			},
+		},
+		{
+			name:  "rolled back",
+			depth: 3,
+			steps: []step{
+				{
+					name: "in block",
+					apply: func(tr *txTracker) {
+						tr.applyBlock(newFakeBlock(10))
+						tr.applyBlock(newFakeBlock(11, ref))
+						tr.applyBlock(newFakeBlock(12))
+					},
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+				},
+				{
+					name: "block rolled back",
+					apply: func(tr *txTracker) {
+						tr.rollback(newFakeBlock(10).slot)
+						tr.setInMempool(tr.txs[0], true)
+					},
+					wantStage: submit.Stage_STAGE_MEMPOOL,
+				},
+				{
+					name: "in a later block",
+					apply: func(tr *txTracker) {
+						tr.applyBlock(newFakeBlock(11))
+						tr.applyBlock(newFakeBlock(12, ref))
+						tr.applyBlock(newFakeBlock(13))
+					},
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+				},
+				{
+					name:      "deep enough",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(14)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+					wantDone:  true,
+				},
+			},
+		},
+		{
+			name:  "through the network",
+			depth: 1,
+			steps: []step{
+				{
+					name: "acknowledged",
+					apply: func(tr *txTracker) {
+						recordSubmittedTx(hex.EncodeToString(ref))
+					},
+					wantStage: submit.Stage_STAGE_ACKNOWLEDGED,
+				},
+				{
+					name:      "in mempool",
+					apply:     func(tr *txTracker) { tr.setInMempool(tr.txs[0], true) },
+					wantStage: submit.Stage_STAGE_MEMPOOL,
+				},
+				{
+					name:      "left the mempool",
+					apply:     func(tr *txTracker) { tr.setInMempool(tr.txs[0], false) },
+					wantStage: submit.Stage_STAGE_NETWORK,
+				},
+				{
+					name:      "in block",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(10, ref)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+					wantDone:  true,
+				},
+			},
+		},
+		{
+			name:  "rolled back out of the mempool",
+			depth: 3,
+			steps: []step{
+				{
+					name:      "in block",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(10, ref)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+				},
+				{
+					name: "block rolled back",
+					apply: func(tr *txTracker) {
+						tr.rollback(newFakeBlock(9).slot)
+						tr.setInMempool(tr.txs[0], false)
+					},
+					wantStage: submit.Stage_STAGE_NETWORK,
+				},
+			},
+		},
+		{
+			name:  "found in the block store",
+			depth: 3,
+			steps: []step{
+				{
+					name:      "found before the replayed blocks",
+					apply:     func(tr *txTracker) { tr.applyStoredBlock(newFakeBlock(10, ref)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+				},
+				{
+					name:      "deep enough",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(12)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+					wantDone:  true,
+				},
+				{
+					name:      "block rolled back",
+					apply:     func(tr *txTracker) { tr.rollback(newFakeBlock(9).slot) },
+					wantStage: submit.Stage_STAGE_NETWORK,
+				},
+			},
+		},
+		{
+			name:  "found in the block store before the tip",
+			depth: 3,
+			steps: []step{
+				{
+					name:      "replayed",
+					apply:     func(tr *txTracker) { tr.applyBlock(newFakeBlock(20)) },
+					wantStage: submit.Stage_STAGE_UNSPECIFIED,
+				},
+				{
+					name:      "found",
+					apply:     func(tr *txTracker) { tr.applyStoredBlock(newFakeBlock(10, ref)) },
+					wantStage: submit.Stage_STAGE_CONFIRMED,
+					wantDone:  true,
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				submittedTxs.Lock()
+				delete(submittedTxs.txs, hex.EncodeToString(ref))
+				submittedTxs.Unlock()
+			})
+			tr := newTxTracker([][]byte{ref}, test.depth)
+			for _, step := range test.steps {
+				step.apply(tr)
+				tr.updates()
+				if stage := tr.txs[0].stage; stage != step.wantStage {
+					t.Fatalf("%s: got stage %s, wanted %s", step.name, stage, step.wantStage)
+				}
+				if done := tr.done(); done != step.wantDone {
+					t.Fatalf("%s: got done %t, wanted %t", step.name, done, step.wantDone)
+				}
+			}
+		})
+	}
+}
+
+func TestTxTrackerRollbackTip(t *testing.T) {
+	tests := []struct {
+		name          string
+		heights       []uint64
+		rollbackTo    uint64
+		wantTipHeight uint64
+	}{
+		{
+			name:          "rolls back to an earlier block",
+			heights:       []uint64{10, 11, 12, 13},
+			rollbackTo:    11,
+			wantTipHeight: 11,
+		},
+		{
+			name:          "rolls back to the tip",
+			heights:       []uint64{10, 11},
+			rollbackTo:    11,
+			wantTipHeight: 11,
+		},
+		{
+			name:          "rolls back before the first block seen",
+			heights:       []uint64{10, 11},
+			rollbackTo:    8,
+			wantTipHeight: 9,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newTxTracker(nil, 1)
+			for _, height := range test.heights {
+				tr.applyBlock(newFakeBlock(height))
+			}
+			tr.rollback(newFakeBlock(test.rollbackTo).slot)
+			if tr.tipHeight != test.wantTipHeight {
+				t.Fatalf("got tip height %d, wanted %d", tr.tipHeight, test.wantTipHeight)
+			}
+		})
+	}
+}
+
+func TestTxTrackerRollbackDepth(t *testing.T) {
+	ref := []byte{0x03}
+	tr := newTxTracker([][]byte{ref}, 3)
+	tr.applyBlock(newFakeBlock(10, ref))
+	tr.applyBlock(newFakeBlock(11))
+	tr.applyBlock(newFakeBlock(12))
+	if !tr.done() {
+		t.Fatalf("transaction is three blocks deep, but the tracker isn't done")
+	}
+	// Rolling back the tip leaves the transaction only two blocks deep
+	tr.rollback(newFakeBlock(11).slot)
+	if tr.done() {
+		t.Fatalf("transaction is two blocks deep after a rollback, but the tracker is done")
+	}
+}
+
+func TestTxTrackerLost(t *testing.T) {
+	tr := newTxTracker([][]byte{{0x04}, {0x05}}, 1)
+	if tx := tr.lost(time.Minute); tx != nil {
+		t.Fatalf("transaction %s lost before the timeout", tx.hash)
+	}
+	tr.txs[0].inMempool = true
+	for _, tx := range tr.txs {
+		tx.lastSeen = time.Now().Add(-2 * time.Minute)
+	}
+	tx := tr.lost(time.Minute)
+	if tx == nil || tx.hash != "05" {
+		t.Fatalf("got lost transaction %v, wanted 05", tx)
+	}
+	if tr.txs[0].lastSeen.Before(time.Now().Add(-time.Minute)) {
+		t.Fatalf("transaction in the mempool wasn't marked as seen")
+	}
+}
@@ -16,16 +16,20 @@ package utxorpc
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 
 	connect "connectrpc.com/connect"
 	"github.com/blinklabs-io/adder/event"
 	input_chainsync "github.com/blinklabs-io/adder/input/chainsync"
+	"github.com/blinklabs-io/gouroboros/ledger"
+	"github.com/blinklabs-io/gouroboros/protocol/chainsync"
 	ocommon "github.com/blinklabs-io/gouroboros/protocol/common"
 	watch "github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch"
 	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch/watchconnect"
 
+	"github.com/blinklabs-io/cardano-node-api/internal/config"
 	"github.com/blinklabs-io/cardano-node-api/internal/node"
 )
 
@@ -34,6 +38,12 @@ type watchServiceServer struct {
 	watchconnect.UnimplementedWatchServiceHandler
 }
 
+// watchedBlock is a recently applied block along with the transactions in it that matched
+type watchedBlock struct {
+	block   ledger.Block
+	matched []ledger.Transaction
+}
+
 // WatchTx
 func (s *watchServiceServer) WatchTx(
 	ctx context.Context,
@@ -41,48 +51,50 @@ func (s *watchServiceServer) WatchTx(
 	stream *connect.ServerStream[watch.WatchTxResponse],
 ) error {
 	predicate := req.Msg.GetPredicate() // Predicate
+	txPred := newWatchTxPredicate(predicate)
 	fieldMask := req.Msg.GetFieldMask()
-	log.Printf(
-		"Got a WatchTx request with predicate %v and fieldMask %v",
-		predicate,
-		fieldMask,
-	)
+	intersect := req.Msg.GetIntersect() // []*BlockRef
+	mask := newFieldMaskTree(fieldMask)
 
 	// Setup event channel
 	eventChan := make(chan event.Event, 10)
-	connCfg := node.ConnectionConfig{
-		ChainSyncEventChan: eventChan,
-	}
-	// Connect to node
-	oConn, err := node.GetConnection(&connCfg)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return err
-	}
-	defer func() {
-		// Close Ouroboros connection
-		oConn.Close()
-	}()
 
-	// Get current tip
-	tip, err := oConn.ChainSync().Client.GetCurrentTip()
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return err
+	// Get our intersect points. We start from the tip if none are given
+	var points []ocommon.Point
+	for _, blockRef := range intersect {
+		points = append(
+			points,
+			ocommon.NewPoint(blockRef.GetIndex(), blockRef.GetHash()),
+		)
 	}
+
 	// Start the sync with the node
-	err = oConn.ChainSync().Client.Sync([]ocommon.Point{tip.Point})
+	syncSub, err := node.SubscribeChainSync(eventChan, points)
 	if err != nil {
-		log.Printf("ERROR: %s", err)
+		if errors.Is(err, chainsync.IntersectNotFoundError) {
+			return connect.NewError(connect.CodeNotFound, err)
+		}
 		return err
 	}
+	defer syncSub.Close()
+
+	// Recently applied blocks, so that we can send their matching transactions back with Undo
+	// on a rollback
+	cfg := config.GetConfig()
+	undoDepth := int(cfg.Node.ChainSyncBufferSize)
+	var recentBlocks []watchedBlock
+	// The point before the next block, where we look up the outputs it spends
+	var prevPoint *ocommon.Point
 
 	// Wait for events
 	for {
-		evt, ok := <-eventChan
-		if !ok {
-			log.Printf("ERROR: channel closed")
-			return fmt.Errorf("ERROR: channel closed")
+		var evt event.Event
+		select {
+		case evt = <-eventChan:
+		case <-syncSub.Done():
+			return syncSub.Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
 		switch evt.Type {
@@ -90,18 +102,12 @@ func (s *watchServiceServer) WatchTx(
 			// Get event context to get the block chain information
 			context := evt.Context
 			if context == nil {
-				log.Printf("ERROR: empty block context")
 				return fmt.Errorf("ERROR: empty block context")
 			}
 			bc := context.(input_chainsync.BlockContext)
 			// Get event payload to get the block data
 			payload := evt.Payload
 			if payload == nil {
-				log.Printf(
-					"ERROR: empty payload: block: %d, slot: %d",
-					bc.BlockNumber,
-					bc.SlotNumber,
-				)
 				return fmt.Errorf(
 					"ERROR: empty payload: block: %d, slot: %d",
 					bc.BlockNumber,
@@ -111,32 +117,96 @@ func (s *watchServiceServer) WatchTx(
 			be := payload.(input_chainsync.BlockEvent)
 			block := be.Block // gOuorboros Block
 
+			// Look up the outputs spent by the block, if the predicate needs them
+			var resolved resolvedOutputs
+			if txPred.needsConsumed() {
+				resolved, err = resolveInputs(ctx, prevPoint, block.Transactions())
+				if err != nil {
+					if !unresolvable(err) {
+						return err
+					}
+					requestLogger(ctx).Warnw(
+						"matching block without the outputs it spends",
+						"slot", block.SlotNumber(),
+						"hash", block.Hash(),
+						"error", err,
+					)
+				}
+			}
+
 			// Loop through transactions
+			watched := watchedBlock{block: block}
 			for _, tx := range block.Transactions() {
-				resp := &watch.WatchTxResponse{}
-				var act watch.AnyChainTx
-				var actc watch.AnyChainTx_Cardano
-				cTx := tx.Utxorpc() // *cardano.Tx
-				actc.Cardano = cTx
-				act.Chain = &actc
-				var wtra watch.WatchTxResponse_Apply
-				wtra.Apply = &act
-				resp.Action = &wtra
-				if predicate == nil {
-					err := stream.Send(resp)
-					if err != nil {
+				if txPred.matches(tx, resolved.resolve) {
+					watched.matched = append(watched.matched, tx)
+					resp := &watch.WatchTxResponse{
+						Action: &watch.WatchTxResponse_Apply{
+							Apply: newAnyChainTx(tx, mask),
+						},
+					}
+					if err := stream.Send(resp); err != nil {
 						return err
 					}
-				} else {
-					// TODO: filter from all Predicate types
-					err := stream.Send(resp)
-					if err != nil {
+				}
+			}
+			recentBlocks = append(recentBlocks, watched)
+			if len(recentBlocks) > undoDepth {
+				recentBlocks = recentBlocks[1:]
+			}
+			point, err := blockPoint(block)
+			if err != nil {
+				return err
+			}
+			prevPoint = &point
+			// Log event
+			requestLogger(ctx).Debugw(
+				"block",
+				"slot", block.SlotNumber(),
+				"hash", block.Hash(),
+			)
+		case "chainsync.rollback":
+			re := evt.Payload.(input_chainsync.RollbackEvent)
+			// Undo the matching transactions from each rolled back block, newest first
+			for len(recentBlocks) > 0 && recentBlocks[len(recentBlocks)-1].block.SlotNumber() > re.SlotNumber {
+				txs := recentBlocks[len(recentBlocks)-1].matched
+				recentBlocks = recentBlocks[:len(recentBlocks)-1]
+				for i := len(txs) - 1; i >= 0; i-- {
+					resp := &watch.WatchTxResponse{
+						Action: &watch.WatchTxResponse_Undo{
+							Undo: newAnyChainTx(txs[i], mask),
+						},
+					}
+					if err := stream.Send(resp); err != nil {
 						return err
 					}
 				}
 			}
+			prevPoint = rollbackPoint(re)
+			// Log event
+			requestLogger(ctx).Debugw(
+				"rollback",
+				"slot", re.SlotNumber,
+				"hash", re.BlockHash,
+			)
 		}
-		// Log event
-		log.Printf("event: %v", evt)
+	}
+}
+
+// rollbackPoint returns the chain point that a rollback moves to
+func rollbackPoint(re input_chainsync.RollbackEvent) *ocommon.Point {
+	hash, _ := hex.DecodeString(re.BlockHash)
+	point := ocommon.NewPoint(re.SlotNumber, hash)
+	return &point
+}
+
+// newAnyChainTx wraps a transaction for a UTxO RPC response, keeping only the fields selected by
+// the field mask
+func newAnyChainTx(tx ledger.Transaction, mask fieldMaskTree) *watch.AnyChainTx {
+	parsed := tx.Utxorpc()
+	mask.apply(parsed)
+	return &watch.AnyChainTx{
+		Chain: &watch.AnyChainTx_Cardano{
+			Cardano: parsed,
+		},
 	}
 }
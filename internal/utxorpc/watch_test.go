@@ -0,0 +1,72 @@
+// Copyright 2024 Blink Labs Software
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utxorpc
+
+import (
+	"context"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/cardano"
+	watch "github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch"
+	"github.com/utxorpc/go-codegen/utxorpc/v1alpha/watch/watchconnect"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWatchTxJSONCodec(t *testing.T) {
+	server, recorder := newTestServer(t)
+	req := &watch.WatchTxRequest{
+		Predicate: &watch.TxPredicate{
+			Match: &watch.AnyChainTxPattern{
+				Chain: &watch.AnyChainTxPattern_Cardano{
+					Cardano: &cardano.TxPattern{
+						HasAddress: &cardano.AddressPattern{
+							PaymentPart: []byte{0x11, 0x22},
+						},
+					},
+				},
+			},
+		},
+		Intersect: []*watch.BlockRef{
+			{Index: 1234, Hash: []byte{0xab, 0xcd}},
+			{Index: 1200, Hash: []byte{0x12, 0x34}},
+		},
+	}
+	for _, protocol := range clientProtocols {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			client := watchconnect.NewWatchServiceClient(
+				server.Client(),
+				server.URL,
+				append(protocol.options, connect.WithProtoJSON())...,
+			)
+			stream, err := client.WatchTx(context.Background(), connect.NewRequest(req))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer stream.Close()
+			for stream.Receive() {
+			}
+			if code := connect.CodeOf(stream.Err()); code != connect.CodeUnavailable {
+				t.Fatalf("got code %s, wanted %s: %v", code, connect.CodeUnavailable, stream.Err())
+			}
+			// The intersect points are decoded from JSON too
+			received := <-recorder.received
+			if !proto.Equal(received, req) {
+				t.Fatalf("handler got %v, wanted %v", received, req)
+			}
+		})
+	}
+}